@@ -1,47 +1,111 @@
 package app
 
 import (
-	"database/sql"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"html"
+	"image"
+	"image/jpeg"
+	"image/png"
 	"log"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
+	"sync"
 	"testing"
+	"time"
+	"unicode/utf16"
 
 	"github.com/gorilla/mux"
 )
 
 const TestDBName = "Test.sqlitedb"
 
+// testDSN returns the database the handler tests run against.
+// Set TEST_POSTGRES_DSN to run the suite against PostgreSQL instead of SQLite.
+func testDSN() string {
+	if dsn := os.Getenv("TEST_POSTGRES_DSN"); dsn != "" {
+		return dsn
+	}
+	return TestDBName
+}
+
 func executeRequest(req *http.Request, emptydb bool) *httptest.ResponseRecorder {
 	rr := httptest.NewRecorder()
 	a := App{}
-	err := a.Initialize(TestDBName)
-	clearTable(a.Database)
+	err := a.Initialize(testDSN())
+	clearTable(a.Store.(*SQLStore).db)
 	if !emptydb {
 		p := Person{
-			id:        1,
+			ID:        1,
 			FirstName: "Test",
 			LastName:  "Name",
 			Email:     "Test.Name@example.com",
 			Phone:     "123-456-7890",
 		}
-		p.dbCreatePerson(a.Database)
+		a.Store.Create(&p)
 	}
 	if err != nil {
 		log.Fatalf("Error Initializing: %v", err.Error())
 	}
 	a.addHandles()
 	a.Router.ServeHTTP(rr, req)
+	a.Store.(*SQLStore).db.Close()
 	os.Remove(TestDBName)
 	return rr
 }
 
+// testAppStores returns a new store of each kind for the handler tests to run against, by name.
+func testAppStores(t *testing.T) map[string]PersonStore {
+	s, err := NewSQLiteStore(filepath.Join(t.TempDir(), TestDBName))
+	if err != nil {
+		t.Fatalf("Error creating SQLite store: %v", err.Error())
+	}
+	t.Cleanup(func() { s.db.Close() })
+	return map[string]PersonStore{
+		"sqlite": s,
+		"memory": NewMemoryStore(),
+	}
+}
+
+// newTestApp returns an App serving store, and do, which serves it a request
+// with the header name, value pairs given.
+func newTestApp(t *testing.T, store PersonStore) (*App, func(method, url, body string, header ...string) *httptest.ResponseRecorder) {
+	t.Helper()
+	a := &App{}
+	a.InitializeWithStore(store)
+	a.addHandles()
+	do := func(method, url, body string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		rr := httptest.NewRecorder()
+		a.Router.ServeHTTP(rr, req)
+		return rr
+	}
+	return a, do
+}
+
+// normalised returns people as a store returns them, with their primary email and phone in the lists.
+func normalised(people ...Person) []Person {
+	for i := range people {
+		people[i].normalise()
+	}
+	return people
+}
+
 func TestApp_Initialize(t *testing.T) {
 	type fields struct {
-		Router   *mux.Router
-		Database *sql.DB
+		Router *mux.Router
+		Store  PersonStore
 	}
 	type args struct {
 		dbname string
@@ -69,12 +133,15 @@ func TestApp_Initialize(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			a := &App{
-				Router:   tt.fields.Router,
-				Database: tt.fields.Database,
+				Router: tt.fields.Router,
+				Store:  tt.fields.Store,
 			}
 			if err := a.Initialize(tt.args.dbname); (err != nil) != tt.wantErr {
 				t.Errorf("App.Initialize() error = %v, wantErr %v", err, tt.wantErr)
 			}
+			if s, ok := a.Store.(*SQLStore); ok {
+				s.Close()
+			}
 			os.Remove(tt.args.dbname)
 		})
 	}
@@ -95,9 +162,34 @@ func TestApp_ReadPeople(t *testing.T) {
 		{
 			request:      "/people",
 			method:       "GET",
-			expectedCode: 500,
+			expectedCode: 200,
 			emptydb:      true,
 		},
+		{
+			request:      "/people?limit=1&offset=0&sort=lastName,-email&lastName=Name",
+			method:       "GET",
+			expectedCode: 200,
+		},
+		{
+			request:      "/people?limit=1&after=1&emailDomain=example.com",
+			method:       "GET",
+			expectedCode: 200,
+		},
+		{
+			request:      "/people?limit=abc",
+			method:       "GET",
+			expectedCode: 400,
+		},
+		{
+			request:      "/people?sort=bogus",
+			method:       "GET",
+			expectedCode: 400,
+		},
+		{
+			request:      "/people?after=1&sort=email",
+			method:       "GET",
+			expectedCode: 400,
+		},
 		{
 			request:      "/people",
 			method:       "POST",
@@ -129,6 +221,117 @@ func TestApp_ReadPeople(t *testing.T) {
 	}
 }
 
+func TestApp_ReadPeopleQuery(t *testing.T) {
+	a := App{}
+	a.InitializeWithStore(NewMemoryStore())
+	a.addHandles()
+	a.Store.Import([]Person{
+		{FirstName: "Ann", LastName: "Smith", Email: "ann@example.com"},
+		{FirstName: "Bob", LastName: "Jones", Email: "bob@example.org"},
+		{FirstName: "Cat", LastName: "Smith", Email: "cat@Example.com"},
+		{FirstName: "Dan", LastName: "Adams", Email: "dan@example.com"},
+	})
+	tests := []struct {
+		request       string
+		expectedNames string
+		expectedTotal string
+		expectedLink  string
+	}{
+		{
+			request:       "/people",
+			expectedNames: "Ann,Bob,Cat,Dan",
+			expectedTotal: "4",
+		},
+		{
+			request:       "/people?sort=lastName,-firstName",
+			expectedNames: "Dan,Bob,Cat,Ann",
+			expectedTotal: "4",
+		},
+		{
+			request:       "/people?lastName=Smith",
+			expectedNames: "Ann,Cat",
+			expectedTotal: "2",
+		},
+		{
+			request:       "/people?emailDomain=example.com",
+			expectedNames: "Ann,Cat,Dan",
+			expectedTotal: "3",
+		},
+		{
+			request:       "/people?limit=2&offset=2",
+			expectedNames: "Cat,Dan",
+			expectedTotal: "4",
+			expectedLink:  `</people?limit=2>; rel="first", </people?limit=2&offset=0>; rel="prev", </people?limit=2&offset=2>; rel="last"`,
+		},
+		{
+			request:       "/people?limit=2&after=1",
+			expectedNames: "Bob,Cat",
+			expectedTotal: "4",
+			expectedLink:  `</people?after=0&limit=2>; rel="first", </people?after=3&limit=2>; rel="next"`,
+		},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", tt.request, nil)
+		rr := httptest.NewRecorder()
+		a.Router.ServeHTTP(rr, req)
+		people := []Person{}
+		if err := json.Unmarshal(rr.Body.Bytes(), &people); err != nil {
+			t.Errorf("%v: could not unmarshal response: %v", tt.request, err)
+			continue
+		}
+		names := []string{}
+		for _, p := range people {
+			names = append(names, p.FirstName)
+		}
+		if got := strings.Join(names, ","); got != tt.expectedNames {
+			t.Errorf("%v: expected people %v. Got %v", tt.request, tt.expectedNames, got)
+		}
+		if got := rr.Header().Get("X-Total-Count"); got != tt.expectedTotal {
+			t.Errorf("%v: expected total %v. Got %v", tt.request, tt.expectedTotal, got)
+		}
+		if got := rr.Header().Get("Link"); got != tt.expectedLink {
+			t.Errorf("%v: expected Link %v. Got %v", tt.request, tt.expectedLink, got)
+		}
+	}
+}
+
+func TestApp_SearchPeople(t *testing.T) {
+	tests := []struct {
+		request      string
+		expectedCode int
+		expectedBody string
+	}{
+		{
+			request:      "/people/search?q=tes+nam",
+			expectedCode: 200,
+			expectedBody: `"Highlights":{"Email":"\u003cmark\u003eTes\u003c/mark\u003et.\u003cmark\u003eNam\u003c/mark\u003ee@example.com","FirstName":"\u003cmark\u003eTes\u003c/mark\u003et","LastName":"\u003cmark\u003eNam\u003c/mark\u003ee"}`,
+		},
+		{
+			request:      "/people/search?q=nobody",
+			expectedCode: 200,
+			expectedBody: `[]`,
+		},
+		{
+			request:      "/people/search?q=",
+			expectedCode: 400,
+		},
+		{
+			request:      "/people/search?q=test&limit=-1",
+			expectedCode: 400,
+		},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", tt.request, nil)
+		response := executeRequest(req, false)
+		if tt.expectedCode != response.Code {
+			t.Errorf("Expected response code %d. Got %d\n", tt.expectedCode, response.Code)
+		}
+		if !strings.Contains(response.Body.String(), tt.expectedBody) {
+			t.Errorf("Expected response body containing %v. Got %v\n", tt.expectedBody, response.Body.String())
+		}
+	}
+}
+
 func TestApp_CreatePerson(t *testing.T) {
 	tests := []struct {
 		request      string
@@ -154,7 +357,7 @@ func TestApp_CreatePerson(t *testing.T) {
 				"Email": "TestUser@example.com",
 				"Phone": "987-654-3210"
 			}`,
-			expectedCode: 200,
+			expectedCode: 201,
 			emptydb:      true,
 		},
 		{
@@ -165,12 +368,22 @@ func TestApp_CreatePerson(t *testing.T) {
 				"Email": "TestUser@example.com",
 				"Phone": "987-654-3210"
 			}`,
-			expectedCode: 200,
+			expectedCode: 201,
 		},
 		{
 			request:      "/person/2",
 			body:         `BadJson`,
-			expectedCode: 500,
+			expectedCode: 400,
+		},
+		{
+			request:      "/person/2",
+			body:         `{"FirstName": "Test", "Email": "not an email", "Phone": "call me"}`,
+			expectedCode: 422,
+		},
+		{
+			request:      "/person/2",
+			body:         `{"Email": "TestUser@example.com"}`,
+			expectedCode: 422,
 		},
 		{
 			request: "/person",
@@ -180,7 +393,7 @@ func TestApp_CreatePerson(t *testing.T) {
 				"Email": "TestUser@example.com",
 				"Phone": "987-654-3210"
 			}`,
-			expectedCode: 200,
+			expectedCode: 201,
 		},
 		{
 			request: "/person/9223372036854775808",
@@ -190,7 +403,7 @@ func TestApp_CreatePerson(t *testing.T) {
 				"Email": "TestUser@example.com",
 				"Phone": "987-654-3210"
 			}`,
-			expectedCode: 409,
+			expectedCode: 400,
 		},
 	}
 	for _, tt := range tests {
@@ -203,6 +416,215 @@ func TestApp_CreatePerson(t *testing.T) {
 	}
 }
 
+func TestApp_PersonResponses(t *testing.T) {
+	tests := []struct {
+		method           string
+		request          string
+		body             string
+		expectedCode     int
+		expectedLocation string
+		expectedPerson   Person
+	}{
+		{
+			method:           "POST",
+			request:          "/person",
+			body:             `{"ID": 1, "FirstName": "New", "LastName": "Person"}`,
+			expectedCode:     201,
+			expectedLocation: "/person/2",
+			expectedPerson:   Person{ID: 2, FirstName: "New", LastName: "Person"},
+		},
+		{
+			method:           "POST",
+			request:          "/person/7",
+			body:             `{"FirstName": "New"}`,
+			expectedCode:     201,
+			expectedLocation: "/person/7",
+			expectedPerson:   Person{ID: 7, FirstName: "New"},
+		},
+		{
+			method:         "GET",
+			request:        "/person/1",
+			expectedCode:   200,
+			expectedPerson: Person{ID: 1, FirstName: "Test", LastName: "Name", Email: "Test.Name@example.com", Phone: "123-456-7890"},
+		},
+		{
+			method:         "PUT",
+			request:        "/person/1",
+			body:           `{"ID": 5, "FirstName": "Replaced"}`,
+			expectedCode:   200,
+			expectedPerson: Person{ID: 1, FirstName: "Replaced"},
+		},
+		{
+			method:         "PATCH",
+			request:        "/person/1",
+			body:           `{"Phone": "555-0100"}`,
+			expectedCode:   200,
+			expectedPerson: Person{ID: 1, FirstName: "Test", LastName: "Name", Email: "Test.Name@example.com", Phone: "555-0100"},
+		},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(tt.method, tt.request, strings.NewReader(tt.body))
+		response := executeRequest(req, false)
+		if tt.expectedCode != response.Code {
+			t.Errorf("%v %v: expected response code %d. Got %d", tt.method, tt.request, tt.expectedCode, response.Code)
+		}
+		if got := response.Header().Get("Location"); got != tt.expectedLocation {
+			t.Errorf("%v %v: expected Location %q. Got %q", tt.method, tt.request, tt.expectedLocation, got)
+		}
+		if ct := response.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("%v %v: expected JSON content type. Got %v", tt.method, tt.request, ct)
+		}
+		p := Person{}
+		if err := json.Unmarshal(response.Body.Bytes(), &p); err != nil || !reflect.DeepEqual(p, normalised(tt.expectedPerson)[0]) {
+			t.Errorf("%v %v: expected person %+v. Got %+v (%v)", tt.method, tt.request, tt.expectedPerson, p, err)
+		}
+	}
+}
+
+func TestApp_Problem(t *testing.T) {
+	tests := []struct {
+		method         string
+		request        string
+		body           string
+		requestID      string
+		expectedStatus int
+		expectedCode   string
+		expectedErrors int
+	}{
+		{
+			method:         "GET",
+			request:        "/person/99",
+			requestID:      "abc123",
+			expectedStatus: 404,
+			expectedCode:   CodePersonNotFound,
+		},
+		{
+			method:         "POST",
+			request:        "/person/1",
+			body:           `{"FirstName": "Test"}`,
+			expectedStatus: 409,
+			expectedCode:   CodeIDExists,
+		},
+		{
+			method:         "POST",
+			request:        "/person/2",
+			body:           `{"Email": "bad", "Phone": "bad"}`,
+			expectedStatus: 422,
+			expectedCode:   CodeValidationFailed,
+			expectedErrors: 3,
+		},
+		{
+			method:         "PATCH",
+			request:        "/person/1",
+			body:           `{"Email": "bad"}`,
+			expectedStatus: 422,
+			expectedCode:   CodeValidationFailed,
+			expectedErrors: 1,
+		},
+		{
+			method:         "GET",
+			request:        "/nowhere",
+			expectedStatus: 404,
+			expectedCode:   CodeRouteNotFound,
+		},
+		{
+			method:         "PUT",
+			request:        "/people",
+			expectedStatus: 405,
+			expectedCode:   CodeMethodNotAllowed,
+		},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(tt.method, tt.request, strings.NewReader(tt.body))
+		if tt.requestID != "" {
+			req.Header.Set("X-Request-ID", tt.requestID)
+		}
+		response := executeRequest(req, false)
+		if ct := response.Header().Get("Content-Type"); ct != "application/problem+json" {
+			t.Errorf("%v %v: expected problem content type. Got %v", tt.method, tt.request, ct)
+		}
+		p := Problem{}
+		if err := json.Unmarshal(response.Body.Bytes(), &p); err != nil {
+			t.Errorf("%v %v: could not unmarshal problem: %v", tt.method, tt.request, err)
+			continue
+		}
+		if p.Status != tt.expectedStatus || response.Code != tt.expectedStatus {
+			t.Errorf("%v %v: expected status %v. Got %v (%v)", tt.method, tt.request, tt.expectedStatus, response.Code, p.Status)
+		}
+		if p.Code != tt.expectedCode || p.Type != problemTypeBase+tt.expectedCode {
+			t.Errorf("%v %v: expected code %v. Got %v (%v)", tt.method, tt.request, tt.expectedCode, p.Code, p.Type)
+		}
+		if len(p.Errors) != tt.expectedErrors {
+			t.Errorf("%v %v: expected %v field errors. Got %+v", tt.method, tt.request, tt.expectedErrors, p.Errors)
+		}
+		if p.RequestID == "" || p.RequestID != response.Header().Get("X-Request-ID") {
+			t.Errorf("%v %v: expected request ID in body and header. Got %q and %q", tt.method, tt.request, p.RequestID, response.Header().Get("X-Request-ID"))
+		}
+		if tt.requestID != "" && p.RequestID != tt.requestID {
+			t.Errorf("%v %v: expected request ID %v. Got %v", tt.method, tt.request, tt.requestID, p.RequestID)
+		}
+	}
+}
+
+func TestApp_ConcurrentCreate(t *testing.T) {
+	const workers = 20
+	const perWorker = 10
+	sqlApp := App{}
+	if err := sqlApp.Initialize(testDSN()); err != nil {
+		t.Fatalf("Error Initializing: %v", err.Error())
+	}
+	clearTable(sqlApp.Store.(*SQLStore).db)
+	defer os.Remove(TestDBName)
+	defer sqlApp.Store.(*SQLStore).Close()
+	memApp := App{}
+	memApp.InitializeWithStore(NewMemoryStore())
+
+	for name, a := range map[string]*App{"sql": &sqlApp, "memory": &memApp} {
+		t.Run(name, func(t *testing.T) {
+			a.addHandles()
+			var wg sync.WaitGroup
+			codes := make(chan int, workers*(perWorker+1))
+			for i := 0; i < workers; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for j := 0; j < perWorker; j++ {
+						req, _ := http.NewRequest("POST", "/person", strings.NewReader(`{"FirstName": "Concurrent"}`))
+						rr := httptest.NewRecorder()
+						a.Router.ServeHTTP(rr, req)
+						codes <- rr.Code
+					}
+					req, _ := http.NewRequest("POST", "/import", strings.NewReader("Imported,A,,\nImported,B,,\n"))
+					rr := httptest.NewRecorder()
+					a.Router.ServeHTTP(rr, req)
+					codes <- rr.Code
+				}()
+			}
+			wg.Wait()
+			close(codes)
+			for code := range codes {
+				if code != 200 && code != 201 {
+					t.Errorf("Expected response code 200 or 201. Got %d", code)
+				}
+			}
+			people, total, err := a.Store.Query(PeopleQuery{Limit: -1})
+			if err != nil {
+				t.Fatalf("Query() error = %v", err)
+			}
+			want := workers * (perWorker + 2)
+			if total != want {
+				t.Errorf("Expected %v people. Got %v", want, total)
+			}
+			for i, p := range people {
+				if p.ID != i+1 {
+					t.Errorf("Expected IDs 1 to %v without gaps. Got %v at position %v", want, p.ID, i)
+					break
+				}
+			}
+		})
+	}
+}
+
 func TestApp_ReadPerson(t *testing.T) {
 	tests := []struct {
 		request      string
@@ -224,7 +646,7 @@ func TestApp_ReadPerson(t *testing.T) {
 		},
 		{
 			request:      "/person/9223372036854775809",
-			expectedCode: 409,
+			expectedCode: 400,
 		},
 	}
 	for _, tt := range tests {
@@ -277,12 +699,12 @@ func TestApp_UpdatePerson(t *testing.T) {
 		{
 			request:      "/person/2",
 			body:         `BadJson`,
-			expectedCode: 500,
+			expectedCode: 400,
 		},
 		{
 			request:      "/person/9223372036854775809",
 			body:         ``,
-			expectedCode: 409,
+			expectedCode: 400,
 		},
 	}
 	for _, tt := range tests {
@@ -336,12 +758,12 @@ func TestApp_UpdatePatchPerson(t *testing.T) {
 		{
 			request:      "/person/2",
 			body:         `BadJson`,
-			expectedCode: 500,
+			expectedCode: 400,
 		},
 		{
 			request:      "/person/9223372036854775809",
 			body:         ``,
-			expectedCode: 409,
+			expectedCode: 400,
 		},
 	}
 	for _, tt := range tests {
@@ -354,93 +776,1827 @@ func TestApp_UpdatePatchPerson(t *testing.T) {
 	}
 }
 
-func TestApp_DeletePerson(t *testing.T) {
-	tests := []struct {
-		request      string
-		expectedCode int
-		emptydb      bool
-	}{
-		{
-			request:      "/person/1",
-			expectedCode: 200,
-		},
-		{
-			request:      "/person/1",
-			expectedCode: 200,
-			emptydb:      true,
-		},
-		{
-			request:      "/person/99",
-			expectedCode: 200,
-		},
-		{
-			request:      "/person/9223372036854775809",
-			expectedCode: 409,
-		},
-	}
-	for _, tt := range tests {
-		req, _ := http.NewRequest("DELETE", tt.request, nil)
-		response := executeRequest(req, tt.emptydb)
-		if tt.expectedCode != response.Code {
-			t.Errorf("Expected response code %d. Got %d\n", tt.expectedCode, response.Code)
-		}
-	}
-}
-func TestApp_Import(t *testing.T) {
-	tests := []struct {
-		method       string
-		request      string
-		body         string
-		expectedCode int
-		emptydb      bool
-	}{
-		{
-			method:  "POST",
-			request: "/import",
-			body: `FirstName,LastName,Email,Phone
-Person 1,Smith,email@example.com,123-456-7890
-Person 2,Smith,email@example.com,123-456-7890
-Person 3,Smith,email@example.com,123-456-7890
-Person 4,Smith,email@example.com,123-456-7890
-`,
-			expectedCode: 200,
-		},
-		{
-			method:  "POST",
-			request: "/import",
-			body: `FirstName,LastName,Email,Phone
-Person 1,Smith,email@example.com,123-456-7890
-Person 2,Smith,email@example.com,123-456-7890
-Person 3,Smith,email@example.com,123-456-7890
-Person 4,Smith,email@example.com,123-456-7890
-`,
-			expectedCode: 200,
-			emptydb:      true,
-		},
-		{
-			method:       "POST",
-			request:      "/import",
-			body:         "",
-			expectedCode: 409,
-		},
-	}
-	for _, tt := range tests {
-		buf := strings.NewReader(tt.body)
-		req, _ := http.NewRequest(tt.method, tt.request, buf)
-		response := executeRequest(req, tt.emptydb)
-		if tt.expectedCode != response.Code {
-			t.Errorf("Expected response code %d. Got %d\n", tt.expectedCode, response.Code)
-		}
+func TestApp_ContactDetails(t *testing.T) {
+	for name, store := range testAppStores(t) {
+		t.Run(name, func(t *testing.T) {
+			a, do := newTestApp(t, store)
+
+			rr := do("POST", "/person", `{"FirstName": "Ann",
+				"Emails": [{"Type": "home", "Value": "ann@example.com"}, {"Type": "work", "Value": "ann@work.example.com"}],
+				"Phones": [{"Type": "mobile", "Value": "555-0100"}],
+				"Addresses": [{"Type": "home", "Street": "1 Main St", "City": "Springfield", "Postcode": "62701"}]}`)
+			p := Person{}
+			json.Unmarshal(rr.Body.Bytes(), &p)
+			if rr.Code != 201 || p.Email != "ann@example.com" || p.Phone != "555-0100" || len(p.Emails) != 2 || len(p.Addresses) != 1 {
+				t.Errorf("Expected 201 with the primary email and phone set. Got %d %+v", rr.Code, p)
+			}
+
+			rr = do("POST", "/person", `{"FirstName": "Bad",
+				"Emails": [{"Value": "bad@example.com"}, {"Type": "pager", "Value": "not an email"}],
+				"Addresses": [{"Type": "home"}]}`)
+			problem := Problem{}
+			json.Unmarshal(rr.Body.Bytes(), &problem)
+			fields := []string{}
+			for _, e := range problem.Errors {
+				fields = append(fields, e.Field)
+			}
+			if expected := []string{"Emails[1].Value", "Emails[1].Type", "Addresses[0]"}; rr.Code != 422 || !reflect.DeepEqual(fields, expected) {
+				t.Errorf("Expected 422 with errors for %v. Got %d %v", expected, rr.Code, fields)
+			}
+
+			// Patching Email replaces the primary address and keeps the others.
+			rr = do("PATCH", "/person/1", `{"Email": "ann@new.example.com"}`)
+			p = Person{}
+			json.Unmarshal(rr.Body.Bytes(), &p)
+			expected := []Email{{Type: TypeHome, Value: "ann@new.example.com"}, {Type: TypeWork, Value: "ann@work.example.com"}}
+			if rr.Code != 200 || p.Email != "ann@new.example.com" || !reflect.DeepEqual(p.Emails, expected) {
+				t.Errorf("Expected emails %+v. Got %d %+v", expected, rr.Code, p)
+			}
+			rr = do("PATCH", "/person/1", `{"Phones": [], "Addresses": []}`)
+			p = Person{}
+			json.Unmarshal(rr.Body.Bytes(), &p)
+			if rr.Code != 200 || p.Phone != "" || p.Phones != nil || p.Addresses != nil || len(p.Emails) != 2 {
+				t.Errorf("Expected phones and addresses to be cleared. Got %d %+v", rr.Code, p)
+			}
+
+			// Typed CSV columns add to the lists, and the address columns fill in the first address.
+			rr = do("POST", "/import", "First Name,Email,Work Email,Mobile Phone,City,Zip\nBob,bob@example.com,bob@work.example.com,555-0200,Shelbyville,12345\n")
+			if rr.Code != 200 {
+				t.Fatalf("Expected import to succeed. Got %d %v", rr.Code, rr.Body.String())
+			}
+			bob, _ := a.Store.Get(2)
+			expectedBob := Person{ID: 2, FirstName: "Bob", Email: "bob@example.com", Phone: "555-0200",
+				Emails:    []Email{{Value: "bob@example.com"}, {Type: TypeWork, Value: "bob@work.example.com"}},
+				Phones:    []Phone{{Type: TypeMobile, Value: "555-0200"}},
+				Addresses: []Address{{City: "Shelbyville", Postcode: "12345"}}}
+			if !reflect.DeepEqual(bob, expectedBob) {
+				t.Errorf("Expected %+v. Got %+v", expectedBob, bob)
+			}
+			rr = do("GET", "/export", "")
+			expectedCSV := "FirstName,LastName,Email,Phone,HomeEmail,WorkEmail,HomePhone,WorkPhone,MobilePhone,Street,City,Region,Postcode,Country,Nickname,Organization,Department,Title,Birthday,Website,Notes,Groups\n" +
+				"Ann,,ann@new.example.com,,ann@new.example.com,ann@work.example.com,,,,,,,,,,,,,,,,\n" +
+				"Bob,,bob@example.com,555-0200,,bob@work.example.com,,,555-0200,,Shelbyville,,12345,,,,,,,,,\n"
+			if rr.Body.String() != expectedCSV {
+				t.Errorf("Expected CSV %q. Got %q", expectedCSV, rr.Body.String())
+			}
+		})
 	}
 }
 
-func TestApp_Export(t *testing.T) {
-	tests := []struct {
-		method       string
-		request      string
-		expectedCode int
-		emptydb      bool
-	}{
+func TestApp_Profile(t *testing.T) {
+	for name, store := range testAppStores(t) {
+		t.Run(name, func(t *testing.T) {
+			a, do := newTestApp(t, store)
+
+			rr := do("POST", "/person", `{"FirstName": "Ann", "LastName": "Smith", "Nickname": "Annie",
+				"Organization": "Acme; Inc", "Department": "Sales", "Title": "Manager", "Birthday": "1985-04-12",
+				"Website": "https://example.com/ann", "Notes": "Met at the conference.\nPrefers email."}`)
+			if rr.Code != 201 {
+				t.Fatalf("Expected 201. Got %d %v", rr.Code, rr.Body.String())
+			}
+
+			future := time.Now().AddDate(1, 0, 0).Format("2006-01-02")
+			rr = do("POST", "/person", `{"FirstName": "Bad", "Birthday": "1985-02-30", "Website": "example.com"}`)
+			problem := Problem{}
+			json.Unmarshal(rr.Body.Bytes(), &problem)
+			expectedErrors := []FieldError{
+				{Field: "Birthday", Reason: "must be a date, YYYY-MM-DD, or --MM-DD without the year"},
+				{Field: "Website", Reason: "not an absolute http or https URL"},
+			}
+			if rr.Code != 422 || !reflect.DeepEqual(problem.Errors, expectedErrors) {
+				t.Errorf("Expected 422 with errors %+v. Got %d %+v", expectedErrors, rr.Code, problem.Errors)
+			}
+			for _, b := range []string{future, "1985-4-12", "--13-01", "12/04/1985"} {
+				if rr = do("POST", "/person", `{"FirstName": "Bad", "Birthday": "`+b+`"}`); rr.Code != 422 {
+					t.Errorf("Expected birthday %q to be rejected. Got %d", b, rr.Code)
+				}
+			}
+
+			// Patching one field leaves the others alone.
+			rr = do("PATCH", "/person/1", `{"Title": "Director", "Birthday": "--04-12"}`)
+			p := Person{}
+			json.Unmarshal(rr.Body.Bytes(), &p)
+			if rr.Code != 200 || p.Title != "Director" || p.Birthday != "--04-12" || p.Organization != "Acme; Inc" || p.Nickname != "Annie" {
+				t.Errorf("Expected the title and birthday to be patched. Got %d %+v", rr.Code, p)
+			}
+			rr = do("PATCH", "/person/1", `{"birthday": "", "Notes": ""}`)
+			cleared := Person{}
+			json.Unmarshal(rr.Body.Bytes(), &cleared)
+			if rr.Code != 200 || cleared.Birthday != "" || cleared.Notes != "" || cleared.Title != "Director" {
+				t.Errorf("Expected the birthday and notes to be cleared. Got %d %+v", rr.Code, cleared)
+			}
+			notes, _ := json.Marshal(p.Notes)
+			do("PATCH", "/person/1", `{"Birthday": "--04-12", "Notes": `+string(notes)+`}`)
+
+			rr = do("GET", "/person/1.vcf", "")
+			expectedCard := "BEGIN:VCARD\r\n" +
+				"VERSION:4.0\r\n" +
+				"FN:Ann Smith\r\n" +
+				"N:Smith;Ann;;;\r\n" +
+				"NICKNAME:Annie\r\n" +
+				"ORG:Acme\\; Inc;Sales\r\n" +
+				"TITLE:Director\r\n" +
+				"BDAY:--0412\r\n" +
+				"URL:https://example.com/ann\r\n" +
+				"NOTE:Met at the conference.\\nPrefers email.\r\n" +
+				"END:VCARD\r\n"
+			if rr.Code != 200 || rr.Body.String() != expectedCard {
+				t.Errorf("Expected vCard %q. Got %d %q", expectedCard, rr.Code, rr.Body.String())
+			}
+
+			// The basic and extended date formats are both read, and times and unknown formats dropped.
+			for bday, expected := range map[string]string{
+				"19850412":             "1985-04-12",
+				"1985-04-12T10:00:00Z": "1985-04-12",
+				"--0412":               "--04-12",
+				"--04-12":              "--04-12",
+				"1985":                 "",
+				"circa 1900":           "",
+			} {
+				rr = do("PUT", "/carddav/people/1.vcf", "BEGIN:VCARD\r\nVERSION:4.0\r\nN:Smith;Ann;;;\r\nBDAY:"+bday+"\r\nEND:VCARD\r\n")
+				p, _ = a.Store.Get(1)
+				if rr.Code >= 300 || p.Birthday != expected {
+					t.Errorf("BDAY:%v: expected birthday %q. Got %d %q", bday, expected, rr.Code, p.Birthday)
+				}
+			}
+
+			rr = do("POST", "/import", "First Name,Company,Job Title,DOB,Web Page,Comments\nBob,Initech,Engineer,1990-01-31,http://example.org,Likes staplers\n")
+			if rr.Code != 200 {
+				t.Fatalf("Expected import to succeed. Got %d %v", rr.Code, rr.Body.String())
+			}
+			bob, _ := a.Store.Get(2)
+			if bob.Organization != "Initech" || bob.Title != "Engineer" || bob.Birthday != "1990-01-31" ||
+				bob.Website != "http://example.org" || bob.Notes != "Likes staplers" {
+				t.Errorf("Expected the profile columns to be imported. Got %+v", bob)
+			}
+		})
+	}
+}
+
+func TestApp_CustomFields(t *testing.T) {
+	for name, store := range testAppStores(t) {
+		t.Run(name, func(t *testing.T) {
+			a, do := newTestApp(t, store)
+			a.AdminToken = "secret"
+			admin := []string{"Authorization", "Bearer secret"}
+			errorFields := func(rr *httptest.ResponseRecorder) []string {
+				problem := Problem{}
+				json.Unmarshal(rr.Body.Bytes(), &problem)
+				fields := []string{}
+				for _, e := range problem.Errors {
+					fields = append(fields, e.Field)
+				}
+				return fields
+			}
+
+			if rr := do("POST", "/fields", `{"Name": "badge", "Type": "number"}`); rr.Code != 401 {
+				t.Errorf("Expected 401 without the admin token. Got %d", rr.Code)
+			}
+			for _, body := range []string{
+				`{"Name": "badge", "Type": "number", "Min": "1"}`,
+				`{"Name": "slack", "Type": "string", "Pattern": "@[a-z0-9._-]+", "MaxLength": 22}`,
+				`{"Name": "started", "Type": "date"}`,
+				`{"Name": "tier", "Type": "enum", "Options": ["gold", "silver"], "Required": true}`,
+				`{"Name": "crm", "Type": "url"}`,
+			} {
+				if rr := do("POST", "/fields", body, admin...); rr.Code != 201 {
+					t.Fatalf("Expected 201 creating %v. Got %d %v", body, rr.Code, rr.Body.String())
+				}
+			}
+			if rr := do("POST", "/fields", `{"Name": "tier", "Type": "string"}`, admin...); rr.Code != 409 {
+				t.Errorf("Expected 409 for an existing field. Got %d", rr.Code)
+			}
+			rr := do("POST", "/fields", `{"Name": "Email", "Type": "enum", "Pattern": "x", "Min": "2", "Max": "1"}`, admin...)
+			if expected := []string{"Name", "Options", "Pattern", "Min", "Max"}; rr.Code != 422 || !reflect.DeepEqual(errorFields(rr), expected) {
+				t.Errorf("Expected 422 with errors for %v. Got %d %v", expected, rr.Code, errorFields(rr))
+			}
+			if rr = do("POST", "/fields", `{"Name": "home_phone", "Type": "string"}`, admin...); rr.Code != 422 {
+				t.Errorf("Expected a name clashing with a CSV column to be rejected. Got %d", rr.Code)
+			}
+
+			rr = do("POST", "/person", `{"FirstName": "Ann", "Custom": {"badge": "0042.50", "slack": "@ann", "tier": "gold", "started": "2020-01-31"}}`)
+			p := Person{}
+			json.Unmarshal(rr.Body.Bytes(), &p)
+			expected := map[string]string{"badge": "42.5", "slack": "@ann", "tier": "gold", "started": "2020-01-31"}
+			if rr.Code != 201 || !reflect.DeepEqual(p.Custom, expected) {
+				t.Errorf("Expected 201 with custom values %v. Got %d %v", expected, rr.Code, rr.Body.String())
+			}
+			rr = do("POST", "/person", `{"FirstName": "Bad", "Custom": {"badge": "0", "slack": "ann", "started": "2020-02-30", "crm": "ftp://x", "shoe": "9"}}`)
+			if expected := []string{"Custom.badge", "Custom.crm", "Custom.slack", "Custom.started", "Custom.tier", "Custom.shoe"}; rr.Code != 422 || !reflect.DeepEqual(errorFields(rr), expected) {
+				t.Errorf("Expected 422 with errors for %v. Got %d %v", expected, rr.Code, errorFields(rr))
+			}
+			do("POST", "/person", `{"FirstName": "Bob", "Custom": {"badge": "7", "tier": "silver"}}`)
+
+			// Patching merges custom values, and an empty value removes one.
+			rr = do("PATCH", "/person/1", `{"Custom": {"slack": "", "crm": "https://crm.example.com/ann"}}`)
+			p = Person{}
+			json.Unmarshal(rr.Body.Bytes(), &p)
+			expected = map[string]string{"badge": "42.5", "tier": "gold", "started": "2020-01-31", "crm": "https://crm.example.com/ann"}
+			if rr.Code != 200 || !reflect.DeepEqual(p.Custom, expected) {
+				t.Errorf("Expected custom values %v. Got %d %v", expected, rr.Code, rr.Body.String())
+			}
+
+			for query, expectedIDs := range map[string][]int{
+				"custom.tier=silver":              {2},
+				"custom.badge=42.50":              {1},
+				"custom.badge=7&custom.tier=gold": {},
+			} {
+				rr = do("GET", "/people?"+query, "")
+				people := []Person{}
+				json.Unmarshal(rr.Body.Bytes(), &people)
+				ids := []int{}
+				for _, p := range people {
+					ids = append(ids, p.ID)
+				}
+				if rr.Code != 200 || !reflect.DeepEqual(ids, expectedIDs) {
+					t.Errorf("%v: expected people %v. Got %d %v", query, expectedIDs, rr.Code, ids)
+				}
+			}
+			for _, query := range []string{"custom.shoe=9", "custom.badge=many"} {
+				if rr = do("GET", "/people?"+query, ""); rr.Code != 400 {
+					t.Errorf("%v: expected 400. Got %d", query, rr.Code)
+				}
+			}
+
+			rr = do("GET", "/export", "")
+			header := "FirstName,LastName,Email,Phone,HomeEmail,WorkEmail,HomePhone,WorkPhone,MobilePhone,Street,City,Region,Postcode,Country,Nickname,Organization,Department,Title,Birthday,Website,Notes,Groups,badge,crm,slack,started,tier\n"
+			expectedCSV := header +
+				"Ann,,,,,,,,,,,,,,,,,,,,,,42.5,https://crm.example.com/ann,,2020-01-31,gold\n" +
+				"Bob,,,,,,,,,,,,,,,,,,,,,,7,,,,silver\n"
+			if rr.Body.String() != expectedCSV {
+				t.Errorf("Expected CSV %q. Got %q", expectedCSV, rr.Body.String())
+			}
+			rr = do("POST", "/import?mode=best-effort", "First Name,Badge,Tier\nCat,9,gold\nDan,3,bronze\n")
+			report := ImportReport{}
+			json.Unmarshal(rr.Body.Bytes(), &report)
+			if rr.Code != 200 || report.Created != 1 || len(report.Rejected) != 1 || report.Rejected[0].Reason != "Custom.tier: must be one of gold, silver" {
+				t.Errorf("Expected Dan's tier to be rejected. Got %d %+v", rr.Code, report)
+			}
+			if cat, _ := a.Store.Get(3); !reflect.DeepEqual(cat.Custom, map[string]string{"badge": "9", "tier": "gold"}) {
+				t.Errorf("Expected Cat's custom values to be imported. Got %+v", cat)
+			}
+
+			// A vCard has no custom fields, so replacing a person's card keeps them.
+			rr = do("PUT", "/carddav/people/2.vcf", "BEGIN:VCARD\r\nVERSION:4.0\r\nN:Jones;Bob;;;\r\nEND:VCARD\r\n")
+			if bob, _ := a.Store.Get(2); rr.Code != 204 || bob.Custom["tier"] != "silver" {
+				t.Errorf("Expected Bob to keep his custom values. Got %d %+v", rr.Code, bob)
+			}
+
+			if rr = do("PUT", "/fields/badge", `{"Type": "string"}`, admin...); rr.Code != 422 {
+				t.Errorf("Expected changing the type to be rejected. Got %d", rr.Code)
+			}
+			if rr = do("PUT", "/fields/badge", `{"Type": "number", "Max": "100"}`, admin...); rr.Code != 200 {
+				t.Errorf("Expected the field to be updated. Got %d %v", rr.Code, rr.Body.String())
+			}
+			rr = do("GET", "/fields/badge", "")
+			f := CustomField{}
+			json.Unmarshal(rr.Body.Bytes(), &f)
+			if expected := (CustomField{Name: "badge", Type: FieldNumber, Max: "100"}); rr.Code != 200 || !reflect.DeepEqual(f, expected) {
+				t.Errorf("Expected %+v. Got %d %+v", expected, rr.Code, f)
+			}
+			if rr = do("DELETE", "/fields/badge", "", admin...); rr.Code != 204 {
+				t.Errorf("Expected 204 deleting the field. Got %d", rr.Code)
+			}
+			if rr = do("DELETE", "/fields/badge", "", admin...); rr.Code != 404 {
+				t.Errorf("Expected 404 deleting a missing field. Got %d", rr.Code)
+			}
+			if ann, _ := a.Store.Get(1); ann.Custom["badge"] != "" {
+				t.Errorf("Expected the deleted field's values to be removed. Got %+v", ann.Custom)
+			}
+		})
+	}
+}
+
+func TestApp_Groups(t *testing.T) {
+	for name, store := range testAppStores(t) {
+		t.Run(name, func(t *testing.T) {
+			a, do := newTestApp(t, store)
+			ids := func(rr *httptest.ResponseRecorder) []int {
+				people := []Person{}
+				json.Unmarshal(rr.Body.Bytes(), &people)
+				ids := []int{}
+				for _, p := range people {
+					ids = append(ids, p.ID)
+				}
+				return ids
+			}
+
+			rr := do("POST", "/groups", `{"Name": " Friends ", "Description": "People I know"}`)
+			if rr.Code != 201 || rr.Header().Get("Location") != "/groups/1" {
+				t.Fatalf("Expected 201 with Location /groups/1. Got %d %v %v", rr.Code, rr.Header().Get("Location"), rr.Body.String())
+			}
+			if rr = do("POST", "/groups", `{"Name": "friends"}`); rr.Code != 409 {
+				t.Errorf("Expected 409 for an existing name. Got %d", rr.Code)
+			}
+			for _, body := range []string{`{"Name": " "}`, `{"Name": "a,b"}`, `{"Name": "` + strings.Repeat("x", 101) + `"}`} {
+				if rr = do("POST", "/groups", body); rr.Code != 422 {
+					t.Errorf("Expected 422 for %.30v. Got %d", body, rr.Code)
+				}
+			}
+
+			// Naming a group that does not exist creates it.
+			rr = do("POST", "/person", `{"FirstName": "Ann", "Groups": ["friends", "Climbing"]}`)
+			p := Person{}
+			json.Unmarshal(rr.Body.Bytes(), &p)
+			if expected := []string{"Climbing", "Friends"}; rr.Code != 201 || !reflect.DeepEqual(p.Groups, expected) {
+				t.Errorf("Expected 201 with groups %q. Got %d %v", expected, rr.Code, rr.Body.String())
+			}
+			if rr = do("POST", "/person", `{"FirstName": "Bad", "Groups": ["a,b"]}`); rr.Code != 422 {
+				t.Errorf("Expected 422 for an invalid group name. Got %d", rr.Code)
+			}
+			do("POST", "/person", `{"FirstName": "Bob"}`)
+
+			if rr = do("PUT", "/groups/1/people/2", ""); rr.Code != 200 {
+				t.Errorf("Expected 200 adding a member. Got %d %v", rr.Code, rr.Body.String())
+			}
+			if rr = do("PUT", "/groups/9/people/2", ""); rr.Code != 404 {
+				t.Errorf("Expected 404 adding to a missing group. Got %d", rr.Code)
+			}
+			if rr = do("PUT", "/groups/1/people/9", ""); rr.Code != 404 {
+				t.Errorf("Expected 404 adding a missing person. Got %d", rr.Code)
+			}
+			rr = do("GET", "/groups", "")
+			groups := []Group{}
+			json.Unmarshal(rr.Body.Bytes(), &groups)
+			expected := []Group{{ID: 2, Name: "Climbing", Members: 1}, {ID: 1, Name: "Friends", Description: "People I know", Members: 2}}
+			if rr.Code != 200 || !reflect.DeepEqual(groups, expected) {
+				t.Errorf("Expected %+v. Got %d %+v", expected, rr.Code, groups)
+			}
+
+			for url, expectedIDs := range map[string][]int{
+				"/groups/1/people":         {1, 2},
+				"/groups/1/people?limit=1": {1},
+				"/groups/2/people":         {1},
+				"/people?group=FRIENDS":    {1, 2},
+				"/people?group=climbing":   {1},
+				"/people?group=nobody":     {},
+			} {
+				if rr = do("GET", url, ""); rr.Code != 200 || !reflect.DeepEqual(ids(rr), expectedIDs) {
+					t.Errorf("%v: expected people %v. Got %d %v", url, expectedIDs, rr.Code, ids(rr))
+				}
+			}
+			if rr = do("GET", "/groups/9/people", ""); rr.Code != 404 {
+				t.Errorf("Expected 404 listing a missing group. Got %d", rr.Code)
+			}
+
+			rr = do("GET", "/person/1.vcf", "")
+			if !strings.Contains(rr.Body.String(), "CATEGORIES:Climbing,Friends\r\n") {
+				t.Errorf("Expected the vCard to have CATEGORIES. Got %q", rr.Body.String())
+			}
+			rr = do("GET", "/export", "")
+			if !strings.Contains(rr.Body.String(), ",\"Climbing, Friends\"\n") {
+				t.Errorf("Expected the CSV to list the groups. Got %q", rr.Body.String())
+			}
+			rr = do("POST", "/import", "FirstName,Tags\nCat,\"Friends, Family\"\n")
+			if cat, _ := a.Store.Get(3); rr.Code != 200 || !reflect.DeepEqual(cat.Groups, []string{"Family", "Friends"}) {
+				t.Errorf("Expected Cat's groups to be imported. Got %d %+v", rr.Code, cat)
+			}
+
+			if rr = do("PUT", "/groups/1", `{"Name": "Pals"}`); rr.Code != 200 {
+				t.Errorf("Expected 200 renaming the group. Got %d %v", rr.Code, rr.Body.String())
+			}
+			if ann, _ := a.Store.Get(1); !reflect.DeepEqual(ann.Groups, []string{"Climbing", "Pals"}) {
+				t.Errorf("Expected Ann's group to be renamed. Got %q", ann.Groups)
+			}
+			if rr = do("PUT", "/groups/1", `{"Name": "climbing"}`); rr.Code != 409 {
+				t.Errorf("Expected 409 renaming to an existing name. Got %d", rr.Code)
+			}
+			if rr = do("DELETE", "/groups/2/people/1", ""); rr.Code != 200 {
+				t.Errorf("Expected 200 removing a member. Got %d", rr.Code)
+			}
+			rr = do("PATCH", "/person/2", `{"Groups": []}`)
+			p = Person{}
+			json.Unmarshal(rr.Body.Bytes(), &p)
+			if rr.Code != 200 || p.Groups != nil {
+				t.Errorf("Expected patching an empty list to remove Bob's groups. Got %d %v", rr.Code, rr.Body.String())
+			}
+			if rr = do("DELETE", "/groups/1", ""); rr.Code != 204 {
+				t.Errorf("Expected 204 deleting the group. Got %d", rr.Code)
+			}
+			if rr = do("GET", "/groups/1", ""); rr.Code != 404 {
+				t.Errorf("Expected 404 for a deleted group. Got %d", rr.Code)
+			}
+			if ann, _ := a.Store.Get(1); ann.Groups != nil {
+				t.Errorf("Expected Ann to be in no groups. Got %q", ann.Groups)
+			}
+		})
+	}
+}
+
+func TestApp_Relationships(t *testing.T) {
+	for name, store := range testAppStores(t) {
+		t.Run(name, func(t *testing.T) {
+			_, do := newTestApp(t, store)
+			rels := func(rr *httptest.ResponseRecorder) []Relationship {
+				rels := []Relationship{}
+				json.Unmarshal(rr.Body.Bytes(), &rels)
+				return rels
+			}
+			for _, name := range []string{"Ann", "Bob", "Cat"} {
+				do("POST", "/person", `{"FirstName": "`+name+`"}`)
+			}
+
+			rr := do("POST", "/person/1/relationships", `{"RelatedID": 2, "Type": "assistant", "Bidirectional": true}`)
+			if rr.Code != 201 || rr.Header().Get("Location") != "/person/1/relationships/1" {
+				t.Fatalf("Expected 201 with Location /person/1/relationships/1. Got %d %v %v", rr.Code, rr.Header().Get("Location"), rr.Body.String())
+			}
+			rr = do("POST", "/person/1/relationships", `{"RelatedID": 3, "Type": "custom", "Label": " Mentor "}`)
+			r := Relationship{}
+			json.Unmarshal(rr.Body.Bytes(), &r)
+			if expected := (Relationship{ID: 3, PersonID: 1, RelatedID: 3, Type: RelCustom, Label: "Mentor"}); rr.Code != 201 || r != expected {
+				t.Errorf("Expected 201 with %+v. Got %d %v", expected, rr.Code, rr.Body.String())
+			}
+			if rr = do("POST", "/person/2/relationships", `{"RelatedID": 1, "Type": "executive"}`); rr.Code != 409 {
+				t.Errorf("Expected 409 for an existing relationship. Got %d", rr.Code)
+			}
+			for body, fields := range map[string]string{
+				`{"RelatedID": 1, "Type": "friend"}`:               "Type,RelatedID",
+				`{"RelatedID": 3, "Type": "custom"}`:               "Label",
+				`{"RelatedID": 3, "Type": "spouse", "Label": "x"}`: "Label",
+				`{"RelatedID": 9, "Type": "spouse"}`:               "RelatedID",
+			} {
+				rr = do("POST", "/person/1/relationships", body)
+				problem := Problem{}
+				json.Unmarshal(rr.Body.Bytes(), &problem)
+				got := []string{}
+				for _, e := range problem.Errors {
+					got = append(got, e.Field)
+				}
+				if rr.Code != 422 || strings.Join(got, ",") != fields {
+					t.Errorf("%v: expected 422 with errors for %v. Got %d %v", body, fields, rr.Code, got)
+				}
+			}
+			if rr = do("POST", "/person/9/relationships", `{"RelatedID": 1, "Type": "spouse"}`); rr.Code != 404 {
+				t.Errorf("Expected 404 for a missing person. Got %d", rr.Code)
+			}
+
+			expected := []Relationship{{ID: 2, PersonID: 2, RelatedID: 1, Type: RelExecutive, Bidirectional: true}}
+			if rr = do("GET", "/person/2/relationships", ""); rr.Code != 200 || !reflect.DeepEqual(rels(rr), expected) {
+				t.Errorf("Expected the inverse %+v. Got %d %v", expected, rr.Code, rr.Body.String())
+			}
+			if rr = do("GET", "/person/1/relationships?type=custom", ""); rr.Code != 200 || len(rels(rr)) != 1 || rels(rr)[0].ID != 3 {
+				t.Errorf("Expected the custom relationship. Got %d %v", rr.Code, rr.Body.String())
+			}
+			if rr = do("GET", "/person/1/relationships?type=friend", ""); rr.Code != 400 {
+				t.Errorf("Expected 400 for an unknown type. Got %d", rr.Code)
+			}
+			if rr = do("GET", "/person/9/relationships", ""); rr.Code != 404 {
+				t.Errorf("Expected 404 for a missing person. Got %d", rr.Code)
+			}
+
+			if rr = do("DELETE", "/person/1/relationships/2", ""); rr.Code != 404 {
+				t.Errorf("Expected 404 deleting another person's relationship. Got %d", rr.Code)
+			}
+			if rr = do("DELETE", "/person/1/relationships/1", ""); rr.Code != 204 {
+				t.Errorf("Expected 204 deleting the relationship. Got %d", rr.Code)
+			}
+			if rr = do("GET", "/person/2/relationships", ""); len(rels(rr)) != 0 {
+				t.Errorf("Expected the inverse to be deleted. Got %v", rr.Body.String())
+			}
+			do("DELETE", "/person/3", "")
+			if rr = do("GET", "/person/1/relationships", ""); len(rels(rr)) != 0 {
+				t.Errorf("Expected deleting a person to hide their relationships. Got %v", rr.Body.String())
+			}
+		})
+	}
+}
+
+func TestApp_Photo(t *testing.T) {
+	for name, store := range testAppStores(t) {
+		t.Run(name, func(t *testing.T) {
+			_, do := newTestApp(t, store)
+			encode := func(width, height int, format string) []byte {
+				img := image.NewRGBA(image.Rect(0, 0, width, height))
+				for i := range img.Pix {
+					img.Pix[i] = uint8(i)
+				}
+				buf := new(bytes.Buffer)
+				if format == PhotoJPEG {
+					jpeg.Encode(buf, img, nil)
+				} else {
+					png.Encode(buf, img)
+				}
+				return buf.Bytes()
+			}
+			do("POST", "/person", `{"FirstName": "Ann"}`)
+
+			photo := encode(300, 200, PhotoPNG)
+			// The format is sniffed, so a wrong Content-Type does not matter.
+			rr := do("PUT", "/person/1/photo", string(photo), "Content-Type", "application/octet-stream")
+			if rr.Code != 201 || rr.Header().Get("ETag") == "" {
+				t.Fatalf("Expected 201 with an ETag. Got %d %v", rr.Code, rr.Body.String())
+			}
+			etag := rr.Header().Get("ETag")
+			rr = do("GET", "/person/1/photo", "")
+			if rr.Code != 200 || rr.Header().Get("Content-Type") != PhotoPNG || !bytes.Equal(rr.Body.Bytes(), photo) || rr.Header().Get("ETag") != etag {
+				t.Errorf("Expected the PNG with ETag %v. Got %d %v %v", etag, rr.Code, rr.Header().Get("Content-Type"), rr.Header().Get("ETag"))
+			}
+			if rr = do("GET", "/person/1/photo", "", "If-None-Match", etag); rr.Code != 304 {
+				t.Errorf("Expected 304 for a matching If-None-Match. Got %d", rr.Code)
+			}
+			rr = do("GET", "/person/1/photo?size=thumbnail", "")
+			if cfg, err := png.DecodeConfig(rr.Body); err != nil || cfg.Width != 128 || cfg.Height != 85 {
+				t.Errorf("Expected a 128x85 PNG thumbnail. Got %+v %v", cfg, err)
+			}
+
+			photo = encode(64, 64, PhotoJPEG)
+			if rr = do("PUT", "/person/1/photo", string(photo)); rr.Code != 204 {
+				t.Errorf("Expected 204 replacing the photo. Got %d %v", rr.Code, rr.Body.String())
+			}
+			rr = do("GET", "/person/1/photo?size=thumbnail", "")
+			if rr.Header().Get("Content-Type") != PhotoJPEG || !bytes.Equal(rr.Body.Bytes(), photo) {
+				t.Errorf("Expected a small JPEG to be its own thumbnail. Got %v", rr.Header().Get("Content-Type"))
+			}
+			rr = do("GET", "/person/1.vcf", "")
+			if !strings.Contains(strings.Replace(rr.Body.String(), "\r\n ", "", -1), "PHOTO:data:image/jpeg;base64,"+base64.StdEncoding.EncodeToString(photo)+"\r\n") {
+				t.Errorf("Expected the vCard to have the photo. Got %q", rr.Body.String())
+			}
+			if rr = do("GET", "/person/1.vcf?version=3.0", ""); !strings.Contains(rr.Body.String(), "PHOTO;ENCODING=b;TYPE=JPEG:") {
+				t.Errorf("Expected the version 3.0 vCard to have the photo. Got %q", rr.Body.String())
+			}
+
+			for _, test := range []struct {
+				url  string
+				body []byte
+				code int
+			}{
+				{"/person/1/photo", []byte("GIF89a not allowed"), 415},
+				{"/person/1/photo", encode(5000, 1, PhotoPNG), 413},
+				{"/person/1/photo", bytes.Repeat([]byte{0xff, 0xd8, 0xff}, 2<<20), 413},
+				{"/person/1/photo", []byte("\x89PNG\r\n\x1a\ntruncated"), 400},
+				{"/person/1/photo", nil, 400},
+				{"/person/9/photo", photo, 404},
+			} {
+				if rr = do("PUT", test.url, string(test.body)); rr.Code != test.code {
+					t.Errorf("Expected %d uploading %.20q to %v. Got %d %v", test.code, test.body, test.url, rr.Code, rr.Body.String())
+				}
+			}
+
+			if rr = do("DELETE", "/person/1/photo", ""); rr.Code != 204 {
+				t.Errorf("Expected 204 deleting the photo. Got %d", rr.Code)
+			}
+			if rr = do("DELETE", "/person/1/photo", ""); rr.Code != 404 {
+				t.Errorf("Expected 404 deleting a missing photo. Got %d", rr.Code)
+			}
+			if rr = do("GET", "/person/1/photo", ""); rr.Code != 404 || !strings.Contains(rr.Body.String(), CodePhotoNotFound) {
+				t.Errorf("Expected 404 photo_not_found. Got %d %v", rr.Code, rr.Body.String())
+			}
+		})
+	}
+}
+
+func TestApp_Trash(t *testing.T) {
+	for name, store := range testAppStores(t) {
+		t.Run(name, func(t *testing.T) {
+			a, do := newTestApp(t, store)
+			dir := t.TempDir()
+			a.Photos, _ = NewDirPhotoStore(dir)
+			people := func(rr *httptest.ResponseRecorder) []Person {
+				people := []Person{}
+				json.Unmarshal(rr.Body.Bytes(), &people)
+				return people
+			}
+			do("POST", "/person", `{"FirstName": "Ann"}`)
+			do("POST", "/person", `{"FirstName": "Bob"}`)
+			buf := new(bytes.Buffer)
+			png.Encode(buf, image.NewGray(image.Rect(0, 0, 8, 8)))
+			do("PUT", "/person/1/photo", buf.String())
+
+			if rr := do("DELETE", "/person/1", ""); rr.Code != 204 {
+				t.Fatalf("Expected 204 deleting a person. Got %d %v", rr.Code, rr.Body.String())
+			}
+			if rr := do("DELETE", "/person/1", ""); rr.Code != 404 {
+				t.Errorf("Expected 404 deleting a person in the trash. Got %d", rr.Code)
+			}
+			for _, url := range []string{"/person/1", "/person/1.vcf", "/person/1/photo"} {
+				if rr := do("GET", url, ""); rr.Code != 404 {
+					t.Errorf("Expected 404 for %v of a person in the trash. Got %d", url, rr.Code)
+				}
+			}
+			if rr := do("DELETE", "/person/1/photo", ""); rr.Code != 404 || !strings.Contains(rr.Body.String(), CodePersonNotFound) {
+				t.Errorf("Expected 404 deleting the photo of a person in the trash. Got %d %v", rr.Code, rr.Body.String())
+			}
+			if rr := do("GET", "/people", ""); rr.Header().Get("X-Total-Count") != "1" {
+				t.Errorf("Expected people in the trash to be hidden. Got %v", rr.Body.String())
+			}
+			if rr := do("GET", "/people?deleted=include", ""); rr.Header().Get("X-Total-Count") != "2" {
+				t.Errorf("Expected deleted=include to list everyone. Got %v", rr.Body.String())
+			}
+			if rr := do("GET", "/people?deleted=yes", ""); rr.Code != 400 {
+				t.Errorf("Expected 400 for an invalid deleted parameter. Got %d", rr.Code)
+			}
+			rr := do("GET", "/trash", "")
+			if trash := people(rr); rr.Code != 200 || len(trash) != 1 || trash[0].FirstName != "Ann" || trash[0].DeletedAt == nil {
+				t.Errorf("Expected Ann in the trash with DeletedAt. Got %d %v", rr.Code, rr.Body.String())
+			}
+
+			if rr := do("POST", "/person/2/restore", ""); rr.Code != 404 {
+				t.Errorf("Expected 404 restoring a person not in the trash. Got %d", rr.Code)
+			}
+			if rr := do("POST", "/person/1/restore", ""); rr.Code != 200 || !strings.Contains(rr.Body.String(), `"FirstName":"Ann"`) {
+				t.Errorf("Expected 200 with the restored person. Got %d %v", rr.Code, rr.Body.String())
+			}
+			if rr := do("GET", "/person/1/photo", ""); rr.Code != 200 {
+				t.Errorf("Expected the photo to survive the trash. Got %d", rr.Code)
+			}
+
+			if rr := do("DELETE", "/trash/2", ""); rr.Code != 404 {
+				t.Errorf("Expected 404 purging a person not in the trash. Got %d", rr.Code)
+			}
+			do("DELETE", "/person/1", "")
+			if rr := do("DELETE", "/trash/1", ""); rr.Code != 204 {
+				t.Errorf("Expected 204 purging a person. Got %d %v", rr.Code, rr.Body.String())
+			}
+			if _, err := os.Stat(filepath.Join(dir, "1.photo")); !os.IsNotExist(err) {
+				t.Errorf("Expected purging a person to delete their photo. Got %v", err)
+			}
+			if rr := do("POST", "/person/1/restore", ""); rr.Code != 404 {
+				t.Errorf("Expected 404 restoring a purged person. Got %d", rr.Code)
+			}
+
+			do("DELETE", "/person/2", "")
+			a.TrashRetention = time.Hour
+			a.purgeDeleted(nil, time.Now().Add(-a.TrashRetention))
+			if trash := people(do("GET", "/trash", "")); len(trash) != 1 {
+				t.Errorf("Expected people deleted within the retention period to be kept. Got %+v", trash)
+			}
+			if rr := do("DELETE", "/trash", ""); rr.Code != 204 {
+				t.Errorf("Expected 204 emptying the trash. Got %d", rr.Code)
+			}
+			if trash := people(do("GET", "/trash", "")); len(trash) != 0 {
+				t.Errorf("Expected an empty trash. Got %+v", trash)
+			}
+		})
+	}
+}
+
+func TestApp_Audit(t *testing.T) {
+	if _, err := ParseTrustedProxies("192.0.2.1,proxy.example.com"); err == nil {
+		t.Errorf("Expected an error for a trusted proxy that is not an address")
+	}
+	proxies, err := ParseTrustedProxies("192.0.2.1, 198.51.100.0/24")
+	if err != nil || len(proxies) != 2 {
+		t.Fatalf("ParseTrustedProxies() = %v, %v", proxies, err)
+	}
+	for name, store := range testAppStores(t) {
+		t.Run(name, func(t *testing.T) {
+			a, do := newTestApp(t, store)
+			a.TrustedProxies = proxies
+			entries := func(rr *httptest.ResponseRecorder) []AuditEntry {
+				entries := []AuditEntry{}
+				json.Unmarshal(rr.Body.Bytes(), &entries)
+				return entries
+			}
+			do("POST", "/person", `{"FirstName": "Ann", "Email": "ann@example.com"}`)
+			do("PATCH", "/person/1", `{"Email": "ann@example.org"}`, "X-Actor", "alice", "X-Request-ID", "req-1")
+
+			rr := do("GET", "/person/1/history", "")
+			history := entries(rr)
+			if rr.Code != 200 || len(history) != 2 || rr.Header().Get("X-Total-Count") != "2" {
+				t.Fatalf("Expected two history entries. Got %d %v", rr.Code, rr.Body.String())
+			}
+			change := func(e AuditEntry, field string) (FieldChange, bool) {
+				for _, c := range e.Changes {
+					if c.Field == field {
+						return c, true
+					}
+				}
+				return FieldChange{}, false
+			}
+			patch, create := history[0], history[1]
+			if create.Action != AuditCreate || create.Before != nil || create.After == nil || create.After.FirstName != "Ann" {
+				t.Errorf("Expected a create entry with the new person. Got %+v", create)
+			}
+			if patch.Action != AuditPatch || patch.Actor != "alice" || patch.RequestID != "req-1" {
+				t.Errorf("Expected a patch by alice in req-1. Got %+v", patch)
+			}
+			if c, ok := change(patch, "Email"); !ok || string(c.Before) != `"ann@example.com"` || string(c.After) != `"ann@example.org"` {
+				t.Errorf("Expected the patch to change Email. Got %+v", patch.Changes)
+			}
+			if _, ok := change(patch, "FirstName"); ok {
+				t.Errorf("Expected unchanged fields to be left out. Got %+v", patch.Changes)
+			}
+
+			do("POST", "/person", `{"FirstName": "Bob"}`, "X-Actor", "bob")
+			req, _ := http.NewRequest("PATCH", "/person/2", strings.NewReader(`{"LastName": "Jones"}`))
+			req.RemoteAddr = "203.0.113.9:1234"
+			req.Header.Set("X-Actor", "alice")
+			a.Router.ServeHTTP(httptest.NewRecorder(), req)
+			if history := entries(do("GET", "/person/2/history", "")); len(history) != 2 || history[0].Actor != "203.0.113.9" {
+				t.Errorf("Expected X-Actor from an untrusted client to be ignored. Got %+v", history)
+			}
+			for url, n := range map[string]int{
+				"/audit":                            4,
+				"/audit?action=create":              2,
+				"/audit?actor=alice":                1,
+				"/audit?personId=2":                 2,
+				"/audit?requestId=req-1":            1,
+				"/audit?limit=1&offset=2":           1,
+				"/audit?since=2000-01-01T00:00:00Z": 4,
+				"/audit?until=2000-01-01T00:00:00Z": 0,
+			} {
+				if rr := do("GET", url, ""); len(entries(rr)) != n {
+					t.Errorf("Expected %d entries for %v. Got %d %v", n, url, rr.Code, rr.Body.String())
+				}
+			}
+			for _, url := range []string{"/audit?action=edit", "/audit?since=yesterday", "/audit?limit=-1"} {
+				if rr := do("GET", url, ""); rr.Code != 400 {
+					t.Errorf("Expected 400 for %v. Got %d", url, rr.Code)
+				}
+			}
+
+			rr = do("POST", fmt.Sprintf("/person/1/history/%d/revert", create.ID), "")
+			if rr.Code != 200 || !strings.Contains(rr.Body.String(), `"Email":"ann@example.com"`) {
+				t.Errorf("Expected 200 with the reverted person. Got %d %v", rr.Code, rr.Body.String())
+			}
+			if history := entries(do("GET", "/person/1/history?limit=1", "")); len(history) != 1 || history[0].Action != AuditRevert {
+				t.Errorf("Expected a revert entry. Got %+v", history)
+			} else if c, ok := change(history[0], "Email"); !ok || string(c.After) != `"ann@example.com"` {
+				t.Errorf("Expected a revert entry changing Email. Got %+v", history)
+			}
+			if rr := do("POST", "/person/2/history/1/revert", ""); rr.Code != 404 {
+				t.Errorf("Expected 404 reverting to another person's entry. Got %d", rr.Code)
+			}
+			if rr := do("POST", "/person/1/history/99/revert", ""); rr.Code != 404 {
+				t.Errorf("Expected 404 reverting to a missing entry. Got %d", rr.Code)
+			}
+
+			do("DELETE", "/person/2", "")
+			deleted := entries(do("GET", "/audit?action=delete", ""))
+			if len(deleted) != 1 || deleted[0].Before == nil || deleted[0].Before.FirstName != "Bob" || deleted[0].After != nil {
+				t.Fatalf("Expected a delete entry with the deleted person. Got %+v", deleted)
+			}
+			if rr := do("POST", fmt.Sprintf("/person/2/history/%d/revert", deleted[0].ID), ""); rr.Code != 409 {
+				t.Errorf("Expected 409 reverting to a deletion. Got %d", rr.Code)
+			}
+			do("DELETE", "/trash/2", "")
+			if history := entries(do("GET", "/person/2/history", "")); len(history) != 4 || history[0].Action != AuditPurge {
+				t.Errorf("Expected history to outlive a purge. Got %+v", history)
+			}
+			// The purged person's ID, and so their history, is not given to the next person created.
+			eve := Person{}
+			json.Unmarshal(do("POST", "/person", `{"FirstName": "Eve"}`).Body.Bytes(), &eve)
+			if eve.ID != 3 {
+				t.Errorf("Expected the person created after a purge to get ID 3. Got %+v", eve)
+			}
+			if history := entries(do("GET", "/person/3/history", "")); len(history) != 1 || history[0].Action != AuditCreate {
+				t.Errorf("Expected a new person's history to have only their create. Got %+v", history)
+			}
+			if rr := do("GET", "/person/2", ""); rr.Code != 404 {
+				t.Errorf("Expected 404 for the purged person's ID. Got %d", rr.Code)
+			}
+
+			do("POST", "/import", "FirstName,LastName\nCat,Smith\nDan,Jones\n", "X-Actor", "importer")
+			if imported := entries(do("GET", "/audit?action=import&actor=importer", "")); len(imported) != 2 ||
+				imported[0].PersonID == 0 || imported[0].After == nil || imported[0].After.FirstName != "Dan" {
+				t.Errorf("Expected an import entry per person. Got %+v", imported)
+			}
+
+			// Changes that are not made to one person at a time are recorded for each person they change.
+			buf := new(bytes.Buffer)
+			png.Encode(buf, image.NewGray(image.Rect(0, 0, 8, 8)))
+			do("PUT", "/person/1/photo", buf.String())
+			do("DELETE", "/person/1/photo", "")
+			if photos := entries(do("GET", "/person/1/history?action=photo", "")); len(photos) != 2 ||
+				len(photos[0].Changes) != 1 || photos[0].Changes[0].Before == nil || photos[0].Changes[0].After != nil {
+				t.Errorf("Expected photo entries for setting and removing the photo. Got %+v", photos)
+			}
+			do("POST", "/groups", `{"Name": "Friends"}`)
+			do("PUT", "/groups/1/people/1", "")
+			do("PUT", "/groups/1", `{"Name": "Family"}`)
+			if history := entries(do("GET", "/person/1/history?limit=1", "")); len(history) != 1 || history[0].After == nil ||
+				!reflect.DeepEqual(history[0].After.Groups, []string{"Family"}) {
+				t.Errorf("Expected renaming a group to record an update of its members. Got %+v", history)
+			}
+			do("POST", "/fields", `{"Name": "badge", "Type": "number"}`)
+			do("PATCH", "/person/1", `{"Custom": {"badge": "7"}}`)
+			do("DELETE", "/fields/badge", "")
+			if history := entries(do("GET", "/person/1/history?limit=1", "")); len(history) != 1 || history[0].Action != AuditUpdate ||
+				history[0].Before.Custom["badge"] != "7" || len(history[0].After.Custom) != 0 {
+				t.Errorf("Expected deleting a field to record an update of the people with it. Got %+v", history)
+			}
+		})
+	}
+}
+
+func TestApp_NoAuditLog(t *testing.T) {
+	// Embedding only the PersonStore interface hides the store's AuditLog methods.
+	_, do := newTestApp(t, struct{ PersonStore }{NewMemoryStore()})
+	if rr := do("POST", "/person", `{"FirstName": "Ann"}`); rr.Code != 201 {
+		t.Fatalf("Expected 201 creating a person without an audit log. Got %d %v", rr.Code, rr.Body.String())
+	}
+	for _, r := range [][2]string{{"GET", "/audit"}, {"GET", "/person/1/history"}, {"POST", "/person/1/history/1/revert"}} {
+		if rr := do(r[0], r[1], ""); rr.Code != 501 || !strings.Contains(rr.Body.String(), CodeNoAuditLog) {
+			t.Errorf("Expected 501 for %v %v without an audit log. Got %d %v", r[0], r[1], rr.Code, rr.Body.String())
+		}
+	}
+}
+
+func TestApp_DeletePerson(t *testing.T) {
+	tests := []struct {
+		request      string
+		expectedCode int
+		emptydb      bool
+	}{
+		{
+			request:      "/person/1",
+			expectedCode: 204,
+		},
+		{
+			request:      "/person/1",
+			expectedCode: 404,
+			emptydb:      true,
+		},
+		{
+			request:      "/person/99",
+			expectedCode: 404,
+		},
+		{
+			request:      "/person/9223372036854775809",
+			expectedCode: 400,
+		},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest("DELETE", tt.request, nil)
+		response := executeRequest(req, tt.emptydb)
+		if tt.expectedCode != response.Code {
+			t.Errorf("Expected response code %d. Got %d\n", tt.expectedCode, response.Code)
+		}
+	}
+}
+func TestApp_Import(t *testing.T) {
+	tests := []struct {
+		method       string
+		request      string
+		body         string
+		expectedCode int
+		emptydb      bool
+	}{
+		{
+			method:  "POST",
+			request: "/import",
+			body: `FirstName,LastName,Email,Phone
+Person 1,Smith,email@example.com,123-456-7890
+Person 2,Smith,email@example.com,123-456-7890
+Person 3,Smith,email@example.com,123-456-7890
+Person 4,Smith,email@example.com,123-456-7890
+`,
+			expectedCode: 200,
+		},
+		{
+			method:  "POST",
+			request: "/import",
+			body: `FirstName,LastName,Email,Phone
+Person 1,Smith,email@example.com,123-456-7890
+Person 2,Smith,email@example.com,123-456-7890
+Person 3,Smith,email@example.com,123-456-7890
+Person 4,Smith,email@example.com,123-456-7890
+`,
+			expectedCode: 200,
+			emptydb:      true,
+		},
+		{
+			method:       "POST",
+			request:      "/import",
+			body:         "",
+			expectedCode: 400,
+		},
+	}
+	for _, tt := range tests {
+		buf := strings.NewReader(tt.body)
+		req, _ := http.NewRequest(tt.method, tt.request, buf)
+		response := executeRequest(req, tt.emptydb)
+		if tt.expectedCode != response.Code {
+			t.Errorf("Expected response code %d. Got %d\n", tt.expectedCode, response.Code)
+		}
+	}
+}
+
+func TestApp_ImportReport(t *testing.T) {
+	body := `FirstName,LastName,Email,Phone
+Good,Row,good@example.com,123-456-7890
+Short,Row
+Bad "quote,Row,,
+,,not an email,
+Another,Good,,
+`
+	tests := []struct {
+		request         string
+		expectedCode    int
+		expectedCreated int
+		expectedPeople  int
+	}{
+		{
+			request:        "/import",
+			expectedCode:   422,
+			expectedPeople: 0,
+		},
+		{
+			request:         "/import?mode=best-effort",
+			expectedCode:    200,
+			expectedCreated: 2,
+			expectedPeople:  2,
+		},
+		{
+			request:      "/import?mode=sometimes",
+			expectedCode: 400,
+		},
+	}
+	expectedRejected := []RejectedRow{
+		{Row: 3, Reason: "expected 4 columns, got 2"},
+		{Row: 4, Reason: `invalid CSV: bare " in non-quoted-field`},
+		{Row: 5, Reason: "FirstName: FirstName or LastName is required; Email: not a valid email address"},
+	}
+	for _, tt := range tests {
+		a := App{}
+		a.InitializeWithStore(NewMemoryStore())
+		a.addHandles()
+		req, _ := http.NewRequest("POST", tt.request, strings.NewReader(body))
+		rr := httptest.NewRecorder()
+		a.Router.ServeHTTP(rr, req)
+		if tt.expectedCode != rr.Code {
+			t.Errorf("%v: expected response code %d. Got %d", tt.request, tt.expectedCode, rr.Code)
+		}
+		if tt.expectedCode == 400 {
+			continue
+		}
+		report := ImportReport{}
+		if tt.expectedCode == 422 {
+			p := Problem{}
+			json.Unmarshal(rr.Body.Bytes(), &p)
+			if p.Code != CodeImportRejected || p.Report == nil {
+				t.Errorf("%v: expected import_rejected problem with report. Got %v", tt.request, rr.Body.String())
+				continue
+			}
+			report = *p.Report
+		} else if err := json.Unmarshal(rr.Body.Bytes(), &report); err != nil {
+			t.Errorf("%v: could not unmarshal report: %v", tt.request, err)
+			continue
+		}
+		if report.Rows != 5 || report.Created != tt.expectedCreated {
+			t.Errorf("%v: expected 5 rows and %v created. Got %+v", tt.request, tt.expectedCreated, report)
+		}
+		if !reflect.DeepEqual(report.Rejected, expectedRejected) {
+			t.Errorf("%v: expected rejected rows %+v. Got %+v", tt.request, expectedRejected, report.Rejected)
+		}
+		if _, total, _ := a.Store.Query(PeopleQuery{Limit: -1}); total != tt.expectedPeople {
+			t.Errorf("%v: expected %v people imported. Got %v", tt.request, tt.expectedPeople, total)
+		}
+	}
+}
+
+func TestApp_ImportDryRun(t *testing.T) {
+	body := `FirstName,LastName,Email,Phone
+Existing,Email,TEST.NAME@example.com,
+New,Person,new@example.com,
+New,Again,new@example.com,
+Test,Name,,
+Bad,Email,not an email,
+`
+	tests := []struct {
+		request        string
+		expected       ImportReport
+		expectedPeople int
+	}{
+		{
+			request:        "/import?dryRun=true&mode=best-effort",
+			expected:       ImportReport{Mode: "best-effort", Duplicates: "allow", DryRun: true, Rows: 5, Inserts: 4, Conflicts: 2, Errors: 1},
+			expectedPeople: 1,
+		},
+		{
+			request:        "/import?dryRun=true&mode=best-effort&duplicates=skip",
+			expected:       ImportReport{Mode: "best-effort", Duplicates: "skip", DryRun: true, Rows: 5, Inserts: 2, Skips: 2, Conflicts: 2, Errors: 1},
+			expectedPeople: 1,
+		},
+		{
+			request:        "/import?dryRun=true",
+			expected:       ImportReport{Mode: "atomic", Duplicates: "allow", DryRun: true, Rows: 5, Conflicts: 2, Errors: 1},
+			expectedPeople: 1,
+		},
+		{
+			request:        "/import?mode=best-effort&duplicates=skip",
+			expected:       ImportReport{Mode: "best-effort", Duplicates: "skip", Rows: 5, Inserts: 2, Skips: 2, Conflicts: 2, Errors: 1, Created: 2},
+			expectedPeople: 3,
+		},
+	}
+	expectedConflicting := []ConflictRow{
+		{Row: 2, ID: 1, Reason: "same email as person 1"},
+		{Row: 4, Reason: "same email as row 3"},
+	}
+	for _, tt := range tests {
+		a := App{}
+		a.InitializeWithStore(NewMemoryStore())
+		a.addHandles()
+		a.Store.Create(&Person{FirstName: "Test", LastName: "Name", Email: "Test.Name@example.com"})
+		req, _ := http.NewRequest("POST", tt.request, strings.NewReader(body))
+		rr := httptest.NewRecorder()
+		a.Router.ServeHTTP(rr, req)
+		if rr.Code != 200 {
+			t.Errorf("%v: expected response code 200. Got %d", tt.request, rr.Code)
+		}
+		report := ImportReport{}
+		if err := json.Unmarshal(rr.Body.Bytes(), &report); err != nil {
+			t.Errorf("%v: could not unmarshal report: %v", tt.request, err)
+			continue
+		}
+		if !reflect.DeepEqual(report.Conflicting, expectedConflicting) || len(report.Rejected) != 1 {
+			t.Errorf("%v: expected conflicts %+v. Got %+v", tt.request, expectedConflicting, report.Conflicting)
+		}
+		report.Conflicting, report.Rejected = nil, nil
+		if !reflect.DeepEqual(report, tt.expected) {
+			t.Errorf("%v: expected report %+v. Got %+v", tt.request, tt.expected, report)
+		}
+		if _, total, _ := a.Store.Query(PeopleQuery{Limit: -1}); total != tt.expectedPeople {
+			t.Errorf("%v: expected %v people after import. Got %v", tt.request, tt.expectedPeople, total)
+		}
+	}
+}
+
+func TestApp_ImportDialect(t *testing.T) {
+	utf16le := func(s string) string {
+		b := []byte{0xff, 0xfe}
+		for _, u := range utf16.Encode([]rune(s)) {
+			b = append(b, byte(u), byte(u>>8))
+		}
+		return string(b)
+	}
+	tests := []struct {
+		name         string
+		request      string
+		contentType  string
+		body         string
+		expectedCode int
+		expected     []Person
+	}{
+		{
+			name:         "header order",
+			request:      "/import",
+			body:         "Email,Source,Last Name,first_name\nann@example.com,ignored,Smith,Ann\n",
+			expectedCode: 200,
+			expected:     []Person{{ID: 1, FirstName: "Ann", LastName: "Smith", Email: "ann@example.com"}},
+		},
+		{
+			name:         "no header",
+			request:      "/import",
+			body:         "Ann,Smith,ann@example.com,123-456-7890\n",
+			expectedCode: 200,
+			expected:     []Person{{ID: 1, FirstName: "Ann", LastName: "Smith", Email: "ann@example.com", Phone: "123-456-7890"}},
+		},
+		{
+			name:         "semicolon",
+			request:      "/import?delimiter=semicolon",
+			body:         "FirstName;LastName;Email;Phone\n\"Smith; Ann\";Smith;;\n",
+			expectedCode: 200,
+			expected:     []Person{{ID: 1, FirstName: "Smith; Ann", LastName: "Smith"}},
+		},
+		{
+			name:         "single quote",
+			request:      "/import?quote='",
+			body:         "FirstName,LastName\n'Ann, \"Annie\"','O''Brien'\n",
+			expectedCode: 200,
+			expected:     []Person{{ID: 1, FirstName: `Ann, "Annie"`, LastName: "O'Brien"}},
+		},
+		{
+			name:         "unknown header",
+			request:      "/import?delimiter=tab",
+			body:         utf16le("Vorname\tNachname\tE-Mail\nJürgen\tMüller\tj@example.com\n"),
+			expectedCode: 422,
+		},
+		{
+			name:         "utf-16 bom mapped",
+			request:      "/import?delimiter=tab",
+			body:         utf16le("First Name\tLast Name\tE-mail Address\r\nJürgen\tMüller\tj@example.com\r\n"),
+			expectedCode: 200,
+			expected:     []Person{{ID: 1, FirstName: "Jürgen", LastName: "Müller", Email: "j@example.com"}},
+		},
+		{
+			name:         "latin1 charset",
+			request:      "/import",
+			contentType:  "text/csv; charset=ISO-8859-1",
+			body:         "FirstName,LastName\nJ\xfcrgen,M\xfcller\n",
+			expectedCode: 200,
+			expected:     []Person{{ID: 1, FirstName: "Jürgen", LastName: "Müller"}},
+		},
+		{
+			name:         "invalid utf-8",
+			request:      "/import",
+			body:         "FirstName,LastName\nJ\xfcrgen,M\xfcller\n",
+			expectedCode: 400,
+		},
+		{
+			name:         "bad delimiter",
+			request:      "/import?delimiter=ab",
+			body:         "Ann,Smith,,\n",
+			expectedCode: 400,
+		},
+		{
+			name:         "bad encoding",
+			request:      "/import?encoding=ebcdic",
+			body:         "Ann,Smith,,\n",
+			expectedCode: 400,
+		},
+	}
+	for _, tt := range tests {
+		a := App{}
+		a.InitializeWithStore(NewMemoryStore())
+		a.addHandles()
+		req, _ := http.NewRequest("POST", tt.request, strings.NewReader(tt.body))
+		if tt.contentType != "" {
+			req.Header.Set("Content-Type", tt.contentType)
+		}
+		rr := httptest.NewRecorder()
+		a.Router.ServeHTTP(rr, req)
+		if tt.expectedCode != rr.Code {
+			t.Errorf("%v: expected response code %d. Got %d: %v", tt.name, tt.expectedCode, rr.Code, rr.Body.String())
+			continue
+		}
+		if tt.expectedCode != 200 {
+			continue
+		}
+		people, _, _ := a.Store.Query(PeopleQuery{Limit: -1})
+		if !reflect.DeepEqual(people, normalised(tt.expected...)) {
+			t.Errorf("%v: expected %+v. Got %+v", tt.name, tt.expected, people)
+		}
+	}
+}
+
+func TestApp_ExportDialect(t *testing.T) {
+	tests := []struct {
+		request             string
+		expectedContentType string
+		expectedBody        string
+	}{
+		{
+			request:             "/export",
+			expectedContentType: "text/csv; charset=utf-8",
+			expectedBody:        "FirstName,LastName,Email,Phone,HomeEmail,WorkEmail,HomePhone,WorkPhone,MobilePhone,Street,City,Region,Postcode,Country,Nickname,Organization,Department,Title,Birthday,Website,Notes,Groups\n\"Smith, Ann\",O'Brien,ann@example.com,,,,,,,,,,,,,,,,,,,\n",
+		},
+		{
+			request:             "/export?delimiter=%3B&quote='&bom=true",
+			expectedContentType: "text/csv; charset=utf-8",
+			expectedBody:        "\xef\xbb\xbfFirstName;LastName;Email;Phone;HomeEmail;WorkEmail;HomePhone;WorkPhone;MobilePhone;Street;City;Region;Postcode;Country;Nickname;Organization;Department;Title;Birthday;Website;Notes;Groups\nSmith, Ann;'O''Brien';ann@example.com;;;;;;;;;;;;;;;;;;;\n",
+		},
+		{
+			request:             "/export?encoding=utf-16&delimiter=tab",
+			expectedContentType: "text/csv; charset=utf-16",
+			expectedBody:        "\xff\xfeF\x00i\x00",
+		},
+		{
+			request:             "/export?encoding=latin1",
+			expectedContentType: "text/csv; charset=iso-8859-1",
+			expectedBody:        "FirstName,LastName,Email,Phone,HomeEmail,WorkEmail,HomePhone,WorkPhone,MobilePhone,Street,City,Region,Postcode,Country,Nickname,Organization,Department,Title,Birthday,Website,Notes,Groups\n\"Smith, Ann\",O'Brien,ann@example.com,,,,,,,,,,,,,,,,,,,\n",
+		},
+	}
+	for _, tt := range tests {
+		a := App{}
+		a.InitializeWithStore(NewMemoryStore())
+		a.addHandles()
+		a.Store.Create(&Person{FirstName: "Smith, Ann", LastName: "O'Brien", Email: "ann@example.com"})
+		req, _ := http.NewRequest("GET", tt.request, nil)
+		rr := httptest.NewRecorder()
+		a.Router.ServeHTTP(rr, req)
+		if ct := rr.Header().Get("Content-Type"); ct != tt.expectedContentType {
+			t.Errorf("%v: expected Content-Type %v. Got %v", tt.request, tt.expectedContentType, ct)
+		}
+		if !strings.HasPrefix(rr.Body.String(), tt.expectedBody) {
+			t.Errorf("%v: expected body %q. Got %q", tt.request, tt.expectedBody, rr.Body.String())
+		}
+
+		// Every dialect must import back to the same person.
+		b := App{}
+		b.InitializeWithStore(NewMemoryStore())
+		b.addHandles()
+		query := strings.TrimPrefix(strings.TrimPrefix(tt.request, "/export"), "?")
+		req, _ = http.NewRequest("POST", "/import?"+query, bytes.NewReader(rr.Body.Bytes()))
+		req.Header.Set("Content-Type", rr.Header().Get("Content-Type"))
+		rr = httptest.NewRecorder()
+		b.Router.ServeHTTP(rr, req)
+		exported, _, _ := a.Store.Query(PeopleQuery{Limit: -1})
+		imported, _, _ := b.Store.Query(PeopleQuery{Limit: -1})
+		if rr.Code != 200 || !reflect.DeepEqual(exported, imported) {
+			t.Errorf("%v: expected round trip to give %+v. Got %d %+v", tt.request, exported, rr.Code, imported)
+		}
+	}
+}
+
+func TestApp_CSVProfiles(t *testing.T) {
+	google := `Name,Given Name,Additional Name,Family Name,Nickname,E-mail 1 - Type,E-mail 1 - Value,E-mail 2 - Type,E-mail 2 - Value,Phone 1 - Type,Phone 1 - Value
+Ann Smith,Ann,,Smith,Annie,* Home,ann@example.com ::: ann.smith@example.com,,,Mobile,123-456-7890
+Bob Jones,Bob,,Jones,,,,Work,bob@example.com,,
+`
+	outlook := "\xef\xbb\xbf" + `First Name,Middle Name,Last Name,E-mail Address,E-mail 2 Address,Home Phone,Business Phone,Mobile Phone
+Ann,,Smith,,ann@example.com,555-0100,,123-456-7890
+`
+	tests := []struct {
+		name         string
+		request      string
+		body         string
+		expectedCode int
+		expected     []Person
+	}{
+		{
+			name:         "google",
+			request:      "/import?profile=google",
+			body:         google,
+			expectedCode: 200,
+			expected: []Person{
+				{ID: 1, FirstName: "Ann", LastName: "Smith", Email: "ann@example.com", Phone: "123-456-7890"},
+				{ID: 2, FirstName: "Bob", LastName: "Jones", Email: "bob@example.com"},
+			},
+		},
+		{
+			name:         "outlook",
+			request:      "/import?profile=outlook",
+			body:         outlook,
+			expectedCode: 200,
+			expected:     []Person{{ID: 1, FirstName: "Ann", LastName: "Smith", Email: "ann@example.com", Phone: "123-456-7890"}},
+		},
+		{
+			name:         "unknown profile",
+			request:      "/import?profile=thunderbird",
+			body:         google,
+			expectedCode: 400,
+		},
+	}
+	for _, tt := range tests {
+		a := App{}
+		a.InitializeWithStore(NewMemoryStore())
+		a.addHandles()
+		req, _ := http.NewRequest("POST", tt.request, strings.NewReader(tt.body))
+		rr := httptest.NewRecorder()
+		a.Router.ServeHTTP(rr, req)
+		if tt.expectedCode != rr.Code {
+			t.Errorf("%v: expected response code %d. Got %d: %v", tt.name, tt.expectedCode, rr.Code, rr.Body.String())
+			continue
+		}
+		if tt.expectedCode != 200 {
+			continue
+		}
+		people, _, _ := a.Store.Query(PeopleQuery{Limit: -1})
+		if !reflect.DeepEqual(people, normalised(tt.expected...)) {
+			t.Errorf("%v: expected %+v. Got %+v", tt.name, tt.expected, people)
+		}
+	}
+
+	exports := []struct {
+		request      string
+		expectedBody string
+	}{
+		{
+			request: "/export?profile=google",
+			expectedBody: `First Name,Last Name,E-mail 1 - Label,E-mail 1 - Value,Phone 1 - Label,Phone 1 - Value
+Ann,Smith,* Other,ann@example.com,Mobile,123-456-7890
+Bob,Jones,,,,
+`,
+		},
+		{
+			request: "/export?profile=outlook",
+			expectedBody: "\xef\xbb\xbf" + `First Name,Last Name,E-mail Address,Mobile Phone
+Ann,Smith,ann@example.com,123-456-7890
+Bob,Jones,,
+`,
+		},
+		{
+			request: "/export?profile=outlook&bom=false",
+			expectedBody: `First Name,Last Name,E-mail Address,Mobile Phone
+Ann,Smith,ann@example.com,123-456-7890
+Bob,Jones,,
+`,
+		},
+	}
+	for _, tt := range exports {
+		a := App{}
+		a.InitializeWithStore(NewMemoryStore())
+		a.addHandles()
+		a.Store.Create(&Person{FirstName: "Ann", LastName: "Smith", Email: "ann@example.com", Phone: "123-456-7890"})
+		a.Store.Create(&Person{FirstName: "Bob", LastName: "Jones"})
+		req, _ := http.NewRequest("GET", tt.request, nil)
+		rr := httptest.NewRecorder()
+		a.Router.ServeHTTP(rr, req)
+		if rr.Body.String() != tt.expectedBody {
+			t.Errorf("%v: expected body %q. Got %q", tt.request, tt.expectedBody, rr.Body.String())
+		}
+
+		// Exports must import back with the same profile.
+		b := App{}
+		b.InitializeWithStore(NewMemoryStore())
+		b.addHandles()
+		req, _ = http.NewRequest("POST", strings.Replace(tt.request, "/export", "/import", 1), bytes.NewReader(rr.Body.Bytes()))
+		rr = httptest.NewRecorder()
+		b.Router.ServeHTTP(rr, req)
+		exported, _, _ := a.Store.Query(PeopleQuery{Limit: -1})
+		imported, _, _ := b.Store.Query(PeopleQuery{Limit: -1})
+		if rr.Code != 200 || !reflect.DeepEqual(exported, imported) {
+			t.Errorf("%v: expected round trip to give %+v. Got %d %+v", tt.request, exported, rr.Code, imported)
+		}
+	}
+}
+
+func TestApp_ImportVCard(t *testing.T) {
+	body := "BEGIN:VCARD\r\n" +
+		"VERSION:4.0\r\n" +
+		"FN:Ann Smith\r\n" +
+		"N:Smith;Ann;;;\r\n" +
+		"EMAIL;TYPE=work:ann.smith@work.example.com\r\n" +
+		"EMAIL;PREF=1:ann@exam\r\n" +
+		" ple.com\r\n" +
+		"TEL;VALUE=uri;TYPE=cell:tel:+1-555-555-0100\r\n" +
+		"ADR;TYPE=home:;Flat 2;1 Main St\\, Suite 5;Springfield;IL;62701;USA\r\n" +
+		"END:VCARD\r\n" +
+		"BEGIN:VCARD\r\n" +
+		"VERSION:2.1\r\n" +
+		"N;CHARSET=UTF-8;ENCODING=QUOTED-PRINTABLE:M=C3=BCller;J=C3=BC=\r\n" +
+		"rgen\r\n" +
+		"TEL;HOME:555-0101\r\n" +
+		"TEL;CELL;PREF:555-0102\r\n" +
+		"END:VCARD\r\n" +
+		"BEGIN:VCARD\r\n" +
+		"VERSION:3.0\r\n" +
+		"item1.EMAIL;TYPE=INTERNET:pat@example.com\r\n" +
+		"FN:Pat O'Brien\r\n" +
+		"END:VCARD\r\n" +
+		"BEGIN:VCARD\r\n" +
+		"VERSION:5.0\r\n" +
+		"FN:Future Person\r\n" +
+		"END:VCARD\r\n" +
+		"BEGIN:VCARD\r\n" +
+		"FN:Unfinished\r\n"
+	a := App{}
+	a.InitializeWithStore(NewMemoryStore())
+	a.addHandles()
+	req, _ := http.NewRequest("POST", "/import?mode=best-effort", strings.NewReader(body))
+	rr := httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	if rr.Code != 200 {
+		t.Fatalf("Expected response code 200. Got %d: %v", rr.Code, rr.Body.String())
+	}
+	report := ImportReport{}
+	json.Unmarshal(rr.Body.Bytes(), &report)
+	expectedRejected := []RejectedRow{
+		{Row: 23, Reason: `unsupported vCard version "5.0"`},
+		{Row: 27, Reason: "missing END:VCARD"},
+	}
+	if report.Rows != 5 || !reflect.DeepEqual(report.Rejected, expectedRejected) {
+		t.Errorf("Expected 5 rows and rejected rows %+v. Got %+v", expectedRejected, report)
+	}
+	expected := []Person{
+		{ID: 1, FirstName: "Ann", LastName: "Smith", Email: "ann@example.com", Phone: "+1-555-555-0100",
+			Emails:    []Email{{Value: "ann@example.com"}, {Type: TypeWork, Value: "ann.smith@work.example.com"}},
+			Phones:    []Phone{{Type: TypeMobile, Value: "+1-555-555-0100"}},
+			Addresses: []Address{{Type: TypeHome, Street: "Flat 2\n1 Main St, Suite 5", City: "Springfield", Region: "IL", Postcode: "62701", Country: "USA"}}},
+		{ID: 2, FirstName: "Jürgen", LastName: "Müller", Phone: "555-0102",
+			Phones: []Phone{{Type: TypeMobile, Value: "555-0102"}, {Type: TypeHome, Value: "555-0101"}}},
+		{ID: 3, FirstName: "Pat", LastName: "O'Brien", Email: "pat@example.com"},
+	}
+	people, _, _ := a.Store.Query(PeopleQuery{Limit: -1})
+	if !reflect.DeepEqual(people, normalised(expected...)) {
+		t.Errorf("Expected %+v. Got %+v", expected, people)
+	}
+
+	// A vCard is recognised by its Content-Type even without BEGIN:VCARD at the start.
+	req, _ = http.NewRequest("POST", "/import", strings.NewReader("FN:Ann\r\n"))
+	req.Header.Set("Content-Type", "text/vcard")
+	rr = httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	if rr.Code != 422 || !strings.Contains(rr.Body.String(), "expected BEGIN:VCARD") {
+		t.Errorf("Expected a rejected vCard. Got %d: %v", rr.Code, rr.Body.String())
+	}
+}
+
+func TestApp_ExportVCard(t *testing.T) {
+	tests := []struct {
+		request      string
+		expectedCode int
+		expectedBody string
+	}{
+		{
+			request:      "/person/1.vcf",
+			expectedCode: 200,
+			expectedBody: "BEGIN:VCARD\r\n" +
+				"VERSION:4.0\r\n" +
+				"FN:Ann Smith\\, Jr.\r\n" +
+				"N:Smith\\, Jr.;Ann;;;\r\n" +
+				"EMAIL:ann@example.com\r\n" +
+				"TEL;TYPE=VOICE:123-456-7890\r\n" +
+				"END:VCARD\r\n",
+		},
+		{
+			request:      "/person/1.vcf?version=3.0",
+			expectedCode: 200,
+			expectedBody: "BEGIN:VCARD\r\n" +
+				"VERSION:3.0\r\n" +
+				"FN:Ann Smith\\, Jr.\r\n" +
+				"N:Smith\\, Jr.;Ann;;;\r\n" +
+				"EMAIL;TYPE=INTERNET:ann@example.com\r\n" +
+				"TEL;TYPE=VOICE:123-456-7890\r\n" +
+				"END:VCARD\r\n",
+		},
+		{
+			request:      "/person/2.vcf",
+			expectedCode: 200,
+			expectedBody: "BEGIN:VCARD\r\n" +
+				"VERSION:4.0\r\n" +
+				"FN:Bartholomew-Maximilian Featherstonehaugh-Cholmondeley-Wolfeschlegelstein\r\n" +
+				"N:Featherstonehaugh-Cholmondeley-Wolfeschlegelstein;Bartholomew-Maximilian;\r\n" +
+				" ;;\r\n" +
+				"END:VCARD\r\n",
+		},
+		{
+			request:      "/person/3.vcf",
+			expectedCode: 404,
+		},
+		{
+			request:      "/person/1.vcf?version=2.1",
+			expectedCode: 400,
+		},
+		{
+			request:      "/export?format=vcard&version=3.0",
+			expectedCode: 200,
+			expectedBody: "BEGIN:VCARD\r\nVERSION:3.0\r\nFN:Ann Smith\\, Jr.\r\n",
+		},
+		{
+			request:      "/export?format=xml",
+			expectedCode: 406,
+		},
+	}
+	for _, tt := range tests {
+		a := App{}
+		a.InitializeWithStore(NewMemoryStore())
+		a.addHandles()
+		a.Store.Create(&Person{FirstName: "Ann", LastName: "Smith, Jr.", Email: "ann@example.com", Phone: "123-456-7890"})
+		a.Store.Create(&Person{FirstName: "Bartholomew-Maximilian", LastName: "Featherstonehaugh-Cholmondeley-Wolfeschlegelstein"})
+		req, _ := http.NewRequest("GET", tt.request, nil)
+		rr := httptest.NewRecorder()
+		a.Router.ServeHTTP(rr, req)
+		if tt.expectedCode != rr.Code {
+			t.Errorf("%v: expected response code %d. Got %d", tt.request, tt.expectedCode, rr.Code)
+			continue
+		}
+		if tt.expectedCode != 200 {
+			continue
+		}
+		if ct := rr.Header().Get("Content-Type"); ct != "text/vcard; charset=utf-8" {
+			t.Errorf("%v: expected a vCard Content-Type. Got %v", tt.request, ct)
+		}
+		if !strings.HasPrefix(rr.Body.String(), tt.expectedBody) {
+			t.Errorf("%v: expected body %q. Got %q", tt.request, tt.expectedBody, rr.Body.String())
+		}
+		if !strings.HasPrefix(tt.request, "/export") {
+			continue
+		}
+
+		// Exports must import back to the same people.
+		b := App{}
+		b.InitializeWithStore(NewMemoryStore())
+		b.addHandles()
+		req, _ = http.NewRequest("POST", "/import", bytes.NewReader(rr.Body.Bytes()))
+		rr = httptest.NewRecorder()
+		b.Router.ServeHTTP(rr, req)
+		exported, _, _ := a.Store.Query(PeopleQuery{Limit: -1})
+		imported, _, _ := b.Store.Query(PeopleQuery{Limit: -1})
+		if rr.Code != 200 || !reflect.DeepEqual(exported, imported) {
+			t.Errorf("%v: expected round trip to give %+v. Got %d %+v", tt.request, exported, rr.Code, imported)
+		}
+	}
+}
+
+func TestApp_ExportFormats(t *testing.T) {
+	tests := []struct {
+		request             string
+		accept              string
+		expectedCode        int
+		expectedContentType string
+		expectedBody        string
+	}{
+		{
+			request:             "/export",
+			expectedCode:        200,
+			expectedContentType: "text/csv; charset=utf-8",
+			expectedBody:        "FirstName,LastName,Email,Phone,HomeEmail,WorkEmail,HomePhone,WorkPhone,MobilePhone,Street,City,Region,Postcode,Country,Nickname,Organization,Department,Title,Birthday,Website,Notes,Groups\nAnn,Smith,ann@example.com,123-456-7890,,,,,,,,,,,,,,,,,,\nBob,Jones,,,,,,,,,,,,,,,,,,,,\n",
+		},
+		{
+			request:             "/export",
+			accept:              "text/html,application/xhtml+xml,*/*;q=0.8",
+			expectedCode:        200,
+			expectedContentType: "text/csv; charset=utf-8",
+		},
+		{
+			request:             "/export",
+			accept:              "application/x-ndjson",
+			expectedCode:        200,
+			expectedContentType: "application/x-ndjson",
+			expectedBody: `{"ID":1,"FirstName":"Ann","LastName":"Smith","Email":"ann@example.com","Phone":"123-456-7890","Nickname":"","Organization":"","Department":"","Title":"","Birthday":"","Website":"","Notes":"","Emails":[{"Type":"","Value":"ann@example.com"}],"Phones":[{"Type":"","Value":"123-456-7890"}]}
+{"ID":2,"FirstName":"Bob","LastName":"Jones","Email":"","Phone":"","Nickname":"","Organization":"","Department":"","Title":"","Birthday":"","Website":"","Notes":""}
+`,
+		},
+		{
+			request:             "/export",
+			accept:              "text/csv;q=0.5, application/vcard+json",
+			expectedCode:        200,
+			expectedContentType: "application/vcard+json",
+			expectedBody: `[["vcard",[["version",{},"text","4.0"],["fn",{},"text","Ann Smith"],["n",{},"text",["Smith","Ann","","",""]],` +
+				`["email",{},"text","ann@example.com"],["tel",{"type":"voice"},"text","123-456-7890"]]],` +
+				`["vcard",[["version",{},"text","4.0"],["fn",{},"text","Bob Jones"],["n",{},"text",["Jones","Bob","","",""]]]]]`,
+		},
+		{
+			request:             "/export?format=vcard",
+			accept:              "application/x-ndjson",
+			expectedCode:        200,
+			expectedContentType: "text/vcard; charset=utf-8",
+		},
+		{
+			request:             "/export",
+			accept:              "text/vcard",
+			expectedCode:        200,
+			expectedContentType: "text/vcard; charset=utf-8",
+		},
+		{
+			request:             "/export",
+			accept:              "application/json",
+			expectedCode:        200,
+			expectedContentType: "text/csv; charset=utf-8",
+		},
+		{
+			request:             "/export",
+			accept:              "application/x-ndjson;q=0",
+			expectedCode:        200,
+			expectedContentType: "text/csv; charset=utf-8",
+		},
+		{
+			request:      "/export?format=pdf",
+			expectedCode: 406,
+		},
+		{
+			request:      "/export?format=ndjson&delimiter=ab",
+			expectedCode: 200,
+		},
+		{
+			request:      "/export?delimiter=ab",
+			expectedCode: 400,
+		},
+	}
+	for _, tt := range tests {
+		a := App{}
+		a.InitializeWithStore(NewMemoryStore())
+		a.addHandles()
+		a.Store.Create(&Person{FirstName: "Ann", LastName: "Smith", Email: "ann@example.com", Phone: "123-456-7890"})
+		a.Store.Create(&Person{FirstName: "Bob", LastName: "Jones"})
+		req, _ := http.NewRequest("GET", tt.request, nil)
+		if tt.accept != "" {
+			req.Header.Set("Accept", tt.accept)
+		}
+		rr := httptest.NewRecorder()
+		a.Router.ServeHTTP(rr, req)
+		if tt.expectedCode != rr.Code {
+			t.Errorf("%v %v: expected response code %d. Got %d", tt.request, tt.accept, tt.expectedCode, rr.Code)
+			continue
+		}
+		if tt.expectedContentType != "" && rr.Header().Get("Content-Type") != tt.expectedContentType {
+			t.Errorf("%v %v: expected Content-Type %v. Got %v", tt.request, tt.accept, tt.expectedContentType, rr.Header().Get("Content-Type"))
+		}
+		if tt.expectedBody != "" && rr.Body.String() != tt.expectedBody {
+			t.Errorf("%v %v: expected body %q. Got %q", tt.request, tt.accept, tt.expectedBody, rr.Body.String())
+		}
+	}
+
+	// An empty book is still a valid document in every format.
+	empty := map[string]string{"csv": "FirstName,LastName,Email,Phone,HomeEmail,WorkEmail,HomePhone,WorkPhone,MobilePhone,Street,City,Region,Postcode,Country,Nickname,Organization,Department,Title,Birthday,Website,Notes,Groups\n", "vcard": "", "ndjson": "", "jcard": "[]"}
+	for format, expected := range empty {
+		a := App{}
+		a.InitializeWithStore(NewMemoryStore())
+		a.addHandles()
+		req, _ := http.NewRequest("GET", "/export?format="+format, nil)
+		rr := httptest.NewRecorder()
+		a.Router.ServeHTTP(rr, req)
+		if rr.Code != 200 || rr.Body.String() != expected {
+			t.Errorf("%v: expected empty export %q. Got %d %q", format, expected, rr.Code, rr.Body.String())
+		}
+	}
+}
+
+// walkFailStore is a MemoryStore whose Walk fails after passing n people to fn.
+type walkFailStore struct {
+	*MemoryStore
+	n int
+}
+
+func (s walkFailStore) Walk(fn func(p *Person) error) error {
+	i := 0
+	err := s.MemoryStore.Walk(func(p *Person) error {
+		if i == s.n {
+			return errors.New("walk failed")
+		}
+		i++
+		return fn(p)
+	})
+	if err == nil {
+		err = errors.New("walk failed")
+	}
+	return err
+}
+
+func TestApp_ExportStream(t *testing.T) {
+	s, err := NewSQLiteStore(TestDBName)
+	if err != nil {
+		t.Fatalf("Could not open store: %v", err)
+	}
+	defer os.Remove(TestDBName)
+	defer s.Close()
+	clearTable(s.db)
+	a := App{}
+	a.InitializeWithStore(s)
+	a.addHandles()
+	people := make([]Person, 5000)
+	for i := range people {
+		people[i] = Person{FirstName: fmt.Sprintf("Person %v", i), LastName: "Smith", Email: fmt.Sprintf("p%v@example.com", i)}
+	}
+	if _, err := a.Store.Import(people); err != nil {
+		t.Fatalf("Could not import people: %v", err)
+	}
+	req, _ := http.NewRequest("GET", "/export?format=ndjson", nil)
+	rr := httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	lines := strings.Split(strings.TrimSuffix(rr.Body.String(), "\n"), "\n")
+	if rr.Code != 200 || len(lines) != len(people) {
+		t.Fatalf("Expected %v lines. Got %d %v", len(people), rr.Code, len(lines))
+	}
+	last := Person{}
+	json.Unmarshal([]byte(lines[len(lines)-1]), &last)
+	if last.ID != len(people) || last.FirstName != fmt.Sprintf("Person %v", len(people)-1) {
+		t.Errorf("Expected people in ID order. Got %+v last", last)
+	}
+
+	// A failure before anything is sent is reported as a problem.
+	memory := NewMemoryStore()
+	memory.Import(people)
+	a = App{}
+	a.InitializeWithStore(walkFailStore{memory, 0})
+	a.addHandles()
+	req, _ = http.NewRequest("GET", "/export", nil)
+	rr = httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	if rr.Code != 500 || rr.Header().Get("Content-Type") != "application/problem+json" {
+		t.Errorf("Expected a 500 problem. Got %d %v", rr.Code, rr.Header().Get("Content-Type"))
+	}
+
+	// A failure part way through aborts the response.
+	a = App{}
+	a.InitializeWithStore(walkFailStore{memory, 4000})
+	a.addHandles()
+	req, _ = http.NewRequest("GET", "/export", nil)
+	rr = httptest.NewRecorder()
+	func() {
+		defer func() {
+			if r := recover(); r != http.ErrAbortHandler {
+				t.Errorf("Expected the export to be aborted. Got %v", r)
+			}
+		}()
+		a.Router.ServeHTTP(rr, req)
+	}()
+}
+
+func TestApp_LDIF(t *testing.T) {
+	body := `version: 1
+
+# The organizational unit is skipped.
+dn: ou=people,dc=legacy,dc=org
+objectClass: organizationalUnit
+ou: people
+
+dn: uid=ann,ou=people,dc=legacy,dc=org
+objectClass: inetOrgPerson
+cn: Ann Smith
+givenName: Ann
+sn: Smith
+mail: ann@example.com
+mail: ann.smith@example.com
+mobile: 555-0101
+telephoneNumber: 555-0100
+street: 1 Main St
+l: Springfield
+postalCode: 62701
+
+dn: uid=jurgen,ou=people,dc=legacy,dc=org
+objectClass: person
+cn:: SsO8cmdlbiBNw7xsbGVy
+sn:: TcO8bGxlcg==
+description: a long description that is fol
+ ded over two lines
+
+dn: uid=gone,ou=people,dc=legacy,dc=org
+changetype: delete
+
+dn: uid=bad,ou=people,dc=legacy,dc=org
+objectClass: person
+cn:: not base64!
+`
+	a := App{}
+	a.InitializeWithStore(NewMemoryStore())
+	a.addHandles()
+	req, _ := http.NewRequest("POST", "/import?mode=best-effort", strings.NewReader(body))
+	rr := httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	if rr.Code != 200 {
+		t.Fatalf("Expected response code 200. Got %d: %v", rr.Code, rr.Body.String())
+	}
+	report := ImportReport{}
+	json.Unmarshal(rr.Body.Bytes(), &report)
+	expectedRejected := []RejectedRow{
+		{Row: 28, Reason: "changetype delete is not supported"},
+		{Row: 31, Reason: "line 33: invalid base64 value for cn"},
+	}
+	if report.Rows != 4 || !reflect.DeepEqual(report.Rejected, expectedRejected) {
+		t.Errorf("Expected 4 rows and rejected rows %+v. Got %+v", expectedRejected, report)
+	}
+	expected := []Person{
+		{ID: 1, FirstName: "Ann", LastName: "Smith", Email: "ann@example.com", Phone: "555-0100",
+			Emails:    []Email{{Value: "ann@example.com"}, {Value: "ann.smith@example.com"}},
+			Phones:    []Phone{{Value: "555-0100"}, {Type: TypeMobile, Value: "555-0101"}},
+			Addresses: []Address{{Street: "1 Main St", City: "Springfield", Postcode: "62701"}}},
+		{ID: 2, FirstName: "Jürgen", LastName: "Müller", Notes: "a long description that is folded over two lines"},
+	}
+	people, _, _ := a.Store.Query(PeopleQuery{Limit: -1})
+	if !reflect.DeepEqual(people, normalised(expected...)) {
+		t.Errorf("Expected %+v. Got %+v", expected, people)
+	}
+
+	a.Store.Create(&Person{FirstName: "Prince", Email: "prince@example.com",
+		Organization: "Paisley Park", Title: "Artist", Website: "https://example.com/prince"})
+	req, _ = http.NewRequest("GET", "/export?baseDN=ou=staff,dc=example,dc=org", nil)
+	req.Header.Set("Accept", "text/x-ldif")
+	rr = httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	expectedBody := `version: 1
+
+dn: uid=1,ou=staff,dc=example,dc=org
+objectClass: top
+objectClass: person
+objectClass: organizationalPerson
+objectClass: inetOrgPerson
+uid: 1
+cn: Ann Smith
+givenName: Ann
+sn: Smith
+mail: ann@example.com
+mail: ann.smith@example.com
+telephoneNumber: 555-0100
+mobile: 555-0101
+street: 1 Main St
+l: Springfield
+postalCode: 62701
+postalAddress: 1 Main St$Springfield$62701
+
+dn: uid=2,ou=staff,dc=example,dc=org
+objectClass: top
+objectClass: person
+objectClass: organizationalPerson
+objectClass: inetOrgPerson
+uid: 2
+cn:: SsO8cmdlbiBNw7xsbGVy
+givenName:: SsO8cmdlbg==
+sn:: TcO8bGxlcg==
+description: a long description that is folded over two lines
+
+dn: uid=3,ou=staff,dc=example,dc=org
+objectClass: top
+objectClass: person
+objectClass: organizationalPerson
+objectClass: inetOrgPerson
+uid: 3
+cn: Prince
+givenName: Prince
+sn: Prince
+mail: prince@example.com
+o: Paisley Park
+title: Artist
+labeledURI: https://example.com/prince
+
+`
+	if rr.Code != 200 || rr.Header().Get("Content-Type") != "text/x-ldif" || rr.Body.String() != expectedBody {
+		t.Errorf("Expected LDIF export %q. Got %d %v %q", expectedBody, rr.Code, rr.Header().Get("Content-Type"), rr.Body.String())
+	}
+
+	// The export must import back to the same people.
+	b := App{}
+	b.InitializeWithStore(NewMemoryStore())
+	b.addHandles()
+	req, _ = http.NewRequest("POST", "/import", bytes.NewReader(rr.Body.Bytes()))
+	rr = httptest.NewRecorder()
+	b.Router.ServeHTTP(rr, req)
+	exported, _, _ := a.Store.Query(PeopleQuery{Limit: -1})
+	imported, _, _ := b.Store.Query(PeopleQuery{Limit: -1})
+	if rr.Code != 200 || !reflect.DeepEqual(exported, imported) {
+		t.Errorf("Expected round trip to give %+v. Got %d %+v", exported, rr.Code, imported)
+	}
+}
+
+func TestApp_Export(t *testing.T) {
+	tests := []struct {
+		method       string
+		request      string
+		expectedCode int
+		emptydb      bool
+	}{
 		{
 			method:       "GET",
 			request:      "/export",
@@ -449,7 +2605,7 @@ func TestApp_Export(t *testing.T) {
 		{
 			method:       "GET",
 			request:      "/export",
-			expectedCode: 500,
+			expectedCode: 200,
 			emptydb:      true,
 		},
 		{
@@ -466,3 +2622,229 @@ func TestApp_Export(t *testing.T) {
 		}
 	}
 }
+
+func TestApp_CardDAV(t *testing.T) {
+	for name, store := range testAppStores(t) {
+		t.Run(name, func(t *testing.T) {
+			a, do := newTestApp(t, store)
+			a.Store.Create(&Person{FirstName: "Ann", LastName: "Smith", Email: "ann@example.com", Phone: "555-0100"})
+			a.Store.Create(&Person{FirstName: "Bob", LastName: "Jones", Email: "bob@example.org"})
+			// multistatus returns the hrefs of a 207 response, each with its status or first found property,
+			// and its sync token.
+			multistatus := func(rr *httptest.ResponseRecorder) ([]string, string) {
+				if rr.Code != http.StatusMultiStatus {
+					t.Fatalf("Expected response code 207. Got %d: %v", rr.Code, rr.Body.String())
+				}
+				ms := davMultistatus{}
+				if err := xml.Unmarshal(rr.Body.Bytes(), &ms); err != nil {
+					t.Fatalf("Invalid multistatus %v: %v", rr.Body.String(), err)
+				}
+				got := []string{}
+				for _, r := range ms.Responses {
+					switch {
+					case r.Status != "":
+						got = append(got, r.Href+" "+r.Status)
+					case len(r.Propstats) > 0 && r.Propstats[0].Status == davStatus(http.StatusOK):
+						got = append(got, r.Href+" "+html.UnescapeString(r.Propstats[0].Prop.Props[0].Inner))
+					default:
+						got = append(got, r.Href)
+					}
+				}
+				return got, ms.SyncToken
+			}
+			ann, _ := a.Store.Get(1)
+			annETag := personETag(&ann)
+
+			rr := do("PROPFIND", "/.well-known/carddav", "")
+			if rr.Code != http.StatusMovedPermanently || rr.Header().Get("Location") != cardDAVHome {
+				t.Errorf("Expected a redirect to %v. Got %d %v", cardDAVHome, rr.Code, rr.Header().Get("Location"))
+			}
+			rr = do("OPTIONS", cardDAVBook, "")
+			if !strings.Contains(rr.Header().Get("DAV"), "addressbook") {
+				t.Errorf("Expected DAV header with addressbook. Got %q", rr.Header().Get("DAV"))
+			}
+
+			got, _ := multistatus(do("PROPFIND", cardDAVHome, `<propfind xmlns="DAV:" xmlns:C="urn:ietf:params:xml:ns:carddav">
+<prop><C:addressbook-home-set/></prop></propfind>`, "Depth", "0"))
+			expected := []string{`/carddav/ <href xmlns="DAV:">/carddav/</href>`}
+			if !reflect.DeepEqual(got, expected) {
+				t.Errorf("Expected home %v. Got %v", expected, got)
+			}
+
+			got, _ = multistatus(do("PROPFIND", cardDAVBook, `<propfind xmlns="DAV:"><prop><getetag/></prop></propfind>`, "Depth", "1"))
+			bob, _ := a.Store.Get(2)
+			expected = []string{"/carddav/people/", "/carddav/people/1.vcf " + annETag, "/carddav/people/2.vcf " + personETag(&bob)}
+			if !reflect.DeepEqual(got, expected) {
+				t.Errorf("Expected book %v. Got %v", expected, got)
+			}
+			rr = do("PROPFIND", cardDAVBook, "", "Depth", "0")
+			if body := rr.Body.String(); !strings.Contains(body, "<addressbook xmlns=\"urn:ietf:params:xml:ns:carddav\"/>") || strings.Contains(body, "sync-token") {
+				t.Errorf("Expected allprop with the addressbook resource type and without sync-token. Got %v", body)
+			}
+
+			query := `<C:addressbook-query xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:carddav">
+<D:prop><D:getetag/></D:prop>
+<C:filter test="anyof">
+<C:prop-filter name="EMAIL"><C:text-match match-type="ends-with">@EXAMPLE.ORG</C:text-match></C:prop-filter>
+<C:prop-filter name="TEL"><C:is-not-defined/></C:prop-filter>
+</C:filter></C:addressbook-query>`
+			got, _ = multistatus(do("REPORT", cardDAVBook, query))
+			expected = []string{"/carddav/people/2.vcf " + personETag(&bob)}
+			if !reflect.DeepEqual(got, expected) {
+				t.Errorf("Expected query %v. Got %v", expected, got)
+			}
+			query = `<C:addressbook-query xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:carddav">
+<D:prop><D:getetag/></D:prop>
+<C:filter><C:prop-filter name="N"><C:text-match>n</C:text-match></C:prop-filter></C:filter>
+<C:limit><C:nresults>1</C:nresults></C:limit></C:addressbook-query>`
+			got, _ = multistatus(do("REPORT", cardDAVBook, query))
+			expected = []string{"/carddav/people/1.vcf " + annETag, "/carddav/people/ HTTP/1.1 507 Insufficient Storage"}
+			if !reflect.DeepEqual(got, expected) {
+				t.Errorf("Expected truncated query %v. Got %v", expected, got)
+			}
+			rr = do("REPORT", cardDAVBook, `<C:addressbook-query xmlns:C="urn:ietf:params:xml:ns:carddav">
+<C:filter><C:prop-filter name="NOTE"/></C:filter></C:addressbook-query>`)
+			if rr.Code != http.StatusForbidden || !strings.Contains(rr.Body.String(), "supported-filter") {
+				t.Errorf("Expected 403 supported-filter. Got %d: %v", rr.Code, rr.Body.String())
+			}
+
+			multiget := `<C:addressbook-multiget xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:carddav">
+<D:prop><C:address-data version="4.0"/></D:prop>
+<D:href>http://localhost/carddav/people/1.vcf</D:href><D:href>/carddav/people/9.vcf</D:href>
+</C:addressbook-multiget>`
+			got, _ = multistatus(do("REPORT", cardDAVBook, multiget))
+			expected = []string{
+				"http://localhost/carddav/people/1.vcf BEGIN:VCARD\r\nVERSION:4.0\r\nUID:urn:didactic-tribble:person:1\r\nFN:Ann Smith\r\n" +
+					"N:Smith;Ann;;;\r\nEMAIL:ann@example.com\r\nTEL;TYPE=VOICE:555-0100\r\nEND:VCARD\r\n",
+				"/carddav/people/9.vcf HTTP/1.1 404 Not Found",
+			}
+			if !reflect.DeepEqual(got, expected) {
+				t.Errorf("Expected multiget %q. Got %q", expected, got)
+			}
+
+			sync := `<D:sync-collection xmlns:D="DAV:"><D:sync-token>%v</D:sync-token><D:sync-level>1</D:sync-level>
+<D:prop><D:getetag/></D:prop></D:sync-collection>`
+			got, token := multistatus(do("REPORT", cardDAVBook, fmt.Sprintf(sync, "")))
+			if len(got) != 2 || token == "" {
+				t.Errorf("Expected an initial sync of 2 cards with a token. Got %v %q", got, token)
+			}
+			got, again := multistatus(do("REPORT", cardDAVBook, fmt.Sprintf(sync, token)))
+			if len(got) != 0 || again != token {
+				t.Errorf("Expected no changes since %q. Got %v %q", token, got, again)
+			}
+
+			rr = do("GET", "/carddav/people/1.vcf", "", "If-None-Match", annETag)
+			if rr.Code != http.StatusNotModified {
+				t.Errorf("Expected response code 304. Got %d", rr.Code)
+			}
+			rr = do("GET", "/carddav/people/1.vcf", "")
+			if rr.Code != 200 || rr.Header().Get("ETag") != annETag || !strings.HasPrefix(rr.Body.String(), "BEGIN:VCARD\r\nVERSION:3.0\r\nUID:") {
+				t.Errorf("Expected the card with ETag %v. Got %d %v: %v", annETag, rr.Code, rr.Header().Get("ETag"), rr.Body.String())
+			}
+
+			card := "BEGIN:VCARD\r\nVERSION:3.0\r\nFN:Ann Jones\r\nN:Jones;Ann;;;\r\nEND:VCARD\r\n"
+			if rr = do("PUT", "/carddav/people/1.vcf", card, "If-Match", `"stale"`); rr.Code != http.StatusPreconditionFailed {
+				t.Errorf("Expected response code 412 for a stale If-Match. Got %d", rr.Code)
+			}
+			if rr = do("PUT", "/carddav/people/1.vcf", card, "If-None-Match", "*"); rr.Code != http.StatusPreconditionFailed {
+				t.Errorf("Expected response code 412 for If-None-Match *. Got %d", rr.Code)
+			}
+			rr = do("PUT", "/carddav/people/1.vcf", card, "If-Match", annETag, "Content-Type", "text/vcard")
+			updated, _ := a.Store.Get(1)
+			if rr.Code != http.StatusNoContent || updated.LastName != "Jones" {
+				t.Errorf("Expected the update to succeed. Got %d %+v", rr.Code, updated)
+			}
+			// The card is not stored as it was sent, so the client is not given an ETag and must fetch it.
+			if etag := rr.Header().Get("ETag"); etag != "" {
+				t.Errorf("Expected no ETag for a card stored differently than sent. Got %v", etag)
+			}
+			stored := do("GET", "/carddav/people/1.vcf", "")
+			rr = do("PUT", "/carddav/people/1.vcf", stored.Body.String(), "If-Match", stored.Header().Get("ETag"))
+			if rr.Code != http.StatusNoContent || rr.Header().Get("ETag") != personETag(&updated) {
+				t.Errorf("Expected the ETag %v putting back the stored card. Got %d %v", personETag(&updated), rr.Code, rr.Header().Get("ETag"))
+			}
+			got, changed := multistatus(do("REPORT", cardDAVBook, fmt.Sprintf(sync, token)))
+			if expected = []string{"/carddav/people/1.vcf " + personETag(&updated)}; !reflect.DeepEqual(got, expected) || changed == token {
+				t.Errorf("Expected a sync of the changed card %v with a new token. Got %v %q", expected, got, changed)
+			}
+			for _, stale := range []string{"data:,0123456789abcdef", cardDAVSyncPrefix + "99"} {
+				if rr = do("REPORT", cardDAVBook, fmt.Sprintf(sync, stale)); rr.Code != http.StatusForbidden || !strings.Contains(rr.Body.String(), "valid-sync-token") {
+					t.Errorf("Expected 403 valid-sync-token for %v. Got %d: %v", stale, rr.Code, rr.Body.String())
+				}
+			}
+
+			cat := "BEGIN:VCARD\r\nVERSION:4.0\r\nFN:Cat\r\nUID:ABC-123\r\nEND:VCARD\r\n"
+			rr = do("PUT", "/carddav/people/ABC-123.vcf", cat, "If-None-Match", "*")
+			if rr.Code != http.StatusCreated || rr.Header().Get("Location") != "/carddav/people/ABC-123.vcf" {
+				t.Errorf("Expected 201 with Location /carddav/people/ABC-123.vcf. Got %d %v", rr.Code, rr.Header().Get("Location"))
+			}
+			rr = do("GET", "/carddav/people/ABC-123.vcf", "")
+			if !strings.Contains(rr.Body.String(), "\r\nUID:ABC-123\r\n") {
+				t.Errorf("Expected the card to keep the client's UID. Got %v", rr.Body.String())
+			}
+			catETag := rr.Header().Get("ETag")
+			if rr = do("PUT", "/carddav/people/ABC-123.vcf", cat, "If-None-Match", "*"); rr.Code != http.StatusPreconditionFailed {
+				t.Errorf("Expected response code 412 creating a named card twice. Got %d", rr.Code)
+			}
+			for _, name := range []string{"XYZ", "2"} {
+				rr = do("PUT", "/carddav/people/"+name+".vcf", cat)
+				if rr.Code != http.StatusConflict || !strings.Contains(rr.Body.String(), `<no-uid-conflict xmlns="urn:ietf:params:xml:ns:carddav"><href xmlns="DAV:">/carddav/people/ABC-123.vcf</href>`) {
+					t.Errorf("Expected 409 no-uid-conflict putting another card with UID ABC-123 as %v. Got %d %v", name, rr.Code, rr.Body.String())
+				}
+			}
+			rr = do("PUT", "/carddav/people/ABC-123.vcf", strings.Replace(cat, "FN:Cat", "FN:Cat Jones", 1), "If-Match", catETag)
+			if updated, _ := a.Store.Get(3); rr.Code != http.StatusNoContent || updated.LastName != "Jones" {
+				t.Errorf("Expected a named card to update the person created from it. Got %d %+v", rr.Code, updated)
+			}
+			if rr = do("GET", "/carddav/people/ABC-123.vcf", ""); rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "FN:Cat Jones") {
+				t.Errorf("Expected the named card. Got %d %v", rr.Code, rr.Body.String())
+			}
+			got, _ = multistatus(do("PROPFIND", cardDAVBook, `<propfind xmlns="DAV:"><prop><getetag/></prop></propfind>`, "Depth", "1"))
+			catPerson, _ := a.Store.Get(3)
+			a.attachCard(&catPerson)
+			if len(got) != 4 || got[3] != "/carddav/people/ABC-123.vcf "+personETag(&catPerson) {
+				t.Errorf("Expected the named card listed by its name. Got %v", got)
+			}
+			if people, _ := a.Store.List(0, -1); len(people) != 3 {
+				t.Errorf("Expected named cards not to be duplicated. Got %+v", people)
+			}
+			if rr = do("PUT", "/carddav/people/4.vcf", "BEGIN:VCARD\r\nFN:Dan\r\n"); rr.Code != http.StatusBadRequest {
+				t.Errorf("Expected response code 400 for an invalid vCard. Got %d", rr.Code)
+			}
+			if rr = do("PUT", "/carddav/people/4.vcf", "BEGIN:VCARD\r\nVERSION:4.0\r\nFN:Dan\r\nEMAIL:not an email\r\nEND:VCARD\r\n"); rr.Code != http.StatusUnprocessableEntity {
+				t.Errorf("Expected response code 422 for an invalid email. Got %d", rr.Code)
+			}
+
+			if rr = do("DELETE", "/carddav/people/2.vcf", "", "If-Match", annETag); rr.Code != http.StatusPreconditionFailed {
+				t.Errorf("Expected response code 412 for a DELETE with another ETag. Got %d", rr.Code)
+			}
+			if rr = do("DELETE", "/carddav/people/2.vcf", ""); rr.Code != http.StatusNoContent {
+				t.Errorf("Expected response code 204. Got %d", rr.Code)
+			}
+			if rr = do("GET", "/carddav/people/2.vcf", ""); rr.Code != http.StatusNotFound {
+				t.Errorf("Expected response code 404 after DELETE. Got %d", rr.Code)
+			}
+			got, _ = multistatus(do("REPORT", cardDAVBook, fmt.Sprintf(sync, changed)))
+			expected = []string{"/carddav/people/2.vcf HTTP/1.1 404 Not Found", "/carddav/people/ABC-123.vcf " + personETag(&catPerson)}
+			if !reflect.DeepEqual(got, expected) {
+				t.Errorf("Expected a sync of the created and deleted cards %v. Got %v", expected, got)
+			}
+
+			// Only positive numbers name cards by ID; any other name is kept like the names clients give.
+			for _, name := range []string{"0", "-5", "007"} {
+				rr = do("PUT", "/carddav/people/"+name+".vcf", "BEGIN:VCARD\r\nVERSION:4.0\r\nFN:Eve\r\nEND:VCARD\r\n")
+				if rr.Code != http.StatusCreated || rr.Header().Get("Location") != "/carddav/people/"+name+".vcf" {
+					t.Errorf("Expected 201 with Location /carddav/people/%v.vcf. Got %d %v", name, rr.Code, rr.Header().Get("Location"))
+				}
+				if rr = do("GET", "/carddav/people/"+name+".vcf", ""); rr.Code != http.StatusOK {
+					t.Errorf("Expected the card created as %v.vcf. Got %d", name, rr.Code)
+				}
+			}
+			for _, id := range []int{0, -5, 7} {
+				if _, err := a.Store.Get(id); err != ErrNotFound {
+					t.Errorf("Expected no person with ID %v. Got %v", id, err)
+				}
+			}
+		})
+	}
+}
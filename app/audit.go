@@ -0,0 +1,556 @@
+package app
+
+// Audit.go contains the audit log of changes to people, the diffs it records,
+// and the /audit and /person/{id}/history endpoints.
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Audited actions, the Action of an AuditEntry.
+const (
+	AuditCreate  = "create"
+	AuditUpdate  = "update"
+	AuditPatch   = "patch"
+	AuditDelete  = "delete"
+	AuditRestore = "restore"
+	AuditPurge   = "purge"
+	AuditImport  = "import"
+	AuditRevert  = "revert"
+	AuditPhoto   = "photo"
+)
+
+// auditActions are the audited actions in the order they are listed in errors.
+var auditActions = []string{AuditCreate, AuditUpdate, AuditPatch, AuditDelete, AuditRestore, AuditPurge, AuditImport, AuditRevert, AuditPhoto}
+
+// auditSystemActor is the actor of changes the service makes on its own, such as purging the trash.
+const auditSystemActor = "system"
+
+// defaultAuditLimit is the number of audit entries returned when the client does not set limit.
+const defaultAuditLimit = 100
+
+// AuditEntry records a change to a person: who made it, when, in which request,
+// and the person before and after it. Before is nil for people who did not exist or were in the trash,
+// and After for people who were deleted or purged.
+type AuditEntry struct {
+	ID        int       `json:"ID"`
+	PersonID  int       `json:"PersonID"`
+	Action    string    `json:"Action"`
+	Actor     string    `json:"Actor"`
+	Time      time.Time `json:"Time"`
+	RequestID string    `json:"RequestID,omitempty"`
+	// Changes are the fields that differ between Before and After.
+	Changes []FieldChange `json:"Changes"`
+	Before  *Person       `json:"Before,omitempty"`
+	After   *Person       `json:"After,omitempty"`
+}
+
+// FieldChange is a field of a person that a change set, cleared or replaced.
+// Before and After are the field's JSON values, and are left out when the field was empty.
+type FieldChange struct {
+	Field  string          `json:"Field"`
+	Before json.RawMessage `json:"Before,omitempty"`
+	After  json.RawMessage `json:"After,omitempty"`
+}
+
+// AuditQuery selects a page of audit entries. Empty filter fields match everything.
+type AuditQuery struct {
+	// AfterID only selects entries with an ID greater than AfterID. It is not read from query parameters.
+	AfterID   int
+	PersonID  int
+	Actor     string
+	Action    string
+	RequestID string
+	// Since and Until, if set, select entries made at or after Since and before Until.
+	Since time.Time
+	Until time.Time
+	// Offset is the number of matching entries to skip.
+	Offset int
+	// Limit is the number of entries to return. -1 returns all matching entries.
+	Limit int
+}
+
+// AuditLog is where the changes made to people are recorded. Entries are never changed or removed,
+// so they outlive the people they describe.
+type AuditLog interface {
+	// Record appends entries to the log with the highest used entry ID + 1 onwards, and sets their IDs.
+	Record(entries []AuditEntry) error
+	// Audit returns the page of entries selected by q, newest first,
+	// along with the total number of entries matching q's filters.
+	Audit(q AuditQuery) ([]AuditEntry, int, error)
+	// GetAuditEntry returns the entry with the given ID, or ErrNotFound.
+	GetAuditEntry(id int) (AuditEntry, error)
+}
+
+// auditSnapshot returns a copy of p to record in the audit log, or nil if p is nil.
+func auditSnapshot(p *Person) *Person {
+	if p == nil {
+		return nil
+	}
+	c := p.clone()
+	c.DeletedAt, c.photo = nil, nil
+	return &c
+}
+
+// diffPeople returns the fields that differ between before and after, in field name order.
+// Either may be nil.
+func diffPeople(before, after *Person) []FieldChange {
+	b, a := personFields(before), personFields(after)
+	names := []string{}
+	for name := range b {
+		names = append(names, name)
+	}
+	for name := range a {
+		if _, ok := b[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	changes := []FieldChange{}
+	for _, name := range names {
+		if !bytes.Equal(b[name], a[name]) {
+			changes = append(changes, FieldChange{Field: name, Before: b[name], After: a[name]})
+		}
+	}
+	return changes
+}
+
+// personFields returns the JSON values of p's fields by name, leaving out the ID and empty fields.
+func personFields(p *Person) map[string]json.RawMessage {
+	fields := map[string]json.RawMessage{}
+	if p == nil {
+		return fields
+	}
+	j, err := json.Marshal(auditSnapshot(p))
+	if err != nil {
+		return fields
+	}
+	json.Unmarshal(j, &fields)
+	delete(fields, "ID")
+	for name, v := range fields {
+		if string(v) == `""` {
+			delete(fields, name)
+		}
+	}
+	return fields
+}
+
+// ParseTrustedProxies parses a comma separated list of IP addresses and CIDR ranges, for App.TrustedProxies.
+func ParseTrustedProxies(s string) ([]*net.IPNet, error) {
+	proxies := []*net.IPNet{}
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if !strings.Contains(p, "/") {
+			ip := net.ParseIP(p)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", p)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q", p)
+		}
+		proxies = append(proxies, n)
+	}
+	return proxies, nil
+}
+
+// auditActor returns who made req: the client's address or, if the client is one of the TrustedProxies,
+// the X-Actor header it set for the user it authenticated.
+func (a *App) auditActor(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	actor := strings.TrimSpace(req.Header.Get("X-Actor"))
+	if ip := net.ParseIP(host); ip != nil && actor != "" {
+		for _, n := range a.TrustedProxies {
+			if n.Contains(ip) {
+				return actor
+			}
+		}
+	}
+	return host
+}
+
+// newAuditEntry returns the entry recording a change to a person made by req,
+// or by the service itself if req is nil.
+func (a *App) newAuditEntry(req *http.Request, action string, personID int, before, after *Person) AuditEntry {
+	e := AuditEntry{
+		PersonID: personID,
+		Action:   action,
+		Actor:    auditSystemActor,
+		Time:     time.Now().UTC().Truncate(time.Second),
+		Changes:  diffPeople(before, after),
+		Before:   auditSnapshot(before),
+		After:    auditSnapshot(after),
+	}
+	if req != nil {
+		e.Actor = a.auditActor(req)
+		e.RequestID = requestID(req)
+	}
+	return e
+}
+
+// audit records a change to a person made by req in the audit log, see newAuditEntry.
+func (a *App) audit(req *http.Request, action string, personID int, before, after *Person) {
+	a.record(a.newAuditEntry(req, action, personID, before, after))
+}
+
+// auditPhoto records that the photo of the person with the given ID was set or removed by req.
+// before and after are the entity tags of the old and new photos, or "" if there was none.
+func (a *App) auditPhoto(req *http.Request, personID int, before, after string) {
+	c := FieldChange{Field: "Photo"}
+	if before != "" {
+		c.Before, _ = json.Marshal(before)
+	}
+	if after != "" {
+		c.After, _ = json.Marshal(after)
+	}
+	e := a.newAuditEntry(req, AuditPhoto, personID, nil, nil)
+	e.Changes = []FieldChange{c}
+	a.record(e)
+}
+
+// auditUpdates records an update made by req for each of people that the store now has a different version of,
+// for changes such as renaming a group that change people without updating them one by one.
+func (a *App) auditUpdates(req *http.Request, people []Person) {
+	entries := []AuditEntry{}
+	for i := range people {
+		p, err := a.Store.Get(people[i].ID)
+		if err != nil {
+			log.Printf("error reading %v for the audit log: %v", people[i].ID, err.Error())
+			continue
+		}
+		if e := a.newAuditEntry(req, AuditUpdate, p.ID, &people[i], &p); len(e.Changes) > 0 {
+			entries = append(entries, e)
+		}
+	}
+	a.record(entries...)
+}
+
+// record appends entries to the audit log. Failures are only logged, as the changes have been made either way.
+func (a *App) record(entries ...AuditEntry) {
+	if a.Audit == nil || len(entries) == 0 {
+		return
+	}
+	if err := a.Audit.Record(entries); err != nil {
+		log.Printf("error recording %v audit entries: %v", len(entries), err.Error())
+	}
+}
+
+// parseAuditQuery reads an AuditQuery from request query parameters:
+// personId, actor, action, requestId, since and until (RFC 3339 times), limit and offset.
+func parseAuditQuery(v url.Values) (AuditQuery, error) {
+	q := AuditQuery{Limit: defaultAuditLimit}
+	var err error
+	if s := v.Get("limit"); s != "" {
+		if q.Limit, err = strconv.Atoi(s); err != nil || q.Limit < 0 || q.Limit > maxQueryLimit {
+			return q, fmt.Errorf("limit must be between 0 and %v", maxQueryLimit)
+		}
+	}
+	if s := v.Get("offset"); s != "" {
+		if q.Offset, err = strconv.Atoi(s); err != nil || q.Offset < 0 {
+			return q, fmt.Errorf("offset must be a non-negative integer")
+		}
+	}
+	if s := v.Get("personId"); s != "" {
+		if q.PersonID, err = strconv.Atoi(s); err != nil || q.PersonID < 1 {
+			return q, fmt.Errorf("personId must be a positive integer")
+		}
+	}
+	q.Action = v.Get("action")
+	if q.Action != "" && !validAuditAction(q.Action) {
+		return q, fmt.Errorf("action must be one of %v", strings.Join(auditActions, ", "))
+	}
+	for _, t := range []struct {
+		name string
+		t    *time.Time
+	}{{"since", &q.Since}, {"until", &q.Until}} {
+		if s := v.Get(t.name); s != "" {
+			if *t.t, err = time.Parse(time.RFC3339, s); err != nil {
+				return q, fmt.Errorf("%v must be an RFC 3339 time, e.g. 2024-01-31T09:00:00Z", t.name)
+			}
+		}
+	}
+	q.Actor = v.Get("actor")
+	q.RequestID = v.Get("requestId")
+	return q, nil
+}
+
+// validAuditAction reports whether action is one of the audited actions.
+func validAuditAction(action string) bool {
+	for _, a := range auditActions {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
+
+// matches reports whether e passes the query's filters, ignoring paging.
+func (q *AuditQuery) matches(e *AuditEntry) bool {
+	switch {
+	case e.ID <= q.AfterID,
+		q.PersonID != 0 && e.PersonID != q.PersonID,
+		q.Actor != "" && e.Actor != q.Actor,
+		q.Action != "" && e.Action != q.Action,
+		q.RequestID != "" && e.RequestID != q.RequestID,
+		!q.Since.IsZero() && e.Time.Before(q.Since),
+		!q.Until.IsZero() && !e.Time.Before(q.Until):
+		return false
+	}
+	return true
+}
+
+// dbValues returns an entry's columns of the audit_log table other than the ID, in the order they are written.
+func (e *AuditEntry) dbValues() ([]interface{}, error) {
+	changes, err := json.Marshal(e.Changes)
+	if err != nil {
+		return nil, err
+	}
+	before, after := []byte{}, []byte{}
+	if e.Before != nil {
+		if before, err = json.Marshal(e.Before); err != nil {
+			return nil, err
+		}
+	}
+	if e.After != nil {
+		if after, err = json.Marshal(e.After); err != nil {
+			return nil, err
+		}
+	}
+	return []interface{}{e.PersonID, e.Action, e.Actor, e.Time.UTC(), e.RequestID,
+		string(changes), string(before), string(after)}, nil
+}
+
+// dbReadAuditEntries returns the audit entries selected by query.
+func dbReadAuditEntries(db *database, query string, args ...interface{}) ([]AuditEntry, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error getting audit entries: %v", err.Error())
+	}
+	defer rows.Close()
+	entries := []AuditEntry{}
+	for rows.Next() {
+		e := AuditEntry{}
+		changes, before, after := "", "", ""
+		if err := rows.Scan(&e.ID, &e.PersonID, &e.Action, &e.Actor, &e.Time, &e.RequestID,
+			&changes, &before, &after); err != nil {
+			return nil, fmt.Errorf("error getting row: %v", err.Error())
+		}
+		e.Time = e.Time.UTC()
+		if err := json.Unmarshal([]byte(changes), &e.Changes); err != nil {
+			return nil, fmt.Errorf("error reading changes of audit entry %v: %v", e.ID, err.Error())
+		}
+		for _, s := range []struct {
+			j string
+			p **Person
+		}{{before, &e.Before}, {after, &e.After}} {
+			if s.j == "" {
+				continue
+			}
+			*s.p = &Person{}
+			if err := json.Unmarshal([]byte(s.j), *s.p); err != nil {
+				return nil, fmt.Errorf("error reading person of audit entry %v: %v", e.ID, err.Error())
+			}
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// Record appends entries to the audit log in the database in a single transaction, and sets their IDs.
+func (s *SQLStore) Record(entries []AuditEntry) error {
+	return s.db.inTx(func(tx *sql.Tx) error {
+		if s.db.lockIDs != "" {
+			if _, err := tx.Exec(s.db.lockIDs); err != nil {
+				return fmt.Errorf("could not lock IDs: %v", err.Error())
+			}
+		}
+		for i := range entries {
+			values, err := entries[i].dbValues()
+			if err != nil {
+				return fmt.Errorf("could not encode audit entry: %v", err.Error())
+			}
+			if err := tx.QueryRow(s.db.rebind(sqlCreateAuditEntry), values...).Scan(&entries[i].ID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Audit returns the page of audit entries selected by q, newest first, and the total number of matches.
+func (s *SQLStore) Audit(q AuditQuery) ([]AuditEntry, int, error) {
+	where, args := []string{}, []interface{}{}
+	filter := func(clause string, arg interface{}) {
+		args = append(args, arg)
+		where = append(where, fmt.Sprintf(clause, s.db.bind(len(args))))
+	}
+	if q.AfterID != 0 {
+		filter("id > %v", q.AfterID)
+	}
+	if q.PersonID != 0 {
+		filter("person_id = %v", q.PersonID)
+	}
+	if q.Actor != "" {
+		filter("actor = %v", q.Actor)
+	}
+	if q.Action != "" {
+		filter("action = %v", q.Action)
+	}
+	if q.RequestID != "" {
+		filter("request_id = %v", q.RequestID)
+	}
+	if !q.Since.IsZero() {
+		filter("logged_at >= %v", q.Since.UTC())
+	}
+	if !q.Until.IsZero() {
+		filter("logged_at < %v", q.Until.UTC())
+	}
+	cond := ""
+	if len(where) > 0 {
+		cond = " WHERE " + strings.Join(where, " AND ")
+	}
+	total := 0
+	if err := s.db.QueryRow(sqlCountAuditEntries+cond, args...).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("error counting audit entries: %v", err.Error())
+	}
+	limit := s.db.noLimit
+	if q.Limit >= 0 {
+		limit = strconv.Itoa(q.Limit)
+	}
+	entries, err := dbReadAuditEntries(s.db,
+		fmt.Sprintf("%v%v ORDER BY id DESC LIMIT %v OFFSET %v", sqlReadAuditEntries, cond, limit, q.Offset), args...)
+	return entries, total, err
+}
+
+// GetAuditEntry returns the audit entry with the given ID from the database, or ErrNotFound.
+func (s *SQLStore) GetAuditEntry(id int) (AuditEntry, error) {
+	entries, err := dbReadAuditEntries(s.db, s.db.rebind(sqlReadAuditEntries+" WHERE id = ?"), id)
+	if err != nil {
+		return AuditEntry{}, err
+	}
+	if len(entries) == 0 {
+		return AuditEntry{}, ErrNotFound
+	}
+	return entries[0], nil
+}
+
+// hasAuditLog writes a 501 problem and returns false if the store keeps no audit log.
+func (a *App) hasAuditLog(w http.ResponseWriter, req *http.Request) bool {
+	if a.Audit == nil {
+		writeProblem(w, req, http.StatusNotImplemented, CodeNoAuditLog, "The store does not keep an audit log.")
+		return false
+	}
+	return true
+}
+
+// writeAuditEntries writes the page of audit entries selected by q as JSON, with the total count in X-Total-Count.
+func (a *App) writeAuditEntries(w http.ResponseWriter, req *http.Request, q AuditQuery) {
+	if !a.hasAuditLog(w, req) {
+		return
+	}
+	entries, total, err := a.Audit.Audit(q)
+	if err != nil {
+		writeInternalError(w, req, "Could not get the audit log.", err)
+		return
+	}
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	writeJSON(w, req, http.StatusOK, entries)
+}
+
+// ReadAudit lists the audit log, newest first, filtered by the query parameters described in parseAuditQuery.
+func (a *App) ReadAudit(w http.ResponseWriter, req *http.Request) {
+	q, err := parseAuditQuery(req.URL.Query())
+	if err != nil {
+		writeProblem(w, req, http.StatusBadRequest, CodeInvalidQuery, err.Error())
+		return
+	}
+	a.writeAuditEntries(w, req, q)
+}
+
+// ReadHistory lists the changes made to the person with the ID in the URL, newest first.
+// It accepts the same query parameters as /audit, and works for people who have been purged.
+func (a *App) ReadHistory(w http.ResponseWriter, req *http.Request) {
+	id, ok := personID(w, req)
+	if !ok {
+		return
+	}
+	q, err := parseAuditQuery(req.URL.Query())
+	if err != nil {
+		writeProblem(w, req, http.StatusBadRequest, CodeInvalidQuery, err.Error())
+		return
+	}
+	q.PersonID = id
+	a.writeAuditEntries(w, req, q)
+}
+
+// RevertPerson replaces the person with the ID in the URL with the version an entry of their history
+// left them in, and returns them. The revert is itself recorded, so it can be reverted too.
+func (a *App) RevertPerson(w http.ResponseWriter, req *http.Request) {
+	log.Printf("Got POST revert %v to %v", mux.Vars(req)["id"], mux.Vars(req)["entry"])
+	id, ok := personID(w, req)
+	if !ok {
+		return
+	}
+	entryID, err := strconv.Atoi(mux.Vars(req)["entry"])
+	if err != nil {
+		writeProblem(w, req, http.StatusBadRequest, CodeInvalidID, "Invalid ID.")
+		return
+	}
+	if !a.hasAuditLog(w, req) {
+		return
+	}
+	e, err := a.Audit.GetAuditEntry(entryID)
+	if err == ErrNotFound || (err == nil && e.PersonID != id) {
+		writeProblem(w, req, http.StatusNotFound, CodeAuditEntryNotFound, "The person has no history entry with this ID.")
+		return
+	} else if err != nil {
+		writeInternalError(w, req, "Could not get the audit log.", err)
+		return
+	}
+	if e.After == nil {
+		writeProblem(w, req, http.StatusConflict, CodeNoVersion, "The entry left the person deleted, so there is no version to revert to.")
+		return
+	}
+	before, err := a.Store.Get(id)
+	if err != nil {
+		writeStoreError(w, req, err)
+		return
+	}
+	p := e.After.clone()
+	p.ID = id
+	if !a.validatePerson(w, req, &p) {
+		return
+	}
+	if err := a.Store.Update(&p); err != nil {
+		writeStoreError(w, req, err)
+		return
+	}
+	a.audit(req, AuditRevert, id, &before, &p)
+	writePerson(w, req, http.StatusOK, &p)
+}
@@ -0,0 +1,987 @@
+package app
+
+// Carddav.go contains the CardDAV (RFC 6352) endpoints that let phones and mail clients sync people as vCards.
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// CardDAV paths. The home collection is also the principal, and holds one address book of everyone.
+const (
+	cardDAVHome = "/carddav/"
+	cardDAVBook = "/carddav/people/"
+)
+
+// cardDAVVersion is the vCard version served unless a report asks for another.
+// Version 3.0 is the one every CardDAV client supports.
+const cardDAVVersion = VCardVersion3
+
+// cardDAVUIDPrefix is prefixed to a person's ID to form the UID of their vCard.
+const cardDAVUIDPrefix = "urn:didactic-tribble:person:"
+
+// cardDAVSyncPrefix is prefixed to the ID of the latest audit log entry to form the address book's sync token.
+const cardDAVSyncPrefix = "urn:didactic-tribble:sync:"
+
+// Properties served by the CardDAV endpoints.
+var (
+	davResourceType         = xml.Name{Space: nsDAV, Local: "resourcetype"}
+	davDisplayName          = xml.Name{Space: nsDAV, Local: "displayname"}
+	davGetETag              = xml.Name{Space: nsDAV, Local: "getetag"}
+	davGetContentType       = xml.Name{Space: nsDAV, Local: "getcontenttype"}
+	davGetContentLength     = xml.Name{Space: nsDAV, Local: "getcontentlength"}
+	davCurrentUserPrincipal = xml.Name{Space: nsDAV, Local: "current-user-principal"}
+	davPrincipalURL         = xml.Name{Space: nsDAV, Local: "principal-URL"}
+	davPrivilegeSet         = xml.Name{Space: nsDAV, Local: "current-user-privilege-set"}
+	davSupportedReportSet   = xml.Name{Space: nsDAV, Local: "supported-report-set"}
+	davSyncToken            = xml.Name{Space: nsDAV, Local: "sync-token"}
+	cardHomeSet             = xml.Name{Space: nsCardDAV, Local: "addressbook-home-set"}
+	cardDescription         = xml.Name{Space: nsCardDAV, Local: "addressbook-description"}
+	cardSupportedData       = xml.Name{Space: nsCardDAV, Local: "supported-address-data"}
+	cardMaxResourceSize     = xml.Name{Space: nsCardDAV, Local: "max-resource-size"}
+	cardAddressData         = xml.Name{Space: nsCardDAV, Local: "address-data"}
+	csGetCTag               = xml.Name{Space: nsCalendarServer, Local: "getctag"}
+)
+
+// Reports and the preconditions whose failures are reported with a DAV:error body.
+var (
+	cardQueryReport        = xml.Name{Space: nsCardDAV, Local: "addressbook-query"}
+	cardMultigetReport     = xml.Name{Space: nsCardDAV, Local: "addressbook-multiget"}
+	davSyncReport          = xml.Name{Space: nsDAV, Local: "sync-collection"}
+	davValidSyncToken      = xml.Name{Space: nsDAV, Local: "valid-sync-token"}
+	davSupportedReport     = xml.Name{Space: nsDAV, Local: "supported-report"}
+	cardSupportedFilter    = xml.Name{Space: nsCardDAV, Local: "supported-filter"}
+	cardSupportedCollation = xml.Name{Space: nsCardDAV, Local: "supported-collation"}
+	cardValidAddressData   = xml.Name{Space: nsCardDAV, Local: "valid-address-data"}
+	cardNoUIDConflict      = xml.Name{Space: nsCardDAV, Local: "no-uid-conflict"}
+)
+
+// cardDAVKind is the kind of a CardDAV resource.
+type cardDAVKind int
+
+const (
+	cardDAVHomeKind cardDAVKind = iota
+	cardDAVBookKind
+	cardDAVCardKind
+)
+
+// cardDAVProps are the properties of each kind of resource, in the order they are listed.
+// allprop requests return all of them except sync-token.
+var cardDAVProps = map[cardDAVKind][]xml.Name{
+	cardDAVHomeKind: {davResourceType, davDisplayName, davCurrentUserPrincipal, davPrincipalURL, cardHomeSet},
+	cardDAVBookKind: {davResourceType, davDisplayName, davCurrentUserPrincipal, davPrivilegeSet, davSupportedReportSet,
+		cardDescription, cardSupportedData, cardMaxResourceSize, csGetCTag, davSyncToken},
+	cardDAVCardKind: {davResourceType, davGetETag, davGetContentType, davGetContentLength},
+}
+
+// cardDAVResource is the home, the address book, or a person's card.
+type cardDAVResource struct {
+	kind   cardDAVKind
+	href   string
+	person *Person
+	// token is the address book's sync token.
+	token string
+}
+
+// CardNameStore keeps the names CardDAV clients give the cards they create, so that later requests
+// for a name find the person created from it. Other cards are named by the person's ID.
+// Alongside the names it keeps the UIDs clients give cards, which are served back in them.
+// SQLStore and MemoryStore implement it.
+type CardNameStore interface {
+	// CardNames returns the name of every card a client named, by person ID.
+	CardNames() (map[int]string, error)
+	// CardPerson returns the ID of the person whose card a client gave name, or ErrNotFound.
+	CardPerson(name string) (int, error)
+	// NameCard records the name a client gave a person's card, taking it from any person who had it.
+	NameCard(personID int, name string) error
+	// CardUID returns the UID a client gave a person's card, or "" if none has.
+	CardUID(personID int) (string, error)
+	// UIDPerson returns the ID of the person whose card a client gave uid, or ErrNotFound.
+	UIDPerson(uid string) (int, error)
+	// SetCardUID records the UID a client gave a person's card, replacing theirs
+	// and taking it from any person who had it.
+	SetCardUID(personID int, uid string) error
+}
+
+// cardHref returns the path of a person's card, which is named by their ID unless names has a name for it.
+func cardHref(id int, names map[int]string) string {
+	if name, ok := names[id]; ok {
+		return cardDAVBook + name + ".vcf"
+	}
+	return cardDAVBook + strconv.Itoa(id) + ".vcf"
+}
+
+// cardName returns the name of the card at href, which may be a full URL.
+func cardName(href string) (string, bool) {
+	u, err := url.Parse(href)
+	if err != nil || !strings.HasPrefix(u.Path, cardDAVBook) || !strings.HasSuffix(u.Path, ".vcf") {
+		return "", false
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(u.Path, cardDAVBook), ".vcf"), true
+}
+
+// cardNames returns the name of every card a client named, by person ID.
+func (a *App) cardNames() (map[int]string, error) {
+	if a.Cards == nil {
+		return map[int]string{}, nil
+	}
+	return a.Cards.CardNames()
+}
+
+// cardID returns the person ID a card's name is, if it is one: a positive integer written as cardHref writes it.
+// Other names, such as "0", "-5" or "007", are names a client gave a card.
+func cardID(name string) (int, bool) {
+	id, err := strconv.Atoi(name)
+	return id, err == nil && id > 0 && strconv.Itoa(id) == name
+}
+
+// cardPersonID returns the ID of the person whose card has the given name: a person's ID,
+// or a name a client gave a card. ErrNotFound is returned if it is neither.
+func (a *App) cardPersonID(name string) (int, error) {
+	if id, ok := cardID(name); ok {
+		return id, nil
+	}
+	if a.Cards == nil {
+		return 0, ErrNotFound
+	}
+	return a.Cards.CardPerson(name)
+}
+
+// CardNames returns the name of every card a client named from the database, by person ID.
+func (s *SQLStore) CardNames() (map[int]string, error) {
+	rows, err := s.db.Query(sqlReadCardNames)
+	if err != nil {
+		return nil, fmt.Errorf("error getting card names: %v", err.Error())
+	}
+	defer rows.Close()
+	names := map[int]string{}
+	for rows.Next() {
+		id, name := 0, ""
+		if err := rows.Scan(&id, &name); err != nil {
+			return nil, fmt.Errorf("error getting row: %v", err.Error())
+		}
+		names[id] = name
+	}
+	return names, rows.Err()
+}
+
+// CardPerson returns the ID of the person whose card a client gave name from the database, or ErrNotFound.
+func (s *SQLStore) CardPerson(name string) (int, error) {
+	id := 0
+	err := s.db.QueryRow(s.db.rebind(sqlCardPerson), name).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, ErrNotFound
+	}
+	return id, err
+}
+
+// NameCard records the name a client gave a person's card in the database.
+func (s *SQLStore) NameCard(personID int, name string) error {
+	_, err := s.db.Exec(s.db.rebind(sqlNameCard), name, personID)
+	return err
+}
+
+// CardUID returns the UID a client gave a person's card from the database, or "" if none has.
+func (s *SQLStore) CardUID(personID int) (string, error) {
+	uid := ""
+	err := s.db.QueryRow(s.db.rebind(sqlCardUID), personID).Scan(&uid)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return uid, err
+}
+
+// UIDPerson returns the ID of the person whose card a client gave uid from the database, or ErrNotFound.
+func (s *SQLStore) UIDPerson(uid string) (int, error) {
+	id := 0
+	err := s.db.QueryRow(s.db.rebind(sqlUIDPerson), uid).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, ErrNotFound
+	}
+	return id, err
+}
+
+// SetCardUID records the UID a client gave a person's card in the database.
+func (s *SQLStore) SetCardUID(personID int, uid string) error {
+	return s.db.inTx(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(s.db.rebind(sqlTakeCardUID), uid, personID); err != nil {
+			return err
+		}
+		_, err := tx.Exec(s.db.rebind(sqlSetCardUID), personID, uid)
+		return err
+	})
+}
+
+// personETag returns the entity tag of a person's card, which changes whenever the person, their photo
+// or their card's UID does.
+func personETag(p *Person) string {
+	j, _ := json.Marshal(p)
+	if p.photo != nil {
+		j = append(j, photoETag(p.photo.Data)...)
+	}
+	if p.uid != "" {
+		j = append(j, p.uid...)
+	}
+	sum := sha256.Sum256(j)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// cardVCard returns a person's card: their vCard, with a UID as CardDAV requires.
+// The UID is the one the client gave the card, or else is made from the person's ID.
+func cardVCard(p *Person, version string) []byte {
+	uid := p.uid
+	if uid == "" {
+		uid = cardDAVUIDPrefix + strconv.Itoa(p.ID)
+	}
+	buf := new(bytes.Buffer)
+	writeVCard(buf, p, version)
+	return bytes.Replace(buf.Bytes(), []byte("\r\nFN:"), []byte("\r\n"+foldVCardLine("UID:"+escapeVCard(uid))+"FN:"), 1)
+}
+
+// cardUID returns the UID of the vCard in body, or "" if it has none.
+func cardUID(body []byte) string {
+	text, err := decodeText(body, "")
+	if err != nil {
+		return ""
+	}
+	lines, numbers := vcardLines(text)
+	for i, line := range lines {
+		if prop, err := parseVCardProperty(line, numbers[i]); err == nil && prop.Name == "UID" {
+			return unescapeVCard(prop.Value)
+		}
+	}
+	return ""
+}
+
+// attachCard sets the photo and the client's UID written in p's card, if they have them.
+func (a *App) attachCard(p *Person) error {
+	if err := a.attachPhoto(p); err != nil {
+		return err
+	}
+	if a.Cards == nil {
+		return nil
+	}
+	uid, err := a.Cards.CardUID(p.ID)
+	p.uid = uid
+	return err
+}
+
+// cardDAVPeople returns everyone in the address book, with their photos.
+func (a *App) cardDAVPeople() ([]Person, error) {
+	people := []Person{}
+	err := a.Store.Walk(func(p *Person) error {
+		if err := a.attachCard(p); err != nil {
+			return err
+		}
+		people = append(people, *p)
+		return nil
+	})
+	return people, err
+}
+
+// cardDAVSyncToken returns the address book's sync token, which changes whenever any card does:
+// the ID of the latest entry in the audit log, or without one, a hash of every person's ID and entity tag.
+func (a *App) cardDAVSyncToken() (string, error) {
+	if a.Audit == nil {
+		h := sha256.New()
+		err := a.Store.Walk(func(p *Person) error {
+			if err := a.attachCard(p); err != nil {
+				return err
+			}
+			fmt.Fprintf(h, "%v %v\n", p.ID, personETag(p))
+			return nil
+		})
+		if err != nil {
+			return "", err
+		}
+		return "data:," + hex.EncodeToString(h.Sum(nil)[:16]), nil
+	}
+	latest, _, err := a.Audit.Audit(AuditQuery{Limit: 1})
+	if err != nil {
+		return "", err
+	}
+	id := 0
+	if len(latest) > 0 {
+		id = latest[0].ID
+	}
+	return cardDAVSyncPrefix + strconv.Itoa(id), nil
+}
+
+// cardDAVChanges returns the responses for the cards that changed after the sync token since was current:
+// the cards of the people changed since, and 404 for those deleted since. ok is false if since is not
+// a token that token, the current one, can be synced from.
+func (a *App) cardDAVChanges(since, token string, pf *davPropfind) (responses []davResponse, ok bool, err error) {
+	after, err := strconv.Atoi(strings.TrimPrefix(since, cardDAVSyncPrefix))
+	latest, _ := strconv.Atoi(strings.TrimPrefix(token, cardDAVSyncPrefix))
+	if a.Audit == nil || !strings.HasPrefix(since, cardDAVSyncPrefix) || err != nil || after < 0 || after > latest {
+		return nil, false, nil
+	}
+	entries, _, err := a.Audit.Audit(AuditQuery{AfterID: after, Limit: -1})
+	if err != nil {
+		return nil, false, err
+	}
+	ids := []int{}
+	seen := map[int]bool{}
+	for _, e := range entries {
+		if !seen[e.PersonID] {
+			seen[e.PersonID] = true
+			ids = append(ids, e.PersonID)
+		}
+	}
+	sort.Ints(ids)
+	names, err := a.cardNames()
+	if err != nil {
+		return nil, false, err
+	}
+	responses = []davResponse{}
+	for _, id := range ids {
+		p, err := a.Store.Get(id)
+		if err == nil {
+			err = a.attachCard(&p)
+		}
+		switch {
+		case err == ErrNotFound:
+			responses = append(responses, davResponse{Href: cardHref(id, names), Status: davStatus(http.StatusNotFound)})
+		case err != nil:
+			return nil, false, err
+		default:
+			responses = append(responses, (&cardDAVResource{kind: cardDAVCardKind, href: cardHref(id, names), person: &p}).response(pf))
+		}
+	}
+	return responses, true, nil
+}
+
+// property returns the value of one of the resource's properties, and false if it does not have it.
+func (r *cardDAVResource) property(n davName) (davProperty, bool) {
+	if n.XMLName == cardAddressData {
+		if r.kind != cardDAVCardKind || (n.ContentType != "" && n.ContentType != "text/vcard") {
+			return davProperty{}, false
+		}
+		version := cardDAVVersion
+		if n.Version == VCardVersion4 {
+			version = VCardVersion4
+		}
+		return davText(cardAddressData, string(cardVCard(r.person, version))), true
+	}
+	has := false
+	for _, name := range cardDAVProps[r.kind] {
+		has = has || name == n.XMLName
+	}
+	if !has {
+		return davProperty{}, false
+	}
+	switch n.XMLName {
+	case davResourceType:
+		switch r.kind {
+		case cardDAVHomeKind:
+			return davProperty{XMLName: n.XMLName, Inner: `<collection xmlns="DAV:"/><principal xmlns="DAV:"/>`}, true
+		case cardDAVBookKind:
+			return davProperty{XMLName: n.XMLName, Inner: `<collection xmlns="DAV:"/><addressbook xmlns="` + nsCardDAV + `"/>`}, true
+		}
+		return davProperty{XMLName: n.XMLName}, true
+	case davDisplayName:
+		if r.kind == cardDAVHomeKind {
+			return davText(n.XMLName, "Address book"), true
+		}
+		return davText(n.XMLName, "People"), true
+	case davCurrentUserPrincipal, davPrincipalURL, cardHomeSet:
+		return davHref(n.XMLName, cardDAVHome), true
+	case davPrivilegeSet:
+		inner := ""
+		for _, p := range []string{"read", "write-content", "bind", "unbind"} {
+			inner += `<privilege xmlns="DAV:"><` + p + `/></privilege>`
+		}
+		return davProperty{XMLName: n.XMLName, Inner: inner}, true
+	case davSupportedReportSet:
+		inner := ""
+		for _, report := range []xml.Name{cardQueryReport, cardMultigetReport, davSyncReport} {
+			inner += `<supported-report xmlns="DAV:"><report><` + report.Local + ` xmlns="` + report.Space + `"/></report></supported-report>`
+		}
+		return davProperty{XMLName: n.XMLName, Inner: inner}, true
+	case cardDescription:
+		return davText(n.XMLName, "Everyone in the address book."), true
+	case cardSupportedData:
+		inner := ""
+		for _, v := range []string{VCardVersion3, VCardVersion4} {
+			inner += `<address-data-type xmlns="` + nsCardDAV + `" content-type="text/vcard" version="` + v + `"/>`
+		}
+		return davProperty{XMLName: n.XMLName, Inner: inner}, true
+	case cardMaxResourceSize:
+		return davText(n.XMLName, strconv.Itoa(davMaxBody)), true
+	case csGetCTag, davSyncToken:
+		return davText(n.XMLName, r.token), true
+	case davGetETag:
+		return davText(n.XMLName, personETag(r.person)), true
+	case davGetContentType:
+		return davText(n.XMLName, formatContentTypes[FormatVCard]), true
+	case davGetContentLength:
+		return davText(n.XMLName, strconv.Itoa(len(cardVCard(r.person, cardDAVVersion)))), true
+	}
+	return davProperty{}, false
+}
+
+// response returns the resource's response to a request for properties.
+// allprop and propname requests list all of them, propname without their values.
+func (r *cardDAVResource) response(pf *davPropfind) davResponse {
+	names := []davName{}
+	if pf.Prop != nil {
+		names = pf.Prop.Names
+	} else {
+		for _, name := range cardDAVProps[r.kind] {
+			if name != davSyncToken || pf.PropName != nil {
+				names = append(names, davName{XMLName: name})
+			}
+		}
+	}
+	found, missing := []davProperty{}, []davProperty{}
+	for _, n := range names {
+		switch p, ok := r.property(n); {
+		case !ok:
+			missing = append(missing, davProperty{XMLName: n.XMLName})
+		case pf.PropName != nil:
+			found = append(found, davProperty{XMLName: n.XMLName})
+		default:
+			found = append(found, p)
+		}
+	}
+	return davPropResponse(r.href, found, missing)
+}
+
+// CardDAVWellKnown redirects /.well-known/carddav to the home collection (RFC 6764).
+func (a *App) CardDAVWellKnown(w http.ResponseWriter, req *http.Request) {
+	http.Redirect(w, req, cardDAVHome, http.StatusMovedPermanently)
+}
+
+// CardDAVOptions advertises the DAV compliance classes and methods of the CardDAV resources.
+func (a *App) CardDAVOptions(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("DAV", "1, 3, addressbook")
+	w.Header().Set("Allow", "OPTIONS, GET, HEAD, PUT, DELETE, PROPFIND, REPORT")
+	w.WriteHeader(http.StatusOK)
+}
+
+// CardDAVPropfind returns the properties of the home, the address book and its cards, or a single card.
+// A Depth of 1 on a collection also returns its members.
+func (a *App) CardDAVPropfind(w http.ResponseWriter, req *http.Request) {
+	log.Printf("Got PROPFIND %v", req.URL.Path)
+	depth, err := davDepth(req)
+	if err != nil {
+		writeProblem(w, req, http.StatusBadRequest, CodeInvalidQuery, err.Error())
+		return
+	}
+	body, ok := readDAVBody(w, req)
+	if !ok {
+		return
+	}
+	pf := &davPropfind{}
+	if len(bytes.TrimSpace(body)) > 0 {
+		if err := xml.Unmarshal(body, pf); err != nil {
+			writeProblem(w, req, http.StatusBadRequest, CodeInvalidXML, "Invalid PROPFIND body: "+err.Error())
+			return
+		}
+	}
+	ms := &davMultistatus{}
+	switch req.URL.Path {
+	case cardDAVHome:
+		ms.Responses = append(ms.Responses, (&cardDAVResource{kind: cardDAVHomeKind, href: cardDAVHome}).response(pf))
+		if depth > 0 {
+			token, err := a.cardDAVSyncToken()
+			if err != nil {
+				writeInternalError(w, req, "Could not list the address book.", err)
+				return
+			}
+			ms.Responses = append(ms.Responses, (&cardDAVResource{kind: cardDAVBookKind, href: cardDAVBook, token: token}).response(pf))
+		}
+	case cardDAVBook:
+		token, err := a.cardDAVSyncToken()
+		if err != nil {
+			writeInternalError(w, req, "Could not list the address book.", err)
+			return
+		}
+		ms.Responses = append(ms.Responses, (&cardDAVResource{kind: cardDAVBookKind, href: cardDAVBook, token: token}).response(pf))
+		if depth > 0 {
+			people, err := a.cardDAVPeople()
+			if err != nil {
+				writeInternalError(w, req, "Could not list the address book.", err)
+				return
+			}
+			names, err := a.cardNames()
+			if err != nil {
+				writeInternalError(w, req, "Could not list the address book.", err)
+				return
+			}
+			ms.Responses = append(ms.Responses, cardResponses(people, names, pf)...)
+		}
+	default:
+		p, ok := a.cardPerson(w, req)
+		if !ok {
+			return
+		}
+		ms.Responses = append(ms.Responses, (&cardDAVResource{kind: cardDAVCardKind, href: req.URL.Path, person: &p}).response(pf))
+	}
+	writeMultistatus(w, ms)
+}
+
+// cardQuery is an addressbook-query REPORT body.
+type cardQuery struct {
+	Prop   davProp    `xml:"DAV: prop"`
+	Filter cardFilter `xml:"urn:ietf:params:xml:ns:carddav filter"`
+	Limit  *struct {
+		NResults int `xml:"urn:ietf:params:xml:ns:carddav nresults"`
+	} `xml:"urn:ietf:params:xml:ns:carddav limit"`
+}
+
+// cardFilter is the filter of an addressbook-query.
+type cardFilter struct {
+	Test        string           `xml:"test,attr"`
+	PropFilters []cardPropFilter `xml:"urn:ietf:params:xml:ns:carddav prop-filter"`
+}
+
+// cardPropFilter tests a vCard property.
+type cardPropFilter struct {
+	Name         string          `xml:"name,attr"`
+	Test         string          `xml:"test,attr"`
+	IsNotDefined *struct{}       `xml:"urn:ietf:params:xml:ns:carddav is-not-defined"`
+	TextMatches  []cardTextMatch `xml:"urn:ietf:params:xml:ns:carddav text-match"`
+	ParamFilters []struct{}      `xml:"urn:ietf:params:xml:ns:carddav param-filter"`
+}
+
+// cardTextMatch tests the text of a vCard property.
+type cardTextMatch struct {
+	Collation string `xml:"collation,attr"`
+	MatchType string `xml:"match-type,attr"`
+	Negate    string `xml:"negate-condition,attr"`
+	Text      string `xml:",chardata"`
+}
+
+// cardFields maps the vCard properties that can be filtered on to the fields they are written from.
+var cardFields = map[string][]string{
+	"FN":    {"name"},
+	"N":     {"lastname", "firstname"},
+	"EMAIL": {"email"},
+	"TEL":   {"phone"},
+}
+
+// condition translates the filter into a Condition on people.
+// N is tested as the last name and the first name, matching if either does.
+// The precondition that failed is returned if the filter uses a property, parameter or collation
+// that is not supported.
+func (f *cardFilter) condition() (Condition, xml.Name, bool) {
+	all := Condition{Op: cardTestOp(f.Test)}
+	for _, pf := range f.PropFilters {
+		fields, ok := cardFields[strings.ToUpper(pf.Name)]
+		if !ok || len(pf.ParamFilters) > 0 {
+			return Condition{}, cardSupportedFilter, false
+		}
+		defined := Condition{Op: CondOr}
+		for _, field := range fields {
+			defined.Children = append(defined.Children, Condition{Op: CondPresent, Field: field})
+		}
+		if pf.IsNotDefined != nil {
+			all.Children = append(all.Children, Condition{Op: CondNot, Children: []Condition{defined}})
+			continue
+		}
+		if len(pf.TextMatches) == 0 {
+			all.Children = append(all.Children, defined)
+			continue
+		}
+		matches := Condition{Op: cardTestOp(pf.Test)}
+		for _, tm := range pf.TextMatches {
+			switch tm.Collation {
+			case "", "i;unicode-casemap", "i;ascii-casemap":
+			default:
+				return Condition{}, cardSupportedCollation, false
+			}
+			match := Condition{Op: CondOr}
+			for _, field := range fields {
+				c := Condition{Op: CondSubstrings, Field: field}
+				switch tm.MatchType {
+				case "equals":
+					c.Op, c.Value = CondEqual, tm.Text
+				case "starts-with":
+					c.Initial = tm.Text
+				case "ends-with":
+					c.Final = tm.Text
+				case "", "contains":
+					c.Any = []string{tm.Text}
+				default:
+					return Condition{}, cardSupportedFilter, false
+				}
+				match.Children = append(match.Children, c)
+			}
+			if tm.Negate == "yes" {
+				match = Condition{Op: CondNot, Children: []Condition{match}}
+			}
+			matches.Children = append(matches.Children, match)
+		}
+		all.Children = append(all.Children, matches)
+	}
+	return all, xml.Name{}, true
+}
+
+// cardTestOp returns the operator of a test attribute, anyof by default.
+func cardTestOp(test string) CondOp {
+	if test == "allof" {
+		return CondAnd
+	}
+	return CondOr
+}
+
+// cardMultiget is an addressbook-multiget REPORT body.
+type cardMultiget struct {
+	Prop  davProp  `xml:"DAV: prop"`
+	Hrefs []string `xml:"DAV: href"`
+}
+
+// davSyncCollection is a sync-collection REPORT body (RFC 6578).
+type davSyncCollection struct {
+	SyncToken string  `xml:"DAV: sync-token"`
+	Prop      davProp `xml:"DAV: prop"`
+}
+
+// CardDAVReport answers the addressbook-query, addressbook-multiget and sync-collection reports
+// on the address book.
+func (a *App) CardDAVReport(w http.ResponseWriter, req *http.Request) {
+	log.Printf("Got REPORT %v", req.URL.Path)
+	body, ok := readDAVBody(w, req)
+	if !ok {
+		return
+	}
+	report, err := davRootName(body)
+	if err != nil {
+		writeProblem(w, req, http.StatusBadRequest, CodeInvalidXML, "Invalid REPORT body: "+err.Error())
+		return
+	}
+	var v interface{}
+	switch report {
+	case cardQueryReport:
+		v = &cardQuery{}
+	case cardMultigetReport:
+		v = &cardMultiget{}
+	case davSyncReport:
+		v = &davSyncCollection{}
+	default:
+		writeDAVError(w, http.StatusForbidden, davSupportedReport)
+		return
+	}
+	if err := xml.Unmarshal(body, v); err != nil {
+		writeProblem(w, req, http.StatusBadRequest, CodeInvalidXML, "Invalid REPORT body: "+err.Error())
+		return
+	}
+	ms := &davMultistatus{}
+	switch r := v.(type) {
+	case *cardQuery:
+		cond, precondition, ok := r.Filter.condition()
+		if !ok {
+			writeDAVError(w, http.StatusForbidden, precondition)
+			return
+		}
+		q := PeopleQuery{Limit: -1, Where: &cond}
+		if r.Limit != nil && r.Limit.NResults > 0 {
+			q.Limit = r.Limit.NResults + 1
+		}
+		people, _, err := a.Store.Query(q)
+		if err != nil {
+			writeInternalError(w, req, "Could not search the address book.", err)
+			return
+		}
+		truncated := q.Limit > 0 && len(people) == q.Limit
+		if truncated {
+			people = people[:r.Limit.NResults]
+		}
+		names, err := a.cardNames()
+		if err != nil {
+			writeInternalError(w, req, "Could not search the address book.", err)
+			return
+		}
+		ms.Responses = cardResponses(people, names, &davPropfind{Prop: &r.Prop})
+		if truncated {
+			// RFC 6352 section 8.6.1: a truncated result ends with 507 for the address book.
+			ms.Responses = append(ms.Responses, davResponse{Href: cardDAVBook, Status: davStatus(http.StatusInsufficientStorage)})
+		}
+		writeMultistatus(w, ms)
+	case *cardMultiget:
+		ms.Responses = []davResponse{}
+		for _, href := range r.Hrefs {
+			name, ok := cardName(href)
+			p, err := Person{}, ErrNotFound
+			if ok {
+				var id int
+				if id, err = a.cardPersonID(name); err == nil {
+					p, err = a.Store.Get(id)
+				}
+			}
+			if err == nil {
+				err = a.attachCard(&p)
+			}
+			switch {
+			case err == ErrNotFound:
+				ms.Responses = append(ms.Responses, davResponse{Href: href, Status: davStatus(http.StatusNotFound)})
+			case err != nil:
+				writeInternalError(w, req, "Could not read the address book.", err)
+				return
+			default:
+				ms.Responses = append(ms.Responses, (&cardDAVResource{kind: cardDAVCardKind, href: href, person: &p}).response(&davPropfind{Prop: &r.Prop}))
+			}
+		}
+		writeMultistatus(w, ms)
+	case *davSyncCollection:
+		token, err := a.cardDAVSyncToken()
+		if err != nil {
+			writeInternalError(w, req, "Could not list the address book.", err)
+			return
+		}
+		// Changes are found in the audit log. Without one, the only token that can be synced from is
+		// the current one, and clients with an older token are told to sync everything again.
+		switch r.SyncToken {
+		case "":
+			people, err := a.cardDAVPeople()
+			if err != nil {
+				writeInternalError(w, req, "Could not list the address book.", err)
+				return
+			}
+			names, err := a.cardNames()
+			if err != nil {
+				writeInternalError(w, req, "Could not list the address book.", err)
+				return
+			}
+			ms.Responses = cardResponses(people, names, &davPropfind{Prop: &r.Prop})
+		case token:
+		default:
+			responses, ok, err := a.cardDAVChanges(r.SyncToken, token, &davPropfind{Prop: &r.Prop})
+			if err != nil {
+				writeInternalError(w, req, "Could not list the changes to the address book.", err)
+				return
+			}
+			if !ok {
+				writeDAVError(w, http.StatusForbidden, davValidSyncToken)
+				return
+			}
+			ms.Responses = responses
+		}
+		ms.SyncToken = token
+		writeMultistatus(w, ms)
+	}
+}
+
+// cardResponses returns the responses for the cards of people, named as described by cardHref.
+func cardResponses(people []Person, names map[int]string, pf *davPropfind) []davResponse {
+	responses := []davResponse{}
+	for i := range people {
+		responses = append(responses, (&cardDAVResource{kind: cardDAVCardKind, href: cardHref(people[i].ID, names), person: &people[i]}).response(pf))
+	}
+	return responses
+}
+
+// cardPerson returns the person whose card the request is for.
+// A problem is written and ok is false if there is no such person.
+func (a *App) cardPerson(w http.ResponseWriter, req *http.Request) (p Person, ok bool) {
+	id, err := a.cardPersonID(mux.Vars(req)["name"])
+	if err == nil {
+		p, err = a.Store.Get(id)
+	}
+	if err == nil {
+		err = a.attachCard(&p)
+	}
+	if err != nil {
+		writeStoreError(w, req, err)
+		return p, false
+	}
+	return p, true
+}
+
+// CardDAVGet returns a person's card, or 304 Not Modified if it matches If-None-Match.
+func (a *App) CardDAVGet(w http.ResponseWriter, req *http.Request) {
+	log.Printf("Got GET %v", req.URL.Path)
+	p, ok := a.cardPerson(w, req)
+	if !ok {
+		return
+	}
+	etag := personETag(&p)
+	w.Header().Set("ETag", etag)
+	if h := req.Header.Get("If-None-Match"); h != "" && etagMatches(h, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	card := cardVCard(&p, cardDAVVersion)
+	w.Header().Set("Content-Type", formatContentTypes[FormatVCard])
+	w.Header().Set("Content-Length", strconv.Itoa(len(card)))
+	if req.Method != http.MethodHead {
+		w.Write(card)
+	}
+}
+
+// CardDAVPut creates or replaces a person from a vCard.
+// A card named by a person's ID replaces them, or creates them with that ID. Cards with other names
+// replace the person created from that name, or create a person with a new ID and keep the name for them.
+// The card's UID is kept, and 409 Conflict is returned if another card has it.
+// If-Match and If-None-Match are checked against the card's current entity tag.
+func (a *App) CardDAVPut(w http.ResponseWriter, req *http.Request) {
+	log.Printf("Got PUT %v", req.URL.Path)
+	body, ok := readDAVBody(w, req)
+	if !ok {
+		return
+	}
+	if mt := req.Header.Get("Content-Type"); mt != "" && !strings.HasPrefix(mt, "text/vcard") && !strings.HasPrefix(mt, "text/x-vcard") {
+		writeDAVError(w, http.StatusUnsupportedMediaType, cardSupportedData)
+		return
+	}
+	rows, err := vcardRows(bytes.NewReader(body))
+	if err != nil || len(rows) != 1 || rows[0].Err != nil {
+		writeDAVError(w, http.StatusBadRequest, cardValidAddressData)
+		return
+	}
+	p := rows[0].Person
+	name := mux.Vars(req)["name"]
+	_, numbered := cardID(name)
+	if !numbered && a.Cards == nil {
+		// The name could not be kept, so later requests for it would not find the person.
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	existing := Person{}
+	id, err := a.cardPersonID(name)
+	if err == nil {
+		existing, err = a.Store.Get(id)
+		if err == nil {
+			err = a.attachCard(&existing)
+		}
+	}
+	if err != nil && err != ErrNotFound {
+		writeStoreError(w, req, err)
+		return
+	}
+	exists := err == nil
+	// vCards have no custom fields, so a replaced person keeps theirs. Their photo is managed
+	// with /person/{id}/photo, so it is kept too.
+	p.Custom, p.photo = existing.Custom, existing.photo
+	if !a.validatePerson(w, req, &p) {
+		return
+	}
+	if h := req.Header.Get("If-Match"); h != "" && (!exists || !etagMatches(h, personETag(&existing))) {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+	if h := req.Header.Get("If-None-Match"); h != "" && exists && etagMatches(h, personETag(&existing)) {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+	// The client's UID is kept and served back in the card, so no other card may have it.
+	uid := ""
+	if a.Cards != nil {
+		uid = cardUID(body)
+	}
+	if uid != "" {
+		owner, err := a.cardUIDOwner(uid)
+		if err != nil && err != ErrNotFound {
+			writeStoreError(w, req, err)
+			return
+		}
+		if err == nil && (!exists || owner != id) {
+			names, err := a.cardNames()
+			if err != nil {
+				writeStoreError(w, req, err)
+				return
+			}
+			writeDAVError(w, http.StatusConflict, cardNoUIDConflict, cardHref(owner, names))
+			return
+		}
+	}
+	if exists && uid == cardDAVUIDPrefix+strconv.Itoa(id) {
+		// The UID made from the person's ID is served without being kept.
+		uid = ""
+	}
+	p.uid = uid
+	if uid == "" {
+		p.uid = existing.uid
+	}
+	if exists {
+		p.ID = id
+		if err := a.Store.Update(&p); err != nil {
+			writeStoreError(w, req, err)
+			return
+		}
+		a.audit(req, AuditUpdate, id, &existing, &p)
+	} else {
+		if numbered {
+			p.ID = id
+		}
+		if err := a.Store.Create(&p); err != nil {
+			if err == ErrExists {
+				w.WriteHeader(http.StatusPreconditionFailed)
+				return
+			}
+			writeStoreError(w, req, err)
+			return
+		}
+		if !numbered {
+			if err := a.Cards.NameCard(p.ID, name); err != nil {
+				writeInternalError(w, req, "Could not name the card.", err)
+				return
+			}
+		}
+		a.audit(req, AuditCreate, p.ID, nil, &p)
+	}
+	if uid != "" && uid != existing.uid {
+		if err := a.Cards.SetCardUID(p.ID, uid); err != nil {
+			writeInternalError(w, req, "Could not keep the card's UID.", err)
+			return
+		}
+	}
+	// As RFC 6352 requires, the ETag is only returned if the card is stored as it was sent,
+	// so that clients fetch the card the server stores instead.
+	if bytes.Equal(cardVCard(&p, cardDAVVersion), body) {
+		w.Header().Set("ETag", personETag(&p))
+	}
+	if exists {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Location", req.URL.Path)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// cardUIDOwner returns the ID of the person whose card has uid, given by a client or made from their ID,
+// or ErrNotFound. A person in the trash gives up their UID to the next card created with it.
+func (a *App) cardUIDOwner(uid string) (int, error) {
+	if id, ok := cardID(strings.TrimPrefix(uid, cardDAVUIDPrefix)); ok && strings.HasPrefix(uid, cardDAVUIDPrefix) {
+		_, err := a.Store.Get(id)
+		return id, err
+	}
+	id, err := a.Cards.UIDPerson(uid)
+	if err == nil {
+		_, err = a.Store.Get(id)
+	}
+	return id, err
+}
+
+// CardDAVDelete moves a person to the trash, checking If-Match against their card's entity tag.
+func (a *App) CardDAVDelete(w http.ResponseWriter, req *http.Request) {
+	log.Printf("Got DELETE %v", req.URL.Path)
+	p, ok := a.cardPerson(w, req)
+	if !ok {
+		return
+	}
+	if h := req.Header.Get("If-Match"); h != "" && !etagMatches(h, personETag(&p)) {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+	if err := a.Store.Delete(p.ID); err != nil {
+		writeStoreError(w, req, err)
+		return
+	}
+	a.audit(req, AuditDelete, p.ID, &p, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
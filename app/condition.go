@@ -0,0 +1,268 @@
+package app
+
+// Condition.go contains boolean conditions over a person's fields, for filters richer than PeopleQuery's exact matches.
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// CondOp is the operator of a Condition.
+type CondOp int
+
+// Condition operators.
+const (
+	// CondTrue matches every person.
+	CondTrue CondOp = iota
+	// CondFalse matches nobody.
+	CondFalse
+	// CondAnd matches if all Children match.
+	CondAnd
+	// CondOr matches if any of Children match.
+	CondOr
+	// CondNot matches if its only child does not.
+	CondNot
+	// CondEqual matches if Field equals Value.
+	CondEqual
+	// CondGreaterOrEqual matches if Field sorts at or after Value.
+	CondGreaterOrEqual
+	// CondLessOrEqual matches if Field sorts at or before Value.
+	CondLessOrEqual
+	// CondSubstrings matches if Field starts with Initial, contains each of Any in order, and ends with Final.
+	CondSubstrings
+	// CondPresent matches if Field is not empty.
+	CondPresent
+)
+
+// Condition is a boolean expression over a person's fields.
+// Comparisons ignore case, except for the id field, which is compared as a number.
+type Condition struct {
+	Op CondOp
+	// Field is one of the sortColumns names, "name" for the first and last name separated by a space,
+	// or one of the conditionDetails fields, which match if any of the values they cover does.
+	Field   string
+	Value   string
+	Initial string
+	Any     []string
+	Final   string
+	// Children are combined by CondAnd and CondOr, or negated by CondNot.
+	Children []Condition
+}
+
+// conditionColumns maps condition fields to SQL expressions.
+var conditionColumns = map[string]string{
+	"id":        "id",
+	"firstname": "fname",
+	"lastname":  "lname",
+	"name":      "TRIM(fname || ' ' || lname)",
+}
+
+// conditionDetail is a condition field over a person's emails or phones.
+type conditionDetail struct {
+	// table holds the values, one row for each with its seq and type.
+	table string
+	// where, if set, selects the rows of table the field covers, as covers does.
+	where string
+	// covers, if set, reports whether the field covers the value at index i with type typ.
+	covers func(i int, typ string) bool
+}
+
+// conditionDetails maps the condition fields over a person's emails or phones to the values they cover.
+// The phone fields other than phone cover the phones personEntry lists under the LDAP attribute of that name.
+var conditionDetails = map[string]conditionDetail{
+	"email":           {table: "person_emails"},
+	"phone":           {table: "person_phones"},
+	"telephonenumber": phoneDetail("telephoneNumber", "(d.seq = 0 OR d.type NOT IN ('mobile', 'home', 'fax'))"),
+	"mobile":          phoneDetail("mobile", "d.seq > 0 AND d.type = 'mobile'"),
+	"homephone":       phoneDetail("homePhone", "d.seq > 0 AND d.type = 'home'"),
+	"fax":             phoneDetail("facsimileTelephoneNumber", "d.seq > 0 AND d.type = 'fax'"),
+}
+
+// phoneDetail returns the field covering the phones listed under an LDAP attribute, which where selects.
+func phoneDetail(attr, where string) conditionDetail {
+	return conditionDetail{table: "person_phones", where: where, covers: func(i int, typ string) bool {
+		return phoneAttribute(i, typ) == attr
+	}}
+}
+
+// value returns the condition's field of p.
+func (c *Condition) value(p *Person) string {
+	switch c.Field {
+	case "id":
+		return strconv.Itoa(p.ID)
+	case "name":
+		return strings.TrimSpace(p.FirstName + " " + p.LastName)
+	}
+	return p.sortValue(c.Field)
+}
+
+// values returns the values of the condition's field of p: those a conditionDetails field covers,
+// or the field's only value.
+func (c *Condition) values(p *Person) []string {
+	d, ok := conditionDetails[c.Field]
+	if !ok {
+		return []string{c.value(p)}
+	}
+	values := []string{}
+	add := func(i int, typ, value string) {
+		if d.covers == nil || d.covers(i, typ) {
+			values = append(values, value)
+		}
+	}
+	if d.table == "person_emails" {
+		for i, e := range p.Emails {
+			add(i, e.Type, e.Value)
+		}
+	} else {
+		for i, ph := range p.Phones {
+			add(i, ph.Type, ph.Value)
+		}
+	}
+	return values
+}
+
+// matches reports whether p satisfies the condition.
+func (c *Condition) matches(p *Person) bool {
+	switch c.Op {
+	case CondTrue:
+		return true
+	case CondAnd, CondOr:
+		for i := range c.Children {
+			if c.Children[i].matches(p) == (c.Op == CondOr) {
+				return c.Op == CondOr
+			}
+		}
+		return c.Op == CondAnd
+	case CondNot:
+		return len(c.Children) == 1 && !c.Children[0].matches(p)
+	case CondPresent, CondSubstrings, CondEqual, CondGreaterOrEqual, CondLessOrEqual:
+		for _, v := range c.values(p) {
+			if c.matchesValue(p, v) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchesValue reports whether v, one of the values of p's field, satisfies the comparison.
+func (c *Condition) matchesValue(p *Person, v string) bool {
+	switch c.Op {
+	case CondPresent:
+		return v != ""
+	case CondSubstrings:
+		return matchSubstrings(strings.ToLower(v), strings.ToLower(c.Initial), lowerAll(c.Any), strings.ToLower(c.Final))
+	}
+	cmp := 0
+	if c.Field == "id" {
+		id, err := strconv.Atoi(c.Value)
+		if err != nil {
+			return false
+		}
+		cmp = p.ID - id
+	} else {
+		cmp = strings.Compare(strings.ToLower(v), strings.ToLower(c.Value))
+	}
+	switch c.Op {
+	case CondGreaterOrEqual:
+		return cmp >= 0
+	case CondLessOrEqual:
+		return cmp <= 0
+	}
+	return cmp == 0
+}
+
+// matchSubstrings reports whether s starts with initial, contains each of any in order, and ends with final.
+func matchSubstrings(s, initial string, any []string, final string) bool {
+	if !strings.HasPrefix(s, initial) {
+		return false
+	}
+	s = s[len(initial):]
+	for _, a := range any {
+		i := strings.Index(s, a)
+		if i < 0 {
+			return false
+		}
+		s = s[i+len(a):]
+	}
+	return strings.HasSuffix(s, final)
+}
+
+// lowerAll returns the lower-cased strings.
+func lowerAll(s []string) []string {
+	lower := make([]string, len(s))
+	for i := range s {
+		lower[i] = strings.ToLower(s[i])
+	}
+	return lower
+}
+
+// sql returns the condition as an SQL expression, calling bind to add each argument
+// and get its placeholder.
+func (c *Condition) sql(bind func(arg interface{}) string) string {
+	switch c.Op {
+	case CondTrue:
+		return "1 = 1"
+	case CondAnd, CondOr:
+		if len(c.Children) == 0 {
+			return (&Condition{Op: map[CondOp]CondOp{CondAnd: CondTrue, CondOr: CondFalse}[c.Op]}).sql(bind)
+		}
+		parts := make([]string, len(c.Children))
+		for i := range c.Children {
+			parts[i] = c.Children[i].sql(bind)
+		}
+		return "(" + strings.Join(parts, map[CondOp]string{CondAnd: " AND ", CondOr: " OR "}[c.Op]) + ")"
+	case CondNot:
+		if len(c.Children) != 1 {
+			break
+		}
+		return "NOT " + c.Children[0].sql(bind)
+	case CondPresent, CondSubstrings, CondEqual, CondGreaterOrEqual, CondLessOrEqual:
+		if d, ok := conditionDetails[c.Field]; ok {
+			return detailFilter(d, c.valueSQL("d.value", bind))
+		}
+		return c.valueSQL(conditionColumns[c.Field], bind)
+	}
+	return "1 = 0"
+}
+
+// valueSQL returns the comparison of the condition as an SQL expression over col, the SQL of its field.
+func (c *Condition) valueSQL(col string, bind func(arg interface{}) string) string {
+	switch c.Op {
+	case CondPresent:
+		if c.Field == "id" {
+			return "1 = 1"
+		}
+		return fmt.Sprintf("%v <> ''", col)
+	case CondSubstrings:
+		if c.Field == "id" {
+			col = "CAST(id AS TEXT)"
+		}
+		pattern := escapeLike(strings.ToLower(c.Initial)) + "%"
+		for _, a := range c.Any {
+			pattern += escapeLike(strings.ToLower(a)) + "%"
+		}
+		pattern += escapeLike(strings.ToLower(c.Final))
+		return fmt.Sprintf(`LOWER(%v) LIKE %v ESCAPE '\'`, col, bind(pattern))
+	case CondEqual, CondGreaterOrEqual, CondLessOrEqual:
+		op := map[CondOp]string{CondEqual: "=", CondGreaterOrEqual: ">=", CondLessOrEqual: "<="}[c.Op]
+		if c.Field == "id" {
+			id, err := strconv.Atoi(c.Value)
+			if err != nil {
+				break
+			}
+			return fmt.Sprintf("id %v %v", op, bind(id))
+		}
+		return fmt.Sprintf("LOWER(%v) %v %v", col, op, bind(strings.ToLower(c.Value)))
+	}
+	return "1 = 0"
+}
+
+// detailFilter returns the SQL condition matching people with a value covered by d that cond matches.
+func detailFilter(d conditionDetail, cond string) string {
+	if d.where != "" {
+		cond = d.where + " AND " + cond
+	}
+	return fmt.Sprintf(sqlDetailFilter, d.table, cond)
+}
@@ -0,0 +1,330 @@
+package app
+
+// Contact.go contains a person's emails, phone numbers and postal addresses, and how they are stored.
+
+import (
+	"database/sql"
+	"fmt"
+	"net/mail"
+	"strings"
+)
+
+// Types of emails, phone numbers and addresses. The empty type is also allowed.
+const (
+	TypeHome   = "home"
+	TypeWork   = "work"
+	TypeMobile = "mobile"
+	TypeFax    = "fax"
+	TypeOther  = "other"
+)
+
+// emailTypes, phoneTypes and addressTypes are the types allowed for each kind of record.
+var (
+	emailTypes   = []string{TypeHome, TypeWork, TypeOther}
+	phoneTypes   = []string{TypeHome, TypeWork, TypeMobile, TypeFax, TypeOther}
+	addressTypes = []string{TypeHome, TypeWork, TypeOther}
+)
+
+// Email is one of a person's email addresses.
+type Email struct {
+	Type  string `json:"Type"`
+	Value string `json:"Value"`
+}
+
+// Phone is one of a person's phone numbers.
+type Phone struct {
+	Type  string `json:"Type"`
+	Value string `json:"Value"`
+}
+
+// Address is one of a person's postal addresses.
+type Address struct {
+	Type     string `json:"Type"`
+	Street   string `json:"Street"`
+	City     string `json:"City"`
+	Region   string `json:"Region"`
+	Postcode string `json:"Postcode"`
+	Country  string `json:"Country"`
+}
+
+// empty reports whether every part of the address is blank.
+func (a *Address) empty() bool {
+	return strings.TrimSpace(a.Street+a.City+a.Region+a.Postcode+a.Country) == ""
+}
+
+// lines returns the non-empty lines of the address as it would be written on an envelope.
+func (a *Address) lines() []string {
+	lines := []string{}
+	for _, l := range strings.Split(a.Street, "\n") {
+		if l = strings.TrimSpace(l); l != "" {
+			lines = append(lines, l)
+		}
+	}
+	for _, l := range []string{a.City, strings.TrimSpace(a.Region + " " + a.Postcode), a.Country} {
+		if l = strings.TrimSpace(l); l != "" {
+			lines = append(lines, l)
+		}
+	}
+	return lines
+}
+
+// normalise makes Email and Phone, the primary email address and phone number, the first of Emails and Phones.
+// A primary value that is not in the list is added to its front, one that is is moved to the front,
+// and an empty one is set from the list. Empty lists and custom values are set to nil,
+// group names are trimmed and de-duplicated, and DeletedAt, which only Delete sets, is cleared.
+func (p *Person) normalise() {
+	values := make([]string, len(p.Emails))
+	for i := range p.Emails {
+		values[i] = p.Emails[i].Value
+	}
+	if i := primaryIndex(values, p.Email); i > 0 {
+		p.Emails = append([]Email{p.Emails[i]}, append(p.Emails[:i:i], p.Emails[i+1:]...)...)
+	} else if i < 0 {
+		p.Emails = append([]Email{{Value: p.Email}}, p.Emails...)
+	}
+	values = make([]string, len(p.Phones))
+	for i := range p.Phones {
+		values[i] = p.Phones[i].Value
+	}
+	if i := primaryIndex(values, p.Phone); i > 0 {
+		p.Phones = append([]Phone{p.Phones[i]}, append(p.Phones[:i:i], p.Phones[i+1:]...)...)
+	} else if i < 0 {
+		p.Phones = append([]Phone{{Value: p.Phone}}, p.Phones...)
+	}
+	p.Email, p.Phone = "", ""
+	if len(p.Emails) == 0 {
+		p.Emails = nil
+	} else {
+		p.Email = p.Emails[0].Value
+	}
+	if len(p.Phones) == 0 {
+		p.Phones = nil
+	} else {
+		p.Phone = p.Phones[0].Value
+	}
+	if len(p.Addresses) == 0 {
+		p.Addresses = nil
+	}
+	if len(p.Custom) == 0 {
+		p.Custom = nil
+	}
+	p.Groups = uniqueGroups(p.Groups)
+	p.DeletedAt = nil
+}
+
+// primaryIndex returns the index of primary in values, 0 if primary is empty,
+// or -1 if it is set but not found.
+func primaryIndex(values []string, primary string) int {
+	if primary == "" {
+		return 0
+	}
+	for i, v := range values {
+		if v == primary {
+			return i
+		}
+	}
+	return -1
+}
+
+// clone returns a copy of p that shares no slices or maps with it.
+func (p Person) clone() Person {
+	p.Emails = append([]Email(nil), p.Emails...)
+	p.Phones = append([]Phone(nil), p.Phones...)
+	p.Addresses = append([]Address(nil), p.Addresses...)
+	if p.Custom != nil {
+		custom := make(map[string]string, len(p.Custom))
+		for k, v := range p.Custom {
+			custom[k] = v
+		}
+		p.Custom = custom
+	}
+	p.Groups = append([]string(nil), p.Groups...)
+	return p
+}
+
+// validEmail reports whether v is a bare email address.
+func validEmail(v string) bool {
+	a, err := mail.ParseAddress(v)
+	return err == nil && a.Address == v
+}
+
+// validType reports whether t is empty or one of types.
+func validType(t string, types []string) bool {
+	if t == "" {
+		return true
+	}
+	for _, v := range types {
+		if t == v {
+			return true
+		}
+	}
+	return false
+}
+
+// validateContact checks a person's emails, phone numbers and addresses.
+// The first email and phone number are not checked again if they are the primary Email and Phone,
+// so an invalid primary value is only reported once.
+func (p *Person) validateContact() []FieldError {
+	errs := []FieldError{}
+	typeReason := func(types []string) string {
+		return "must be one of " + strings.Join(types, ", ") + " or empty"
+	}
+	for i, e := range p.Emails {
+		field := fmt.Sprintf("Emails[%v]", i)
+		if !(i == 0 && e.Value == p.Email) && !validEmail(e.Value) {
+			errs = append(errs, FieldError{Field: field + ".Value", Reason: "not a valid email address"})
+		}
+		if !validType(e.Type, emailTypes) {
+			errs = append(errs, FieldError{Field: field + ".Type", Reason: typeReason(emailTypes)})
+		}
+	}
+	for i, ph := range p.Phones {
+		field := fmt.Sprintf("Phones[%v]", i)
+		if !(i == 0 && ph.Value == p.Phone) && !validPhone.MatchString(ph.Value) {
+			errs = append(errs, FieldError{Field: field + ".Value", Reason: "not a valid phone number"})
+		}
+		if !validType(ph.Type, phoneTypes) {
+			errs = append(errs, FieldError{Field: field + ".Type", Reason: typeReason(phoneTypes)})
+		}
+	}
+	for i, a := range p.Addresses {
+		field := fmt.Sprintf("Addresses[%v]", i)
+		if a.empty() {
+			errs = append(errs, FieldError{Field: field, Reason: "the address is empty"})
+		}
+		if !validType(a.Type, addressTypes) {
+			errs = append(errs, FieldError{Field: field + ".Type", Reason: typeReason(addressTypes)})
+		}
+	}
+	return errs
+}
+
+// detailsBatch is the most people whose emails, phones and addresses are read with one query.
+const detailsBatch = 500
+
+// dbCreateDetails inserts the emails, phone numbers, addresses, custom values and groups of p inside tx.
+func (p *Person) dbCreateDetails(db *database, tx *sql.Tx) error {
+	for i, e := range p.Emails {
+		if _, err := tx.Exec(db.rebind(sqlCreateEmail), p.ID, i, e.Type, e.Value); err != nil {
+			return fmt.Errorf("could not write email: %v", err.Error())
+		}
+	}
+	for i, ph := range p.Phones {
+		if _, err := tx.Exec(db.rebind(sqlCreatePhone), p.ID, i, ph.Type, ph.Value); err != nil {
+			return fmt.Errorf("could not write phone: %v", err.Error())
+		}
+	}
+	for i, a := range p.Addresses {
+		if _, err := tx.Exec(db.rebind(sqlCreateAddress),
+			p.ID, i, a.Type, a.Street, a.City, a.Region, a.Postcode, a.Country); err != nil {
+			return fmt.Errorf("could not write address: %v", err.Error())
+		}
+	}
+	if err := p.dbCreateCustom(db, tx); err != nil {
+		return err
+	}
+	return p.dbCreateGroups(db, tx)
+}
+
+// dbUpdateDetails replaces the emails, phone numbers, addresses, custom values and groups of p inside tx.
+func (p *Person) dbUpdateDetails(db *database, tx *sql.Tx) error {
+	for _, query := range []string{sqlDeleteEmails, sqlDeletePhones, sqlDeleteAddresses, sqlDeleteCustom, sqlDeleteMemberships} {
+		if _, err := tx.Exec(db.rebind(query), p.ID); err != nil {
+			return fmt.Errorf("could not clear details: %v", err.Error())
+		}
+	}
+	return p.dbCreateDetails(db, tx)
+}
+
+// dbLoadDetails reads the emails, phone numbers, addresses, custom values and groups of people,
+// detailsBatch people at a time.
+func dbLoadDetails(db *database, people []Person) error {
+	for start := 0; start < len(people); start += detailsBatch {
+		end := start + detailsBatch
+		if end > len(people) {
+			end = len(people)
+		}
+		byID := map[int]*Person{}
+		ids, marks := []interface{}{}, []string{}
+		for i := start; i < end; i++ {
+			byID[people[i].ID] = &people[i]
+			ids = append(ids, people[i].ID)
+			marks = append(marks, db.bind(len(ids)))
+		}
+		in := strings.Join(marks, ", ")
+		err := dbQueryDetails(db, fmt.Sprintf(sqlReadEmails, in), ids, func(rows *sql.Rows) error {
+			id, e := 0, Email{}
+			if err := rows.Scan(&id, &e.Type, &e.Value); err != nil {
+				return err
+			}
+			byID[id].Emails = append(byID[id].Emails, e)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		err = dbQueryDetails(db, fmt.Sprintf(sqlReadPhones, in), ids, func(rows *sql.Rows) error {
+			id, ph := 0, Phone{}
+			if err := rows.Scan(&id, &ph.Type, &ph.Value); err != nil {
+				return err
+			}
+			byID[id].Phones = append(byID[id].Phones, ph)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		err = dbQueryDetails(db, fmt.Sprintf(sqlReadAddresses, in), ids, func(rows *sql.Rows) error {
+			id, a := 0, Address{}
+			if err := rows.Scan(&id, &a.Type, &a.Street, &a.City, &a.Region, &a.Postcode, &a.Country); err != nil {
+				return err
+			}
+			byID[id].Addresses = append(byID[id].Addresses, a)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		err = dbQueryDetails(db, fmt.Sprintf(sqlReadCustom, in), ids, func(rows *sql.Rows) error {
+			id, name, v := 0, "", ""
+			if err := rows.Scan(&id, &name, &v); err != nil {
+				return err
+			}
+			if byID[id].Custom == nil {
+				byID[id].Custom = map[string]string{}
+			}
+			byID[id].Custom[name] = v
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		err = dbQueryDetails(db, fmt.Sprintf(sqlReadMemberships, in), ids, func(rows *sql.Rows) error {
+			id, name := 0, ""
+			if err := rows.Scan(&id, &name); err != nil {
+				return err
+			}
+			byID[id].Groups = append(byID[id].Groups, name)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dbQueryDetails runs a query and calls scan for each row.
+func dbQueryDetails(db *database, query string, args []interface{}, scan func(rows *sql.Rows) error) error {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return fmt.Errorf("error getting details: %v", err.Error())
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err := scan(rows); err != nil {
+			return fmt.Errorf("error getting row: %v", err.Error())
+		}
+	}
+	return rows.Err()
+}
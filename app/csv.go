@@ -0,0 +1,587 @@
+package app
+
+// Csv.go contains the CSV dialects, text encodings and header mapping used to import and export people.
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Text encodings accepted by the encoding query parameter.
+const (
+	EncodingUTF8    = "utf-8"
+	EncodingUTF16   = "utf-16"
+	EncodingUTF16LE = "utf-16le"
+	EncodingUTF16BE = "utf-16be"
+	EncodingLatin1  = "latin1"
+)
+
+// encodingNames maps the accepted spellings of each encoding to its canonical name.
+var encodingNames = map[string]string{
+	"utf-8":      EncodingUTF8,
+	"utf8":       EncodingUTF8,
+	"utf-16":     EncodingUTF16,
+	"utf16":      EncodingUTF16,
+	"utf-16le":   EncodingUTF16LE,
+	"utf-16be":   EncodingUTF16BE,
+	"latin1":     EncodingLatin1,
+	"iso-8859-1": EncodingLatin1,
+}
+
+var (
+	bomUTF8    = []byte{0xef, 0xbb, 0xbf}
+	bomUTF16LE = []byte{0xff, 0xfe}
+	bomUTF16BE = []byte{0xfe, 0xff}
+)
+
+// csvDialect describes how a CSV file is delimited, quoted and encoded.
+type csvDialect struct {
+	// Comma is the field delimiter.
+	Comma rune
+	// Quote is the character used to quote fields.
+	Quote rune
+	// Encoding is the canonical name of the text encoding.
+	// When importing, an empty Encoding is detected from the byte order mark, defaulting to UTF-8.
+	Encoding string
+	// BOM writes a byte order mark when exporting. UTF-16 is always written with one.
+	BOM bool
+}
+
+// defaultCSVDialect is plain comma separated, double quoted UTF-8.
+var defaultCSVDialect = csvDialect{Comma: ',', Quote: '"'}
+
+// parseCSVDialect reads the delimiter, quote, encoding and bom query parameters, overriding those of d.
+// contentType is the Content-Type of an uploaded file, whose charset is used if no encoding is given.
+func parseCSVDialect(v url.Values, contentType string, d csvDialect) (csvDialect, error) {
+	var err error
+	if s := v.Get("delimiter"); s != "" {
+		if d.Comma, err = dialectRune("delimiter", s); err != nil {
+			return d, err
+		}
+	}
+	if s := v.Get("quote"); s != "" {
+		if d.Quote, err = dialectRune("quote", s); err != nil {
+			return d, err
+		}
+	}
+	if d.Comma == d.Quote || d.Comma == '"' {
+		return d, fmt.Errorf("delimiter must differ from the quote character")
+	}
+	enc := v.Get("encoding")
+	if enc == "" && contentType != "" {
+		if _, params, err := mime.ParseMediaType(contentType); err == nil {
+			enc = params["charset"]
+		}
+	}
+	if enc != "" {
+		var ok bool
+		if d.Encoding, ok = encodingNames[strings.ToLower(enc)]; !ok {
+			return d, fmt.Errorf("encoding must be one of utf-8, utf-16, utf-16le, utf-16be or latin1")
+		}
+	}
+	if s := v.Get("bom"); s != "" {
+		if d.BOM, err = strconv.ParseBool(s); err != nil {
+			return d, fmt.Errorf("bom must be true or false")
+		}
+	}
+	return d, nil
+}
+
+// dialectRunes are the names accepted for characters that are awkward to put in a URL.
+var dialectRunes = map[string]rune{
+	"tab":       '\t',
+	"semicolon": ';',
+	"pipe":      '|',
+}
+
+// dialectRune parses a delimiter or quote parameter, which is a single character or one of the dialectRunes.
+func dialectRune(name, s string) (rune, error) {
+	if r, ok := dialectRunes[s]; ok {
+		return r, nil
+	}
+	r, size := utf8.DecodeRuneInString(s)
+	if size != len(s) || r == utf8.RuneError || r == '\r' || r == '\n' || unicode.IsSpace(r) && r != '\t' {
+		return 0, fmt.Errorf("%v must be a single character", name)
+	}
+	return r, nil
+}
+
+// decodeText converts data in the dialect's encoding to a string, removing any byte order mark.
+func decodeText(data []byte, enc string) (string, error) {
+	switch {
+	case enc == "" && bytes.HasPrefix(data, bomUTF16LE), enc == EncodingUTF16 && bytes.HasPrefix(data, bomUTF16LE):
+		return decodeUTF16(data[2:], false)
+	case enc == "" && bytes.HasPrefix(data, bomUTF16BE), enc == EncodingUTF16 && bytes.HasPrefix(data, bomUTF16BE):
+		return decodeUTF16(data[2:], true)
+	case enc == EncodingUTF16, enc == EncodingUTF16LE:
+		return decodeUTF16(bytes.TrimPrefix(data, bomUTF16LE), false)
+	case enc == EncodingUTF16BE:
+		return decodeUTF16(bytes.TrimPrefix(data, bomUTF16BE), true)
+	case enc == EncodingLatin1:
+		runes := make([]rune, len(data))
+		for i, b := range data {
+			runes[i] = rune(b)
+		}
+		return string(runes), nil
+	}
+	data = bytes.TrimPrefix(data, bomUTF8)
+	if !utf8.Valid(data) {
+		return "", fmt.Errorf("not valid UTF-8, set the encoding query parameter")
+	}
+	return string(data), nil
+}
+
+// decodeUTF16 converts UTF-16 data without a byte order mark to a string.
+func decodeUTF16(data []byte, bigEndian bool) (string, error) {
+	if len(data)%2 != 0 {
+		return "", fmt.Errorf("not valid UTF-16, odd number of bytes")
+	}
+	units := make([]uint16, len(data)/2)
+	for i := range units {
+		if bigEndian {
+			units[i] = uint16(data[2*i])<<8 | uint16(data[2*i+1])
+		} else {
+			units[i] = uint16(data[2*i+1])<<8 | uint16(data[2*i])
+		}
+	}
+	return string(utf16.Decode(units)), nil
+}
+
+// encodeText converts s to the dialect's encoding.
+// Characters that cannot be represented in latin1 are replaced with '?'.
+func encodeText(s string, d csvDialect) []byte {
+	buf := new(bytes.Buffer)
+	switch d.Encoding {
+	case EncodingUTF16, EncodingUTF16LE, EncodingUTF16BE:
+		for _, u := range utf16.Encode([]rune(s)) {
+			if d.Encoding == EncodingUTF16BE {
+				buf.Write([]byte{byte(u >> 8), byte(u)})
+			} else {
+				buf.Write([]byte{byte(u), byte(u >> 8)})
+			}
+		}
+	case EncodingLatin1:
+		for _, r := range s {
+			if r > 0xff {
+				r = '?'
+			}
+			buf.WriteByte(byte(r))
+		}
+	default:
+		buf.WriteString(s)
+	}
+	return buf.Bytes()
+}
+
+// bom returns the byte order mark to start an export with, if any.
+// UTF-16 is always written with one, other encodings only if BOM is set.
+func (d csvDialect) bom() []byte {
+	switch {
+	case d.Encoding == EncodingLatin1:
+		return nil
+	case d.Encoding == EncodingUTF16 || d.BOM:
+		return encodeText("\ufeff", d)
+	}
+	return nil
+}
+
+// dialectWriter encodes the UTF-8 CSV written to it in a dialect's encoding and quote character,
+// starting with the dialect's byte order mark.
+type dialectWriter struct {
+	w       io.Writer
+	d       csvDialect
+	started bool
+	// pending holds an incomplete UTF-8 sequence at the end of the last write.
+	pending []byte
+}
+
+// Write encodes b, holding back any incomplete UTF-8 sequence at its end until the next write.
+func (dw *dialectWriter) Write(b []byte) (int, error) {
+	n := len(b)
+	if len(dw.pending) > 0 {
+		b = append(dw.pending, b...)
+		dw.pending = nil
+	}
+	for i := len(b) - 1; i >= 0 && i >= len(b)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(b[i]) {
+			if !utf8.FullRune(b[i:]) {
+				dw.pending = append([]byte{}, b[i:]...)
+				b = b[:i]
+			}
+			break
+		}
+	}
+	out := encodeText(dw.d.swapQuote(string(b)), dw.d)
+	if !dw.started {
+		dw.started = true
+		out = append(dw.d.bom(), out...)
+	}
+	if _, err := dw.w.Write(out); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// charset returns the Content-Type charset for the dialect's encoding.
+func (d csvDialect) charset() string {
+	switch d.Encoding {
+	case "":
+		return EncodingUTF8
+	case EncodingLatin1:
+		return "iso-8859-1"
+	}
+	return d.Encoding
+}
+
+// swapQuote exchanges the dialect's quote character with '"', so that encoding/csv,
+// which only quotes with '"', can read and write other quote characters.
+// Swapping is its own inverse.
+func (d csvDialect) swapQuote(s string) string {
+	if d.Quote == '"' {
+		return s
+	}
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case d.Quote:
+			return '"'
+		case '"':
+			return d.Quote
+		}
+		return r
+	}, s)
+}
+
+// csvColumn is a Person field stored in a CSV column.
+type csvColumn struct {
+	// Header is the column name written when exporting.
+	Header string
+	// Names are the normalised header names recognised when importing, see normaliseHeader.
+	// If a file has several of them, the first non-empty one in this order is used.
+	Names []string
+	// Optional columns may be missing from the end of records in files without a header.
+	Optional bool
+	get      func(p *Person) string
+	// set is nil for columns that are only exported.
+	set func(p *Person, v string)
+}
+
+// personColumns are the CSV columns for a person, in the order they are exported
+// and expected in files without a header.
+// Email and Phone are the primary email and phone number. The typed columns hold the first email
+// or phone number of their type, and the address columns the first address.
+// Every column after Phone is optional, so files written before they were added can still be read.
+// Groups lists the names of the person's groups separated by commas.
+var personColumns = []csvColumn{
+	{
+		Header: "FirstName",
+		Names:  []string{"firstname", "first", "givenname", "forename"},
+		get:    func(p *Person) string { return p.FirstName },
+		set:    func(p *Person, v string) { p.FirstName = v },
+	},
+	{
+		Header: "LastName",
+		Names:  []string{"lastname", "last", "surname", "familyname"},
+		get:    func(p *Person) string { return p.LastName },
+		set:    func(p *Person, v string) { p.LastName = v },
+	},
+	{
+		Header: "Email",
+		Names:  []string{"email", "emailaddress", "mail"},
+		get:    func(p *Person) string { return p.Email },
+		set:    func(p *Person, v string) { p.Email = v },
+	},
+	{
+		Header: "Phone",
+		Names:  []string{"phone", "phonenumber", "telephone", "tel", "mobile"},
+		get:    func(p *Person) string { return p.Phone },
+		set:    func(p *Person, v string) { p.Phone = v },
+	},
+	emailColumn("HomeEmail", TypeHome, "homeemail", "personalemail"),
+	emailColumn("WorkEmail", TypeWork, "workemail", "businessemail"),
+	phoneColumn("HomePhone", TypeHome, "homephone"),
+	phoneColumn("WorkPhone", TypeWork, "workphone", "businessphone"),
+	phoneColumn("MobilePhone", TypeMobile, "mobilephone", "cellphone", "cell"),
+	addressColumn("Street", func(a *Address) *string { return &a.Street }, "street", "streetaddress", "address"),
+	addressColumn("City", func(a *Address) *string { return &a.City }, "city", "town", "locality"),
+	addressColumn("Region", func(a *Address) *string { return &a.Region }, "region", "state", "province", "county"),
+	addressColumn("Postcode", func(a *Address) *string { return &a.Postcode }, "postcode", "postalcode", "zip", "zipcode"),
+	addressColumn("Country", func(a *Address) *string { return &a.Country }, "country"),
+	fieldColumn("Nickname", func(p *Person) *string { return &p.Nickname }, "nickname", "nick"),
+	fieldColumn("Organization", func(p *Person) *string { return &p.Organization }, "organization", "organisation", "company", "companyname"),
+	fieldColumn("Department", func(p *Person) *string { return &p.Department }, "department", "dept"),
+	fieldColumn("Title", func(p *Person) *string { return &p.Title }, "title", "jobtitle"),
+	fieldColumn("Birthday", func(p *Person) *string { return &p.Birthday }, "birthday", "birthdate", "dateofbirth", "dob"),
+	fieldColumn("Website", func(p *Person) *string { return &p.Website }, "website", "webpage", "homepage", "url"),
+	fieldColumn("Notes", func(p *Person) *string { return &p.Notes }, "notes", "note", "comments"),
+	{
+		Header:   "Groups",
+		Names:    []string{"groups", "group", "tags", "categories", "labels"},
+		Optional: true,
+		get:      func(p *Person) string { return strings.Join(p.Groups, ", ") },
+		set:      func(p *Person, v string) { p.Groups = uniqueGroups(strings.Split(v, ",")) },
+	},
+}
+
+// fieldColumn returns an optional column for a text field of a person.
+func fieldColumn(header string, field func(p *Person) *string, names ...string) csvColumn {
+	return csvColumn{
+		Header:   header,
+		Names:    names,
+		Optional: true,
+		get:      func(p *Person) string { return *field(p) },
+		set:      func(p *Person, v string) { *field(p) = v },
+	}
+}
+
+// emailColumn returns an optional column for the first email of a type.
+// Importing a value the person already has does not add it again.
+func emailColumn(header, typ string, names ...string) csvColumn {
+	return csvColumn{
+		Header:   header,
+		Names:    names,
+		Optional: true,
+		get: func(p *Person) string {
+			for _, e := range p.Emails {
+				if e.Type == typ {
+					return e.Value
+				}
+			}
+			return ""
+		},
+		set: func(p *Person, v string) {
+			for _, e := range p.Emails {
+				if e.Value == v {
+					return
+				}
+			}
+			p.Emails = append(p.Emails, Email{Type: typ, Value: v})
+		},
+	}
+}
+
+// phoneColumn returns an optional column for the first phone number of a type.
+// Importing a value the person already has does not add it again.
+func phoneColumn(header, typ string, names ...string) csvColumn {
+	return csvColumn{
+		Header:   header,
+		Names:    names,
+		Optional: true,
+		get: func(p *Person) string {
+			for _, ph := range p.Phones {
+				if ph.Type == typ {
+					return ph.Value
+				}
+			}
+			return ""
+		},
+		set: func(p *Person, v string) {
+			for _, ph := range p.Phones {
+				if ph.Value == v {
+					return
+				}
+			}
+			p.Phones = append(p.Phones, Phone{Type: typ, Value: v})
+		},
+	}
+}
+
+// addressColumn returns an optional column for a part of the first address.
+func addressColumn(header string, part func(a *Address) *string, names ...string) csvColumn {
+	return csvColumn{
+		Header:   header,
+		Names:    names,
+		Optional: true,
+		get: func(p *Person) string {
+			if len(p.Addresses) == 0 {
+				return ""
+			}
+			return *part(&p.Addresses[0])
+		},
+		set: func(p *Person, v string) {
+			if len(p.Addresses) == 0 {
+				p.Addresses = []Address{{}}
+			}
+			*part(&p.Addresses[0]) = v
+		},
+	}
+}
+
+// normaliseHeader lower-cases a header name and removes everything but letters and digits,
+// so that "E-mail Address" and "email_address" both become "emailaddress".
+func normaliseHeader(h string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsNumber(r) {
+			return unicode.ToLower(r)
+		}
+		return -1
+	}, h)
+}
+
+// csvMapping maps the columns of a file to csvColumns.
+type csvMapping struct {
+	// fields[i] is the csvColumn stored in column i of the file, or nil if the column is ignored.
+	fields []*csvColumn
+	// rank[i] is the position of column i's header in the csvColumn's Names.
+	rank []int
+	// width is the number of columns a record needs to hold every mapped column.
+	width int
+}
+
+// positionalMapping maps the columns in order, for files without a header.
+// Records must hold every column up to the last one that is not optional.
+func positionalMapping(columns []csvColumn) csvMapping {
+	m := csvMapping{fields: make([]*csvColumn, len(columns)), rank: make([]int, len(columns))}
+	for i := range columns {
+		m.fields[i] = &columns[i]
+		if !columns[i].Optional {
+			m.width = i + 1
+		}
+	}
+	return m
+}
+
+// headerMapping maps a header record to columns. Unrecognised columns are ignored.
+// ok is false if the record does not look like a header: it must name
+// at least two known columns, or consist of a single known column.
+func headerMapping(columns []csvColumn, header []string) (m csvMapping, ok bool) {
+	type name struct {
+		column *csvColumn
+		rank   int
+	}
+	names := map[string]name{}
+	for i := range columns {
+		for j, n := range columns[i].Names {
+			names[n] = name{&columns[i], j}
+		}
+	}
+	m.fields = make([]*csvColumn, len(header))
+	m.rank = make([]int, len(header))
+	known := 0
+	for i, h := range header {
+		n, found := names[normaliseHeader(h)]
+		if !found {
+			continue
+		}
+		m.fields[i], m.rank[i] = n.column, n.rank
+		m.width = i + 1
+		known++
+	}
+	return m, known >= 2 || known == 1 && len(header) == 1
+}
+
+// person builds a person from a record.
+// A field mapped from several columns takes the best ranked non-empty value.
+func (m csvMapping) person(record []string) Person {
+	p := Person{}
+	best := map[*csvColumn]int{}
+	for i, c := range m.fields {
+		if c == nil || c.set == nil || i >= len(record) || record[i] == "" {
+			continue
+		}
+		if rank, ok := best[c]; ok && rank <= m.rank[i] {
+			continue
+		}
+		best[c] = m.rank[i]
+		c.set(&p, record[i])
+	}
+	return p
+}
+
+// csvRows decodes CSV formatted people, one importRow per record.
+// If the first record is a header its column names are used to map it to columns,
+// otherwise the file is expected to hold the columns in order.
+func csvRows(r io.Reader, d csvDialect, columns []csvColumn) ([]importRow, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	text, err := decodeText(data, d.Encoding)
+	if err != nil {
+		return nil, err
+	}
+	cr := csv.NewReader(strings.NewReader(d.swapQuote(text)))
+	cr.Comma = d.Comma
+	cr.FieldsPerRecord = -1
+	mapping := positionalMapping(columns)
+	rows := []importRow{}
+	first := true
+	for {
+		line, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		header := first
+		first = false
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			rows = append(rows, importRow{Line: parseErr.StartLine, Err: fmt.Errorf("invalid CSV: %v", parseErr.Err)})
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		for i := range line {
+			line[i] = d.swapQuote(line[i])
+		}
+		n, _ := cr.FieldPos(0)
+		if header {
+			if m, ok := headerMapping(columns, line); ok {
+				mapping = m
+				continue
+			}
+		}
+		if len(line) < mapping.width {
+			rows = append(rows, importRow{Line: n, Err: fmt.Errorf("expected %v columns, got %v", mapping.width, len(line))})
+			continue
+		}
+		rows = append(rows, importRow{Line: n, Person: mapping.person(line)})
+	}
+	return rows, nil
+}
+
+// csvWriter writes people as CSV in a dialect, after a header row of column names.
+type csvWriter struct {
+	cw      *csv.Writer
+	d       csvDialect
+	columns []csvColumn
+	record  []string
+}
+
+// newCSVWriter returns a csvWriter that has written the header row.
+func newCSVWriter(w io.Writer, d csvDialect, columns []csvColumn) (*csvWriter, error) {
+	c := &csvWriter{cw: csv.NewWriter(&dialectWriter{w: w, d: d}), d: d, columns: columns, record: make([]string, len(columns))}
+	c.cw.Comma = d.Comma
+	for i, col := range columns {
+		c.record[i] = d.swapQuote(col.Header)
+	}
+	if err := c.cw.Write(c.record); err != nil {
+		return nil, fmt.Errorf("could not write headers: %v", err.Error())
+	}
+	return c, nil
+}
+
+// Write writes a row for p.
+func (c *csvWriter) Write(p *Person) error {
+	for i, col := range c.columns {
+		c.record[i] = c.d.swapQuote(col.get(p))
+	}
+	if err := c.cw.Write(c.record); err != nil {
+		return fmt.Errorf("could not write person %v: %v", p.ID, err.Error())
+	}
+	return nil
+}
+
+// Close flushes any buffered rows.
+func (c *csvWriter) Close() error {
+	c.cw.Flush()
+	return c.cw.Error()
+}
@@ -0,0 +1,187 @@
+package app
+
+// Dav.go contains the WebDAV (RFC 4918) request and multistatus XML that the CardDAV endpoints are built on.
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// XML namespaces of WebDAV and its extensions.
+const (
+	nsDAV            = "DAV:"
+	nsCardDAV        = "urn:ietf:params:xml:ns:carddav"
+	nsCalendarServer = "http://calendarserver.org/ns/"
+)
+
+// davMaxBody limits the size of PROPFIND and REPORT request bodies.
+const davMaxBody = 1 << 20
+
+// davName is a property named in a request, with the attributes address-data may have.
+type davName struct {
+	XMLName     xml.Name
+	ContentType string `xml:"content-type,attr"`
+	Version     string `xml:"version,attr"`
+}
+
+// davProp is the DAV:prop element of a request, the properties it asks for.
+type davProp struct {
+	Names []davName `xml:",any"`
+}
+
+// davPropfind is a PROPFIND request body. An empty body is an allprop request.
+type davPropfind struct {
+	XMLName  xml.Name  `xml:"DAV: propfind"`
+	AllProp  *struct{} `xml:"DAV: allprop"`
+	PropName *struct{} `xml:"DAV: propname"`
+	Prop     *davProp  `xml:"DAV: prop"`
+}
+
+// davProperty is a property in a response, with its contents as XML.
+type davProperty struct {
+	XMLName xml.Name
+	Inner   string `xml:",innerxml"`
+}
+
+// davText returns a property containing escaped text.
+func davText(name xml.Name, text string) davProperty {
+	buf := new(bytes.Buffer)
+	xml.EscapeText(buf, []byte(text))
+	return davProperty{XMLName: name, Inner: buf.String()}
+}
+
+// davHref returns a property containing an href.
+func davHref(name xml.Name, href string) davProperty {
+	p := davText(name, href)
+	p.Inner = "<href xmlns=\"DAV:\">" + p.Inner + "</href>"
+	return p
+}
+
+// davMultistatus is a 207 Multi-Status response body.
+type davMultistatus struct {
+	XMLName   xml.Name      `xml:"DAV: multistatus"`
+	Responses []davResponse `xml:"response"`
+	// SyncToken is the collection's new sync token in a sync-collection report.
+	SyncToken string `xml:"sync-token,omitempty"`
+}
+
+// davResponse is the status of a resource, or of its properties.
+type davResponse struct {
+	Href      string        `xml:"href"`
+	Status    string        `xml:"status,omitempty"`
+	Propstats []davPropstat `xml:"propstat"`
+}
+
+// davPropstat is a group of properties with the same status.
+type davPropstat struct {
+	Prop   davPropValues `xml:"prop"`
+	Status string        `xml:"status"`
+}
+
+// davPropValues is the DAV:prop element of a response.
+type davPropValues struct {
+	Props []davProperty `xml:",any"`
+}
+
+// davStatus returns the HTTP status line used in multistatus responses.
+func davStatus(code int) string {
+	return fmt.Sprintf("HTTP/1.1 %v %v", code, http.StatusText(code))
+}
+
+// davPropResponse returns the response for a resource's properties,
+// those that were found with 200 OK and those that were not with 404 Not Found.
+func davPropResponse(href string, found, missing []davProperty) davResponse {
+	r := davResponse{Href: href}
+	if len(found) > 0 {
+		r.Propstats = append(r.Propstats, davPropstat{Prop: davPropValues{found}, Status: davStatus(http.StatusOK)})
+	}
+	if len(missing) > 0 {
+		r.Propstats = append(r.Propstats, davPropstat{Prop: davPropValues{missing}, Status: davStatus(http.StatusNotFound)})
+	}
+	return r
+}
+
+// writeMultistatus writes a 207 Multi-Status response.
+func writeMultistatus(w http.ResponseWriter, ms *davMultistatus) {
+	b, err := xml.Marshal(ms)
+	if err != nil {
+		log.Printf("could not marshal multistatus: %v", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(http.StatusMultiStatus)
+	io.WriteString(w, xml.Header)
+	w.Write(b)
+}
+
+// writeDAVError writes a response with a DAV:error body naming the precondition that failed,
+// and the resources given by hrefs that it failed on.
+func writeDAVError(w http.ResponseWriter, status int, condition xml.Name, hrefs ...string) {
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(status)
+	if len(hrefs) == 0 {
+		fmt.Fprintf(w, "%v<error xmlns=\"DAV:\"><%v xmlns=\"%v\"/></error>", xml.Header, condition.Local, condition.Space)
+		return
+	}
+	fmt.Fprintf(w, "%v<error xmlns=\"DAV:\"><%v xmlns=\"%v\">", xml.Header, condition.Local, condition.Space)
+	for _, href := range hrefs {
+		io.WriteString(w, "<href xmlns=\"DAV:\">")
+		xml.EscapeText(w, []byte(href))
+		io.WriteString(w, "</href>")
+	}
+	fmt.Fprintf(w, "</%v></error>", condition.Local)
+}
+
+// readDAVBody reads a request body of at most davMaxBody bytes.
+// A problem is written and ok is false if it is too large.
+func readDAVBody(w http.ResponseWriter, req *http.Request) (body []byte, ok bool) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, req.Body, davMaxBody))
+	if err != nil {
+		writeProblem(w, req, http.StatusRequestEntityTooLarge, CodeTooLarge, "The request body is too large.")
+		return nil, false
+	}
+	return body, true
+}
+
+// davRootName returns the name of the root element of an XML document.
+func davRootName(body []byte) (xml.Name, error) {
+	d := xml.NewDecoder(bytes.NewReader(body))
+	for {
+		t, err := d.Token()
+		if err != nil {
+			return xml.Name{}, err
+		}
+		if start, ok := t.(xml.StartElement); ok {
+			return start.Name, nil
+		}
+	}
+}
+
+// davDepth reads the Depth header, 0 or 1. infinity, the default, is treated as 1,
+// since no collection has more than one level of members.
+func davDepth(req *http.Request) (int, error) {
+	switch strings.TrimSpace(req.Header.Get("Depth")) {
+	case "0":
+		return 0, nil
+	case "1", "infinity", "":
+		return 1, nil
+	}
+	return 0, fmt.Errorf("the Depth header must be 0, 1 or infinity")
+}
+
+// etagMatches reports whether an If-Match or If-None-Match header lists etag, or is *.
+func etagMatches(header, etag string) bool {
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" || strings.TrimPrefix(t, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,223 @@
+package app
+
+// Directory.go contains the read-only LDAP directory that exposes people as inetOrgPerson entries.
+
+import (
+	"crypto/subtle"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/unixblackhole/didactic-tribble/app/ldap"
+)
+
+// ldapMaxResults is the most entries a search returns, whatever its size limit.
+const ldapMaxResults = maxQueryLimit
+
+// ldapFields maps lower-cased LDAP attribute names to the condition fields they are searched as.
+// mail and the phone attributes match any of the values personEntry lists under them.
+var ldapFields = map[string]string{
+	"uid":                      "id",
+	"givenname":                "firstname",
+	"gn":                       "firstname",
+	"sn":                       "lastname",
+	"surname":                  "lastname",
+	"cn":                       "name",
+	"commonname":               "name",
+	"displayname":              "name",
+	"mail":                     "email",
+	"email":                    "email",
+	"telephonenumber":          "telephonenumber",
+	"mobile":                   "mobile",
+	"homephone":                "homephone",
+	"facsimiletelephonenumber": "fax",
+}
+
+// ldapDirectory is an ldap.Handler serving the people in a store as entries under baseDN.
+// If bindDN is set, clients must bind as it with password before searching.
+type ldapDirectory struct {
+	store    PersonStore
+	baseDN   string
+	bindDN   string
+	password string
+}
+
+// directory returns the App's LDAP directory.
+func (a *App) directory() *ldapDirectory {
+	d := &ldapDirectory{store: a.Store, baseDN: a.LDAPBaseDN, bindDN: a.LDAPBindDN, password: a.LDAPPassword}
+	if d.baseDN == "" {
+		d.baseDN = defaultBaseDN
+	}
+	return d
+}
+
+// Bind accepts anonymous binds and binds as bindDN with its password.
+func (d *ldapDirectory) Bind(name, password string) ldap.Result {
+	switch {
+	case name == "" && password == "":
+		return ldap.Result{}
+	case password == "":
+		return ldap.Result{Code: ldap.UnwillingToPerform, Message: "unauthenticated binds are not allowed"}
+	case d.bindDN != "" && normaliseDN(name) == normaliseDN(d.bindDN) &&
+		subtle.ConstantTimeCompare([]byte(password), []byte(d.password)) == 1:
+		return ldap.Result{}
+	}
+	return ldap.Result{Code: ldap.InvalidCredentials}
+}
+
+// Search returns the root DSE, the base entry and the people beneath it that the request selects.
+// Searches return at most ldapMaxResults entries, or fewer if the request's size limit is lower.
+func (d *ldapDirectory) Search(bound string, req *ldap.SearchRequest, send func(e *ldap.Entry) error) ldap.Result {
+	if d.bindDN != "" && bound == "" {
+		return ldap.Result{Code: ldap.InsufficientAccessRights, Message: "bind before searching"}
+	}
+	limit := ldapMaxResults
+	if req.SizeLimit > 0 && req.SizeLimit < limit {
+		limit = req.SizeLimit
+	}
+	sent := 0
+	counted := func(e *ldap.Entry) error {
+		sent++
+		return send(e)
+	}
+	base, root := normaliseDN(req.BaseDN), normaliseDN(d.baseDN)
+	switch {
+	case base == "" && req.Scope == ldap.ScopeBaseObject:
+		return d.sendMatching(d.rootDSE(), req, send)
+	case base == root:
+		if req.Scope != ldap.ScopeSingleLevel {
+			if res := d.sendMatching(d.baseEntry(), req, counted); res.Code != ldap.Success || req.Scope == ldap.ScopeBaseObject {
+				return res
+			}
+		}
+		return d.searchPeople(req, nil, limit-sent, send)
+	case strings.HasSuffix(base, ","+root):
+		rdn := strings.TrimSuffix(base, ","+root)
+		id, err := strconv.Atoi(strings.TrimPrefix(rdn, "uid="))
+		if !strings.HasPrefix(rdn, "uid=") || err != nil {
+			return ldap.Result{Code: ldap.NoSuchObject, MatchedDN: d.baseDN}
+		}
+		if _, err := d.store.Get(id); err != nil {
+			return ldap.Result{Code: ldap.NoSuchObject, MatchedDN: d.baseDN}
+		}
+		if req.Scope == ldap.ScopeSingleLevel {
+			return ldap.Result{}
+		}
+		return d.searchPeople(req, &Condition{Op: CondEqual, Field: "id", Value: strconv.Itoa(id)}, limit, send)
+	}
+	return ldap.Result{Code: ldap.NoSuchObject}
+}
+
+// sendMatching sends e if it matches the request's filter.
+func (d *ldapDirectory) sendMatching(e *ldap.Entry, req *ldap.SearchRequest, send func(e *ldap.Entry) error) ldap.Result {
+	if req.Filter.Matches(e) {
+		if err := send(e); err != nil {
+			return ldap.Result{Code: ldap.Other, Message: err.Error()}
+		}
+	}
+	return ldap.Result{}
+}
+
+// rootDSE returns the entry describing the server.
+func (d *ldapDirectory) rootDSE() *ldap.Entry {
+	return &ldap.Entry{Attributes: []ldap.Attribute{
+		{Name: "objectClass", Values: []string{"top"}},
+		{Name: "namingContexts", Values: []string{d.baseDN}},
+		{Name: "supportedLDAPVersion", Values: []string{"3"}},
+	}}
+}
+
+// baseEntry returns the entry of baseDN, an organizational unit if its RDN is an ou.
+func (d *ldapDirectory) baseEntry() *ldap.Entry {
+	rdn := strings.SplitN(d.baseDN, ",", 2)[0]
+	name, value := rdn, ""
+	if i := strings.IndexByte(rdn, '='); i >= 0 {
+		name, value = strings.TrimSpace(rdn[:i]), strings.TrimSpace(rdn[i+1:])
+	}
+	classes := []string{"top"}
+	if strings.EqualFold(name, "ou") {
+		classes = append(classes, "organizationalUnit")
+	}
+	return &ldap.Entry{DN: d.baseDN, Attributes: []ldap.Attribute{
+		{Name: "objectClass", Values: classes},
+		{Name: name, Values: []string{value}},
+	}}
+}
+
+// searchPeople sends up to limit people matching the request's filter and, if set, where.
+func (d *ldapDirectory) searchPeople(req *ldap.SearchRequest, where *Condition, limit int, send func(e *ldap.Entry) error) ldap.Result {
+	cond := ldapCondition(req.Filter)
+	if where != nil {
+		cond = Condition{Op: CondAnd, Children: []Condition{*where, cond}}
+	}
+	people, _, err := d.store.Query(PeopleQuery{Limit: limit + 1, Where: &cond})
+	if err != nil {
+		log.Printf("LDAP search %v: %v", req.Filter, err.Error())
+		return ldap.Result{Code: ldap.OperationsError, Message: "could not search the directory"}
+	}
+	for i := range people {
+		if i == limit {
+			return ldap.Result{Code: ldap.SizeLimitExceeded}
+		}
+		if err := send(personEntry(&people[i], d.baseDN)); err != nil {
+			return ldap.Result{Code: ldap.Other, Message: err.Error()}
+		}
+	}
+	return ldap.Result{}
+}
+
+// ldapCondition translates an LDAP filter into a Condition on people.
+// objectClass assertions are decided against the classes every person has,
+// and assertions on attributes people do not have, or extensible matches, are false.
+// sn is searched as the last name, so it does not find people whose entry fills in sn with their first name.
+func ldapCondition(f ldap.Filter) Condition {
+	switch f.Op {
+	case ldap.FilterAnd, ldap.FilterOr, ldap.FilterNot:
+		c := Condition{Op: map[ldap.FilterOp]CondOp{ldap.FilterAnd: CondAnd, ldap.FilterOr: CondOr, ldap.FilterNot: CondNot}[f.Op]}
+		for _, child := range f.Children {
+			c.Children = append(c.Children, ldapCondition(child))
+		}
+		return c
+	case ldap.FilterExtensible:
+		return Condition{Op: CondFalse}
+	}
+	attr := strings.ToLower(f.Attr)
+	if attr == "objectclass" {
+		if f.Matches(&ldap.Entry{Attributes: []ldap.Attribute{{Name: f.Attr, Values: ldifObjectClasses}}}) {
+			return Condition{Op: CondTrue}
+		}
+		return Condition{Op: CondFalse}
+	}
+	field, ok := ldapFields[attr]
+	if !ok {
+		return Condition{Op: CondFalse}
+	}
+	c := Condition{Field: field, Value: f.Value, Initial: f.Initial, Any: f.Any, Final: f.Final}
+	switch f.Op {
+	case ldap.FilterEqual, ldap.FilterApprox:
+		c.Op = CondEqual
+	case ldap.FilterSubstrings:
+		c.Op = CondSubstrings
+	case ldap.FilterGreaterOrEqual:
+		c.Op = CondGreaterOrEqual
+	case ldap.FilterLessOrEqual:
+		c.Op = CondLessOrEqual
+	case ldap.FilterPresent:
+		c.Op = CondPresent
+	}
+	return c
+}
+
+// normaliseDN lower-cases a DN and removes the spaces around its RDNs and their =.
+// It does not handle escaped commas, which the DNs of the directory never contain.
+func normaliseDN(dn string) string {
+	rdns := strings.Split(strings.ToLower(dn), ",")
+	for i, rdn := range rdns {
+		parts := strings.SplitN(rdn, "=", 2)
+		for j := range parts {
+			parts[j] = strings.TrimSpace(parts[j])
+		}
+		rdns[i] = strings.Join(parts, "=")
+	}
+	return strings.Join(rdns, ",")
+}
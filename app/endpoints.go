@@ -4,273 +4,559 @@ package app
 
 import (
 	"bytes"
-	"encoding/csv"
 	"encoding/json"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
 
 	"github.com/gorilla/mux"
 )
 
-//ReadPeople handles returning multiple people from the /people request
+// ReadPeople handles returning multiple people from the /people request.
+// The results can be paged, sorted and filtered with query parameters, see parsePeopleQuery.
 func (a *App) ReadPeople(w http.ResponseWriter, req *http.Request) {
-	log.Printf("Got GET ALL")
-	people, err := dbGetPeople(a.Database, 0, -1)
+	log.Printf("Got GET ALL %v", req.URL.RawQuery)
+	q, ok := a.peopleQuery(w, req)
+	if !ok {
+		return
+	}
+	a.writePeople(w, req, q)
+}
+
+// peopleQuery reads and checks the query parameters of a request for a list of people.
+// A problem is written and ok is false if they are invalid.
+func (a *App) peopleQuery(w http.ResponseWriter, req *http.Request) (q PeopleQuery, ok bool) {
+	q, err := parsePeopleQuery(req.URL.Query())
 	if err != nil {
-		w.WriteHeader(500)
-		fmt.Fprintf(w, "Could not get people: %v", err.Error())
+		writeProblem(w, req, http.StatusBadRequest, CodeInvalidQuery, err.Error())
+		return q, false
+	}
+	if len(q.Custom) > 0 {
+		fields, err := a.Store.Fields()
+		if err != nil {
+			writeInternalError(w, req, "Could not get custom fields.", err)
+			return q, false
+		}
+		if err := q.checkCustom(fields); err != nil {
+			writeProblem(w, req, http.StatusBadRequest, CodeInvalidQuery, err.Error())
+			return q, false
+		}
+	}
+	return q, true
+}
+
+// writePeople writes the page of people selected by q as JSON,
+// with the total count in X-Total-Count and links to the other pages.
+func (a *App) writePeople(w http.ResponseWriter, req *http.Request, q PeopleQuery) {
+	people, total, err := a.Store.Query(q)
+	if err != nil {
+		writeInternalError(w, req, "Could not get people.", err)
 		return
 	}
 	j, err := json.Marshal(people)
 	if err != nil {
-		w.WriteHeader(500)
-		fmt.Fprintf(w, "could not marshal people: %v", err.Error())
+		writeInternalError(w, req, "Could not format people.", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	if links := pageLinks(req.URL, q, people, total); links != "" {
+		w.Header().Set("Link", links)
 	}
 	fmt.Fprint(w, string(j))
 }
 
-// CreatePerson creates a new person in the database with ID n
-func (a *App) CreatePerson(w http.ResponseWriter, req *http.Request) {
-	vars := mux.Vars(req)
-	p := Person{}
-	if vars["id"] != "" {
-		log.Printf("Got POST ID %v", vars["id"])
-		i, err := strconv.Atoi(vars["id"])
-		if err != nil {
-			w.WriteHeader(409)
-			fmt.Fprintf(w, "Invalid ID")
-			log.Printf("invalid ID passed: %v", err.Error())
-			return
-		}
-		p.id = i
-	} else {
-		log.Printf("Got POST with NO ID")
-		i, err := dbGetNextID(a.Database)
-		if err != nil {
-			w.WriteHeader(500)
-			fmt.Fprintf(w, "Error getting next ID.")
-			log.Printf("error getting next id: %v", err.Error())
+// SearchPeople handles searching people with the /people/search?q= request
+func (a *App) SearchPeople(w http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query().Get("q")
+	log.Printf("Got SEARCH %v", q)
+	if len(searchTerms(q)) == 0 {
+		writeProblem(w, req, http.StatusBadRequest, CodeInvalidQuery, "q is required")
+		return
+	}
+	limit := defaultSearchLimit
+	if s := req.URL.Query().Get("limit"); s != "" {
+		var err error
+		if limit, err = strconv.Atoi(s); err != nil || limit < 0 || limit > maxQueryLimit {
+			writeProblem(w, req, http.StatusBadRequest, CodeInvalidQuery,
+				fmt.Sprintf("limit must be between 0 and %v", maxQueryLimit))
 			return
 		}
-		p.id = i
 	}
+	results, err := a.Store.Search(q, limit)
+	if err != nil {
+		writeInternalError(w, req, "Could not search people.", err)
+		return
+	}
+	j, err := json.Marshal(results)
+	if err != nil {
+		writeInternalError(w, req, "Could not format results.", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, string(j))
+}
+
+// personID parses the {id} route variable.
+// A problem is written and ok is false if the ID is invalid.
+func personID(w http.ResponseWriter, req *http.Request) (id int, ok bool) {
+	id, err := strconv.Atoi(mux.Vars(req)["id"])
+	if err != nil {
+		log.Printf("invalid ID passed: %v", err.Error())
+		writeProblem(w, req, http.StatusBadRequest, CodeInvalidID, "Invalid ID.")
+		return 0, false
+	}
+	return id, true
+}
+
+// decodePerson unmarshals a JSON person from the request body into p.
+// A problem is written and ok is false if the body is not valid JSON.
+func decodePerson(w http.ResponseWriter, req *http.Request, p *Person) (ok bool) {
+	buf := new(bytes.Buffer)
+	buf.ReadFrom(req.Body)
+	if err := json.Unmarshal(buf.Bytes(), p); err != nil {
+		log.Printf("error unmarshalling data: %v", err.Error())
+		writeProblem(w, req, http.StatusBadRequest, CodeInvalidJSON, "Invalid input data: "+err.Error())
+		return false
+	}
+	return true
+}
 
+// decodePatch reads the partial person in req's body into p, and returns the names of the fields it sets,
+// lower-cased as JSON field names are matched regardless of case. Otherwise it is like decodePerson.
+func decodePatch(w http.ResponseWriter, req *http.Request, p *Person) (given map[string]bool, ok bool) {
 	buf := new(bytes.Buffer)
 	buf.ReadFrom(req.Body)
-	err := json.Unmarshal(buf.Bytes(), &p)
+	fields := map[string]json.RawMessage{}
+	err := json.Unmarshal(buf.Bytes(), p)
+	if err == nil {
+		err = json.Unmarshal(buf.Bytes(), &fields)
+	}
 	if err != nil {
-		w.WriteHeader(500)
-		fmt.Fprintf(w, "Error Creating Person. Invalid input Data.")
 		log.Printf("error unmarshalling data: %v", err.Error())
-		return
+		writeProblem(w, req, http.StatusBadRequest, CodeInvalidJSON, "Invalid input data: "+err.Error())
+		return nil, false
 	}
+	given = map[string]bool{}
+	for name := range fields {
+		given[strings.ToLower(name)] = true
+	}
+	return given, true
+}
 
-	err = p.dbCreatePerson(a.Database)
+// validatePerson checks p's fields, and its custom values against the store's custom fields.
+// A problem listing each invalid field is written and ok is false if p is invalid.
+func (a *App) validatePerson(w http.ResponseWriter, req *http.Request, p *Person) (ok bool) {
+	fields, err := a.Store.Fields()
 	if err != nil {
-		w.WriteHeader(409)
-		fmt.Fprintf(w, "Error Creating Person. ID Already Exists.")
-		log.Printf("Error creating person: %v", err.Error())
+		writeInternalError(w, req, "Could not get custom fields.", err)
+		return false
+	}
+	errs := append(p.validate(), p.validateCustom(fields)...)
+	if len(errs) == 0 {
+		return true
+	}
+	writeProblemBody(w, req, Problem{
+		Status: http.StatusUnprocessableEntity,
+		Code:   CodeValidationFailed,
+		Detail: "The person has invalid fields.",
+		Errors: errs,
+	})
+	return false
+}
+
+// writeStoreError writes the problem matching an error returned by the PersonStore.
+func writeStoreError(w http.ResponseWriter, req *http.Request, err error) {
+	switch err {
+	case ErrNotFound:
+		writeProblem(w, req, http.StatusNotFound, CodePersonNotFound, "Person not found.")
+	case ErrExists:
+		writeProblem(w, req, http.StatusConflict, CodeIDExists, "A person with this ID already exists.")
+	default:
+		writeInternalError(w, req, "Could not access the address book.", err)
+	}
+}
+
+// writePerson writes p as JSON with the given status code.
+func writePerson(w http.ResponseWriter, req *http.Request, status int, p *Person) {
+	j, err := json.Marshal(p)
+	if err != nil {
+		writeInternalError(w, req, "Could not format person.", err)
 		return
 	}
-	fmt.Fprintf(w, "Created Person with ID %v.", p.id)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(j)
 }
 
-// ReadPerson creates a new person in the database with ID n
-func (a *App) ReadPerson(w http.ResponseWriter, req *http.Request) {
+// personURL returns the path of a person's resource.
+func personURL(id int) string {
+	return fmt.Sprintf("/person/%v", id)
+}
+
+// CreatePerson creates a new person in the database with ID n,
+// and returns it with a Location header pointing at the new resource.
+func (a *App) CreatePerson(w http.ResponseWriter, req *http.Request) {
 	vars := mux.Vars(req)
+	id := 0
+	if vars["id"] != "" {
+		log.Printf("Got POST ID %v", vars["id"])
+		i, ok := personID(w, req)
+		if !ok {
+			return
+		}
+		id = i
+	} else {
+		log.Printf("Got POST with NO ID")
+	}
 	p := Person{}
-	id, err := strconv.Atoi(vars["id"])
+	if !decodePerson(w, req, &p) || !a.validatePerson(w, req, &p) {
+		return
+	}
+	p.ID = id
+	if err := a.Store.Create(&p); err != nil {
+		log.Printf("Error creating person: %v", err.Error())
+		writeStoreError(w, req, err)
+		return
+	}
+	a.audit(req, AuditCreate, p.ID, nil, &p)
+	w.Header().Set("Location", personURL(p.ID))
+	writePerson(w, req, http.StatusCreated, &p)
+}
+
+// ReadPerson returns the person in the database with ID n
+func (a *App) ReadPerson(w http.ResponseWriter, req *http.Request) {
+	id, ok := personID(w, req)
+	if !ok {
+		return
+	}
+	p, err := a.Store.Get(id)
 	if err != nil {
-		w.WriteHeader(409)
-		fmt.Fprintf(w, "Invalid ID")
-		log.Printf("invalid ID passed: %v", err.Error())
+		writeStoreError(w, req, err)
+		return
+	}
+	writePerson(w, req, http.StatusOK, &p)
+}
+
+// ReadPersonVCard returns a single person as a vCard, of the version given by the version query parameter.
+func (a *App) ReadPersonVCard(w http.ResponseWriter, req *http.Request) {
+	id, ok := personID(w, req)
+	if !ok {
 		return
 	}
-	err = p.dbGetPerson(a.Database, id)
+	version, err := parseVCardVersion(req.URL.Query())
 	if err != nil {
-		w.WriteHeader(404)
-		fmt.Fprintf(w, "Person not found.")
-		log.Printf("could not marshal person: %v", err.Error())
+		writeProblem(w, req, http.StatusBadRequest, CodeInvalidQuery, err.Error())
 		return
 	}
-	j, err := json.Marshal(p)
+	p, err := a.Store.Get(id)
+	if err == nil {
+		err = a.attachPhoto(&p)
+	}
 	if err != nil {
-		w.WriteHeader(500)
-		fmt.Fprintf(w, "Could not format person.")
-		log.Printf("could not marshal person: %v", err.Error())
+		writeStoreError(w, req, err)
 		return
 	}
-	fmt.Fprint(w, string(j))
+	w.Header().Set("Content-Type", formatContentTypes[FormatVCard])
+	if err := writeVCard(w, &p, version); err != nil {
+		log.Printf("Failed to write vCard: %v", err.Error())
+	}
 }
 
-// UpdatePerson updates a person in the database with ID
+// UpdatePerson replaces a person in the database with ID, and returns the updated person
 func (a *App) UpdatePerson(w http.ResponseWriter, req *http.Request) {
-	vars := mux.Vars(req)
-	log.Printf("Got UPDATE (%v) ID %v", req.Method, vars["id"])
+	log.Printf("Got UPDATE (%v) ID %v", req.Method, mux.Vars(req)["id"])
+	id, ok := personID(w, req)
+	if !ok {
+		return
+	}
 	p := Person{}
-	id, err := strconv.Atoi(vars["id"])
-	if err != nil {
-		w.WriteHeader(409)
-		fmt.Fprintf(w, "Invalid ID")
-		log.Printf("invalid ID passed: %v", err.Error())
+	if !decodePerson(w, req, &p) || !a.validatePerson(w, req, &p) {
 		return
 	}
-	p.id = id
-	buf := new(bytes.Buffer)
-	buf.ReadFrom(req.Body)
-	err = json.Unmarshal(buf.Bytes(), &p)
+	before, err := a.Store.Get(id)
 	if err != nil {
-		w.WriteHeader(500)
-		fmt.Fprintf(w, "Error Updating Person. Invalid input Data.")
-		log.Printf("error unmarshalling data: %v", err.Error())
+		writeStoreError(w, req, err)
 		return
 	}
-
-	err = p.dbUpdatePerson(a.Database)
-	if err != nil {
-		w.WriteHeader(404)
-		fmt.Fprintf(w, "Person not found.")
-		log.Printf("error creating person: %v", err.Error())
+	p.ID = id
+	if err := a.Store.Update(&p); err != nil {
+		log.Printf("error updating person: %v", err.Error())
+		writeStoreError(w, req, err)
 		return
 	}
-	fmt.Fprintf(w, "Updated Person with ID %v.", p.id)
+	a.audit(req, AuditUpdate, id, &before, &p)
+	writePerson(w, req, http.StatusOK, &p)
 }
 
-// UpdatePatchPerson updates a person in the database with ID and partial input
+// UpdatePatchPerson updates a person in the database with ID and partial input, and returns the updated person
 func (a *App) UpdatePatchPerson(w http.ResponseWriter, req *http.Request) {
-	vars := mux.Vars(req)
-	log.Printf("Got UPDATE (%v) ID %v", req.Method, vars["id"])
+	log.Printf("Got UPDATE (%v) ID %v", req.Method, mux.Vars(req)["id"])
+	id, ok := personID(w, req)
+	if !ok {
+		return
+	}
 	p := Person{}
-	Prev := Person{}
-	id, err := strconv.Atoi(vars["id"])
+	given, ok := decodePatch(w, req, &p)
+	if !ok {
+		return
+	}
+	Prev, err := a.Store.Get(id)
 	if err != nil {
-		w.WriteHeader(409)
-		fmt.Fprintf(w, "Invalid ID")
-		log.Printf("invalid ID passed: %v", err.Error())
+		writeStoreError(w, req, err)
 		return
 	}
-	p.id = id
-	Prev.dbGetPerson(a.Database, id)
-	buf := new(bytes.Buffer)
-	buf.ReadFrom(req.Body)
-	err = json.Unmarshal(buf.Bytes(), &p)
+	before := Prev.clone()
 	if p.FirstName != "" {
 		Prev.FirstName = p.FirstName
 	}
 	if p.LastName != "" {
 		Prev.LastName = p.LastName
 	}
-	if p.Phone != "" {
+	// Profile fields in the body replace the person's, so "" clears one.
+	for _, f := range []struct {
+		name     string
+		prev, to *string
+	}{
+		{"nickname", &Prev.Nickname, &p.Nickname},
+		{"organization", &Prev.Organization, &p.Organization},
+		{"department", &Prev.Department, &p.Department},
+		{"title", &Prev.Title, &p.Title},
+		{"birthday", &Prev.Birthday, &p.Birthday},
+		{"website", &Prev.Website, &p.Website},
+		{"notes", &Prev.Notes, &p.Notes},
+	} {
+		if given[f.name] {
+			*f.prev = *f.to
+		}
+	}
+	// A new Email or Phone replaces the primary one, a list replaces all of them.
+	if p.Phones != nil {
+		Prev.Phones, Prev.Phone = p.Phones, p.Phone
+	} else if p.Phone != "" {
+		if len(Prev.Phones) > 0 {
+			Prev.Phones[0].Value = p.Phone
+		}
 		Prev.Phone = p.Phone
 	}
-	if p.Email != "" {
+	if p.Emails != nil {
+		Prev.Emails, Prev.Email = p.Emails, p.Email
+	} else if p.Email != "" {
+		if len(Prev.Emails) > 0 {
+			Prev.Emails[0].Value = p.Email
+		}
 		Prev.Email = p.Email
 	}
-	if err != nil {
-		w.WriteHeader(500)
-		fmt.Fprintf(w, "Error Updating Person. Invalid input Data.")
-		log.Printf("error unmarshalling data: %v", err.Error())
+	if p.Addresses != nil {
+		Prev.Addresses = p.Addresses
+	}
+	if p.Groups != nil {
+		Prev.Groups = p.Groups
+	}
+	// Custom values are merged, and an empty value removes one.
+	for name, v := range p.Custom {
+		if Prev.Custom == nil {
+			Prev.Custom = map[string]string{}
+		}
+		Prev.Custom[name] = v
+	}
+	if !a.validatePerson(w, req, &Prev) {
 		return
 	}
-	err = Prev.dbUpdatePerson(a.Database)
-	if err != nil {
-		w.WriteHeader(404)
-		fmt.Fprintf(w, "Person not found.")
-		log.Printf("error creating person: %v", err.Error())
+	if err := a.Store.Update(&Prev); err != nil {
+		log.Printf("error updating person: %v", err.Error())
+		writeStoreError(w, req, err)
 		return
 	}
-	fmt.Fprintf(w, "Updated Person with ID %v.", p.id)
+	a.audit(req, AuditPatch, id, &before, &Prev)
+	writePerson(w, req, http.StatusOK, &Prev)
 }
 
-// DeletePerson creates a new person in the database with ID n
+// DeletePerson moves the person in the database with ID n to the trash, see trash.go, and returns 204 No Content.
 func (a *App) DeletePerson(w http.ResponseWriter, req *http.Request) {
-	vars := mux.Vars(req)
-	log.Printf("Got DELETE ID %v", vars["id"])
-	id, err := strconv.Atoi(vars["id"])
-	if err != nil {
-		w.WriteHeader(409)
-		fmt.Fprintf(w, "Invalid ID")
-		log.Printf("invalid ID passed: %v", err.Error())
+	log.Printf("Got DELETE ID %v", mux.Vars(req)["id"])
+	id, ok := personID(w, req)
+	if !ok {
 		return
 	}
-	p := Person{id: id}
-	err = p.dbDeletePerson(a.Database)
+	before, err := a.Store.Get(id)
 	if err != nil {
-		fmt.Fprintf(w, "error deleting person: %v", err.Error())
+		writeStoreError(w, req, err)
+		return
+	}
+	if err := a.Store.Delete(id); err != nil {
+		writeStoreError(w, req, err)
 		return
 	}
-	fmt.Fprintf(w, "Deleted Person with ID %v ", p.id)
+	a.audit(req, AuditDelete, id, &before, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// parseImportOptions reads the mode, duplicates and dryRun query parameters.
+func parseImportOptions(v url.Values) (importOptions, error) {
+	opts := importOptions{Mode: v.Get("mode"), Duplicates: v.Get("duplicates")}
+	if opts.Mode == "" {
+		opts.Mode = ImportAtomic
+	}
+	if opts.Mode != ImportAtomic && opts.Mode != ImportBestEffort {
+		return opts, fmt.Errorf("mode must be %v or %v", ImportAtomic, ImportBestEffort)
+	}
+	if opts.Duplicates == "" {
+		opts.Duplicates = DuplicatesAllow
+	}
+	if opts.Duplicates != DuplicatesAllow && opts.Duplicates != DuplicatesSkip {
+		return opts, fmt.Errorf("duplicates must be %v or %v", DuplicatesAllow, DuplicatesSkip)
+	}
+	if s := v.Get("dryRun"); s != "" {
+		var err error
+		if opts.DryRun, err = strconv.ParseBool(s); err != nil {
+			return opts, fmt.Errorf("dryRun must be true or false")
+		}
+	}
+	return opts, nil
 }
 
-// ImportCSV imports a CSV formatted list of entries into the database
+// ImportCSV imports a CSV, vCard or LDIF formatted list of entries into the database.
+// The format is chosen by importFormat, from the format query parameter, the Content-Type or the data.
+// The mode query parameter selects ImportAtomic (the default) or ImportBestEffort,
+// duplicates selects DuplicatesAllow (the default) or DuplicatesSkip,
+// and dryRun=true validates the import without writing anything.
+// Columns are mapped by the header row if there is one, and include the custom fields. The profile query parameter
+// selects the layout of another application, see csvProfiles, and the delimiter, quote
+// and encoding query parameters select the CSV dialect, see parseCSVDialect.
+// A JSON ImportReport is returned listing any rejected and conflicting rows.
 func (a *App) ImportCSV(w http.ResponseWriter, req *http.Request) {
 	log.Printf("Got POST to Import")
+	opts, err := parseImportOptions(req.URL.Query())
+	if err != nil {
+		writeProblem(w, req, http.StatusBadRequest, CodeInvalidQuery, err.Error())
+		return
+	}
 	buf := new(bytes.Buffer)
 	buf.ReadFrom(req.Body)
 	if buf.Len() == 0 {
-		w.WriteHeader(409)
-		fmt.Fprintf(w, "No Data.")
 		log.Printf("No data provided on import")
+		writeProblem(w, req, http.StatusBadRequest, CodeNoData, "No data.")
 		return
 	}
-	fmt.Printf("%v", buf.String())
-	cr := csv.NewReader(buf)
-	i := 0
-	for {
-		line, err := cr.Read()
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			log.Fatal(err)
+	format, err := importFormat(req.URL.Query(), req.Header.Get("Content-Type"), buf.Bytes())
+	if err != nil {
+		writeProblem(w, req, http.StatusBadRequest, CodeInvalidQuery, err.Error())
+		return
+	}
+	var rows []importRow
+	switch format {
+	case FormatVCard:
+		if rows, err = vcardRows(buf); err != nil {
+			writeProblem(w, req, http.StatusBadRequest, CodeInvalidVCard, "Could not read vCard: "+err.Error())
+			return
+		}
+	case FormatLDIF:
+		if rows, err = ldifRows(buf); err != nil {
+			writeProblem(w, req, http.StatusBadRequest, CodeInvalidLDIF, "Could not read LDIF: "+err.Error())
+			return
+		}
+	default:
+		profile, err := parseCSVProfile(req.URL.Query())
+		if err != nil {
+			writeProblem(w, req, http.StatusBadRequest, CodeInvalidQuery, err.Error())
+			return
 		}
-		log.Printf("%v", line[0])
-		id, err := dbGetNextID(a.Database)
+		dialect, err := parseCSVDialect(req.URL.Query(), req.Header.Get("Content-Type"), profile.Dialect)
 		if err != nil {
-			w.WriteHeader(500)
-			fmt.Fprintf(w, "Error getting next ID.")
-			log.Printf("error getting next id: %v", err.Error())
+			writeProblem(w, req, http.StatusBadRequest, CodeInvalidQuery, err.Error())
 			return
 		}
-		if line[0] == "FirstName" {
-			continue
+		fields, err := a.Store.Fields()
+		if err != nil {
+			writeInternalError(w, req, "Could not get custom fields.", err)
+			return
 		}
-		p := Person{
-			id:        id,
-			FirstName: line[0],
-			LastName:  line[1],
-			Email:     line[2],
-			Phone:     line[3],
+		if rows, err = csvRows(buf, dialect, profile.columns(fields)); err != nil {
+			writeProblem(w, req, http.StatusBadRequest, CodeInvalidCSV, "Could not read CSV: "+err.Error())
+			return
 		}
-		p.dbCreatePerson(a.Database)
-		i++
 	}
-	fmt.Fprintf(w, "Created %v entries.", i)
+	report, err := importPeople(a.Store, rows, opts)
+	if err != nil {
+		writeInternalError(w, req, "Error importing entries.", err)
+		return
+	}
+	if opts.Mode == ImportAtomic && report.Errors > 0 && !opts.DryRun {
+		writeProblemBody(w, req, Problem{
+			Status: http.StatusUnprocessableEntity,
+			Code:   CodeImportRejected,
+			Detail: fmt.Sprintf("%v of %v rows were rejected, nothing was imported.", len(report.Rejected), report.Rows),
+			Report: &report,
+		})
+		return
+	}
+	entries := make([]AuditEntry, len(report.created))
+	for i := range report.created {
+		entries[i] = a.newAuditEntry(req, AuditImport, report.created[i].ID, nil, &report.created[i])
+	}
+	a.record(entries...)
+	log.Printf("Imported %v of %v entries (dry run: %v)", report.Created, report.Rows, opts.DryRun)
+	j, err := json.Marshal(report)
+	if err != nil {
+		writeInternalError(w, req, "Could not format report.", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(j)
 }
 
-// ExportCSV exports a CSV formatted list of entries into the database
+// ExportCSV streams every entry in the database, in ID order, as CSV, vCard, JSON lines, jCard or LDIF.
+// The format is chosen with the format query parameter or the Accept header, see exportFormat.
+// For CSV the profile query parameter selects the layout of another application, see csvProfiles,
+// the default layout being followed by a column for each custom field,
+// and the delimiter, quote, encoding and bom query parameters select the dialect, see parseCSVDialect.
+// For vCard the version query parameter selects the version, and for LDIF baseDN sets the DN entries are under.
 func (a *App) ExportCSV(w http.ResponseWriter, req *http.Request) {
 	log.Printf("Got Export")
-	people, err := dbGetPeople(a.Database, 0, -1)
+	format, err := exportFormat(req.URL.Query(), req.Header.Get("Accept"))
 	if err != nil {
-		w.WriteHeader(500)
-		fmt.Fprintf(w, "Could not get people: %v", err.Error())
+		writeProblem(w, req, http.StatusNotAcceptable, CodeNotAcceptable, err.Error())
 		return
 	}
-	buf := new(bytes.Buffer)
-	cw := csv.NewWriter(buf)
-	headers := people[0].GetHeaders()
-	if err := cw.Write(headers); err != nil {
-		log.Printf("Failed to write headers: %v", err.Error())
-	}
-	for _, person := range people {
-		values := person.ToSlice()
-		if err := cw.Write(values); err != nil {
-			log.Printf("Failed to write values: %v", err.Error())
+	var fields []CustomField
+	if format == FormatCSV {
+		if fields, err = a.Store.Fields(); err != nil {
+			writeInternalError(w, req, "Could not get custom fields.", err)
+			return
 		}
 	}
-	cw.Flush()
-	fmt.Fprintf(w, "%+v", buf.String())
+	out := &countingWriter{w: w}
+	pw, contentType, err := newPeopleWriter(out, format, req.URL.Query(), fields)
+	if err != nil {
+		writeProblem(w, req, http.StatusBadRequest, CodeInvalidQuery, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	write := pw.Write
+	if format == FormatVCard || format == FormatJCard {
+		write = func(p *Person) error {
+			if err := a.attachPhoto(p); err != nil {
+				return err
+			}
+			return pw.Write(p)
+		}
+	}
+	err = a.Store.Walk(write)
+	if err == nil {
+		err = pw.Close()
+	}
+	if err == nil {
+		return
+	}
+	if out.n == 0 {
+		writeInternalError(w, req, "Could not export people.", err)
+		return
+	}
+	// The response has started, so the error can only be reported by aborting it.
+	log.Printf("[%v] export failed after %v bytes: %v", requestID(req), out.n, err.Error())
+	panic(http.ErrAbortHandler)
 }
@@ -0,0 +1,142 @@
+package app
+
+// Errors.go contains the RFC 7807 problem responses returned for every API error, and request ID tracking.
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// Error codes returned in the code member of a Problem. These are stable, clients may branch on them.
+const (
+	CodeInvalidID        = "invalid_id"
+	CodeInvalidJSON      = "invalid_json"
+	CodeInvalidQuery     = "invalid_query"
+	CodeInvalidCSV       = "invalid_csv"
+	CodeInvalidVCard     = "invalid_vcard"
+	CodeInvalidLDIF      = "invalid_ldif"
+	CodeNoData           = "no_data"
+	CodeTooLarge         = "too_large"
+	CodeInvalidXML       = "invalid_xml"
+	CodeValidationFailed = "validation_failed"
+	CodeImportRejected   = "import_rejected"
+	CodePersonNotFound   = "person_not_found"
+	CodeRouteNotFound    = "route_not_found"
+	CodeMethodNotAllowed = "method_not_allowed"
+	CodeNotAcceptable    = "not_acceptable"
+	CodeIDExists         = "id_exists"
+	CodeFieldNotFound    = "field_not_found"
+	CodeFieldExists      = "field_exists"
+	CodeGroupNotFound    = "group_not_found"
+	CodeGroupExists      = "group_exists"
+	CodeUnauthorized     = "unauthorized"
+	CodeInternal         = "internal_error"
+
+	CodeRelationshipNotFound = "relationship_not_found"
+	CodeRelationshipExists   = "relationship_exists"
+	CodePhotoNotFound        = "photo_not_found"
+	CodeUnsupportedMediaType = "unsupported_media_type"
+	CodeInvalidImage         = "invalid_image"
+	CodeAuditEntryNotFound   = "audit_entry_not_found"
+	CodeNoVersion            = "no_version"
+	CodeNoAuditLog           = "no_audit_log"
+)
+
+// problemTypeBase is prefixed to an error code to form a Problem's type URI.
+const problemTypeBase = "urn:didactic-tribble:problem:"
+
+// Problem is an RFC 7807 problem details response.
+type Problem struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Detail    string `json:"detail,omitempty"`
+	Instance  string `json:"instance,omitempty"`
+	Code      string `json:"code"`
+	RequestID string `json:"requestId,omitempty"`
+	// Errors lists the individual failures for validation problems.
+	Errors []FieldError `json:"errors,omitempty"`
+	// Report is the import report for rejected imports.
+	Report *ImportReport `json:"report,omitempty"`
+}
+
+// FieldError is a validation failure for a single field.
+type FieldError struct {
+	Field  string `json:"field"`
+	Reason string `json:"reason"`
+}
+
+// requestIDHeader is the header used to pass request IDs in and out of the service.
+const requestIDHeader = "X-Request-ID"
+
+type contextKey int
+
+const requestIDKey contextKey = iota
+
+// withRequestID tags each request with an ID, taken from the X-Request-ID header
+// if the client sent one, and echoes it in the response headers.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		id := req.Header.Get(requestIDHeader)
+		if id == "" || len(id) > 128 {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), requestIDKey, id)))
+	})
+}
+
+// newRequestID returns a random 16 character hex ID.
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		log.Printf("could not generate request ID: %v", err.Error())
+	}
+	return hex.EncodeToString(b)
+}
+
+// requestID returns the ID assigned to the request by withRequestID.
+func requestID(req *http.Request) string {
+	id, _ := req.Context().Value(requestIDKey).(string)
+	return id
+}
+
+// writeProblem writes an application/problem+json response.
+func writeProblem(w http.ResponseWriter, req *http.Request, status int, code, detail string) {
+	writeProblemBody(w, req, Problem{Status: status, Code: code, Detail: detail})
+}
+
+// writeProblemBody fills in the standard members of p and writes it as an application/problem+json response.
+func writeProblemBody(w http.ResponseWriter, req *http.Request, p Problem) {
+	p.Type = problemTypeBase + p.Code
+	p.Title = http.StatusText(p.Status)
+	p.Instance = req.URL.Path
+	p.RequestID = requestID(req)
+	j, err := json.Marshal(p)
+	if err != nil {
+		log.Printf("could not marshal problem: %v", err.Error())
+	}
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(p.Status)
+	w.Write(j)
+}
+
+// writeInternalError logs err and writes a 500 problem that does not leak its details.
+func writeInternalError(w http.ResponseWriter, req *http.Request, detail string, err error) {
+	log.Printf("[%v] %v: %v", requestID(req), detail, err.Error())
+	writeProblem(w, req, http.StatusInternalServerError, CodeInternal, detail)
+}
+
+// notFound handles requests that do not match any route.
+func notFound(w http.ResponseWriter, req *http.Request) {
+	writeProblem(w, req, http.StatusNotFound, CodeRouteNotFound, "No such endpoint.")
+}
+
+// methodNotAllowed handles requests to a route with an unsupported method.
+func methodNotAllowed(w http.ResponseWriter, req *http.Request) {
+	writeProblem(w, req, http.StatusMethodNotAllowed, CodeMethodNotAllowed, req.Method+" is not supported here.")
+}
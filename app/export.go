@@ -0,0 +1,142 @@
+package app
+
+// Export.go contains the writers that stream people to /export in each format.
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/url"
+)
+
+// peopleWriter writes people to an export one at a time.
+type peopleWriter interface {
+	Write(p *Person) error
+	// Close writes anything that follows the last person and flushes the output.
+	Close() error
+}
+
+// newPeopleWriter returns a writer for the format, configured by the query parameters,
+// and the Content-Type of its output. fields are the custom fields written as CSV columns.
+// Errors are caused by invalid query parameters.
+func newPeopleWriter(w io.Writer, format string, v url.Values, fields []CustomField) (peopleWriter, string, error) {
+	switch format {
+	case FormatVCard:
+		version, err := parseVCardVersion(v)
+		if err != nil {
+			return nil, "", err
+		}
+		return &vcardWriter{w: bufio.NewWriter(w), version: version}, formatContentTypes[format], nil
+	case FormatNDJSON:
+		bw := bufio.NewWriter(w)
+		return &ndjsonWriter{w: bw, enc: json.NewEncoder(bw)}, formatContentTypes[format], nil
+	case FormatJCard:
+		return &jcardWriter{w: bufio.NewWriter(w)}, formatContentTypes[format], nil
+	case FormatLDIF:
+		return &ldifWriter{w: bufio.NewWriter(w), baseDN: parseBaseDN(v)}, formatContentTypes[format], nil
+	}
+	profile, err := parseCSVProfile(v)
+	if err != nil {
+		return nil, "", err
+	}
+	dialect, err := parseCSVDialect(v, "", profile.Dialect)
+	if err != nil {
+		return nil, "", err
+	}
+	cw, err := newCSVWriter(w, dialect, profile.columns(fields))
+	if err != nil {
+		return nil, "", err
+	}
+	return cw, formatContentTypes[FormatCSV] + "; charset=" + dialect.charset(), nil
+}
+
+// vcardWriter writes a vCard for each person.
+type vcardWriter struct {
+	w       *bufio.Writer
+	version string
+}
+
+func (vw *vcardWriter) Write(p *Person) error {
+	return writeVCard(vw.w, p, vw.version)
+}
+
+func (vw *vcardWriter) Close() error {
+	return vw.w.Flush()
+}
+
+// ndjsonWriter writes each person as a line of JSON.
+type ndjsonWriter struct {
+	w   *bufio.Writer
+	enc *json.Encoder
+}
+
+func (nw *ndjsonWriter) Write(p *Person) error {
+	return nw.enc.Encode(p)
+}
+
+func (nw *ndjsonWriter) Close() error {
+	return nw.w.Flush()
+}
+
+// jcardWriter writes a JSON array of jCards.
+type jcardWriter struct {
+	w       *bufio.Writer
+	started bool
+}
+
+func (jw *jcardWriter) Write(p *Person) error {
+	sep := ","
+	if !jw.started {
+		sep, jw.started = "[", true
+	}
+	j, err := json.Marshal(jcardPerson(p))
+	if err != nil {
+		return err
+	}
+	jw.w.WriteString(sep)
+	_, err = jw.w.Write(j)
+	return err
+}
+
+func (jw *jcardWriter) Close() error {
+	if !jw.started {
+		jw.w.WriteString("[")
+	}
+	jw.w.WriteString("]")
+	return jw.w.Flush()
+}
+
+// ldifWriter writes an LDIF file of inetOrgPerson entries.
+type ldifWriter struct {
+	w       *bufio.Writer
+	baseDN  string
+	started bool
+}
+
+func (lw *ldifWriter) Write(p *Person) error {
+	if !lw.started {
+		lw.started = true
+		lw.w.WriteString("version: 1\n\n")
+	}
+	return writeLDIF(lw.w, p, lw.baseDN)
+}
+
+func (lw *ldifWriter) Close() error {
+	if !lw.started {
+		lw.w.WriteString("version: 1\n")
+	}
+	return lw.w.Flush()
+}
+
+// countingWriter counts the bytes written through it,
+// so that a handler can tell whether it has started its response.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(b []byte) (int, error) {
+	n, err := cw.w.Write(b)
+	cw.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,509 @@
+package app
+
+// Fields.go contains the custom fields administrators define for people, how their values are
+// validated, filtered and mapped to CSV columns, how they are stored, and the /fields endpoints.
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+// Types of custom fields.
+const (
+	FieldString = "string"
+	FieldNumber = "number"
+	FieldDate   = "date"
+	FieldEnum   = "enum"
+	FieldURL    = "url"
+)
+
+// fieldTypes are the types a custom field may have.
+var fieldTypes = []string{FieldString, FieldNumber, FieldDate, FieldEnum, FieldURL}
+
+// CustomField is the definition of a custom field, whose values people keep in Person.Custom.
+// The rules that do not apply to a field's type must be left empty.
+type CustomField struct {
+	// Name is the key of the field's values and the header of its CSV column.
+	Name string `json:"Name"`
+	Type string `json:"Type"`
+	// Required fields must have a value.
+	Required bool `json:"Required"`
+	// Options are the values allowed for an enum.
+	Options []string `json:"Options,omitempty"`
+	// Pattern is a regular expression string values must match in full.
+	Pattern string `json:"Pattern,omitempty"`
+	// MaxLength is the most characters a string value may have, 0 for no limit.
+	MaxLength int `json:"MaxLength,omitempty"`
+	// Min and Max are the inclusive bounds of number and date values.
+	Min string `json:"Min,omitempty"`
+	Max string `json:"Max,omitempty"`
+}
+
+// validFieldName matches the names of custom fields.
+var validFieldName = regexp.MustCompile(`^[a-z][a-z0-9_]{0,49}$`)
+
+// validate checks a custom field's definition, returning a FieldError for each invalid rule.
+func (f *CustomField) validate() []FieldError {
+	errs := []FieldError{}
+	if !validFieldName.MatchString(f.Name) {
+		errs = append(errs, FieldError{Field: "Name",
+			Reason: "must start with a letter and hold only lower-case letters, digits and underscores, at most 50 characters"})
+	} else if c := personColumn(normaliseHeader(f.Name)); c != nil {
+		errs = append(errs, FieldError{Field: "Name", Reason: "is already used by the " + c.Header + " column"})
+	}
+	if !validType(f.Type, fieldTypes) || f.Type == "" {
+		errs = append(errs, FieldError{Field: "Type", Reason: "must be one of " + strings.Join(fieldTypes, ", ")})
+	}
+	only := func(field string, set bool, types ...string) bool {
+		if set && !validType(f.Type, types) {
+			errs = append(errs, FieldError{Field: field, Reason: "only applies to " + strings.Join(types, " and ") + " fields"})
+			return false
+		}
+		return set
+	}
+	if f.Type == FieldEnum && len(f.Options) == 0 {
+		errs = append(errs, FieldError{Field: "Options", Reason: "an enum needs at least one option"})
+	}
+	if only("Options", len(f.Options) > 0, FieldEnum) {
+		seen := map[string]bool{}
+		for i, o := range f.Options {
+			field := fmt.Sprintf("Options[%v]", i)
+			switch {
+			case strings.TrimSpace(o) == "":
+				errs = append(errs, FieldError{Field: field, Reason: "must not be empty"})
+			case seen[o]:
+				errs = append(errs, FieldError{Field: field, Reason: "is a duplicate"})
+			}
+			seen[o] = true
+		}
+	}
+	if only("Pattern", f.Pattern != "", FieldString) {
+		if _, err := regexp.Compile(f.Pattern); err != nil {
+			errs = append(errs, FieldError{Field: "Pattern", Reason: "not a valid regular expression"})
+		}
+	}
+	if f.MaxLength < 0 {
+		errs = append(errs, FieldError{Field: "MaxLength", Reason: "must not be negative"})
+	} else {
+		only("MaxLength", f.MaxLength > 0, FieldString)
+	}
+	bounds := f.Type == FieldNumber || f.Type == FieldDate
+	for _, b := range []struct{ field, value string }{{"Min", f.Min}, {"Max", f.Max}} {
+		if only(b.field, b.value != "", FieldNumber, FieldDate) {
+			if _, ok := f.parse(b.value); !ok {
+				errs = append(errs, FieldError{Field: b.field, Reason: "not a valid " + f.Type})
+				bounds = false
+			}
+		}
+	}
+	if bounds && f.Min != "" && f.Max != "" && f.compare(f.Min, f.Max) > 0 {
+		errs = append(errs, FieldError{Field: "Max", Reason: "must not be less than Min"})
+	}
+	return errs
+}
+
+// parse returns the canonical form of a number or date value: numbers without exponents or
+// trailing zeros, and dates as YYYY-MM-DD. ok is false if the value is not valid for the type.
+func (f *CustomField) parse(v string) (canonical string, ok bool) {
+	switch f.Type {
+	case FieldNumber:
+		n, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil || math.IsInf(n, 0) || math.IsNaN(n) {
+			return "", false
+		}
+		return strconv.FormatFloat(n, 'f', -1, 64), true
+	case FieldDate:
+		d, err := time.Parse("2006-01-02", strings.TrimSpace(v))
+		if err != nil {
+			return "", false
+		}
+		return d.Format("2006-01-02"), true
+	}
+	return v, true
+}
+
+// compare compares two canonical values of a number or date field.
+func (f *CustomField) compare(a, b string) int {
+	if f.Type == FieldNumber {
+		x, _ := strconv.ParseFloat(a, 64)
+		y, _ := strconv.ParseFloat(b, 64)
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+		return 0
+	}
+	return strings.Compare(a, b)
+}
+
+// check validates a non-empty value of the field, returning its canonical form,
+// or the reason it is invalid.
+func (f *CustomField) check(v string) (canonical, reason string) {
+	canonical, ok := f.parse(v)
+	if !ok {
+		return "", "not a valid " + f.Type
+	}
+	switch f.Type {
+	case FieldString:
+		if f.MaxLength > 0 && utf8.RuneCountInString(v) > f.MaxLength {
+			return "", fmt.Sprintf("must be at most %v characters", f.MaxLength)
+		}
+		if f.Pattern != "" {
+			if re, err := regexp.Compile(`^(?:` + f.Pattern + `)$`); err != nil || !re.MatchString(v) {
+				return "", "does not match the pattern " + f.Pattern
+			}
+		}
+	case FieldNumber, FieldDate:
+		if f.Min != "" && f.compare(canonical, f.Min) < 0 {
+			return "", "must not be less than " + f.Min
+		}
+		if f.Max != "" && f.compare(canonical, f.Max) > 0 {
+			return "", "must not be greater than " + f.Max
+		}
+	case FieldEnum:
+		if !validType(v, f.Options) {
+			return "", "must be one of " + strings.Join(f.Options, ", ")
+		}
+	case FieldURL:
+		if !validWebURL(v) {
+			return "", "not an absolute http or https URL"
+		}
+	}
+	return canonical, ""
+}
+
+// validateCustom checks a person's custom values against the field definitions,
+// returning a FieldError for each invalid or unknown one.
+// Valid values are replaced by their canonical form, and empty values are removed.
+func (p *Person) validateCustom(fields []CustomField) []FieldError {
+	errs := []FieldError{}
+	defined := map[string]bool{}
+	for i := range fields {
+		f := &fields[i]
+		defined[f.Name] = true
+		v := p.Custom[f.Name]
+		if v == "" {
+			delete(p.Custom, f.Name)
+			if f.Required {
+				errs = append(errs, FieldError{Field: "Custom." + f.Name, Reason: "is required"})
+			}
+			continue
+		}
+		canonical, reason := f.check(v)
+		if reason != "" {
+			errs = append(errs, FieldError{Field: "Custom." + f.Name, Reason: reason})
+			continue
+		}
+		p.Custom[f.Name] = canonical
+	}
+	unknown := []string{}
+	for name := range p.Custom {
+		if !defined[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	sort.Strings(unknown)
+	for _, name := range unknown {
+		errs = append(errs, FieldError{Field: "Custom." + name, Reason: "no such custom field"})
+	}
+	if len(p.Custom) == 0 {
+		p.Custom = nil
+	}
+	return errs
+}
+
+// checkCustom checks the custom field filters of a query against the field definitions,
+// replacing each value with its canonical form so it compares equal to stored values.
+func (q *PeopleQuery) checkCustom(fields []CustomField) error {
+	byName := map[string]*CustomField{}
+	for i := range fields {
+		byName[fields[i].Name] = &fields[i]
+	}
+	for name, v := range q.Custom {
+		f, ok := byName[name]
+		if !ok {
+			return fmt.Errorf("no such custom field %q", name)
+		}
+		canonical, ok := f.parse(v)
+		if !ok {
+			return fmt.Errorf("custom.%v must be a valid %v", name, f.Type)
+		}
+		q.Custom[name] = canonical
+	}
+	return nil
+}
+
+// appendCustomColumns returns columns followed by an optional column for each custom field,
+// headed by its name.
+func appendCustomColumns(columns []csvColumn, fields []CustomField) []csvColumn {
+	columns = columns[:len(columns):len(columns)]
+	for _, f := range fields {
+		name := f.Name
+		columns = append(columns, csvColumn{
+			Header:   name,
+			Names:    []string{normaliseHeader(name)},
+			Optional: true,
+			get:      func(p *Person) string { return p.Custom[name] },
+			set: func(p *Person, v string) {
+				if p.Custom == nil {
+					p.Custom = map[string]string{}
+				}
+				p.Custom[name] = v
+			},
+		})
+	}
+	return columns
+}
+
+// personColumn returns the default CSV column recognised by a normalised header name, or nil.
+func personColumn(name string) *csvColumn {
+	for i := range personColumns {
+		for _, n := range personColumns[i].Names {
+			if n == name {
+				return &personColumns[i]
+			}
+		}
+	}
+	return nil
+}
+
+// dbReadCustomFields returns the custom fields in the database, in name order.
+func dbReadCustomFields(db *database) ([]CustomField, error) {
+	rows, err := db.Query(sqlReadCustomFields)
+	if err != nil {
+		return nil, fmt.Errorf("error getting custom fields: %v", err.Error())
+	}
+	defer rows.Close()
+	fields := []CustomField{}
+	for rows.Next() {
+		f, options := CustomField{}, ""
+		if err := rows.Scan(&f.Name, &f.Type, &f.Required, &options, &f.Pattern, &f.MaxLength, &f.Min, &f.Max); err != nil {
+			return nil, fmt.Errorf("error getting row: %v", err.Error())
+		}
+		if err := json.Unmarshal([]byte(options), &f.Options); err != nil {
+			return nil, fmt.Errorf("invalid options of custom field %v: %v", f.Name, err.Error())
+		}
+		fields = append(fields, f)
+	}
+	return fields, rows.Err()
+}
+
+// dbValues returns a custom field's columns other than its name, in the order they are written.
+func (f *CustomField) dbValues() []interface{} {
+	options, _ := json.Marshal(f.Options)
+	return []interface{}{f.Type, f.Required, string(options), f.Pattern, f.MaxLength, f.Min, f.Max}
+}
+
+// dbCreateCustom inserts the custom values of p inside tx.
+func (p *Person) dbCreateCustom(db *database, tx *sql.Tx) error {
+	for name, v := range p.Custom {
+		if _, err := tx.Exec(db.rebind(sqlCreateCustom), p.ID, name, v); err != nil {
+			return fmt.Errorf("could not write custom field %v: %v", name, err.Error())
+		}
+	}
+	return nil
+}
+
+// customFilter returns the SQL condition matching people whose custom field has a value,
+// calling bind to add each argument and get its placeholder.
+func customFilter(name, value string, bind func(arg interface{}) string) string {
+	return fmt.Sprintf(sqlCustomFilter, bind(name), bind(value))
+}
+
+// requireAdmin checks the request's bearer token against the App's AdminToken, if it has one.
+// A problem is written and ok is false if the token is missing or wrong.
+func (a *App) requireAdmin(w http.ResponseWriter, req *http.Request) (ok bool) {
+	if a.AdminToken == "" {
+		return true
+	}
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(a.AdminToken)) == 1 {
+		return true
+	}
+	w.Header().Set("WWW-Authenticate", `Bearer realm="fields"`)
+	writeProblem(w, req, http.StatusUnauthorized, CodeUnauthorized, "An admin token is required.")
+	return false
+}
+
+// fieldURL returns the path of a custom field's resource.
+func fieldURL(name string) string {
+	return "/fields/" + name
+}
+
+// writeJSON writes v as JSON with the given status code.
+func writeJSON(w http.ResponseWriter, req *http.Request, status int, v interface{}) {
+	j, err := json.Marshal(v)
+	if err != nil {
+		writeInternalError(w, req, "Could not format response.", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(j)
+}
+
+// decodeField unmarshals and validates a JSON custom field from the request body into f.
+// A problem is written and ok is false if the body is not valid JSON or the field is invalid.
+func decodeField(w http.ResponseWriter, req *http.Request, f *CustomField) (ok bool) {
+	buf := new(bytes.Buffer)
+	buf.ReadFrom(req.Body)
+	if err := json.Unmarshal(buf.Bytes(), f); err != nil {
+		log.Printf("error unmarshalling data: %v", err.Error())
+		writeProblem(w, req, http.StatusBadRequest, CodeInvalidJSON, "Invalid input data: "+err.Error())
+		return false
+	}
+	if errs := f.validate(); len(errs) > 0 {
+		writeProblemBody(w, req, Problem{
+			Status: http.StatusUnprocessableEntity,
+			Code:   CodeValidationFailed,
+			Detail: "The custom field is invalid.",
+			Errors: errs,
+		})
+		return false
+	}
+	return true
+}
+
+// writeFieldStoreError writes the problem matching an error returned by the PersonStore's field methods.
+func writeFieldStoreError(w http.ResponseWriter, req *http.Request, err error) {
+	switch err {
+	case ErrNotFound:
+		writeProblem(w, req, http.StatusNotFound, CodeFieldNotFound, "Custom field not found.")
+	case ErrExists:
+		writeProblem(w, req, http.StatusConflict, CodeFieldExists, "A custom field with this name already exists.")
+	default:
+		writeInternalError(w, req, "Could not access the custom fields.", err)
+	}
+}
+
+// findField returns the custom field with the name in the {name} route variable.
+// A problem is written and ok is false if there is no such field.
+func (a *App) findField(w http.ResponseWriter, req *http.Request) (f CustomField, ok bool) {
+	fields, err := a.Store.Fields()
+	if err != nil {
+		writeFieldStoreError(w, req, err)
+		return f, false
+	}
+	for _, f := range fields {
+		if f.Name == mux.Vars(req)["name"] {
+			return f, true
+		}
+	}
+	writeFieldStoreError(w, req, ErrNotFound)
+	return f, false
+}
+
+// ReadFields returns every custom field, in name order.
+func (a *App) ReadFields(w http.ResponseWriter, req *http.Request) {
+	fields, err := a.Store.Fields()
+	if err != nil {
+		writeFieldStoreError(w, req, err)
+		return
+	}
+	writeJSON(w, req, http.StatusOK, fields)
+}
+
+// ReadField returns the custom field named in the URL.
+func (a *App) ReadField(w http.ResponseWriter, req *http.Request) {
+	if f, ok := a.findField(w, req); ok {
+		writeJSON(w, req, http.StatusOK, f)
+	}
+}
+
+// CreateField defines a new custom field, and returns it with a Location header pointing at it.
+func (a *App) CreateField(w http.ResponseWriter, req *http.Request) {
+	log.Printf("Got POST field")
+	f := CustomField{}
+	if !a.requireAdmin(w, req) || !decodeField(w, req, &f) {
+		return
+	}
+	if err := a.Store.CreateField(&f); err != nil {
+		writeFieldStoreError(w, req, err)
+		return
+	}
+	w.Header().Set("Location", fieldURL(f.Name))
+	writeJSON(w, req, http.StatusCreated, f)
+}
+
+// UpdateField replaces the definition of the custom field named in the URL.
+// Its type cannot be changed, and people's existing values are not checked against the new rules.
+func (a *App) UpdateField(w http.ResponseWriter, req *http.Request) {
+	log.Printf("Got PUT field %v", mux.Vars(req)["name"])
+	if !a.requireAdmin(w, req) {
+		return
+	}
+	prev, ok := a.findField(w, req)
+	if !ok {
+		return
+	}
+	f := CustomField{Name: prev.Name}
+	if !decodeField(w, req, &f) {
+		return
+	}
+	errs := []FieldError{}
+	if f.Name != prev.Name {
+		errs = append(errs, FieldError{Field: "Name", Reason: "cannot be changed"})
+	}
+	if f.Type != prev.Type {
+		errs = append(errs, FieldError{Field: "Type", Reason: "cannot be changed, delete the field and create it again"})
+	}
+	if len(errs) > 0 {
+		writeProblemBody(w, req, Problem{
+			Status: http.StatusUnprocessableEntity,
+			Code:   CodeValidationFailed,
+			Detail: "The custom field is invalid.",
+			Errors: errs,
+		})
+		return
+	}
+	if err := a.Store.UpdateField(&f); err != nil {
+		writeFieldStoreError(w, req, err)
+		return
+	}
+	writeJSON(w, req, http.StatusOK, f)
+}
+
+// DeleteField removes the custom field named in the URL, and every person's value for it.
+func (a *App) DeleteField(w http.ResponseWriter, req *http.Request) {
+	log.Printf("Got DELETE field %v", mux.Vars(req)["name"])
+	if !a.requireAdmin(w, req) {
+		return
+	}
+	name := mux.Vars(req)["name"]
+	// Deleting the field changes everyone with a value for it, so they are read first for the audit log.
+	holders := []Person{}
+	if a.Audit != nil {
+		err := a.Store.Walk(func(p *Person) error {
+			if _, ok := p.Custom[name]; ok {
+				holders = append(holders, p.clone())
+			}
+			return nil
+		})
+		if err != nil {
+			writeInternalError(w, req, "Could not read the people with the field.", err)
+			return
+		}
+	}
+	if err := a.Store.DeleteField(name); err != nil {
+		writeFieldStoreError(w, req, err)
+		return
+	}
+	a.auditUpdates(req, holders)
+	w.WriteHeader(http.StatusNoContent)
+}
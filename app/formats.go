@@ -0,0 +1,143 @@
+package app
+
+// Formats.go contains the selection of the file format read by /import and written by /export.
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// File formats, chosen with the format query parameter on /import and /export.
+// Only CSV, vCard and LDIF can be imported.
+const (
+	FormatCSV    = "csv"
+	FormatVCard  = "vcard"
+	FormatNDJSON = "ndjson"
+	FormatJCard  = "jcard"
+	FormatLDIF   = "ldif"
+)
+
+// errNotAcceptable is returned by exportFormat if the format query parameter names none of the formats.
+var errNotAcceptable = fmt.Errorf("format must be one of %v, %v, %v, %v or %v", FormatCSV, FormatVCard, FormatNDJSON, FormatJCard, FormatLDIF)
+
+// formatMediaTypes maps the media types of uploaded files to their format.
+var formatMediaTypes = map[string]string{
+	"text/csv":          FormatCSV,
+	"text/vcard":        FormatVCard,
+	"text/x-vcard":      FormatVCard,
+	"text/directory":    FormatVCard,
+	"application/csv":   FormatCSV,
+	"application/x-csv": FormatCSV,
+	"text/x-ldif":       FormatLDIF,
+	"text/ldif":         FormatLDIF,
+	"application/ldif":  FormatLDIF,
+}
+
+// exportMediaTypes maps the media types in an Accept header to the format written for them.
+var exportMediaTypes = map[string]string{
+	"text/csv":               FormatCSV,
+	"text/vcard":             FormatVCard,
+	"text/x-vcard":           FormatVCard,
+	"application/x-ndjson":   FormatNDJSON,
+	"application/ndjson":     FormatNDJSON,
+	"application/jsonl":      FormatNDJSON,
+	"application/vcard+json": FormatJCard,
+	"text/x-ldif":            FormatLDIF,
+	"text/ldif":              FormatLDIF,
+	"application/ldif":       FormatLDIF,
+	"text/*":                 FormatCSV,
+	"*/*":                    FormatCSV,
+}
+
+// formatContentTypes are the Content-Types written for each format.
+// The charset of CSV depends on its dialect.
+var formatContentTypes = map[string]string{
+	FormatCSV:    "text/csv",
+	FormatVCard:  "text/vcard; charset=utf-8",
+	FormatNDJSON: "application/x-ndjson",
+	FormatJCard:  "application/vcard+json",
+	FormatLDIF:   "text/x-ldif",
+}
+
+// importFormat returns the format of an uploaded file: the format query parameter if given,
+// otherwise the format of its Content-Type, otherwise the format its first line looks like, see sniffFormat.
+func importFormat(v url.Values, contentType string, data []byte) (string, error) {
+	if f := v.Get("format"); f != "" {
+		if f != FormatCSV && f != FormatVCard && f != FormatLDIF {
+			return "", fmt.Errorf("format must be %v, %v or %v", FormatCSV, FormatVCard, FormatLDIF)
+		}
+		return f, nil
+	}
+	if mt, _, err := mime.ParseMediaType(contentType); err == nil {
+		if f, ok := formatMediaTypes[mt]; ok {
+			return f, nil
+		}
+	}
+	return sniffFormat(data), nil
+}
+
+// sniffFormat returns vCard if the first line of data is BEGIN:VCARD,
+// LDIF if it is an LDIF version or dn line, ignoring comments, and CSV otherwise.
+func sniffFormat(data []byte) string {
+	data = bytes.TrimPrefix(data, bomUTF8)
+	for len(data) > 0 {
+		line := data
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			line, data = data[:i], data[i+1:]
+		} else {
+			data = nil
+		}
+		line = bytes.TrimSpace(line)
+		upper := strings.ToUpper(string(line))
+		switch {
+		case len(line) == 0 || line[0] == '#':
+			continue
+		case upper == "BEGIN:VCARD":
+			return FormatVCard
+		case strings.HasPrefix(upper, "VERSION:") || strings.HasPrefix(upper, "DN:"):
+			return FormatLDIF
+		}
+		return FormatCSV
+	}
+	return FormatCSV
+}
+
+// exportFormat returns the format query parameter if given, otherwise the format
+// of the media type the Accept header prefers, defaulting to CSV.
+// Media types that are not export formats are ignored, as clients often send Accept: application/json
+// whatever they ask for. errNotAcceptable is returned if the format query parameter is not a format.
+func exportFormat(v url.Values, accept string) (string, error) {
+	if f := v.Get("format"); f != "" {
+		if _, ok := formatContentTypes[f]; !ok {
+			return "", errNotAcceptable
+		}
+		return f, nil
+	}
+	if strings.TrimSpace(accept) == "" {
+		return FormatCSV, nil
+	}
+	best, bestQ := "", 0.0
+	for _, r := range strings.Split(accept, ",") {
+		mt, params, err := mime.ParseMediaType(r)
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if s, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(s, 64); err != nil {
+				continue
+			}
+		}
+		if f, ok := exportMediaTypes[mt]; ok && q > bestQ {
+			best, bestQ = f, q
+		}
+	}
+	if best == "" {
+		return FormatCSV, nil
+	}
+	return best, nil
+}
@@ -0,0 +1,372 @@
+package app
+
+// Groups.go contains the groups, or tags, people are organised into, how memberships are stored,
+// and the /groups endpoints.
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+// maxGroupName is the most characters a group name may have.
+const maxGroupName = 100
+
+// Group is a named set of people. Names are unique, ignoring case.
+type Group struct {
+	ID          int    `json:"ID"`
+	Name        string `json:"Name"`
+	Description string `json:"Description"`
+	// Members is the number of people in the group. It is ignored in request bodies.
+	Members int `json:"Members"`
+}
+
+// groupNameReason returns why name is not a valid group name, or "" if it is.
+// Names are listed with commas in CSV files, so they cannot contain them.
+func groupNameReason(name string) string {
+	switch {
+	case strings.TrimSpace(name) == "":
+		return "must not be empty"
+	case strings.Contains(name, ","):
+		return "must not contain commas"
+	case utf8.RuneCountInString(name) > maxGroupName:
+		return fmt.Sprintf("must be at most %v characters", maxGroupName)
+	}
+	return ""
+}
+
+// validateGroups checks the names of the groups a person is in.
+func (p *Person) validateGroups() []FieldError {
+	errs := []FieldError{}
+	for i, g := range p.Groups {
+		if reason := groupNameReason(g); reason != "" {
+			errs = append(errs, FieldError{Field: fmt.Sprintf("Groups[%v]", i), Reason: reason})
+		}
+	}
+	return errs
+}
+
+// uniqueGroups returns the trimmed group names, without blanks or names repeated in another case,
+// or nil if there are none.
+func uniqueGroups(names []string) []string {
+	unique := []string{}
+	seen := map[string]bool{}
+	for _, n := range names {
+		n = strings.TrimSpace(n)
+		if n == "" || seen[strings.ToLower(n)] {
+			continue
+		}
+		seen[strings.ToLower(n)] = true
+		unique = append(unique, n)
+	}
+	if len(unique) == 0 {
+		return nil
+	}
+	return unique
+}
+
+// inGroup reports whether p is in the named group, ignoring case.
+func (p *Person) inGroup(name string) bool {
+	for _, g := range p.Groups {
+		if strings.EqualFold(g, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// dbCreateGroups adds p to its groups inside tx, creating any that do not exist,
+// and replaces p.Groups with the groups' names in name order.
+func (p *Person) dbCreateGroups(db *database, tx *sql.Tx) error {
+	names := []string{}
+	for _, name := range p.Groups {
+		g := Group{Name: name}
+		err := tx.QueryRow(db.rebind(sqlFindGroup), name).Scan(&g.ID, &g.Name)
+		if err == sql.ErrNoRows {
+			err = g.dbCreateGroup(db, tx)
+		}
+		if err != nil {
+			return fmt.Errorf("could not find group %v: %v", name, err.Error())
+		}
+		if _, err := tx.Exec(db.rebind(sqlCreateMembership), p.ID, g.ID); err != nil {
+			return fmt.Errorf("could not add to group %v: %v", name, err.Error())
+		}
+		names = append(names, g.Name)
+	}
+	sort.Strings(names)
+	p.Groups = uniqueGroups(names)
+	return nil
+}
+
+// dbCreateGroup inserts g with the next free ID inside tx, and sets g.ID.
+func (g *Group) dbCreateGroup(db *database, tx *sql.Tx) error {
+	if db.lockIDs != "" {
+		if _, err := tx.Exec(db.lockIDs); err != nil {
+			return fmt.Errorf("could not lock IDs: %v", err.Error())
+		}
+	}
+	if err := tx.QueryRow(db.rebind(sqlCreateGroup), g.Name, g.Description).Scan(&g.ID); err != nil {
+		if isUniqueViolation(err) {
+			return ErrExists
+		}
+		return err
+	}
+	return nil
+}
+
+// dbReadGroups returns the groups selected by query, with their member counts.
+func dbReadGroups(db *database, query string, args ...interface{}) ([]Group, error) {
+	rows, err := db.Query(db.rebind(query), args...)
+	if err != nil {
+		return nil, fmt.Errorf("error getting groups: %v", err.Error())
+	}
+	defer rows.Close()
+	groups := []Group{}
+	for rows.Next() {
+		g := Group{}
+		if err := rows.Scan(&g.ID, &g.Name, &g.Description, &g.Members); err != nil {
+			return nil, fmt.Errorf("error getting row: %v", err.Error())
+		}
+		groups = append(groups, g)
+	}
+	return groups, rows.Err()
+}
+
+// groupFilter returns the SQL condition matching people in the named group,
+// calling bind to add the argument and get its placeholder.
+func groupFilter(name string, bind func(arg interface{}) string) string {
+	return fmt.Sprintf(sqlGroupFilter, bind(name))
+}
+
+// groupID parses the {id} route variable of a group.
+// A problem is written and ok is false if the ID is invalid.
+func groupID(w http.ResponseWriter, req *http.Request) (id int, ok bool) {
+	id, err := strconv.Atoi(mux.Vars(req)["id"])
+	if err != nil {
+		writeProblem(w, req, http.StatusBadRequest, CodeInvalidID, "Invalid ID.")
+		return 0, false
+	}
+	return id, true
+}
+
+// groupURL returns the path of a group's resource.
+func groupURL(id int) string {
+	return fmt.Sprintf("/groups/%v", id)
+}
+
+// decodeGroup unmarshals and validates a JSON group from the request body into g.
+// A problem is written and ok is false if the body is not valid JSON or the group is invalid.
+func decodeGroup(w http.ResponseWriter, req *http.Request, g *Group) (ok bool) {
+	buf := new(bytes.Buffer)
+	buf.ReadFrom(req.Body)
+	if err := json.Unmarshal(buf.Bytes(), g); err != nil {
+		log.Printf("error unmarshalling data: %v", err.Error())
+		writeProblem(w, req, http.StatusBadRequest, CodeInvalidJSON, "Invalid input data: "+err.Error())
+		return false
+	}
+	g.Name = strings.TrimSpace(g.Name)
+	if reason := groupNameReason(g.Name); reason != "" {
+		writeProblemBody(w, req, Problem{
+			Status: http.StatusUnprocessableEntity,
+			Code:   CodeValidationFailed,
+			Detail: "The group is invalid.",
+			Errors: []FieldError{{Field: "Name", Reason: reason}},
+		})
+		return false
+	}
+	return true
+}
+
+// writeGroupStoreError writes the problem matching an error returned by the PersonStore's group methods.
+func writeGroupStoreError(w http.ResponseWriter, req *http.Request, err error) {
+	switch err {
+	case ErrNotFound:
+		writeProblem(w, req, http.StatusNotFound, CodeGroupNotFound, "Group not found.")
+	case ErrExists:
+		writeProblem(w, req, http.StatusConflict, CodeGroupExists, "A group with this name already exists.")
+	default:
+		writeInternalError(w, req, "Could not access the groups.", err)
+	}
+}
+
+// ReadGroups returns every group, in name order.
+func (a *App) ReadGroups(w http.ResponseWriter, req *http.Request) {
+	groups, err := a.Store.Groups()
+	if err != nil {
+		writeGroupStoreError(w, req, err)
+		return
+	}
+	writeJSON(w, req, http.StatusOK, groups)
+}
+
+// ReadGroup returns the group with the ID in the URL.
+func (a *App) ReadGroup(w http.ResponseWriter, req *http.Request) {
+	id, ok := groupID(w, req)
+	if !ok {
+		return
+	}
+	g, err := a.Store.GetGroup(id)
+	if err != nil {
+		writeGroupStoreError(w, req, err)
+		return
+	}
+	writeJSON(w, req, http.StatusOK, g)
+}
+
+// CreateGroup creates a group with a new ID, and returns it with a Location header pointing at it.
+func (a *App) CreateGroup(w http.ResponseWriter, req *http.Request) {
+	log.Printf("Got POST group")
+	g := Group{}
+	if !decodeGroup(w, req, &g) {
+		return
+	}
+	g.ID, g.Members = 0, 0
+	if err := a.Store.CreateGroup(&g); err != nil {
+		writeGroupStoreError(w, req, err)
+		return
+	}
+	w.Header().Set("Location", groupURL(g.ID))
+	writeJSON(w, req, http.StatusCreated, g)
+}
+
+// UpdateGroup renames the group with the ID in the URL, or changes its description.
+func (a *App) UpdateGroup(w http.ResponseWriter, req *http.Request) {
+	log.Printf("Got PUT group %v", mux.Vars(req)["id"])
+	id, ok := groupID(w, req)
+	if !ok {
+		return
+	}
+	g := Group{}
+	if !decodeGroup(w, req, &g) {
+		return
+	}
+	g.ID = id
+	members, ok := a.groupMembers(w, req, id)
+	if !ok {
+		return
+	}
+	if err := a.Store.UpdateGroup(&g); err != nil {
+		writeGroupStoreError(w, req, err)
+		return
+	}
+	a.auditUpdates(req, members)
+	a.ReadGroup(w, req)
+}
+
+// DeleteGroup deletes the group with the ID in the URL. Its members are not deleted.
+func (a *App) DeleteGroup(w http.ResponseWriter, req *http.Request) {
+	log.Printf("Got DELETE group %v", mux.Vars(req)["id"])
+	id, ok := groupID(w, req)
+	if !ok {
+		return
+	}
+	members, ok := a.groupMembers(w, req, id)
+	if !ok {
+		return
+	}
+	if err := a.Store.DeleteGroup(id); err != nil {
+		writeGroupStoreError(w, req, err)
+		return
+	}
+	a.auditUpdates(req, members)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// groupMembers returns the people in the group with the given ID, whose Groups renaming or deleting it changes,
+// for the audit log. A problem is written and ok is false if the group cannot be read.
+func (a *App) groupMembers(w http.ResponseWriter, req *http.Request, id int) (members []Person, ok bool) {
+	if a.Audit == nil {
+		return nil, true
+	}
+	g, err := a.Store.GetGroup(id)
+	if err == nil {
+		members, _, err = a.Store.Query(PeopleQuery{Limit: -1, Group: g.Name})
+	}
+	if err != nil {
+		writeGroupStoreError(w, req, err)
+		return nil, false
+	}
+	return members, true
+}
+
+// ReadGroupPeople lists the people in the group with the ID in the URL.
+// It accepts the same query parameters as /people.
+func (a *App) ReadGroupPeople(w http.ResponseWriter, req *http.Request) {
+	id, ok := groupID(w, req)
+	if !ok {
+		return
+	}
+	g, err := a.Store.GetGroup(id)
+	if err != nil {
+		writeGroupStoreError(w, req, err)
+		return
+	}
+	q, ok := a.peopleQuery(w, req)
+	if !ok {
+		return
+	}
+	q.Group = g.Name
+	a.writePeople(w, req, q)
+}
+
+// AddGroupMember adds the person with the ID in the URL to the group, and returns the person.
+func (a *App) AddGroupMember(w http.ResponseWriter, req *http.Request) {
+	a.updateMembership(w, req, func(p *Person, g *Group) {
+		p.Groups = append(p.Groups, g.Name)
+	})
+}
+
+// RemoveGroupMember removes the person with the ID in the URL from the group, and returns the person.
+func (a *App) RemoveGroupMember(w http.ResponseWriter, req *http.Request) {
+	a.updateMembership(w, req, func(p *Person, g *Group) {
+		groups := []string{}
+		for _, name := range p.Groups {
+			if !strings.EqualFold(name, g.Name) {
+				groups = append(groups, name)
+			}
+		}
+		p.Groups = groups
+	})
+}
+
+// updateMembership changes the groups of the person in the {person} route variable with change,
+// and saves and returns them.
+func (a *App) updateMembership(w http.ResponseWriter, req *http.Request, change func(p *Person, g *Group)) {
+	log.Printf("Got %v %v", req.Method, req.URL.Path)
+	id, ok := groupID(w, req)
+	if !ok {
+		return
+	}
+	personID, err := strconv.Atoi(mux.Vars(req)["person"])
+	if err != nil {
+		writeProblem(w, req, http.StatusBadRequest, CodeInvalidID, "Invalid ID.")
+		return
+	}
+	g, err := a.Store.GetGroup(id)
+	if err != nil {
+		writeGroupStoreError(w, req, err)
+		return
+	}
+	p, err := a.Store.Get(personID)
+	if err != nil {
+		writeStoreError(w, req, err)
+		return
+	}
+	before := p.clone()
+	change(&p, &g)
+	if err := a.Store.Update(&p); err != nil {
+		writeStoreError(w, req, err)
+		return
+	}
+	a.audit(req, AuditUpdate, personID, &before, &p)
+	writePerson(w, req, http.StatusOK, &p)
+}
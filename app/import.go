@@ -0,0 +1,177 @@
+package app
+
+// Import.go contains the bulk import of people, shared by every import format.
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Import modes, chosen with the mode query parameter on /import.
+const (
+	// ImportAtomic imports nothing if any row is rejected.
+	ImportAtomic = "atomic"
+	// ImportBestEffort imports every valid row and reports the rejected ones.
+	ImportBestEffort = "best-effort"
+)
+
+// Duplicate policies, chosen with the duplicates query parameter on /import.
+const (
+	// DuplicatesAllow imports rows that duplicate an existing person or an earlier row.
+	DuplicatesAllow = "allow"
+	// DuplicatesSkip does not import duplicate rows.
+	DuplicatesSkip = "skip"
+)
+
+// importOptions controls how importPeople handles the decoded rows.
+type importOptions struct {
+	Mode       string
+	Duplicates string
+	// DryRun builds the report without writing to the store.
+	DryRun bool
+}
+
+// importRow is a single decoded record from an import file.
+type importRow struct {
+	// Line is the line number of the record in the file.
+	Line   int
+	Person Person
+	// Err is set if the record could not be decoded.
+	Err error
+}
+
+// RejectedRow is a row that was not imported, and why.
+type RejectedRow struct {
+	Row    int    `json:"row"`
+	Reason string `json:"reason"`
+}
+
+// ConflictRow is a row that duplicates an existing person or an earlier row.
+type ConflictRow struct {
+	Row int `json:"row"`
+	// ID is the existing person the row duplicates, or 0 if it duplicates an earlier row.
+	ID     int    `json:"id,omitempty"`
+	Reason string `json:"reason"`
+}
+
+// ImportReport summarises the result of an import.
+// A dry run returns the same report a real import would, with Created left at 0.
+type ImportReport struct {
+	Mode       string `json:"mode"`
+	Duplicates string `json:"duplicates"`
+	DryRun     bool   `json:"dryRun"`
+	// Rows is the number of records read, excluding any header.
+	Rows int `json:"rows"`
+	// Inserts is the number of rows that are (or would be) imported.
+	Inserts int `json:"inserts"`
+	// Skips is the number of duplicate rows not imported.
+	Skips int `json:"skips"`
+	// Conflicts is the number of rows duplicating an existing person or an earlier row.
+	Conflicts int `json:"conflicts"`
+	// Errors is the number of rejected rows.
+	Errors int `json:"errors"`
+	// Created is the number of people actually written to the store.
+	Created     int           `json:"created"`
+	Rejected    []RejectedRow `json:"rejected"`
+	Conflicting []ConflictRow `json:"conflicting"`
+	// created are the people written to the store, with their IDs, for the audit log.
+	created []Person
+}
+
+// duplicateKey returns the key used to detect duplicate people:
+// the email address if set, otherwise the full name.
+func duplicateKey(p *Person) string {
+	if p.Email != "" {
+		return "email:" + strings.ToLower(p.Email)
+	}
+	return "name:" + strings.ToLower(p.FirstName) + "\x00" + strings.ToLower(p.LastName)
+}
+
+// describeDuplicate explains which field a duplicate matched on.
+func describeDuplicate(p *Person) string {
+	if p.Email != "" {
+		return "same email as"
+	}
+	return "same name as"
+}
+
+// importPeople validates the decoded rows, detects duplicates of existing people
+// and earlier rows, and imports the rows that pass into the store.
+// In ImportAtomic mode nothing is imported if any row is rejected.
+// With opts.DryRun the report is built without writing anything.
+func importPeople(s PersonStore, rows []importRow, opts importOptions) (ImportReport, error) {
+	report := ImportReport{
+		Mode:        opts.Mode,
+		Duplicates:  opts.Duplicates,
+		DryRun:      opts.DryRun,
+		Rows:        len(rows),
+		Rejected:    []RejectedRow{},
+		Conflicting: []ConflictRow{},
+	}
+	fields, err := s.Fields()
+	if err != nil {
+		return report, err
+	}
+	// Existing people are walked in batches, keeping only their duplicate keys.
+	seen := map[string]int{}
+	err = s.Walk(func(p *Person) error {
+		if _, ok := seen[duplicateKey(p)]; !ok {
+			seen[duplicateKey(p)] = p.ID
+		}
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+	earlier := map[string]int{}
+
+	people := []Person{}
+	for _, row := range rows {
+		if row.Err != nil {
+			report.Rejected = append(report.Rejected, RejectedRow{Row: row.Line, Reason: row.Err.Error()})
+			continue
+		}
+		if errs := append(row.Person.validate(), row.Person.validateCustom(fields)...); len(errs) > 0 {
+			reasons := make([]string, len(errs))
+			for i, e := range errs {
+				reasons[i] = e.Field + ": " + e.Reason
+			}
+			report.Rejected = append(report.Rejected, RejectedRow{Row: row.Line, Reason: strings.Join(reasons, "; ")})
+			continue
+		}
+		row.Person.normalise()
+		key := duplicateKey(&row.Person)
+		conflict := ConflictRow{Row: row.Line}
+		if id, ok := seen[key]; ok {
+			conflict.ID = id
+			conflict.Reason = fmt.Sprintf("%v person %v", describeDuplicate(&row.Person), id)
+		} else if line, ok := earlier[key]; ok {
+			conflict.Reason = fmt.Sprintf("%v row %v", describeDuplicate(&row.Person), line)
+		} else {
+			earlier[key] = row.Line
+		}
+		if conflict.Reason != "" {
+			report.Conflicting = append(report.Conflicting, conflict)
+			report.Conflicts++
+			if opts.Duplicates == DuplicatesSkip {
+				report.Skips++
+				continue
+			}
+		}
+		people = append(people, row.Person)
+	}
+	report.Errors = len(report.Rejected)
+	if opts.Mode == ImportAtomic && report.Errors > 0 {
+		return report, nil
+	}
+	report.Inserts = len(people)
+	if opts.DryRun {
+		return report, nil
+	}
+	n, err := s.Import(people)
+	if err != nil {
+		return report, err
+	}
+	report.Created, report.created = n, people
+	return report, nil
+}
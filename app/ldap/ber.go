@@ -0,0 +1,208 @@
+package ldap
+
+// Ber.go contains the subset of ASN.1 BER (X.690) encoding that LDAP messages use.
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// maxMessageSize limits the size of a request, so that a length prefix cannot make the server allocate without bound.
+const maxMessageSize = 1 << 20
+
+// Classes of BER tags.
+const (
+	classUniversal   = 0x00
+	classApplication = 0x40
+	classContext     = 0x80
+)
+
+// Universal tags.
+const (
+	tagBoolean     = 1
+	tagInteger     = 2
+	tagOctetString = 4
+	tagEnumerated  = 10
+	tagSequence    = 16
+	tagSet         = 17
+)
+
+// errMessageTooLarge is returned when an element is longer than maxMessageSize.
+var errMessageTooLarge = errors.New("message too large")
+
+// element is a decoded BER element. Constructed elements keep their encoded children in data.
+type element struct {
+	class       byte
+	constructed bool
+	tag         byte
+	data        []byte
+}
+
+// is reports whether the element has the class and tag.
+func (e element) is(class, tag byte) bool {
+	return e.class == class && e.tag == tag
+}
+
+// readElement reads an element from r.
+func readElement(r *bufio.Reader) (element, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return element{}, err
+	}
+	e := element{class: b & 0xc0, constructed: b&0x20 != 0, tag: b & 0x1f}
+	if e.tag == 0x1f {
+		return element{}, errors.New("high tag numbers are not supported")
+	}
+	n, err := readLength(r)
+	if err != nil {
+		return element{}, err
+	}
+	e.data = make([]byte, n)
+	if _, err := io.ReadFull(r, e.data); err != nil {
+		return element{}, err
+	}
+	return e, nil
+}
+
+// readLength reads a definite length.
+func readLength(r io.ByteReader) (int, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	if b < 0x80 {
+		return int(b), nil
+	}
+	if b == 0x80 {
+		return 0, errors.New("indefinite lengths are not supported")
+	}
+	if b&0x7f > 4 {
+		return 0, errMessageTooLarge
+	}
+	n := 0
+	for i := byte(0); i < b&0x7f; i++ {
+		c, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		n = n<<8 | int(c)
+	}
+	if n > maxMessageSize {
+		return 0, errMessageTooLarge
+	}
+	return n, nil
+}
+
+// sliceReader is an io.ByteReader over a byte slice.
+type sliceReader struct {
+	b []byte
+}
+
+func (s *sliceReader) ReadByte() (byte, error) {
+	if len(s.b) == 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	c := s.b[0]
+	s.b = s.b[1:]
+	return c, nil
+}
+
+// children decodes the elements a constructed element contains.
+func (e element) children() ([]element, error) {
+	if !e.constructed {
+		return nil, errors.New("expected a constructed element")
+	}
+	s := &sliceReader{e.data}
+	children := []element{}
+	for len(s.b) > 0 {
+		b, _ := s.ReadByte()
+		c := element{class: b & 0xc0, constructed: b&0x20 != 0, tag: b & 0x1f}
+		if c.tag == 0x1f {
+			return nil, errors.New("high tag numbers are not supported")
+		}
+		n, err := readLength(s)
+		if err != nil {
+			return nil, err
+		}
+		if n > len(s.b) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		c.data, s.b = s.b[:n], s.b[n:]
+		children = append(children, c)
+	}
+	return children, nil
+}
+
+// int decodes an INTEGER or ENUMERATED.
+func (e element) int() (int64, error) {
+	if e.constructed || len(e.data) == 0 || len(e.data) > 8 {
+		return 0, fmt.Errorf("invalid integer")
+	}
+	v := int64(int8(e.data[0]))
+	for _, b := range e.data[1:] {
+		v = v<<8 | int64(b)
+	}
+	return v, nil
+}
+
+// bool decodes a BOOLEAN.
+func (e element) bool() (bool, error) {
+	if e.constructed || len(e.data) != 1 {
+		return false, fmt.Errorf("invalid boolean")
+	}
+	return e.data[0] != 0, nil
+}
+
+// encode returns the encoding of an element with the class, tag and contents.
+func encode(class byte, constructed bool, tag byte, data []byte) []byte {
+	b := class | tag
+	if constructed {
+		b |= 0x20
+	}
+	out := []byte{b}
+	switch n := len(data); {
+	case n < 0x80:
+		out = append(out, byte(n))
+	case n < 0x100:
+		out = append(out, 0x81, byte(n))
+	case n < 0x10000:
+		out = append(out, 0x82, byte(n>>8), byte(n))
+	default:
+		out = append(out, 0x84, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+	return append(out, data...)
+}
+
+// encodeInt returns the encoding of an integer with the class and tag.
+func encodeInt(class, tag byte, v int64) []byte {
+	data := []byte{byte(v)}
+	for v >= 0x80 || v < -0x80 {
+		v >>= 8
+		data = append([]byte{byte(v)}, data...)
+	}
+	return encode(class, false, tag, data)
+}
+
+// encodeString returns the encoding of an OCTET STRING with the class and tag.
+func encodeString(class, tag byte, s string) []byte {
+	return encode(class, false, tag, []byte(s))
+}
+
+// encodeBool returns the encoding of a BOOLEAN.
+func encodeBool(v bool) []byte {
+	if v {
+		return encode(classUniversal, false, tagBoolean, []byte{0xff})
+	}
+	return encode(classUniversal, false, tagBoolean, []byte{0})
+}
+
+// encodeConstructed returns the encoding of a constructed element containing the encoded children.
+func encodeConstructed(class, tag byte, children ...[]byte) []byte {
+	data := []byte{}
+	for _, c := range children {
+		data = append(data, c...)
+	}
+	return encode(class, true, tag, data)
+}
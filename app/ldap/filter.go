@@ -0,0 +1,441 @@
+package ldap
+
+// Filter.go contains search filters, decoded from requests or parsed from their RFC 4515 string form.
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// FilterOp is the kind of a Filter. Its values are the filter's BER context tags.
+type FilterOp int
+
+// Filter kinds.
+const (
+	FilterAnd FilterOp = iota
+	FilterOr
+	FilterNot
+	FilterEqual
+	FilterSubstrings
+	FilterGreaterOrEqual
+	FilterLessOrEqual
+	FilterPresent
+	FilterApprox
+	FilterExtensible
+)
+
+// Filter is a search filter.
+type Filter struct {
+	Op FilterOp
+	// Children are combined by FilterAnd and FilterOr, or negated by FilterNot.
+	Children []Filter
+	// Attr is the attribute compared by the other kinds. It is empty for an extensible match on any attribute.
+	Attr string
+	// Value is the assertion value of equality, ordering, approximate and extensible matches.
+	Value string
+	// Initial, Any and Final are the parts of a substrings filter, Initial*Any*...*Final.
+	Initial string
+	Any     []string
+	Final   string
+	// MatchingRule and DNAttributes are set by extensible matches.
+	MatchingRule string
+	DNAttributes bool
+}
+
+// decodeFilter decodes a Filter from its BER encoding.
+func decodeFilter(e element) (Filter, error) {
+	if e.class != classContext || e.tag > byte(FilterExtensible) {
+		return Filter{}, errors.New("invalid filter")
+	}
+	f := Filter{Op: FilterOp(e.tag)}
+	if f.Op == FilterPresent {
+		f.Attr = string(e.data)
+		return f, nil
+	}
+	children, err := e.children()
+	if err != nil {
+		return Filter{}, err
+	}
+	switch f.Op {
+	case FilterAnd, FilterOr, FilterNot:
+		if f.Op == FilterNot && len(children) != 1 {
+			return Filter{}, errors.New("not filter must have one child")
+		}
+		for _, c := range children {
+			child, err := decodeFilter(c)
+			if err != nil {
+				return Filter{}, err
+			}
+			f.Children = append(f.Children, child)
+		}
+	case FilterSubstrings:
+		if len(children) != 2 {
+			return Filter{}, errors.New("invalid substrings filter")
+		}
+		f.Attr = string(children[0].data)
+		parts, err := children[1].children()
+		if err != nil || len(parts) == 0 {
+			return Filter{}, errors.New("invalid substrings filter")
+		}
+		for i, p := range parts {
+			switch {
+			case p.is(classContext, 0) && i == 0:
+				f.Initial = string(p.data)
+			case p.is(classContext, 1):
+				f.Any = append(f.Any, string(p.data))
+			case p.is(classContext, 2) && i == len(parts)-1:
+				f.Final = string(p.data)
+			default:
+				return Filter{}, errors.New("invalid substrings filter")
+			}
+		}
+	case FilterExtensible:
+		for _, c := range children {
+			switch {
+			case c.is(classContext, 1):
+				f.MatchingRule = string(c.data)
+			case c.is(classContext, 2):
+				f.Attr = string(c.data)
+			case c.is(classContext, 3):
+				f.Value = string(c.data)
+			case c.is(classContext, 4):
+				f.DNAttributes = len(c.data) == 1 && c.data[0] != 0
+			default:
+				return Filter{}, errors.New("invalid extensible match")
+			}
+		}
+	default:
+		if len(children) != 2 {
+			return Filter{}, errors.New("invalid attribute value assertion")
+		}
+		f.Attr, f.Value = string(children[0].data), string(children[1].data)
+	}
+	return f, nil
+}
+
+// encode returns the BER encoding of the filter.
+func (f Filter) encode() []byte {
+	tag := byte(f.Op)
+	switch f.Op {
+	case FilterAnd, FilterOr, FilterNot:
+		children := make([][]byte, len(f.Children))
+		for i, c := range f.Children {
+			children[i] = c.encode()
+		}
+		return encodeConstructed(classContext, tag, children...)
+	case FilterPresent:
+		return encodeString(classContext, tag, f.Attr)
+	case FilterSubstrings:
+		parts := [][]byte{}
+		if f.Initial != "" {
+			parts = append(parts, encodeString(classContext, 0, f.Initial))
+		}
+		for _, a := range f.Any {
+			parts = append(parts, encodeString(classContext, 1, a))
+		}
+		if f.Final != "" {
+			parts = append(parts, encodeString(classContext, 2, f.Final))
+		}
+		return encodeConstructed(classContext, tag,
+			encodeString(classUniversal, tagOctetString, f.Attr),
+			encodeConstructed(classUniversal, tagSequence, parts...))
+	case FilterExtensible:
+		parts := [][]byte{}
+		if f.MatchingRule != "" {
+			parts = append(parts, encodeString(classContext, 1, f.MatchingRule))
+		}
+		if f.Attr != "" {
+			parts = append(parts, encodeString(classContext, 2, f.Attr))
+		}
+		parts = append(parts, encodeString(classContext, 3, f.Value))
+		if f.DNAttributes {
+			parts = append(parts, encode(classContext, false, 4, []byte{0xff}))
+		}
+		return encodeConstructed(classContext, tag, parts...)
+	}
+	return encodeConstructed(classContext, tag,
+		encodeString(classUniversal, tagOctetString, f.Attr),
+		encodeString(classUniversal, tagOctetString, f.Value))
+}
+
+// ParseFilter parses the string representation of a filter (RFC 4515), such as (|(sn=smi*)(mail=*@example.com)).
+func ParseFilter(s string) (Filter, error) {
+	p := filterParser{s: s}
+	f, err := p.filter()
+	if err == nil && p.i < len(s) {
+		err = p.errorf("unexpected %q", s[p.i:])
+	}
+	if err != nil {
+		return Filter{}, err
+	}
+	return f, nil
+}
+
+// filterParser is a recursive descent parser of filter strings.
+type filterParser struct {
+	s string
+	i int
+}
+
+func (p *filterParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("invalid filter at offset %v: %v", p.i, fmt.Sprintf(format, args...))
+}
+
+// filter parses a parenthesised filter.
+func (p *filterParser) filter() (Filter, error) {
+	if p.i >= len(p.s) || p.s[p.i] != '(' {
+		return Filter{}, p.errorf("expected (")
+	}
+	p.i++
+	var f Filter
+	var err error
+	switch {
+	case p.i >= len(p.s):
+		return Filter{}, p.errorf("unexpected end")
+	case p.s[p.i] == '&' || p.s[p.i] == '|' || p.s[p.i] == '!':
+		f.Op = map[byte]FilterOp{'&': FilterAnd, '|': FilterOr, '!': FilterNot}[p.s[p.i]]
+		p.i++
+		for p.i < len(p.s) && p.s[p.i] == '(' {
+			child, err := p.filter()
+			if err != nil {
+				return Filter{}, err
+			}
+			f.Children = append(f.Children, child)
+		}
+		if f.Op == FilterNot && len(f.Children) != 1 {
+			return Filter{}, p.errorf("! must be followed by one filter")
+		}
+	default:
+		f, err = p.item()
+		if err != nil {
+			return Filter{}, err
+		}
+	}
+	if p.i >= len(p.s) || p.s[p.i] != ')' {
+		return Filter{}, p.errorf("expected )")
+	}
+	p.i++
+	return f, nil
+}
+
+// item parses a comparison: attr=value, attr~=value, attr>=value, attr<=value,
+// attr=*, a substrings pattern, or an extensible match attr:dn:rule:=value.
+func (p *filterParser) item() (Filter, error) {
+	end := strings.IndexAny(p.s[p.i:], "=)")
+	if end <= 0 || p.s[p.i+end] != '=' {
+		return Filter{}, p.errorf("expected an attribute and a value")
+	}
+	attr := p.s[p.i : p.i+end]
+	p.i += end + 1
+	f := Filter{Op: FilterEqual}
+	switch {
+	case strings.HasSuffix(attr, "~"):
+		f.Op, attr = FilterApprox, attr[:len(attr)-1]
+	case strings.HasSuffix(attr, ">"):
+		f.Op, attr = FilterGreaterOrEqual, attr[:len(attr)-1]
+	case strings.HasSuffix(attr, "<"):
+		f.Op, attr = FilterLessOrEqual, attr[:len(attr)-1]
+	case strings.HasSuffix(attr, ":"):
+		f.Op = FilterExtensible
+		parts := strings.Split(attr[:len(attr)-1], ":")
+		f.Attr = parts[0]
+		for _, part := range parts[1:] {
+			switch {
+			case strings.EqualFold(part, "dn") && !f.DNAttributes && f.MatchingRule == "":
+				f.DNAttributes = true
+			case part != "" && f.MatchingRule == "":
+				f.MatchingRule = part
+			default:
+				return Filter{}, p.errorf("invalid extensible match %q", attr)
+			}
+		}
+		if f.Attr == "" && f.MatchingRule == "" {
+			return Filter{}, p.errorf("extensible match needs an attribute or a matching rule")
+		}
+		v, err := p.value()
+		f.Value = v
+		return f, err
+	}
+	if attr == "" || strings.ContainsAny(attr, "*()\\") {
+		return Filter{}, p.errorf("invalid attribute %q", attr)
+	}
+	f.Attr = attr
+	if f.Op != FilterEqual {
+		v, err := p.value()
+		f.Value = v
+		return f, err
+	}
+	parts := []string{}
+	for {
+		v, err := p.value()
+		if err != nil {
+			return Filter{}, err
+		}
+		parts = append(parts, v)
+		if p.i >= len(p.s) || p.s[p.i] != '*' {
+			break
+		}
+		p.i++
+	}
+	switch {
+	case len(parts) == 1:
+		f.Value = parts[0]
+	case len(parts) == 2 && parts[0] == "" && parts[1] == "":
+		f.Op = FilterPresent
+	default:
+		f.Op = FilterSubstrings
+		f.Initial, f.Final = parts[0], parts[len(parts)-1]
+		for _, a := range parts[1 : len(parts)-1] {
+			if a == "" {
+				return Filter{}, p.errorf("empty substring")
+			}
+			f.Any = append(f.Any, a)
+		}
+	}
+	return f, nil
+}
+
+// value parses an assertion value up to the next unescaped * or ), decoding \XX escapes.
+func (p *filterParser) value() (string, error) {
+	var b strings.Builder
+	for p.i < len(p.s) {
+		c := p.s[p.i]
+		switch c {
+		case '*', ')':
+			return b.String(), nil
+		case '(':
+			return "", p.errorf("unescaped (")
+		case '\\':
+			if p.i+2 >= len(p.s) || unhex(p.s[p.i+1]) < 0 || unhex(p.s[p.i+2]) < 0 {
+				return "", p.errorf("invalid escape")
+			}
+			b.WriteByte(byte(unhex(p.s[p.i+1])<<4 | unhex(p.s[p.i+2])))
+			p.i += 3
+			continue
+		}
+		b.WriteByte(c)
+		p.i++
+	}
+	return "", p.errorf("unexpected end")
+}
+
+// unhex returns the value of a hex digit, or -1.
+func unhex(c byte) int {
+	switch {
+	case c >= '0' && c <= '9':
+		return int(c - '0')
+	case c >= 'a' && c <= 'f':
+		return int(c-'a') + 10
+	case c >= 'A' && c <= 'F':
+		return int(c-'A') + 10
+	}
+	return -1
+}
+
+// escapeFilterValue escapes the characters that are special in filter strings.
+func escapeFilterValue(v string) string {
+	var b strings.Builder
+	for i := 0; i < len(v); i++ {
+		switch c := v[i]; c {
+		case '*', '(', ')', '\\', 0:
+			fmt.Fprintf(&b, "\\%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// String returns the filter's string representation.
+func (f Filter) String() string {
+	switch f.Op {
+	case FilterAnd, FilterOr, FilterNot:
+		s := "(" + map[FilterOp]string{FilterAnd: "&", FilterOr: "|", FilterNot: "!"}[f.Op]
+		for _, c := range f.Children {
+			s += c.String()
+		}
+		return s + ")"
+	case FilterPresent:
+		return "(" + f.Attr + "=*)"
+	case FilterSubstrings:
+		s := "(" + f.Attr + "=" + escapeFilterValue(f.Initial) + "*"
+		for _, a := range f.Any {
+			s += escapeFilterValue(a) + "*"
+		}
+		return s + escapeFilterValue(f.Final) + ")"
+	case FilterExtensible:
+		s := "(" + f.Attr
+		if f.DNAttributes {
+			s += ":dn"
+		}
+		if f.MatchingRule != "" {
+			s += ":" + f.MatchingRule
+		}
+		return s + ":=" + escapeFilterValue(f.Value) + ")"
+	}
+	op := map[FilterOp]string{FilterEqual: "=", FilterApprox: "~=", FilterGreaterOrEqual: ">=", FilterLessOrEqual: "<="}[f.Op]
+	return "(" + f.Attr + op + escapeFilterValue(f.Value) + ")"
+}
+
+// Matches reports whether the entry satisfies the filter, comparing values without regard to case.
+// Extensible matches are not supported and never match.
+func (f Filter) Matches(e *Entry) bool {
+	switch f.Op {
+	case FilterAnd, FilterOr:
+		for _, c := range f.Children {
+			if c.Matches(e) == (f.Op == FilterOr) {
+				return f.Op == FilterOr
+			}
+		}
+		return f.Op == FilterAnd
+	case FilterNot:
+		return len(f.Children) == 1 && !f.Children[0].Matches(e)
+	case FilterExtensible:
+		return false
+	}
+	values := e.Values(f.Attr)
+	if f.Op == FilterPresent {
+		return len(values) > 0
+	}
+	for _, v := range values {
+		v = strings.ToLower(v)
+		switch f.Op {
+		case FilterEqual, FilterApprox:
+			if v == strings.ToLower(f.Value) {
+				return true
+			}
+		case FilterGreaterOrEqual:
+			if v >= strings.ToLower(f.Value) {
+				return true
+			}
+		case FilterLessOrEqual:
+			if v <= strings.ToLower(f.Value) {
+				return true
+			}
+		case FilterSubstrings:
+			if matchSubstrings(v, f) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchSubstrings reports whether the lower-cased value matches the substrings filter.
+func matchSubstrings(v string, f Filter) bool {
+	initial, final := strings.ToLower(f.Initial), strings.ToLower(f.Final)
+	if !strings.HasPrefix(v, initial) {
+		return false
+	}
+	v = v[len(initial):]
+	for _, a := range f.Any {
+		a = strings.ToLower(a)
+		i := strings.Index(v, a)
+		if i < 0 {
+			return false
+		}
+		v = v[i+len(a):]
+	}
+	return strings.HasSuffix(v, final)
+}
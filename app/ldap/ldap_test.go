@@ -0,0 +1,276 @@
+package ldap
+
+import (
+	"bufio"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestParseFilter(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter string
+		want   Filter
+		err    bool
+	}{
+		{"equality", "(sn=Smith)", Filter{Op: FilterEqual, Attr: "sn", Value: "Smith"}, false},
+		{"present", "(mail=*)", Filter{Op: FilterPresent, Attr: "mail"}, false},
+		{"initial", "(sn=smi*)", Filter{Op: FilterSubstrings, Attr: "sn", Initial: "smi"}, false},
+		{"substrings", "(cn=a*b*c*d)", Filter{Op: FilterSubstrings, Attr: "cn", Initial: "a", Any: []string{"b", "c"}, Final: "d"}, false},
+		{"or", "(|(sn=smi*)(mail=*@example.com))", Filter{Op: FilterOr, Children: []Filter{
+			{Op: FilterSubstrings, Attr: "sn", Initial: "smi"},
+			{Op: FilterSubstrings, Attr: "mail", Final: "@example.com"},
+		}}, false},
+		{"not", "(!(uid=1))", Filter{Op: FilterNot, Children: []Filter{{Op: FilterEqual, Attr: "uid", Value: "1"}}}, false},
+		{"ordering", "(&(uid>=2)(uid<=3))", Filter{Op: FilterAnd, Children: []Filter{
+			{Op: FilterGreaterOrEqual, Attr: "uid", Value: "2"},
+			{Op: FilterLessOrEqual, Attr: "uid", Value: "3"},
+		}}, false},
+		{"approx", "(cn~=jon)", Filter{Op: FilterApprox, Attr: "cn", Value: "jon"}, false},
+		{"extensible", "(cn:dn:2.5.13.2:=x)", Filter{Op: FilterExtensible, Attr: "cn", DNAttributes: true, MatchingRule: "2.5.13.2", Value: "x"}, false},
+		{"escapes", `(cn=a\2ab\29)`, Filter{Op: FilterEqual, Attr: "cn", Value: "a*b)"}, false},
+		{"no parentheses", "sn=Smith", Filter{}, true},
+		{"unbalanced", "(|(sn=a)", Filter{}, true},
+		{"trailing", "(sn=a))", Filter{}, true},
+		{"bad escape", `(sn=\zz)`, Filter{}, true},
+		{"no attribute", "(=a)", Filter{}, true},
+		{"not two", "(!(a=1)(b=2))", Filter{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseFilter(tt.filter)
+			if (err != nil) != tt.err {
+				t.Fatalf("ParseFilter(%q) error = %v, want error %v", tt.filter, err, tt.err)
+			}
+			if tt.err {
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseFilter(%q) = %+v, want %+v", tt.filter, got, tt.want)
+			}
+			if s := got.String(); s != tt.filter {
+				t.Errorf("String() = %q, want %q", s, tt.filter)
+			}
+			e := got.encode()
+			decoded, err := decodeFilter(element{class: e[0] & 0xc0, constructed: e[0]&0x20 != 0, tag: e[0] & 0x1f, data: e[2:]})
+			if err != nil || !reflect.DeepEqual(decoded, got) {
+				t.Errorf("decodeFilter(encode()) = %+v, %v, want %+v", decoded, err, got)
+			}
+		})
+	}
+}
+
+func TestFilter_Matches(t *testing.T) {
+	e := &Entry{DN: "uid=1,ou=people", Attributes: []Attribute{
+		{Name: "objectClass", Values: []string{"top", "inetOrgPerson"}},
+		{Name: "sn", Values: []string{"Smith"}},
+		{Name: "mail", Values: []string{"js@Example.com"}},
+	}}
+	tests := []struct {
+		filter string
+		want   bool
+	}{
+		{"(objectClass=inetorgperson)", true},
+		{"(objectclass=*)", true},
+		{"(|(sn=smi*)(mail=*@example.com))", true},
+		{"(&(sn=smi*)(mail=*@example.org))", false},
+		{"(!(sn=jones))", true},
+		{"(sn>=s)", true},
+		{"(sn<=r)", false},
+		{"(telephoneNumber=*)", false},
+		{"(sn:=smith)", false},
+	}
+	for _, tt := range tests {
+		f, err := ParseFilter(tt.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := f.Matches(e); got != tt.want {
+			t.Errorf("%v matches = %v, want %v", tt.filter, got, tt.want)
+		}
+	}
+}
+
+// testHandler allows one bind and returns its entries to any search.
+type testHandler struct {
+	entries []Entry
+	search  *SearchRequest
+}
+
+func (h *testHandler) Bind(name, password string) Result {
+	if name == "" && password == "" || name == "cn=admin" && password == "secret" {
+		return Result{}
+	}
+	return Result{Code: InvalidCredentials}
+}
+
+func (h *testHandler) Search(bound string, req *SearchRequest, send func(e *Entry) error) Result {
+	h.search = req
+	if bound != "cn=admin" {
+		return Result{Code: InsufficientAccessRights}
+	}
+	for i := range h.entries {
+		if req.Filter.Matches(&h.entries[i]) {
+			if err := send(&h.entries[i]); err != nil {
+				return Result{Code: Other}
+			}
+		}
+	}
+	return Result{}
+}
+
+// testClient sends requests to a server over a pipe.
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+	id   int64
+}
+
+func newTestClient(t *testing.T, h Handler) *testClient {
+	client, server := net.Pipe()
+	go (&Server{Handler: h}).ServeConn(server)
+	t.Cleanup(func() { client.Close() })
+	return &testClient{t: t, conn: client, r: bufio.NewReader(client)}
+}
+
+// send writes a request and returns the ID it was sent with.
+func (c *testClient) send(op []byte) int64 {
+	c.id++
+	if _, err := c.conn.Write(encodeMessage(c.id, op)); err != nil {
+		c.t.Fatal(err)
+	}
+	return c.id
+}
+
+// receive reads a response to the last request.
+func (c *testClient) receive() element {
+	e, err := readElement(c.r)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	id, op, err := decodeMessage(e)
+	if err != nil || id != c.id {
+		c.t.Fatalf("got message %v, %v, want ID %v", id, err, c.id)
+	}
+	return op
+}
+
+// result reads an LDAPResult with the APPLICATION tag and returns its code.
+func (c *testClient) result(tag byte) int64 {
+	op := c.receive()
+	children, err := op.children()
+	if !op.is(classApplication, tag) || err != nil || len(children) < 3 {
+		c.t.Fatalf("got operation %v, want %v", op.tag, tag)
+	}
+	code, _ := children[0].int()
+	return code
+}
+
+func (c *testClient) bind(name, password string) int64 {
+	c.send(encodeConstructed(classApplication, opBindRequest,
+		encodeInt(classUniversal, tagInteger, 3),
+		encodeString(classUniversal, tagOctetString, name),
+		encodeString(classContext, 0, password)))
+	return c.result(opBindResponse)
+}
+
+// search searches the whole subtree of ou=people and returns the entries found and the result code.
+func (c *testClient) search(filter string, typesOnly bool, attrs ...string) ([]Entry, int64) {
+	f, err := ParseFilter(filter)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	selection := [][]byte{}
+	for _, a := range attrs {
+		selection = append(selection, encodeString(classUniversal, tagOctetString, a))
+	}
+	c.send(encodeConstructed(classApplication, opSearchRequest,
+		encodeString(classUniversal, tagOctetString, "ou=people"),
+		encodeInt(classUniversal, tagEnumerated, ScopeWholeSubtree),
+		encodeInt(classUniversal, tagEnumerated, 0),
+		encodeInt(classUniversal, tagInteger, 0),
+		encodeInt(classUniversal, tagInteger, 0),
+		encodeBool(typesOnly),
+		f.encode(),
+		encodeConstructed(classUniversal, tagSequence, selection...)))
+	entries := []Entry{}
+	for {
+		op := c.receive()
+		if op.is(classApplication, opSearchResultDone) {
+			children, _ := op.children()
+			code, _ := children[0].int()
+			return entries, code
+		}
+		parts, _ := op.children()
+		e := Entry{DN: string(parts[0].data)}
+		attributes, _ := parts[1].children()
+		for _, a := range attributes {
+			nameValues, _ := a.children()
+			values, _ := nameValues[1].children()
+			attr := Attribute{Name: string(nameValues[0].data)}
+			for _, v := range values {
+				attr.Values = append(attr.Values, string(v.data))
+			}
+			e.Attributes = append(e.Attributes, attr)
+		}
+		entries = append(entries, e)
+	}
+}
+
+func TestServer(t *testing.T) {
+	h := &testHandler{entries: []Entry{
+		{DN: "uid=1,ou=people", Attributes: []Attribute{{Name: "sn", Values: []string{"Smith"}}, {Name: "mail", Values: []string{"a@example.com"}}}},
+		{DN: "uid=2,ou=people", Attributes: []Attribute{{Name: "sn", Values: []string{"Jones"}}, {Name: "mail", Values: []string{"b@example.org"}}}},
+	}}
+	c := newTestClient(t, h)
+
+	if code := c.bind("cn=admin", "wrong"); code != InvalidCredentials {
+		t.Errorf("bind with a wrong password = %v, want %v", code, InvalidCredentials)
+	}
+	if _, code := c.search("(sn=*)", false); code != InsufficientAccessRights {
+		t.Errorf("search after a failed bind = %v, want %v", code, InsufficientAccessRights)
+	}
+	if code := c.bind("cn=admin", "secret"); code != Success {
+		t.Fatalf("bind = %v, want %v", code, Success)
+	}
+
+	entries, code := c.search("(|(sn=smi*)(mail=*@example.org))", false)
+	if code != Success || !reflect.DeepEqual(entries, h.entries) {
+		t.Errorf("search = %+v, %v, want %+v", entries, code, h.entries)
+	}
+	if h.search.BaseDN != "ou=people" || h.search.Scope != ScopeWholeSubtree {
+		t.Errorf("handler got request %+v", h.search)
+	}
+
+	entries, _ = c.search("(sn=jones)", false, "MAIL")
+	want := []Entry{{DN: "uid=2,ou=people", Attributes: []Attribute{{Name: "mail", Values: []string{"b@example.org"}}}}}
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("search selecting mail = %+v, want %+v", entries, want)
+	}
+	entries, _ = c.search("(sn=jones)", true)
+	want = []Entry{{DN: "uid=2,ou=people", Attributes: []Attribute{{Name: "sn"}, {Name: "mail"}}}}
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("search with typesOnly = %+v, want %+v", entries, want)
+	}
+	entries, _ = c.search("(sn=jones)", false, "1.1")
+	want = []Entry{{DN: "uid=2,ou=people"}}
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("search selecting 1.1 = %+v, want %+v", entries, want)
+	}
+
+	c.send(encodeString(classApplication, opDelRequest, "uid=1,ou=people"))
+	if code := c.result(opDelRequest + 1); code != UnwillingToPerform {
+		t.Errorf("delete = %v, want %v", code, UnwillingToPerform)
+	}
+	c.send(encodeConstructed(classApplication, opExtendedRequest, encodeString(classContext, 0, "1.3.6.1.4.1.1466.20037")))
+	if code := c.result(opExtendedResponse); code != ProtocolError {
+		t.Errorf("StartTLS = %v, want %v", code, ProtocolError)
+	}
+
+	c.send(encode(classApplication, false, opUnbindRequest, nil))
+	if _, err := c.r.ReadByte(); err == nil {
+		t.Errorf("connection still open after unbind")
+	}
+}
@@ -0,0 +1,323 @@
+// Package ldap implements a read-only LDAPv3 server (RFC 4511) that supports bind and search,
+// leaving the directory's contents to a Handler.
+package ldap
+
+// Server.go contains the server, its connection loop and the encoding of requests and responses.
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strings"
+)
+
+// Result codes (RFC 4511 appendix A).
+const (
+	Success                  = 0
+	OperationsError          = 1
+	ProtocolError            = 2
+	SizeLimitExceeded        = 4
+	AuthMethodNotSupported   = 7
+	NoSuchObject             = 32
+	InvalidDNSyntax          = 34
+	InvalidCredentials       = 49
+	InsufficientAccessRights = 50
+	UnwillingToPerform       = 53
+	Other                    = 80
+)
+
+// Search scopes.
+const (
+	ScopeBaseObject   = 0
+	ScopeSingleLevel  = 1
+	ScopeWholeSubtree = 2
+)
+
+// Protocol operations, the APPLICATION tags of requests and responses.
+const (
+	opBindRequest       = 0
+	opBindResponse      = 1
+	opUnbindRequest     = 2
+	opSearchRequest     = 3
+	opSearchResultEntry = 4
+	opSearchResultDone  = 5
+	opModifyRequest     = 6
+	opAddRequest        = 8
+	opDelRequest        = 10
+	opModifyDNRequest   = 12
+	opCompareRequest    = 14
+	opAbandonRequest    = 16
+	opExtendedRequest   = 23
+	opExtendedResponse  = 24
+)
+
+// Result is the outcome of an operation.
+type Result struct {
+	Code int
+	// MatchedDN is the closest existing entry to a DN that was not found.
+	MatchedDN string
+	Message   string
+}
+
+// Attribute is an attribute of an entry and its values.
+type Attribute struct {
+	Name   string
+	Values []string
+}
+
+// Entry is a directory entry returned by a search.
+type Entry struct {
+	DN         string
+	Attributes []Attribute
+}
+
+// Values returns the values of the named attribute, ignoring case.
+func (e *Entry) Values(name string) []string {
+	for _, a := range e.Attributes {
+		if strings.EqualFold(a.Name, name) {
+			return a.Values
+		}
+	}
+	return nil
+}
+
+// SearchRequest is a search operation.
+type SearchRequest struct {
+	BaseDN string
+	Scope  int
+	// SizeLimit is the maximum number of entries to return, or 0 for no limit.
+	SizeLimit int
+	TypesOnly bool
+	Filter    Filter
+	// Attributes are the attributes to return. The server removes the others, see selectAttributes.
+	Attributes []string
+}
+
+// Handler provides the contents of the directory.
+type Handler interface {
+	// Bind checks the credentials of a simple bind. An empty name and password is an anonymous bind.
+	Bind(name, password string) Result
+	// Search calls send with each entry matching the request, on behalf of bound,
+	// the name of the connection's last successful bind. It stops if send returns an error.
+	Search(bound string, req *SearchRequest, send func(e *Entry) error) Result
+}
+
+// Server answers LDAP requests with a Handler.
+// Operations that would change the directory are refused with UnwillingToPerform.
+type Server struct {
+	Handler Handler
+}
+
+// readOnlyResponses maps the requests that change the directory to their responses.
+var readOnlyResponses = map[byte]byte{
+	opModifyRequest:   opModifyRequest + 1,
+	opAddRequest:      opAddRequest + 1,
+	opDelRequest:      opDelRequest + 1,
+	opModifyDNRequest: opModifyDNRequest + 1,
+	opCompareRequest:  opCompareRequest + 1,
+}
+
+// ListenAndServe listens on the TCP address and serves connections with the handler.
+func ListenAndServe(addr string, h Handler) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return (&Server{Handler: h}).Serve(l)
+}
+
+// Serve accepts connections on l and serves each in its own goroutine, until l is closed.
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.ServeConn(c)
+	}
+}
+
+// ServeConn answers the requests on a connection until the client unbinds or disconnects, then closes it.
+func (s *Server) ServeConn(c net.Conn) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	bound := ""
+	for {
+		e, err := readElement(r)
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("LDAP %v: %v", c.RemoteAddr(), err.Error())
+			}
+			return
+		}
+		id, op, err := decodeMessage(e)
+		if err != nil {
+			log.Printf("LDAP %v: %v", c.RemoteAddr(), err.Error())
+			return
+		}
+		var responses [][]byte
+		switch {
+		case op.is(classApplication, opUnbindRequest):
+			return
+		case op.is(classApplication, opAbandonRequest):
+			// Requests are answered in order, so there is never one to abandon.
+		case op.is(classApplication, opBindRequest):
+			var res Result
+			bound, res = s.bind(op)
+			responses = append(responses, res.encode(opBindResponse))
+		case op.is(classApplication, opSearchRequest):
+			responses = append(responses, s.search(c, id, bound, op))
+		case op.class == classApplication && readOnlyResponses[op.tag] != 0:
+			responses = append(responses, Result{Code: UnwillingToPerform, Message: "the directory is read-only"}.encode(readOnlyResponses[op.tag]))
+		case op.is(classApplication, opExtendedRequest):
+			responses = append(responses, Result{Code: ProtocolError, Message: "extended operations are not supported"}.encode(opExtendedResponse))
+		default:
+			log.Printf("LDAP %v: unknown operation %v", c.RemoteAddr(), op.tag)
+			return
+		}
+		for _, res := range responses {
+			if _, err := c.Write(encodeMessage(id, res)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// decodeMessage decodes an LDAPMessage into its ID and protocol operation, ignoring controls.
+func decodeMessage(e element) (int64, element, error) {
+	if !e.is(classUniversal, tagSequence) {
+		return 0, element{}, errors.New("expected an LDAPMessage")
+	}
+	children, err := e.children()
+	if err != nil || len(children) < 2 || !children[0].is(classUniversal, tagInteger) {
+		return 0, element{}, errors.New("invalid LDAPMessage")
+	}
+	id, err := children[0].int()
+	if err != nil {
+		return 0, element{}, err
+	}
+	return id, children[1], nil
+}
+
+// encodeMessage returns an LDAPMessage with the ID and the encoded protocol operation.
+func encodeMessage(id int64, op []byte) []byte {
+	return encodeConstructed(classUniversal, tagSequence, encodeInt(classUniversal, tagInteger, id), op)
+}
+
+// encode returns the result as an LDAPResult with the APPLICATION tag of the response.
+func (r Result) encode(tag byte) []byte {
+	return encodeConstructed(classApplication, tag,
+		encodeInt(classUniversal, tagEnumerated, int64(r.Code)),
+		encodeString(classUniversal, tagOctetString, r.MatchedDN),
+		encodeString(classUniversal, tagOctetString, r.Message))
+}
+
+// bind handles a BindRequest and returns the connection's new bound name.
+// A failed bind leaves the connection anonymous.
+func (s *Server) bind(op element) (string, Result) {
+	children, err := op.children()
+	if err != nil || len(children) != 3 {
+		return "", Result{Code: ProtocolError, Message: "invalid bind request"}
+	}
+	if version, err := children[0].int(); err != nil || version != 3 {
+		return "", Result{Code: ProtocolError, Message: "only LDAPv3 is supported"}
+	}
+	if !children[2].is(classContext, 0) || children[2].constructed {
+		return "", Result{Code: AuthMethodNotSupported, Message: "only simple binds are supported"}
+	}
+	name := string(children[1].data)
+	res := s.Handler.Bind(name, string(children[2].data))
+	if res.Code != Success {
+		return "", res
+	}
+	return name, res
+}
+
+// search handles a SearchRequest, writing entries to w as the handler finds them,
+// and returns the SearchResultDone.
+func (s *Server) search(w io.Writer, id int64, bound string, op element) []byte {
+	req, err := decodeSearchRequest(op)
+	if err != nil {
+		return Result{Code: ProtocolError, Message: err.Error()}.encode(opSearchResultDone)
+	}
+	res := s.Handler.Search(bound, req, func(e *Entry) error {
+		_, err := w.Write(encodeMessage(id, selectAttributes(e, req).encode()))
+		return err
+	})
+	return res.encode(opSearchResultDone)
+}
+
+// decodeSearchRequest decodes the fields of a SearchRequest.
+func decodeSearchRequest(op element) (*SearchRequest, error) {
+	children, err := op.children()
+	if err != nil || len(children) != 8 {
+		return nil, errors.New("invalid search request")
+	}
+	req := &SearchRequest{BaseDN: string(children[0].data)}
+	scope, err := children[1].int()
+	if err != nil || scope < ScopeBaseObject || scope > ScopeWholeSubtree {
+		return nil, errors.New("invalid search scope")
+	}
+	req.Scope = int(scope)
+	sizeLimit, err := children[3].int()
+	if err != nil || sizeLimit < 0 {
+		return nil, errors.New("invalid size limit")
+	}
+	req.SizeLimit = int(sizeLimit)
+	if req.TypesOnly, err = children[5].bool(); err != nil {
+		return nil, err
+	}
+	if req.Filter, err = decodeFilter(children[6]); err != nil {
+		return nil, err
+	}
+	attrs, err := children[7].children()
+	if err != nil {
+		return nil, errors.New("invalid attribute selection")
+	}
+	for _, a := range attrs {
+		req.Attributes = append(req.Attributes, string(a.data))
+	}
+	return req, nil
+}
+
+// selectAttributes returns the entry with only the attributes the request selects:
+// all of them if it lists none or *, none if it lists only 1.1, otherwise those named.
+// With TypesOnly the values are removed.
+func selectAttributes(e *Entry, req *SearchRequest) *Entry {
+	all := len(req.Attributes) == 0
+	named := map[string]bool{}
+	for _, a := range req.Attributes {
+		all = all || a == "*"
+		named[strings.ToLower(a)] = true
+	}
+	selected := &Entry{DN: e.DN}
+	for _, a := range e.Attributes {
+		if !all && !named[strings.ToLower(a.Name)] {
+			continue
+		}
+		if req.TypesOnly {
+			a.Values = nil
+		}
+		selected.Attributes = append(selected.Attributes, a)
+	}
+	return selected
+}
+
+// encode returns the entry as a SearchResultEntry.
+func (e *Entry) encode() []byte {
+	attrs := make([][]byte, len(e.Attributes))
+	for i, a := range e.Attributes {
+		values := make([][]byte, len(a.Values))
+		for j, v := range a.Values {
+			values[j] = encodeString(classUniversal, tagOctetString, v)
+		}
+		attrs[i] = encodeConstructed(classUniversal, tagSequence,
+			encodeString(classUniversal, tagOctetString, a.Name),
+			encodeConstructed(classUniversal, tagSet, values...))
+	}
+	return encodeConstructed(classApplication, opSearchResultEntry,
+		encodeString(classUniversal, tagOctetString, e.DN),
+		encodeConstructed(classUniversal, tagSequence, attrs...))
+}
@@ -0,0 +1,353 @@
+package app
+
+// Ldif.go contains the reading and writing of people as LDIF (RFC 2849) inetOrgPerson entries.
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/unixblackhole/didactic-tribble/app/ldap"
+)
+
+// defaultBaseDN is the DN people are exported under when no baseDN query parameter is given.
+const defaultBaseDN = "ou=people,dc=example,dc=com"
+
+// ldifMaxLine is the length at which LDIF lines are folded.
+const ldifMaxLine = 76
+
+// ldifObjectClasses are written for every exported person.
+var ldifObjectClasses = []string{"top", "person", "organizationalPerson", "inetOrgPerson"}
+
+// ldifPersonClasses are the object classes of entries imported as people.
+var ldifPersonClasses = map[string]bool{
+	"person":               true,
+	"organizationalperson": true,
+	"inetorgperson":        true,
+}
+
+// ldifRecord is an LDIF entry with lower-cased attribute names, without options.
+type ldifRecord struct {
+	// Line is the line number of the record's dn.
+	Line  int
+	DN    string
+	Attrs map[string][]string
+}
+
+// first returns the first value of the first of the attributes that is set.
+func (r ldifRecord) first(attrs ...string) string {
+	for _, a := range attrs {
+		if v := r.Attrs[a]; len(v) > 0 {
+			return v[0]
+		}
+	}
+	return ""
+}
+
+// parseBaseDN reads the baseDN query parameter.
+func parseBaseDN(v url.Values) string {
+	if dn := v.Get("baseDN"); dn != "" {
+		return dn
+	}
+	return defaultBaseDN
+}
+
+// ldifLines splits text into unfolded lines, dropping comments,
+// and returns the line number each starts on.
+// Records remain separated by empty lines.
+func ldifLines(text string) (lines []string, numbers []int) {
+	comment := false
+	for i, l := range strings.Split(text, "\n") {
+		l = strings.TrimSuffix(l, "\r")
+		if l != "" && l[0] == ' ' {
+			if !comment && len(lines) > 0 && lines[len(lines)-1] != "" {
+				lines[len(lines)-1] += l[1:]
+			}
+			continue
+		}
+		comment = strings.HasPrefix(l, "#")
+		if !comment {
+			lines = append(lines, l)
+			numbers = append(numbers, i+1)
+		}
+	}
+	return lines, numbers
+}
+
+// parseLDIFLine parses an attrval-spec: name[;options]: value, name:: base64 or name:< URL.
+func parseLDIFLine(line string, number int) (name, value string, err error) {
+	colon := strings.IndexByte(line, ':')
+	if colon <= 0 {
+		return "", "", fmt.Errorf("line %v: expected an attribute, got %q", number, line)
+	}
+	name = strings.ToLower(line[:colon])
+	if semi := strings.IndexByte(name, ';'); semi >= 0 {
+		name = name[:semi]
+	}
+	value = line[colon+1:]
+	switch {
+	case strings.HasPrefix(value, ":"):
+		b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value[1:]))
+		if err != nil {
+			return "", "", fmt.Errorf("line %v: invalid base64 value for %v", number, name)
+		}
+		return name, string(b), nil
+	case strings.HasPrefix(value, "<"):
+		return "", "", fmt.Errorf("line %v: URL values are not supported", number)
+	}
+	return name, strings.TrimLeft(value, " "), nil
+}
+
+// ldifPhoneTypes maps the phone number attributes of an entry to phone types, in the order they are read.
+var ldifPhoneTypes = []struct {
+	attr, typ string
+}{
+	{"telephonenumber", ""},
+	{"mobile", TypeMobile},
+	{"homephone", TypeHome},
+	{"facsimiletelephonenumber", TypeFax},
+}
+
+// ldifPerson maps an inetOrgPerson entry to a person.
+// If there is no givenName it is taken from cn, less any trailing sn.
+// Every mail and phone number is read, the first being the primary ones, preferring telephoneNumber
+// to mobile and homePhone. An address is read from street, l, st and postalCode; postalAddress is ignored.
+// The website is the URL of the first labeledURI, without its label.
+func ldifPerson(r ldifRecord) Person {
+	p := Person{
+		FirstName:    r.first("givenname", "gn"),
+		LastName:     r.first("sn", "surname"),
+		Organization: r.first("o", "organizationname"),
+		Department:   r.first("ou", "organizationalunitname"),
+		Title:        r.first("title"),
+		Notes:        r.first("description"),
+	}
+	if uri := strings.Fields(r.first("labeleduri")); len(uri) > 0 {
+		p.Website = uri[0]
+	}
+	for _, a := range []string{"mail", "email"} {
+		for _, v := range r.Attrs[a] {
+			p.Emails = append(p.Emails, Email{Value: v})
+		}
+	}
+	for _, t := range ldifPhoneTypes {
+		for _, v := range r.Attrs[t.attr] {
+			p.Phones = append(p.Phones, Phone{Type: t.typ, Value: v})
+		}
+	}
+	a := Address{Street: r.first("street"), City: r.first("l"), Region: r.first("st"), Postcode: r.first("postalcode")}
+	if !a.empty() {
+		p.Addresses = []Address{a}
+	}
+	p.normalise()
+	cn := r.first("cn", "commonname")
+	// personEntry fills in sn with the first name if there is no last name.
+	if p.LastName == p.FirstName && cn == p.FirstName {
+		p.LastName = ""
+	}
+	if p.FirstName == "" && cn != "" {
+		switch {
+		case p.LastName == "":
+			p.FirstName = cn
+		case cn != p.LastName && strings.HasSuffix(cn, " "+p.LastName):
+			p.FirstName = strings.TrimSuffix(cn, " "+p.LastName)
+		}
+	}
+	return p
+}
+
+// ldifRows decodes the entries of an LDIF file, one importRow per person entry.
+// Entries with an objectClass that is not a person, such as organizational units, are skipped.
+func ldifRows(r io.Reader) ([]importRow, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	text, err := decodeText(data, "")
+	if err != nil {
+		return nil, err
+	}
+	lines, numbers := ldifLines(text)
+	rows := []importRow{}
+	var record *ldifRecord
+	var recordErr error
+	finish := func() {
+		if record == nil {
+			return
+		}
+		if recordErr != nil {
+			rows = append(rows, importRow{Line: record.Line, Err: recordErr})
+		} else if classes := record.Attrs["objectclass"]; len(classes) == 0 || hasPersonClass(classes) {
+			rows = append(rows, importRow{Line: record.Line, Person: ldifPerson(*record)})
+		}
+		record, recordErr = nil, nil
+	}
+	for i, line := range lines {
+		if line == "" {
+			finish()
+			continue
+		}
+		name, value, err := parseLDIFLine(line, numbers[i])
+		switch {
+		case record == nil && err == nil && name == "version":
+			if value != "1" {
+				return nil, fmt.Errorf("unsupported LDIF version %q", value)
+			}
+		case record == nil && err == nil && name == "dn":
+			record = &ldifRecord{Line: numbers[i], DN: value, Attrs: map[string][]string{}}
+		case record == nil:
+			rows = append(rows, importRow{Line: numbers[i], Err: fmt.Errorf("expected dn, got %q", line)})
+		case recordErr != nil:
+		case err != nil:
+			recordErr = err
+		case name == "changetype" && !strings.EqualFold(value, "add"):
+			recordErr = fmt.Errorf("changetype %v is not supported", value)
+		default:
+			record.Attrs[name] = append(record.Attrs[name], value)
+		}
+	}
+	finish()
+	return rows, nil
+}
+
+// hasPersonClass reports whether any of the object classes is a person.
+func hasPersonClass(classes []string) bool {
+	for _, c := range classes {
+		if ldifPersonClasses[strings.ToLower(c)] {
+			return true
+		}
+	}
+	return false
+}
+
+// ldifDN returns the DN of a person under baseDN.
+func ldifDN(p *Person, baseDN string) string {
+	return "uid=" + strconv.Itoa(p.ID) + "," + baseDN
+}
+
+// ldifSafe reports whether v can be written as a SAFE-STRING rather than base64.
+func ldifSafe(v string) bool {
+	if v == "" {
+		return true
+	}
+	if v[0] == ' ' || v[0] == ':' || v[0] == '<' || v[len(v)-1] == ' ' {
+		return false
+	}
+	for i := 0; i < len(v); i++ {
+		if c := v[i]; c == 0 || c == '\n' || c == '\r' || c > 127 {
+			return false
+		}
+	}
+	return true
+}
+
+// writeLDIFAttr writes an attribute, base64 encoded if it is not a SAFE-STRING, folded at ldifMaxLine.
+func writeLDIFAttr(w *bufio.Writer, name, value string) {
+	line := name + ": " + value
+	if !ldifSafe(value) {
+		line = name + ":: " + base64.StdEncoding.EncodeToString([]byte(value))
+	}
+	for limit := ldifMaxLine; len(line) > limit; limit = ldifMaxLine - 1 {
+		w.WriteString(line[:limit])
+		w.WriteString("\n ")
+		line = line[limit:]
+	}
+	w.WriteString(line)
+	w.WriteString("\n")
+}
+
+// personEntry returns a person as an inetOrgPerson entry under baseDN.
+// sn is required by the schema, so the first name is used if there is no last name.
+// The primary phone number is the first telephoneNumber, whatever its type,
+// and the first address is also written as street, l, st and postalCode.
+// inetOrgPerson has no attributes for a nickname or birthday, so they are not written.
+func personEntry(p *Person, baseDN string) *ldap.Entry {
+	sn := p.LastName
+	if sn == "" {
+		sn = p.FirstName
+	}
+	e := &ldap.Entry{DN: ldifDN(p, baseDN), Attributes: []ldap.Attribute{
+		{Name: "objectClass", Values: ldifObjectClasses},
+		{Name: "uid", Values: []string{strconv.Itoa(p.ID)}},
+		{Name: "cn", Values: []string{strings.TrimSpace(p.FirstName + " " + p.LastName)}},
+	}}
+	if p.FirstName != "" {
+		e.Attributes = append(e.Attributes, ldap.Attribute{Name: "givenName", Values: []string{p.FirstName}})
+	}
+	e.Attributes = append(e.Attributes, ldap.Attribute{Name: "sn", Values: []string{sn}})
+	add := func(name string, values []string) {
+		if len(values) > 0 {
+			e.Attributes = append(e.Attributes, ldap.Attribute{Name: name, Values: values})
+		}
+	}
+	mail := []string{}
+	for _, m := range p.Emails {
+		mail = append(mail, m.Value)
+	}
+	add("mail", mail)
+	phones := map[string][]string{}
+	for i, ph := range p.Phones {
+		attr := phoneAttribute(i, ph.Type)
+		phones[attr] = append(phones[attr], ph.Value)
+	}
+	for _, attr := range []string{"telephoneNumber", "mobile", "homePhone", "facsimileTelephoneNumber"} {
+		add(attr, phones[attr])
+	}
+	postal := []string{}
+	for _, a := range p.Addresses {
+		postal = append(postal, strings.Join(a.lines(), "$"))
+	}
+	if len(p.Addresses) > 0 {
+		a := p.Addresses[0]
+		add("street", nonEmpty(a.Street))
+		add("l", nonEmpty(a.City))
+		add("st", nonEmpty(a.Region))
+		add("postalCode", nonEmpty(a.Postcode))
+	}
+	add("postalAddress", postal)
+	add("o", nonEmpty(p.Organization))
+	add("ou", nonEmpty(p.Department))
+	add("title", nonEmpty(p.Title))
+	add("labeledURI", nonEmpty(p.Website))
+	add("description", nonEmpty(p.Notes))
+	return e
+}
+
+// phoneAttribute returns the attribute personEntry lists the phone at index i with type typ under.
+func phoneAttribute(i int, typ string) string {
+	switch {
+	case i == 0:
+	case typ == TypeMobile:
+		return "mobile"
+	case typ == TypeHome:
+		return "homePhone"
+	case typ == TypeFax:
+		return "facsimileTelephoneNumber"
+	}
+	return "telephoneNumber"
+}
+
+// nonEmpty returns v as a single value, or no values if it is empty.
+func nonEmpty(v string) []string {
+	if v == "" {
+		return nil
+	}
+	return []string{v}
+}
+
+// writeLDIF writes a person's entry, see personEntry, followed by an empty line.
+func writeLDIF(w *bufio.Writer, p *Person, baseDN string) error {
+	e := personEntry(p, baseDN)
+	writeLDIFAttr(w, "dn", e.DN)
+	for _, a := range e.Attributes {
+		for _, v := range a.Values {
+			writeLDIFAttr(w, a.Name, v)
+		}
+	}
+	_, err := w.WriteString("\n")
+	return err
+}
@@ -0,0 +1,692 @@
+package app
+
+// Memory.go contains an in-memory PersonStore for tests and ephemeral deployments.
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStore is a PersonStore that keeps people in memory.
+// People in the trash stay in people, with DeletedAt set. Data is lost when the process exits.
+type MemoryStore struct {
+	mu     sync.RWMutex
+	people map[int]Person
+	fields map[string]CustomField
+	groups map[int]Group
+	rels   map[int]Relationship
+	photos map[int]Photo
+	audit  []AuditEntry
+	cards  map[string]int
+	uids   map[int]string
+	// lastID is the highest ID ever used, so the IDs of purged people are not given out again.
+	lastID int
+}
+
+// NewMemoryStore returns an empty MemoryStore.
+// People are copied in and out of the store, so callers never share their emails, phones or addresses with it.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{people: map[int]Person{}, fields: map[string]CustomField{}, groups: map[int]Group{}, rels: map[int]Relationship{}, photos: map[int]Photo{}, audit: []AuditEntry{}, cards: map[string]int{}, uids: map[int]string{}}
+}
+
+// Create inserts a new person.
+// If p.ID is 0 the next free ID is allocated and p.ID is set.
+// ErrExists will be returned if the ID is already in use, or is no higher than the highest ID ever used.
+func (m *MemoryStore) Create(p *Person) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if p.ID == 0 {
+		p.ID = m.nextID()
+	}
+	if _, ok := m.people[p.ID]; ok || p.ID <= m.lastID {
+		return ErrExists
+	}
+	p.normalise()
+	m.resolveGroups(p)
+	m.people[p.ID] = p.clone()
+	m.lastID = p.ID
+	return nil
+}
+
+// Get returns a specific person.
+func (m *MemoryStore) Get(id int) (Person, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	p, ok := m.people[id]
+	if !ok || p.DeletedAt != nil {
+		return Person{}, ErrNotFound
+	}
+	return p.clone(), nil
+}
+
+// List returns count people ordered by ID, starting at offset start.
+// Count of -1 returns all records
+func (m *MemoryStore) List(start, count int) ([]Person, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	people := make([]Person, 0, len(m.people))
+	for _, p := range m.people {
+		if p.DeletedAt == nil {
+			people = append(people, p.clone())
+		}
+	}
+	sort.Slice(people, func(i, j int) bool { return people[i].ID < people[j].ID })
+	if start > len(people) {
+		start = len(people)
+	}
+	people = people[start:]
+	if count >= 0 && count < len(people) {
+		people = people[:count]
+	}
+	if len(people) == 0 {
+		return nil, ErrNoPeople
+	}
+	return people, nil
+}
+
+// Walk calls fn for every person in ID order.
+// fn is called on a snapshot, so it may use the store.
+func (m *MemoryStore) Walk(fn func(p *Person) error) error {
+	people, err := m.List(0, -1)
+	if err == ErrNoPeople {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for i := range people {
+		if err := fn(&people[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Query returns a filtered, sorted page of people and the total number of matches.
+func (m *MemoryStore) Query(q PeopleQuery) ([]Person, int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	people := []Person{}
+	for _, p := range m.people {
+		if q.matches(&p) {
+			people = append(people, p.clone())
+		}
+	}
+	total := len(people)
+	sort.Slice(people, func(i, j int) bool { return q.less(&people[i], &people[j]) })
+	if q.AfterID > 0 {
+		i := sort.Search(len(people), func(i int) bool { return people[i].ID > q.AfterID })
+		people = people[i:]
+	}
+	start := q.Offset
+	if start > len(people) {
+		start = len(people)
+	}
+	people = people[start:]
+	if q.Limit >= 0 && q.Limit < len(people) {
+		people = people[:q.Limit]
+	}
+	return people, total, nil
+}
+
+// Search returns up to limit people matching q, best matches first.
+func (m *MemoryStore) Search(q string, limit int) ([]SearchResult, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	terms := searchTerms(q)
+	results := []SearchResult{}
+	if len(terms) == 0 {
+		return results, nil
+	}
+	for _, p := range m.people {
+		if p.DeletedAt != nil {
+			continue
+		}
+		if r, ok := searchPerson(p.clone(), terms); ok {
+			results = append(results, r)
+		}
+	}
+	return rankResults(results, limit), nil
+}
+
+// Update replaces a stored person.
+// An error will be returned if the person does not exist or is in the trash.
+func (m *MemoryStore) Update(p *Person) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if old, ok := m.people[p.ID]; !ok || old.DeletedAt != nil {
+		return ErrNotFound
+	}
+	p.normalise()
+	m.resolveGroups(p)
+	m.people[p.ID] = p.clone()
+	return nil
+}
+
+// Delete moves a person to the trash.
+// An error will be returned if the person does not exist or is already in the trash.
+func (m *MemoryStore) Delete(id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p, ok := m.people[id]
+	if !ok || p.DeletedAt != nil {
+		return ErrNotFound
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	p.DeletedAt = &now
+	m.people[id] = p
+	return nil
+}
+
+// Restore takes a person out of the trash.
+// An error will be returned if the person is not in the trash.
+func (m *MemoryStore) Restore(id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p, ok := m.people[id]
+	if !ok || p.DeletedAt == nil {
+		return ErrNotFound
+	}
+	p.DeletedAt = nil
+	m.people[id] = p
+	return nil
+}
+
+// Purge removes a person in the trash, their photo, and every relationship to or from them.
+// An error will be returned if the person is not in the trash.
+func (m *MemoryStore) Purge(id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if p, ok := m.people[id]; !ok || p.DeletedAt == nil {
+		return ErrNotFound
+	}
+	m.purge(id)
+	return nil
+}
+
+// PurgeDeleted removes everyone moved to the trash before the given time, like Purge,
+// and returns their IDs in ID order.
+func (m *MemoryStore) PurgeDeleted(before time.Time) ([]int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ids := []int{}
+	for id, p := range m.people {
+		if p.DeletedAt != nil && p.DeletedAt.Before(before) {
+			m.purge(id)
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	return ids, nil
+}
+
+// purge removes a person, their photo, and every relationship to or from them.
+// The caller must hold m.mu for writing.
+func (m *MemoryStore) purge(id int) {
+	delete(m.people, id)
+	delete(m.photos, id)
+	delete(m.uids, id)
+	for name, pid := range m.cards {
+		if pid == id {
+			delete(m.cards, name)
+		}
+	}
+	for rid, r := range m.rels {
+		if r.PersonID == id || r.RelatedID == id {
+			delete(m.rels, rid)
+		}
+	}
+}
+
+// nextID returns the highest ID ever used + 1. The caller must hold m.mu.
+func (m *MemoryStore) nextID() int {
+	return m.lastID + 1
+}
+
+// Import inserts each person with the next available ID, and sets their IDs.
+func (m *MemoryStore) Import(people []Person) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range people {
+		p := &people[i]
+		p.ID = m.nextID()
+		p.normalise()
+		m.resolveGroups(p)
+		m.people[p.ID] = p.clone()
+		m.lastID = p.ID
+	}
+	return len(people), nil
+}
+
+// Fields returns the custom field definitions in name order.
+func (m *MemoryStore) Fields() ([]CustomField, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	fields := []CustomField{}
+	for _, f := range m.fields {
+		f.Options = append([]string(nil), f.Options...)
+		fields = append(fields, f)
+	}
+	sort.Slice(fields, func(i, j int) bool { return fields[i].Name < fields[j].Name })
+	return fields, nil
+}
+
+// CreateField adds a custom field.
+// ErrExists will be returned if the name is already in use.
+func (m *MemoryStore) CreateField(f *CustomField) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.fields[f.Name]; ok {
+		return ErrExists
+	}
+	c := *f
+	c.Options = append([]string(nil), f.Options...)
+	m.fields[f.Name] = c
+	return nil
+}
+
+// UpdateField replaces a custom field.
+// An error will be returned if the field does not exist.
+func (m *MemoryStore) UpdateField(f *CustomField) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.fields[f.Name]; !ok {
+		return ErrNotFound
+	}
+	c := *f
+	c.Options = append([]string(nil), f.Options...)
+	m.fields[f.Name] = c
+	return nil
+}
+
+// DeleteField removes a custom field and every person's value for it.
+// An error will be returned if the field does not exist.
+func (m *MemoryStore) DeleteField(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.fields[name]; !ok {
+		return ErrNotFound
+	}
+	delete(m.fields, name)
+	for id, p := range m.people {
+		if _, ok := p.Custom[name]; ok {
+			delete(p.Custom, name)
+			if len(p.Custom) == 0 {
+				p.Custom = nil
+			}
+			m.people[id] = p
+		}
+	}
+	return nil
+}
+
+// resolveGroups replaces p.Groups with the names of the groups it names, in name order,
+// creating any that do not exist. The caller must hold m.mu for writing.
+func (m *MemoryStore) resolveGroups(p *Person) {
+	names := []string{}
+	for _, name := range p.Groups {
+		g, ok := m.findGroup(name)
+		if !ok {
+			g = Group{ID: m.nextGroupID(), Name: name}
+			m.groups[g.ID] = g
+		}
+		names = append(names, g.Name)
+	}
+	sort.Strings(names)
+	p.Groups = uniqueGroups(names)
+}
+
+// findGroup returns the group with the given name, ignoring case. The caller must hold m.mu.
+func (m *MemoryStore) findGroup(name string) (Group, bool) {
+	for _, g := range m.groups {
+		if strings.EqualFold(g.Name, name) {
+			return g, true
+		}
+	}
+	return Group{}, false
+}
+
+// nextGroupID returns the highest used group ID + 1. The caller must hold m.mu.
+func (m *MemoryStore) nextGroupID() int {
+	max := 0
+	for id := range m.groups {
+		if id > max {
+			max = id
+		}
+	}
+	return max + 1
+}
+
+// countMembers sets the number of people in g, leaving out people in the trash. The caller must hold m.mu.
+func (m *MemoryStore) countMembers(g *Group) {
+	g.Members = 0
+	for _, p := range m.people {
+		if p.DeletedAt == nil && p.inGroup(g.Name) {
+			g.Members++
+		}
+	}
+}
+
+// Groups returns every group in name order, with the number of people in it.
+func (m *MemoryStore) Groups() ([]Group, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	groups := []Group{}
+	for _, g := range m.groups {
+		m.countMembers(&g)
+		groups = append(groups, g)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].Name != groups[j].Name {
+			return groups[i].Name < groups[j].Name
+		}
+		return groups[i].ID < groups[j].ID
+	})
+	return groups, nil
+}
+
+// GetGroup returns the group with the given ID, or ErrNotFound.
+func (m *MemoryStore) GetGroup(id int) (Group, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	g, ok := m.groups[id]
+	if !ok {
+		return Group{}, ErrNotFound
+	}
+	m.countMembers(&g)
+	return g, nil
+}
+
+// CreateGroup adds a group with the next free group ID and sets g.ID.
+// ErrExists will be returned if the name is already in use.
+func (m *MemoryStore) CreateGroup(g *Group) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.findGroup(g.Name); ok {
+		return ErrExists
+	}
+	g.ID = m.nextGroupID()
+	c := *g
+	c.Members = 0
+	m.groups[g.ID] = c
+	return nil
+}
+
+// UpdateGroup renames a group, for every person in it, or changes its description.
+// ErrNotFound will be returned if the group does not exist, and ErrExists if the name is in use.
+func (m *MemoryStore) UpdateGroup(g *Group) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	old, ok := m.groups[g.ID]
+	if !ok {
+		return ErrNotFound
+	}
+	if other, ok := m.findGroup(g.Name); ok && other.ID != g.ID {
+		return ErrExists
+	}
+	c := *g
+	c.Members = 0
+	m.groups[g.ID] = c
+	for id, p := range m.people {
+		for i, name := range p.Groups {
+			if name == old.Name {
+				p.Groups[i] = g.Name
+				sort.Strings(p.Groups)
+				m.people[id] = p
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// DeleteGroup removes a group, and every person from it.
+// An error will be returned if the group does not exist.
+func (m *MemoryStore) DeleteGroup(id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	g, ok := m.groups[id]
+	if !ok {
+		return ErrNotFound
+	}
+	delete(m.groups, id)
+	for pid, p := range m.people {
+		groups := []string{}
+		for _, name := range p.Groups {
+			if name != g.Name {
+				groups = append(groups, name)
+			}
+		}
+		p.Groups = uniqueGroups(groups)
+		m.people[pid] = p
+	}
+	return nil
+}
+
+// Relationships returns the relationships of a person to people not in the trash, in ID order.
+func (m *MemoryStore) Relationships(personID int) ([]Relationship, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	rels := []Relationship{}
+	for _, r := range m.rels {
+		if r.PersonID == personID && m.people[r.RelatedID].DeletedAt == nil {
+			rels = append(rels, r)
+		}
+	}
+	sort.Slice(rels, func(i, j int) bool { return rels[i].ID < rels[j].ID })
+	return rels, nil
+}
+
+// CreateRelationship adds a relationship with the next free relationship ID and sets r.ID,
+// along with its inverse if it is bidirectional.
+// ErrNotFound will be returned if either person does not exist, and ErrExists if either relationship does.
+func (m *MemoryStore) CreateRelationship(r *Relationship) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, id := range []int{r.PersonID, r.RelatedID} {
+		if p, ok := m.people[id]; !ok || p.DeletedAt != nil {
+			return ErrNotFound
+		}
+	}
+	add := []*Relationship{r}
+	inv := r.inverse()
+	if r.Bidirectional {
+		add = append(add, &inv)
+	}
+	for _, a := range add {
+		for _, existing := range m.rels {
+			if existing.same(a) {
+				return ErrExists
+			}
+		}
+	}
+	for _, a := range add {
+		a.ID = m.nextRelationshipID()
+		m.rels[a.ID] = *a
+	}
+	return nil
+}
+
+// DeleteRelationship removes a relationship of a person, and its inverse if it is bidirectional.
+// An error will be returned if the person has no such relationship.
+func (m *MemoryStore) DeleteRelationship(personID, id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r, ok := m.rels[id]
+	if !ok || r.PersonID != personID {
+		return ErrNotFound
+	}
+	delete(m.rels, id)
+	if r.Bidirectional {
+		inv := r.inverse()
+		for rid, existing := range m.rels {
+			if existing.same(&inv) {
+				delete(m.rels, rid)
+			}
+		}
+	}
+	return nil
+}
+
+// nextRelationshipID returns the highest used relationship ID + 1. The caller must hold m.mu.
+func (m *MemoryStore) nextRelationshipID() int {
+	max := 0
+	for id := range m.rels {
+		if id > max {
+			max = id
+		}
+	}
+	return max + 1
+}
+
+// Photo returns a person's photo.
+func (m *MemoryStore) Photo(personID int) (Photo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	ph, ok := m.photos[personID]
+	if !ok {
+		return Photo{}, ErrNotFound
+	}
+	return ph, nil
+}
+
+// PutPhoto stores a person's photo, replacing any they have.
+// The images are copied, so the caller may reuse them.
+func (m *MemoryStore) PutPhoto(ph *Photo) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c := *ph
+	c.Data = append([]byte(nil), ph.Data...)
+	c.Thumbnail = append([]byte(nil), ph.Thumbnail...)
+	m.photos[ph.PersonID] = c
+	return nil
+}
+
+// DeletePhoto removes a person's photo.
+// An error will be returned if they have no photo.
+func (m *MemoryStore) DeletePhoto(personID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.photos[personID]; !ok {
+		return ErrNotFound
+	}
+	delete(m.photos, personID)
+	return nil
+}
+
+// CardNames returns the name of every card a client named, by person ID.
+func (m *MemoryStore) CardNames() (map[int]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	names := map[int]string{}
+	for name, id := range m.cards {
+		names[id] = name
+	}
+	return names, nil
+}
+
+// CardPerson returns the ID of the person whose card a client gave name, or ErrNotFound.
+func (m *MemoryStore) CardPerson(name string) (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	id, ok := m.cards[name]
+	if !ok {
+		return 0, ErrNotFound
+	}
+	return id, nil
+}
+
+// NameCard records the name a client gave a person's card.
+func (m *MemoryStore) NameCard(personID int, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cards[name] = personID
+	return nil
+}
+
+// CardUID returns the UID a client gave a person's card, or "" if none has.
+func (m *MemoryStore) CardUID(personID int) (string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.uids[personID], nil
+}
+
+// UIDPerson returns the ID of the person whose card a client gave uid, or ErrNotFound.
+func (m *MemoryStore) UIDPerson(uid string) (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for id, u := range m.uids {
+		if u == uid {
+			return id, nil
+		}
+	}
+	return 0, ErrNotFound
+}
+
+// SetCardUID records the UID a client gave a person's card.
+func (m *MemoryStore) SetCardUID(personID int, uid string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, u := range m.uids {
+		if u == uid {
+			delete(m.uids, id)
+		}
+	}
+	m.uids[personID] = uid
+	return nil
+}
+
+// Record appends entries to the audit log, setting their IDs.
+// The people in them are copied, so the caller may reuse them.
+func (m *MemoryStore) Record(entries []AuditEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range entries {
+		entries[i].ID = len(m.audit) + 1
+		e := entries[i]
+		e.Changes = append([]FieldChange{}, e.Changes...)
+		e.Before, e.After = auditSnapshot(e.Before), auditSnapshot(e.After)
+		m.audit = append(m.audit, e)
+	}
+	return nil
+}
+
+// Audit returns the page of audit entries selected by q, newest first, and the total number of matches.
+func (m *MemoryStore) Audit(q AuditQuery) ([]AuditEntry, int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	matched := []AuditEntry{}
+	for i := len(m.audit) - 1; i >= 0; i-- {
+		if q.matches(&m.audit[i]) {
+			matched = append(matched, m.copyAuditEntry(i))
+		}
+	}
+	total := len(matched)
+	if q.Offset >= total {
+		return []AuditEntry{}, total, nil
+	}
+	matched = matched[q.Offset:]
+	if q.Limit >= 0 && q.Limit < len(matched) {
+		matched = matched[:q.Limit]
+	}
+	return matched, total, nil
+}
+
+// GetAuditEntry returns the audit entry with the given ID, or ErrNotFound.
+func (m *MemoryStore) GetAuditEntry(id int) (AuditEntry, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if id < 1 || id > len(m.audit) {
+		return AuditEntry{}, ErrNotFound
+	}
+	return m.copyAuditEntry(id - 1), nil
+}
+
+// copyAuditEntry returns a copy of the audit entry at index i, so callers never share its people with the store.
+// The caller must hold m.mu.
+func (m *MemoryStore) copyAuditEntry(i int) AuditEntry {
+	e := m.audit[i]
+	e.Before, e.After = auditSnapshot(e.Before), auditSnapshot(e.After)
+	return e
+}
@@ -0,0 +1,196 @@
+// Package migrations applies ordered, numbered schema migrations to a database/sql database
+package migrations
+
+// Migrations.go contains the migration runner and the schema_version bookkeeping.
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+)
+
+const sqlVersionTableCreate = `
+CREATE TABLE IF NOT EXISTS schema_version
+(
+version INTEGER NOT NULL,
+applied_at TEXT NOT NULL,
+CONSTRAINT schema_version_pkey PRIMARY KEY (version)
+)`
+
+const sqlVersionRead = `
+SELECT version FROM schema_version ORDER BY version
+`
+
+// Versions are always integers, so they are formatted into the queries
+// to avoid depending on the driver's placeholder syntax.
+
+const sqlVersionInsert = `
+INSERT INTO schema_version (version, applied_at) VALUES (%d, CURRENT_TIMESTAMP)
+`
+
+const sqlVersionDelete = `
+DELETE FROM schema_version WHERE version = %d
+`
+
+// Migration is a single numbered change to the schema.
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Status is a migration along with whether it has been applied.
+type Status struct {
+	Migration
+	Applied bool
+}
+
+// Migrator applies a set of migrations to a database.
+type Migrator struct {
+	db         *sql.DB
+	migrations []Migration
+}
+
+// New returns a Migrator for the given migrations.
+// An error is returned if two migrations share a version number.
+func New(db *sql.DB, migrations []Migration) (*Migrator, error) {
+	ms := make([]Migration, len(migrations))
+	copy(ms, migrations)
+	sort.Slice(ms, func(i, j int) bool { return ms[i].Version < ms[j].Version })
+	for i := 1; i < len(ms); i++ {
+		if ms[i].Version == ms[i-1].Version {
+			return nil, fmt.Errorf("duplicate migration version %v", ms[i].Version)
+		}
+	}
+	return &Migrator{db: db, migrations: ms}, nil
+}
+
+// applied returns the set of applied migration versions.
+func (m *Migrator) applied() (map[int]bool, error) {
+	if _, err := m.db.Exec(sqlVersionTableCreate); err != nil {
+		return nil, fmt.Errorf("could not create schema_version table: %v", err.Error())
+	}
+	rows, err := m.db.Query(sqlVersionRead)
+	if err != nil {
+		return nil, fmt.Errorf("could not read schema_version: %v", err.Error())
+	}
+	defer rows.Close()
+	versions := map[int]bool{}
+	for rows.Next() {
+		v := 0
+		if err := rows.Scan(&v); err != nil {
+			return nil, fmt.Errorf("error getting row: %v", err.Error())
+		}
+		versions[v] = true
+	}
+	return versions, rows.Err()
+}
+
+// Status returns every known migration and whether it has been applied.
+func (m *Migrator) Status() ([]Status, error) {
+	applied, err := m.applied()
+	if err != nil {
+		return nil, err
+	}
+	status := make([]Status, len(m.migrations))
+	for i, mig := range m.migrations {
+		status[i] = Status{Migration: mig, Applied: applied[mig.Version]}
+	}
+	return status, nil
+}
+
+// Version returns the highest applied migration version, or 0 if none have been applied.
+func (m *Migrator) Version() (int, error) {
+	applied, err := m.applied()
+	if err != nil {
+		return 0, err
+	}
+	v := 0
+	for version := range applied {
+		if version > v {
+			v = version
+		}
+	}
+	return v, nil
+}
+
+// Latest returns the highest known migration version.
+func (m *Migrator) Latest() int {
+	if len(m.migrations) == 0 {
+		return 0
+	}
+	return m.migrations[len(m.migrations)-1].Version
+}
+
+// Up applies all pending migrations.
+func (m *Migrator) Up() error {
+	return m.To(m.Latest())
+}
+
+// Down rolls back the given number of applied migrations, newest first.
+func (m *Migrator) Down(steps int) error {
+	applied, err := m.applied()
+	if err != nil {
+		return err
+	}
+	for i := len(m.migrations) - 1; i >= 0 && steps > 0; i-- {
+		mig := m.migrations[i]
+		if !applied[mig.Version] {
+			continue
+		}
+		if err := m.run(mig, false); err != nil {
+			return err
+		}
+		steps--
+	}
+	return nil
+}
+
+// To migrates the database up or down so that exactly the migrations
+// numbered at or below version are applied.
+func (m *Migrator) To(version int) error {
+	applied, err := m.applied()
+	if err != nil {
+		return err
+	}
+	for i := len(m.migrations) - 1; i >= 0; i-- {
+		mig := m.migrations[i]
+		if mig.Version > version && applied[mig.Version] {
+			if err := m.run(mig, false); err != nil {
+				return err
+			}
+		}
+	}
+	for _, mig := range m.migrations {
+		if mig.Version <= version && !applied[mig.Version] {
+			if err := m.run(mig, true); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// run applies (up) or rolls back (down) a single migration in a transaction.
+func (m *Migrator) run(mig Migration, up bool) error {
+	query, record, direction := mig.Down, sqlVersionDelete, "down"
+	if up {
+		query, record, direction = mig.Up, sqlVersionInsert, "up"
+	}
+	tx, err := m.db.Begin()
+	if err != nil {
+		return fmt.Errorf("could not start migration %v: %v", mig.Version, err.Error())
+	}
+	if query != "" {
+		if _, err := tx.Exec(query); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %v (%v) %v failed: %v", mig.Version, mig.Name, direction, err.Error())
+		}
+	}
+	if _, err := tx.Exec(fmt.Sprintf(record, mig.Version)); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("could not record migration %v: %v", mig.Version, err.Error())
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,78 @@
+package migrations
+
+import (
+	"database/sql"
+	"os"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3" // SQLITE3 driver for database/sql
+)
+
+const TestDBName = "TestMigrations.sqlitedb"
+
+var testMigrations = []Migration{
+	{Version: 2, Name: "add b", Up: "CREATE TABLE b (id INTEGER)", Down: "DROP TABLE b"},
+	{Version: 1, Name: "add a", Up: "CREATE TABLE a (id INTEGER)", Down: "DROP TABLE a"},
+	{Version: 3, Name: "broken", Up: "CREATE TABLE", Down: ""},
+}
+
+func tableExists(t *testing.T, db *sql.DB, name string) bool {
+	n := 0
+	err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?", name).Scan(&n)
+	if err != nil {
+		t.Fatalf("could not check table %v: %v", name, err.Error())
+	}
+	return n == 1
+}
+
+func TestMigrator(t *testing.T) {
+	db, err := sql.Open("sqlite3", TestDBName)
+	if err != nil {
+		t.Fatalf("could not open database: %v", err.Error())
+	}
+	defer os.Remove(TestDBName)
+	defer db.Close()
+
+	m, err := New(db, testMigrations)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	if v, err := m.Version(); err != nil || v != 0 {
+		t.Errorf("Version() on new database = %v, %v, want 0", v, err)
+	}
+	if err := m.Up(); err == nil {
+		t.Errorf("Up() with broken migration expected error")
+	}
+	if v, _ := m.Version(); v != 2 {
+		t.Errorf("Version() after failed Up() = %v, want 2", v)
+	}
+	if !tableExists(t, db, "a") || !tableExists(t, db, "b") {
+		t.Errorf("Up() did not create tables a and b")
+	}
+	status, err := m.Status()
+	if err != nil || len(status) != 3 || !status[0].Applied || !status[1].Applied || status[2].Applied {
+		t.Errorf("Status() = %+v, %v", status, err)
+	}
+	if err := m.Down(1); err != nil {
+		t.Errorf("Down(1) error = %v", err)
+	}
+	if v, _ := m.Version(); v != 1 || tableExists(t, db, "b") {
+		t.Errorf("Down(1) left version %v", v)
+	}
+	if err := m.To(0); err != nil {
+		t.Errorf("To(0) error = %v", err)
+	}
+	if tableExists(t, db, "a") {
+		t.Errorf("To(0) did not drop table a")
+	}
+	if err := m.To(2); err != nil {
+		t.Errorf("To(2) error = %v", err)
+	}
+	if v, _ := m.Version(); v != 2 {
+		t.Errorf("To(2) left version %v", v)
+	}
+
+	if _, err := New(db, append(testMigrations, Migration{Version: 1})); err == nil {
+		t.Errorf("New() with duplicate versions expected error")
+	}
+}
@@ -5,153 +5,822 @@ package app
 import (
 	"database/sql"
 	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/unixblackhole/didactic-tribble/app/migrations"
 )
 
 // Person is an address book entry for a person.
+// Email and Phone are the primary email address and phone number, the first of Emails and Phones;
+// stores keep them in step, see normalise.
 type Person struct {
-	id        int
-	FirstName string `json:"FirstName"`
-	LastName  string `json:"LastName"`
-	Email     string `json:"Email"`
-	Phone     string `json:"Phone"`
+	ID           int    `json:"ID"`
+	FirstName    string `json:"FirstName"`
+	LastName     string `json:"LastName"`
+	Email        string `json:"Email"`
+	Phone        string `json:"Phone"`
+	Nickname     string `json:"Nickname"`
+	Organization string `json:"Organization"`
+	Department   string `json:"Department"`
+	Title        string `json:"Title"`
+	// Birthday is a date, YYYY-MM-DD, or --MM-DD if the year is not known.
+	Birthday string `json:"Birthday"`
+	// Website is an absolute http or https URL.
+	Website   string    `json:"Website"`
+	Notes     string    `json:"Notes"`
+	Emails    []Email   `json:"Emails,omitempty"`
+	Phones    []Phone   `json:"Phones,omitempty"`
+	Addresses []Address `json:"Addresses,omitempty"`
+	// Custom holds the values of custom fields by field name, see CustomField.
+	Custom map[string]string `json:"Custom,omitempty"`
+	// Groups are the names of the groups the person is in, in name order.
+	// Stores create any group that does not exist yet.
+	Groups []string `json:"Groups,omitempty"`
+	// DeletedAt is when the person was moved to the trash, or nil if they are not in it.
+	// Only PersonStore.Delete sets it.
+	DeletedAt *time.Time `json:"DeletedAt,omitempty"`
+	// photo, if set, is written in the person's vCard. Stores never set it, see App.attachPhoto.
+	photo *Photo
+	// uid, if set, is the UID a CardDAV client gave the person's card. Stores never set it, see App.attachCard.
+	uid string
+}
+
+// dbFields returns pointers to a person's columns of the people table, in the order they are selected.
+func (p *Person) dbFields() []interface{} {
+	return []interface{}{&p.ID, &p.FirstName, &p.LastName, &p.Email, &p.Phone,
+		&p.Organization, &p.Title, &p.Department, &p.Nickname, &p.Birthday, &p.Website, &p.Notes, &p.DeletedAt}
+}
+
+// dbValues returns a person's columns of the people table other than the ID and deleted_at,
+// in the order they are written.
+func (p *Person) dbValues() []interface{} {
+	return []interface{}{p.FirstName, p.LastName, p.Email, p.Phone,
+		p.Organization, p.Title, p.Department, p.Nickname, p.Birthday, p.Website, p.Notes}
+}
+
+// database is a database connection along with the SQL dialect it speaks.
+type database struct {
+	*sql.DB
+	dialect
 }
 
-// connectDatabase Creates our database connection
-// An error is returned if ther is an issue creating the database or the table.
-func connectDatabase(name string) (*sql.DB, error) {
-	db, err := sql.Open("sqlite3", name)
+// connectDatabase Creates our database connection, and applies any pending migrations if migrate is set.
+// An error is returned if ther is an issue creating the database or migrating the schema.
+func connectDatabase(d dialect, name string, migrate bool) (*database, error) {
+	if d.dsnOptions != "" {
+		sep := "?"
+		if strings.Contains(name, "?") {
+			sep = "&"
+		}
+		name += sep + d.dsnOptions
+	}
+	conn, err := sql.Open(d.driver, name)
 	if err != nil {
 		fmt.Printf("could not open database: %v", err.Error())
 		return nil, err
 	}
-	err = db.Ping()
+	err = conn.Ping()
 	if err != nil {
 		return nil, fmt.Errorf("could not open database: %v", err.Error())
 	}
-	err = createTable(db)
+	db := &database{DB: conn, dialect: d}
+	if d.check != nil {
+		if err := d.check(db); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if !migrate {
+		return db, nil
+	}
+	err = migrateDatabase(db)
 	if err != nil {
-		fmt.Printf("Could not create table: %v", err.Error())
+		fmt.Printf("Could not migrate database: %v", err.Error())
 		return nil, err
 	}
 	return db, nil
 }
 
-// createTable creates an empty sql table to store the data in.
-func createTable(db *sql.DB) error {
-	if _, err := db.Exec(sqlTableCreate); err != nil {
+// migrateDatabase applies all pending schema migrations to the database.
+func migrateDatabase(db *database) error {
+	m, err := migrations.New(db.DB, db.migrations)
+	if err != nil {
 		return err
 	}
-	return nil
+	return m.Up()
 }
 
 // clearTable deletes any data in the database.
-func clearTable(db *sql.DB) error {
-	if _, err := db.Exec(sqlTableClear); err != nil {
+func clearTable(db *database) error {
+	if _, err := db.Exec(db.tableClear); err != nil {
 		return err
 	}
 	return nil
 }
 
-// dbGetNextID gets the highest used ID number in the database + 1
-func dbGetNextID(db *sql.DB) (int, error) {
-	row := db.QueryRow(sqlGetNextID)
-	id := 0
-	err := row.Scan(&id)
+// maxCreateAttempts is the number of times allocating an ID is retried
+// if it races with a person being created with an explicit ID.
+const maxCreateAttempts = 3
+
+// inTx runs f in a transaction, committing if it returns nil and rolling back otherwise.
+func (db *database) inTx(f func(tx *sql.Tx) error) error {
+	tx, err := db.Begin()
 	if err != nil {
-		return 0, fmt.Errorf("error getting row: %v", err.Error())
+		return fmt.Errorf("could not start transaction: %v", err.Error())
 	}
-	return id, nil
+	if err := f(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// dbCreateNewPerson inserts p and its details with the next free ID inside tx, and sets p.ID.
+// The ID is allocated by the database so concurrent creates cannot collide.
+func (p *Person) dbCreateNewPerson(db *database, tx *sql.Tx) error {
+	if db.lockIDs != "" {
+		if _, err := tx.Exec(db.lockIDs); err != nil {
+			return fmt.Errorf("could not lock IDs: %v", err.Error())
+		}
+	}
+	err := tx.QueryRow(db.createNew, p.dbValues()...).Scan(&p.ID)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return ErrExists
+		}
+		return err
+	}
+	if err := dbUseID(db, tx, p.ID); err != nil {
+		return err
+	}
+	return p.dbCreateDetails(db, tx)
+}
+
+// dbUseID raises the highest used person ID to id inside tx, if it is lower.
+func dbUseID(db *database, tx *sql.Tx, id int) error {
+	if _, err := tx.Exec(db.rebind(sqlUseID), id, id); err != nil {
+		return fmt.Errorf("could not record the person ID: %v", err.Error())
+	}
+	return nil
 }
 
 // dbGetPeople returns a slice of Person(s) and error.
 // db is a Database connection, Start is the begining offset,
 // and count is the number of records to return.
 // Count of -1 returns all records
-func dbGetPeople(db *sql.DB, start, count int) ([]Person, error) {
-	rows, err := db.Query(sqlReadPeople, count, start)
+func dbGetPeople(db *database, start, count int) ([]Person, error) {
+	rows, err := db.Query(db.readPeople, count, start)
 	if err != nil {
 		return nil, fmt.Errorf("error getting people: %v", err.Error())
 	}
+	defer rows.Close()
 	People := []Person{}
 	for rows.Next() {
 		p := Person{}
-		err = rows.Scan(&p.id, &p.FirstName, &p.LastName, &p.Email, &p.Phone)
+		err = rows.Scan(p.dbFields()...)
 		if err != nil {
 			return nil, fmt.Errorf("error getting row: %v", err.Error())
 		}
 		People = append(People, p)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error getting people: %v", err.Error())
+	}
 	if len(People) == 0 {
-		return nil, fmt.Errorf("no people returned")
+		return nil, ErrNoPeople
+	}
+	return People, dbLoadDetails(db, People)
+}
+
+// dbWalkPeople calls fn for each person in the database in ID order,
+// reading them and their details detailsBatch people at a time.
+func dbWalkPeople(db *database, fn func(p *Person) error) error {
+	after := 0
+	for {
+		people, err := dbWalkBatch(db, after)
+		if err != nil {
+			return err
+		}
+		for i := range people {
+			if err := fn(&people[i]); err != nil {
+				return err
+			}
+		}
+		if len(people) < detailsBatch {
+			return nil
+		}
+		after = people[len(people)-1].ID
+	}
+}
+
+// dbWalkBatch returns the next detailsBatch people with IDs after after.
+func dbWalkBatch(db *database, after int) ([]Person, error) {
+	rows, err := db.Query(db.rebind(sqlWalkPeople), after, detailsBatch)
+	if err != nil {
+		return nil, fmt.Errorf("error getting people: %v", err.Error())
+	}
+	defer rows.Close()
+	people := []Person{}
+	for rows.Next() {
+		p := Person{}
+		if err := rows.Scan(p.dbFields()...); err != nil {
+			return nil, fmt.Errorf("error getting row: %v", err.Error())
+		}
+		people = append(people, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error getting people: %v", err.Error())
+	}
+	rows.Close()
+	return people, dbLoadDetails(db, people)
+}
+
+// dbQueryPeople returns the page of people selected by q and the total number of matches.
+func dbQueryPeople(db *database, q PeopleQuery) ([]Person, int, error) {
+	where, args := []string{}, []interface{}{}
+	filter := func(clause string, arg interface{}) {
+		args = append(args, arg)
+		where = append(where, fmt.Sprintf(clause, db.bind(len(args))))
+	}
+	if q.FirstName != "" {
+		filter("fname = %v", q.FirstName)
+	}
+	if q.LastName != "" {
+		filter("lname = %v", q.LastName)
+	}
+	if q.Email != "" {
+		filter(detailFilter(conditionDetails["email"], "d.value = %v"), q.Email)
+	}
+	if q.Phone != "" {
+		filter(detailFilter(conditionDetails["phone"], "d.value = %v"), q.Phone)
+	}
+	if q.EmailDomain != "" {
+		filter(detailFilter(conditionDetails["email"], `LOWER(d.value) LIKE %v ESCAPE '\'`), "%@"+escapeLike(strings.ToLower(q.EmailDomain)))
+	}
+	bind := func(arg interface{}) string {
+		args = append(args, arg)
+		return db.bind(len(args))
+	}
+	for _, name := range q.customNames() {
+		where = append(where, customFilter(name, q.Custom[name], bind))
 	}
-	return People, nil
+	if q.Group != "" {
+		where = append(where, groupFilter(q.Group, bind))
+	}
+	if q.Where != nil {
+		where = append(where, q.Where.sql(bind))
+	}
+	switch q.Deleted {
+	case DeletedInclude:
+	case DeletedOnly:
+		where = append(where, "deleted_at IS NOT NULL")
+	default:
+		where = append(where, "deleted_at IS NULL")
+	}
+	cond := ""
+	if len(where) > 0 {
+		cond = " WHERE " + strings.Join(where, " AND ")
+	}
+	total := 0
+	if err := db.QueryRow(sqlCountPeople+cond, args...).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("error counting people: %v", err.Error())
+	}
+
+	if q.AfterID > 0 {
+		filter("id > %v", q.AfterID)
+		cond = " WHERE " + strings.Join(where, " AND ")
+	}
+	order := []string{}
+	for _, sf := range q.Sort {
+		col := sortColumns[sf.Field]
+		if sf.Desc {
+			col += " DESC"
+		}
+		order = append(order, col)
+	}
+	order = append(order, "id")
+	limit := db.noLimit
+	if q.Limit >= 0 {
+		limit = strconv.Itoa(q.Limit)
+	}
+	query := fmt.Sprintf("%v%v ORDER BY %v LIMIT %v OFFSET %v",
+		sqlQueryPeople, cond, strings.Join(order, ", "), limit, q.Offset)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error getting people: %v", err.Error())
+	}
+	defer rows.Close()
+	people := []Person{}
+	for rows.Next() {
+		p := Person{}
+		if err := rows.Scan(p.dbFields()...); err != nil {
+			return nil, 0, fmt.Errorf("error getting row: %v", err.Error())
+		}
+		people = append(people, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("error getting people: %v", err.Error())
+	}
+	rows.Close()
+	return people, total, dbLoadDetails(db, people)
+}
+
+// escapeLike escapes the LIKE wildcards in s.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+// validate checks a person's fields, returning a FieldError for each invalid field.
+func (p *Person) validate() []FieldError {
+	errs := []FieldError{}
+	if strings.TrimSpace(p.FirstName) == "" && strings.TrimSpace(p.LastName) == "" {
+		errs = append(errs, FieldError{Field: "FirstName", Reason: "FirstName or LastName is required"})
+	}
+	if p.Email != "" && !validEmail(p.Email) {
+		errs = append(errs, FieldError{Field: "Email", Reason: "not a valid email address"})
+	}
+	if p.Phone != "" && !validPhone.MatchString(p.Phone) {
+		errs = append(errs, FieldError{Field: "Phone", Reason: "not a valid phone number"})
+	}
+	if p.Birthday != "" {
+		if d, hasYear, err := parseBirthday(p.Birthday); err != nil {
+			errs = append(errs, FieldError{Field: "Birthday", Reason: "must be a date, YYYY-MM-DD, or --MM-DD without the year"})
+		} else if hasYear && d.After(time.Now()) {
+			errs = append(errs, FieldError{Field: "Birthday", Reason: "must not be in the future"})
+		}
+	}
+	if p.Website != "" && !validWebURL(p.Website) {
+		errs = append(errs, FieldError{Field: "Website", Reason: "not an absolute http or https URL"})
+	}
+	errs = append(errs, p.validateGroups()...)
+	return append(errs, p.validateContact()...)
+}
+
+// validWebURL reports whether s is an absolute http or https URL with a host.
+func validWebURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// validPhone matches phone numbers made of digits and common separators.
+var validPhone = regexp.MustCompile(`^\+?[0-9 ().\-/]*[0-9][0-9 ().\-/]*( ?(x|ext\.?) ?[0-9]+)?$`)
+
+// parseBirthday parses a birthday, YYYY-MM-DD, or --MM-DD if the year is not known.
+// Birthdays without a year are returned in 2000, a leap year, so --02-29 is valid.
+func parseBirthday(b string) (d time.Time, hasYear bool, err error) {
+	if strings.HasPrefix(b, "--") {
+		d, err = time.Parse("2006-01-02", "2000"+b[1:])
+		return d, false, err
+	}
+	d, err = time.Parse("2006-01-02", b)
+	return d, true, err
 }
 
-// GetHeaders returns a person's headers (fields names)
+// GetHeaders returns a person's headers (fields names), the header row of a CSV export.
 func (p *Person) GetHeaders() []string {
-	return []string{
-		"FirstName",
-		"LastName",
-		"Email",
-		"Phone",
+	headers := make([]string, len(personColumns))
+	for i, c := range personColumns {
+		headers[i] = c.Header
 	}
+	return headers
 }
 
-// ToSlice returns a person as a slice of fields
+// ToSlice returns a person as a slice of fields, in the order of GetHeaders.
 func (p *Person) ToSlice() []string {
-	return []string{
-		p.FirstName,
-		p.LastName,
-		p.Email,
-		p.Phone,
+	values := make([]string, len(personColumns))
+	for i, c := range personColumns {
+		values[i] = c.get(p)
 	}
+	return values
 }
 
-// dbCreatePerson Inserts a new person into the database.
-// An error will be returned if the ID is already in use.
-func (p *Person) dbCreatePerson(db *sql.DB) error {
-	if _, err := db.Exec(sqlCreatePerson,
-		p.id, p.FirstName, p.LastName, p.Email, p.Phone); err != nil {
+// dbCreatePerson Inserts a new person and their details into the database inside tx.
+// ErrExists will be returned if the ID is already in use, or is no higher than the highest ID ever used.
+func (p *Person) dbCreatePerson(db *database, tx *sql.Tx) error {
+	if db.lockIDs != "" {
+		if _, err := tx.Exec(db.lockIDs); err != nil {
+			return fmt.Errorf("could not lock IDs: %v", err.Error())
+		}
+	}
+	last := 0
+	if err := tx.QueryRow(sqlReadLastID).Scan(&last); err != nil {
+		return fmt.Errorf("could not read the highest person ID: %v", err.Error())
+	}
+	if p.ID <= last {
+		return ErrExists
+	}
+	if _, err := tx.Exec(db.createPerson, append([]interface{}{p.ID}, p.dbValues()...)...); err != nil {
+		if isUniqueViolation(err) {
+			return ErrExists
+		}
 		return err
 	}
-	return nil
+	if err := dbUseID(db, tx, p.ID); err != nil {
+		return err
+	}
+	return p.dbCreateDetails(db, tx)
 }
 
 // dbGetPerson Gets a specific person from the database.
 // An error will be returned if there are no people in the database.
-func (p *Person) dbGetPerson(db *sql.DB, id int) error {
-	row := db.QueryRow(sqlReadPerson, id)
-	err := row.Scan(&p.id, &p.FirstName, &p.LastName, &p.Email, &p.Phone)
+func (p *Person) dbGetPerson(db *database, id int) error {
+	row := db.QueryRow(db.readPerson, id)
+	err := row.Scan(p.dbFields()...)
 	if err != nil {
-		if err.Error() == "sql: no rows in result set" {
-			return fmt.Errorf("ID not found")
+		if err == sql.ErrNoRows {
+			return ErrNotFound
 		}
 		return fmt.Errorf("error getting row: %v", err.Error())
 	}
+	people := []Person{*p}
+	if err := dbLoadDetails(db, people); err != nil {
+		return err
+	}
+	*p = people[0]
 	return nil
 }
 
-// dbUpdatePerson Updates a specified person in the database.
+// dbUpdatePerson Updates a specified person and their details in the database.
 // An error will be returned if the person is not already in the database.
-func (p *Person) dbUpdatePerson(db *sql.DB) error {
-	prev := Person{}
-	err := prev.dbGetPerson(db, p.id)
+func (p *Person) dbUpdatePerson(db *database) error {
+	return db.inTx(func(tx *sql.Tx) error {
+		res, err := tx.Exec(db.updatePerson, append(p.dbValues(), p.ID)...)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return ErrNotFound
+		}
+		return p.dbUpdateDetails(db, tx)
+	})
+}
+
+// dbDeletePerson Moves a specified person to the trash, setting p.DeletedAt.
+// ErrNotFound will be returned if the person is not in the database, or already in the trash.
+func (p *Person) dbDeletePerson(db *database) error {
+	now := time.Now().UTC().Truncate(time.Second)
+	res, err := db.Exec(db.deletePerson, now, p.ID)
 	if err != nil {
 		return err
 	}
-	if _, err := db.Exec(sqlUpdatePerson,
-		p.FirstName, p.LastName, p.Email, p.Phone, p.id); err != nil {
+	if n, err := res.RowsAffected(); err != nil {
 		return err
+	} else if n == 0 {
+		return ErrNotFound
 	}
+	p.DeletedAt = &now
 	return nil
 }
 
-// dbDeletePerson Deletes a specified person from the database.
-// An error will be returned if the person is not already in the database.
-func (p *Person) dbDeletePerson(db *sql.DB) error {
-	if _, err := db.Exec(sqlDeletePerson,
-		p.id); err != nil {
+// dbExecTrash runs a statement changing the person with the given ID in the trash,
+// returning ErrNotFound if it changed nobody.
+func dbExecTrash(db *database, query string, id int) error {
+	res, err := db.Exec(db.rebind(query), id)
+	if err != nil {
 		return err
 	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
 	return nil
 }
+
+// SQLStore is a PersonStore backed by a SQL database.
+type SQLStore struct {
+	db *database
+}
+
+// OpenStore opens a SQLStore for the given DSN, applying any pending migrations if migrate is set.
+// DSNs starting with postgres:// or postgresql:// open a PostgreSQL database,
+// anything else is treated as the path to a SQLite database.
+func OpenStore(dsn string, migrate bool) (*SQLStore, error) {
+	d := sqliteDialect
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		d = postgresDialect
+	}
+	db, err := connectDatabase(d, dsn, migrate)
+	if err != nil {
+		return nil, err
+	}
+	return &SQLStore{db: db}, nil
+}
+
+// NewSQLiteStore opens (or creates) the SQLite database at name.
+func NewSQLiteStore(name string) (*SQLStore, error) {
+	db, err := connectDatabase(sqliteDialect, name, true)
+	if err != nil {
+		return nil, err
+	}
+	return &SQLStore{db: db}, nil
+}
+
+// NewPostgresStore connects to the PostgreSQL database described by dsn.
+func NewPostgresStore(dsn string) (*SQLStore, error) {
+	db, err := connectDatabase(postgresDialect, dsn, true)
+	if err != nil {
+		return nil, err
+	}
+	return &SQLStore{db: db}, nil
+}
+
+// Migrator returns a schema migrator for the store's database.
+func (s *SQLStore) Migrator() (*migrations.Migrator, error) {
+	return migrations.New(s.db.DB, s.db.migrations)
+}
+
+// Close closes the underlying database connection.
+func (s *SQLStore) Close() error {
+	return s.db.Close()
+}
+
+// Create inserts a new person into the database.
+// If p.ID is 0 the next free ID is allocated and p.ID is set.
+func (s *SQLStore) Create(p *Person) error {
+	p.normalise()
+	if p.ID != 0 {
+		return s.db.inTx(func(tx *sql.Tx) error {
+			return p.dbCreatePerson(s.db, tx)
+		})
+	}
+	var err error
+	for i := 0; i < maxCreateAttempts; i++ {
+		err = s.db.inTx(func(tx *sql.Tx) error {
+			return p.dbCreateNewPerson(s.db, tx)
+		})
+		if err != ErrExists {
+			return err
+		}
+	}
+	return err
+}
+
+// Get returns a specific person from the database.
+func (s *SQLStore) Get(id int) (Person, error) {
+	p := Person{}
+	err := p.dbGetPerson(s.db, id)
+	return p, err
+}
+
+// List returns a slice of people from the database.
+func (s *SQLStore) List(start, count int) ([]Person, error) {
+	return dbGetPeople(s.db, start, count)
+}
+
+// Walk calls fn for every person in the database in ID order.
+func (s *SQLStore) Walk(fn func(p *Person) error) error {
+	return dbWalkPeople(s.db, fn)
+}
+
+// Query returns a filtered, sorted page of people from the database.
+func (s *SQLStore) Query(q PeopleQuery) ([]Person, int, error) {
+	return dbQueryPeople(s.db, q)
+}
+
+// Search returns up to limit people matching q, best matches first.
+func (s *SQLStore) Search(q string, limit int) ([]SearchResult, error) {
+	terms := searchTerms(q)
+	if len(terms) == 0 {
+		return []SearchResult{}, nil
+	}
+	results, err := dbSearchPeople(s.db, terms, limit)
+	if err != nil {
+		return nil, err
+	}
+	people := make([]Person, len(results))
+	for i := range results {
+		people[i] = results[i].Person
+	}
+	if err := dbLoadDetails(s.db, people); err != nil {
+		return nil, err
+	}
+	for i := range results {
+		results[i].Person = people[i]
+	}
+	return results, nil
+}
+
+// Update updates a person in the database.
+func (s *SQLStore) Update(p *Person) error {
+	p.normalise()
+	return p.dbUpdatePerson(s.db)
+}
+
+// Delete moves a person to the trash.
+func (s *SQLStore) Delete(id int) error {
+	p := Person{ID: id}
+	return p.dbDeletePerson(s.db)
+}
+
+// Restore takes a person out of the trash.
+func (s *SQLStore) Restore(id int) error {
+	return dbExecTrash(s.db, sqlRestorePerson, id)
+}
+
+// Purge deletes a person in the trash from the database. Their details, memberships,
+// relationships and photo are deleted with them by the foreign keys.
+func (s *SQLStore) Purge(id int) error {
+	return dbExecTrash(s.db, sqlPurgePerson, id)
+}
+
+// PurgeDeleted deletes everyone moved to the trash before the given time from the database,
+// and returns their IDs.
+func (s *SQLStore) PurgeDeleted(before time.Time) ([]int, error) {
+	rows, err := s.db.Query(s.db.rebind(sqlPurgeDeleted), before.UTC())
+	if err != nil {
+		return nil, fmt.Errorf("error purging people: %v", err.Error())
+	}
+	defer rows.Close()
+	ids := []int{}
+	for rows.Next() {
+		id := 0
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("error getting row: %v", err.Error())
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// Import inserts each person with the next available ID in a single transaction, and sets their IDs.
+func (s *SQLStore) Import(people []Person) (int, error) {
+	err := s.db.inTx(func(tx *sql.Tx) error {
+		for i := range people {
+			p := &people[i]
+			p.ID = 0
+			p.normalise()
+			if err := p.dbCreateNewPerson(s.db, tx); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(people), nil
+}
+
+// Fields returns the custom field definitions in name order.
+func (s *SQLStore) Fields() ([]CustomField, error) {
+	return dbReadCustomFields(s.db)
+}
+
+// CreateField adds a custom field to the database.
+// ErrExists will be returned if the name is already in use.
+func (s *SQLStore) CreateField(f *CustomField) error {
+	if _, err := s.db.Exec(s.db.rebind(sqlCreateCustomField), append([]interface{}{f.Name}, f.dbValues()...)...); err != nil {
+		if isUniqueViolation(err) {
+			return ErrExists
+		}
+		return err
+	}
+	return nil
+}
+
+// UpdateField replaces a custom field in the database.
+// An error will be returned if the field does not exist.
+func (s *SQLStore) UpdateField(f *CustomField) error {
+	res, err := s.db.Exec(s.db.rebind(sqlUpdateCustomField), append(f.dbValues(), f.Name)...)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// DeleteField removes a custom field from the database, and with it every person's value for it.
+// An error will be returned if the field does not exist.
+func (s *SQLStore) DeleteField(name string) error {
+	res, err := s.db.Exec(s.db.rebind(sqlDeleteCustomField), name)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Groups returns every group in name order, with the number of people in it.
+func (s *SQLStore) Groups() ([]Group, error) {
+	return dbReadGroups(s.db, sqlReadGroups)
+}
+
+// GetGroup returns the group with the given ID, or ErrNotFound.
+func (s *SQLStore) GetGroup(id int) (Group, error) {
+	groups, err := dbReadGroups(s.db, sqlReadGroup, id)
+	if err != nil {
+		return Group{}, err
+	}
+	if len(groups) == 0 {
+		return Group{}, ErrNotFound
+	}
+	return groups[0], nil
+}
+
+// CreateGroup adds a group to the database with the next free ID and sets g.ID.
+// ErrExists will be returned if the name is already in use.
+func (s *SQLStore) CreateGroup(g *Group) error {
+	return s.db.inTx(func(tx *sql.Tx) error {
+		return g.dbCreateGroup(s.db, tx)
+	})
+}
+
+// UpdateGroup renames a group in the database or changes its description.
+// ErrNotFound will be returned if the group does not exist, and ErrExists if the name is in use.
+func (s *SQLStore) UpdateGroup(g *Group) error {
+	res, err := s.db.Exec(s.db.rebind(sqlUpdateGroup), g.Name, g.Description, g.ID)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return ErrExists
+		}
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// DeleteGroup removes a group from the database, and with it every membership of it.
+// An error will be returned if the group does not exist.
+func (s *SQLStore) DeleteGroup(id int) error {
+	res, err := s.db.Exec(s.db.rebind(sqlDeleteGroup), id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Relationships returns the relationships of a person from the database, in ID order.
+func (s *SQLStore) Relationships(personID int) ([]Relationship, error) {
+	return dbReadRelationships(s.db, s.db.rebind(sqlReadRelationships), personID)
+}
+
+// CreateRelationship adds a relationship to the database with the next free ID and sets r.ID,
+// along with its inverse if it is bidirectional.
+// ErrNotFound will be returned if either person does not exist, and ErrExists if either relationship does.
+func (s *SQLStore) CreateRelationship(r *Relationship) error {
+	return s.db.inTx(func(tx *sql.Tx) error {
+		n := 0
+		if err := tx.QueryRow(s.db.rebind(sqlCountRelated), r.PersonID, r.RelatedID).Scan(&n); err != nil {
+			return fmt.Errorf("error counting people: %v", err.Error())
+		}
+		if n != 2 {
+			return ErrNotFound
+		}
+		if err := r.dbCreateRelationship(s.db, tx); err != nil {
+			return err
+		}
+		if !r.Bidirectional {
+			return nil
+		}
+		inv := r.inverse()
+		return inv.dbCreateRelationship(s.db, tx)
+	})
+}
+
+// DeleteRelationship removes a relationship of a person from the database, and its inverse if it is bidirectional.
+// An error will be returned if the person has no such relationship.
+func (s *SQLStore) DeleteRelationship(personID, id int) error {
+	return s.db.inTx(func(tx *sql.Tx) error {
+		rels, err := dbReadRelationships(tx, s.db.rebind(sqlReadRelationship), id, personID)
+		if err != nil {
+			return err
+		}
+		if len(rels) == 0 {
+			return ErrNotFound
+		}
+		if _, err := tx.Exec(s.db.rebind(sqlDeleteRelationship), id); err != nil {
+			return err
+		}
+		if !rels[0].Bidirectional {
+			return nil
+		}
+		inv := rels[0].inverse()
+		_, err = tx.Exec(s.db.rebind(sqlDeleteRelationshipLink), inv.PersonID, inv.RelatedID, inv.Type, inv.Label)
+		return err
+	})
+}
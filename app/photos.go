@@ -0,0 +1,430 @@
+package app
+
+// Photos.go contains people's photos: where they are stored, how thumbnails are made,
+// and the /person/{id}/photo endpoints.
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// Photo content types, the only formats accepted.
+const (
+	PhotoJPEG = "image/jpeg"
+	PhotoPNG  = "image/png"
+)
+
+// maxPhotoSize is the largest photo upload, in bytes.
+const maxPhotoSize = 5 << 20
+
+// maxPhotoSide is the most pixels a photo may be wide or high, which bounds the memory decoding it needs.
+const maxPhotoSide = 4096
+
+// thumbnailSide is the most pixels a thumbnail is wide or high.
+const thumbnailSide = 128
+
+// Photo is a person's picture, as uploaded, and a thumbnail of it in the same format.
+type Photo struct {
+	PersonID    int
+	ContentType string
+	Data        []byte
+	Thumbnail   []byte
+}
+
+// PhotoStore is where people's photos are kept. SQLStore and MemoryStore keep them with the people,
+// DirPhotoStore in a directory of their own.
+type PhotoStore interface {
+	// Photo returns a person's photo, or ErrNotFound.
+	Photo(personID int) (Photo, error)
+	// PutPhoto stores a photo, replacing any the person already has.
+	PutPhoto(ph *Photo) error
+	// DeletePhoto removes a person's photo, or returns ErrNotFound.
+	DeletePhoto(personID int) error
+}
+
+// photoETag returns the entity tag of an image.
+func photoETag(data []byte) string {
+	sum := sha256.Sum256(data)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// errUnsupportedPhoto is returned by newPhoto for images that are not JPEG or PNG.
+var errUnsupportedPhoto = errors.New("photos must be JPEG or PNG images")
+
+// newPhoto checks an uploaded image and makes its thumbnail.
+// The format is sniffed from the data, whatever the request's Content-Type says.
+func newPhoto(personID int, data []byte) (Photo, error) {
+	ph := Photo{PersonID: personID, ContentType: http.DetectContentType(data), Data: data}
+	if ph.ContentType != PhotoJPEG && ph.ContentType != PhotoPNG {
+		return ph, errUnsupportedPhoto
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return ph, fmt.Errorf("could not read the image: %v", err.Error())
+	}
+	if cfg.Width > maxPhotoSide || cfg.Height > maxPhotoSide {
+		return ph, errPhotoTooLarge
+	}
+	if cfg.Width <= thumbnailSide && cfg.Height <= thumbnailSide {
+		ph.Thumbnail = data
+		return ph, nil
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return ph, fmt.Errorf("could not read the image: %v", err.Error())
+	}
+	buf := new(bytes.Buffer)
+	thumb := resizeImage(img, thumbnailSide)
+	if ph.ContentType == PhotoJPEG {
+		err = jpeg.Encode(buf, thumb, &jpeg.Options{Quality: 85})
+	} else {
+		err = png.Encode(buf, thumb)
+	}
+	if err != nil {
+		return ph, fmt.Errorf("could not make the thumbnail: %v", err.Error())
+	}
+	ph.Thumbnail = buf.Bytes()
+	return ph, nil
+}
+
+// errPhotoTooLarge is returned by newPhoto for images wider or higher than maxPhotoSide.
+var errPhotoTooLarge = fmt.Errorf("photos must be at most %v by %v pixels", maxPhotoSide, maxPhotoSide)
+
+// resizeImage scales img down, keeping its aspect ratio, so that neither side is longer than side.
+// Each pixel is the average of up to 4 by 4 samples of the area of img it covers.
+func resizeImage(img image.Image, side int) image.Image {
+	b := img.Bounds()
+	w, h := side, b.Dy()*side/b.Dx()
+	if b.Dy() > b.Dx() {
+		w, h = b.Dx()*side/b.Dy(), side
+	}
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		y0, y1 := b.Min.Y+y*b.Dy()/h, b.Min.Y+(y+1)*b.Dy()/h
+		for x := 0; x < w; x++ {
+			x0, x1 := b.Min.X+x*b.Dx()/w, b.Min.X+(x+1)*b.Dx()/w
+			var r, g, bl, a, n uint32
+			for sy := 0; sy < 4; sy++ {
+				py := y0 + sy*(y1-y0)/4
+				for sx := 0; sx < 4; sx++ {
+					pr, pg, pb, pa := img.At(x0+sx*(x1-x0)/4, py).RGBA()
+					r, g, bl, a, n = r+pr, g+pg, bl+pb, a+pa, n+1
+				}
+			}
+			dst.Set(x, y, color.RGBA64{uint16(r / n), uint16(g / n), uint16(bl / n), uint16(a / n)})
+		}
+	}
+	return dst
+}
+
+// vcardPhoto returns the PHOTO property of a person's vCard, or "" if they have no photo.
+// Version 4.0 uses a data URI, and earlier versions an inline base64 value.
+func vcardPhoto(ph *Photo, version string) string {
+	if ph == nil {
+		return ""
+	}
+	if version == VCardVersion4 {
+		return "PHOTO:" + photoDataURI(ph)
+	}
+	typ := "JPEG"
+	if ph.ContentType == PhotoPNG {
+		typ = "PNG"
+	}
+	return "PHOTO;ENCODING=b;TYPE=" + typ + ":" + base64.StdEncoding.EncodeToString(ph.Data)
+}
+
+// photoDataURI returns a photo as a data URI.
+func photoDataURI(ph *Photo) string {
+	return "data:" + ph.ContentType + ";base64," + base64.StdEncoding.EncodeToString(ph.Data)
+}
+
+// attachPhoto sets the photo written in p's vCard, if they have one.
+func (a *App) attachPhoto(p *Person) error {
+	if a.Photos == nil {
+		return nil
+	}
+	ph, err := a.Photos.Photo(p.ID)
+	if err == ErrNotFound {
+		p.photo = nil
+		return nil
+	} else if err != nil {
+		return err
+	}
+	p.photo = &ph
+	return nil
+}
+
+// purgedPhoto removes the photo of a person who has been purged from the trash. Stores that keep
+// photos with the people have already removed it, but a DirPhotoStore has not. Failures are only
+// logged, as the person is gone either way.
+func (a *App) purgedPhoto(personID int) {
+	if a.Photos == nil {
+		return
+	}
+	if err := a.Photos.DeletePhoto(personID); err != nil && err != ErrNotFound {
+		log.Printf("error deleting photo of %v: %v", personID, err.Error())
+	}
+}
+
+// DirPhotoStore keeps photos as files in a directory, named by the person's ID:
+// the photo as uploaded in <id>.photo, and its thumbnail in <id>.thumb.
+type DirPhotoStore struct {
+	Dir string
+}
+
+// NewDirPhotoStore returns a DirPhotoStore for dir, creating it if it does not exist.
+func NewDirPhotoStore(dir string) (*DirPhotoStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("could not create photo directory: %v", err.Error())
+	}
+	return &DirPhotoStore{Dir: dir}, nil
+}
+
+// path returns the path of a person's photo file with the given extension.
+func (d *DirPhotoStore) path(personID int, ext string) string {
+	return filepath.Join(d.Dir, strconv.Itoa(personID)+ext)
+}
+
+// Photo reads a person's photo from the directory.
+func (d *DirPhotoStore) Photo(personID int) (Photo, error) {
+	ph := Photo{PersonID: personID}
+	var err error
+	if ph.Data, err = os.ReadFile(d.path(personID, ".photo")); os.IsNotExist(err) {
+		return ph, ErrNotFound
+	} else if err != nil {
+		return ph, err
+	}
+	if ph.Thumbnail, err = os.ReadFile(d.path(personID, ".thumb")); os.IsNotExist(err) {
+		ph.Thumbnail = ph.Data
+	} else if err != nil {
+		return ph, err
+	}
+	ph.ContentType = http.DetectContentType(ph.Data)
+	return ph, nil
+}
+
+// PutPhoto writes a person's photo to the directory. Each file is written to a temporary file
+// and renamed over the old one, so readers never see a partly written photo.
+func (d *DirPhotoStore) PutPhoto(ph *Photo) error {
+	for _, f := range []struct {
+		ext  string
+		data []byte
+	}{{".thumb", ph.Thumbnail}, {".photo", ph.Data}} {
+		tmp, err := os.CreateTemp(d.Dir, "upload-*")
+		if err != nil {
+			return err
+		}
+		_, err = tmp.Write(f.data)
+		if cerr := tmp.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil {
+			err = os.Rename(tmp.Name(), d.path(ph.PersonID, f.ext))
+		}
+		if err != nil {
+			os.Remove(tmp.Name())
+			return err
+		}
+	}
+	return nil
+}
+
+// DeletePhoto removes a person's photo files from the directory.
+func (d *DirPhotoStore) DeletePhoto(personID int) error {
+	err := os.Remove(d.path(personID, ".photo"))
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	} else if err != nil {
+		return err
+	}
+	if err := os.Remove(d.path(personID, ".thumb")); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Photo reads a person's photo from the database.
+func (s *SQLStore) Photo(personID int) (Photo, error) {
+	ph := Photo{PersonID: personID}
+	err := s.db.QueryRow(s.db.rebind(sqlReadPhoto), personID).Scan(&ph.ContentType, &ph.Data, &ph.Thumbnail)
+	if err == sql.ErrNoRows {
+		return ph, ErrNotFound
+	}
+	return ph, err
+}
+
+// PutPhoto writes a person's photo to the database, replacing any they have.
+func (s *SQLStore) PutPhoto(ph *Photo) error {
+	_, err := s.db.Exec(s.db.rebind(sqlPutPhoto), ph.PersonID, ph.ContentType, ph.Data, ph.Thumbnail)
+	return err
+}
+
+// DeletePhoto removes a person's photo from the database.
+// An error will be returned if they have no photo.
+func (s *SQLStore) DeletePhoto(personID int) error {
+	res, err := s.db.Exec(s.db.rebind(sqlDeletePhoto), personID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// writePhotoStoreError writes the problem matching an error returned by a PhotoStore.
+func writePhotoStoreError(w http.ResponseWriter, req *http.Request, err error) {
+	if err == ErrNotFound {
+		writeProblem(w, req, http.StatusNotFound, CodePhotoNotFound, "The person has no photo.")
+		return
+	}
+	writeInternalError(w, req, "Could not access the photo.", err)
+}
+
+// ReadPhoto returns the photo of the person with the ID in the URL, or its thumbnail with size=thumbnail,
+// or 304 Not Modified if it matches If-None-Match.
+func (a *App) ReadPhoto(w http.ResponseWriter, req *http.Request) {
+	id, ok := personID(w, req)
+	if !ok {
+		return
+	}
+	size := req.URL.Query().Get("size")
+	if size != "" && size != "thumbnail" && size != "original" {
+		writeProblem(w, req, http.StatusBadRequest, CodeInvalidQuery, "size must be thumbnail or original")
+		return
+	}
+	// The photos of people in the trash are kept, but not shown.
+	if _, err := a.Store.Get(id); err != nil {
+		writeStoreError(w, req, err)
+		return
+	}
+	ph, err := a.Photos.Photo(id)
+	if err != nil {
+		writePhotoStoreError(w, req, err)
+		return
+	}
+	data := ph.Data
+	if size == "thumbnail" {
+		data = ph.Thumbnail
+	}
+	etag := photoETag(data)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "no-cache")
+	if h := req.Header.Get("If-None-Match"); h != "" && etagMatches(h, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", ph.ContentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	if req.Method != http.MethodHead {
+		w.Write(data)
+	}
+}
+
+// UpdatePhoto stores the JPEG or PNG image in the request body as the photo of the person with the ID in the URL.
+// It returns 201 Created if they had no photo, and 204 No Content if it was replaced.
+func (a *App) UpdatePhoto(w http.ResponseWriter, req *http.Request) {
+	log.Printf("Got PUT photo %v", mux.Vars(req)["id"])
+	id, ok := personID(w, req)
+	if !ok {
+		return
+	}
+	if _, err := a.Store.Get(id); err != nil {
+		writeStoreError(w, req, err)
+		return
+	}
+	data, err := io.ReadAll(http.MaxBytesReader(w, req.Body, maxPhotoSize))
+	if err != nil {
+		writeProblem(w, req, http.StatusRequestEntityTooLarge, CodeTooLarge,
+			fmt.Sprintf("Photos must be at most %v MiB.", maxPhotoSize>>20))
+		return
+	}
+	if len(data) == 0 {
+		writeProblem(w, req, http.StatusBadRequest, CodeNoData, "No photo provided.")
+		return
+	}
+	ph, err := newPhoto(id, data)
+	switch err {
+	case nil:
+	case errUnsupportedPhoto:
+		writeProblem(w, req, http.StatusUnsupportedMediaType, CodeUnsupportedMediaType, "Photos must be JPEG or PNG images.")
+		return
+	case errPhotoTooLarge:
+		writeProblem(w, req, http.StatusRequestEntityTooLarge, CodeTooLarge,
+			fmt.Sprintf("Photos must be at most %v by %v pixels.", maxPhotoSide, maxPhotoSide))
+		return
+	default:
+		writeProblem(w, req, http.StatusBadRequest, CodeInvalidImage, "The photo could not be read.")
+		return
+	}
+	prev, err := a.Photos.Photo(id)
+	if err != nil && err != ErrNotFound {
+		writePhotoStoreError(w, req, err)
+		return
+	}
+	existed, prevETag := err == nil, ""
+	if existed {
+		prevETag = photoETag(prev.Data)
+	}
+	if err := a.Photos.PutPhoto(&ph); err != nil {
+		writePhotoStoreError(w, req, err)
+		return
+	}
+	a.auditPhoto(req, id, prevETag, photoETag(ph.Data))
+	w.Header().Set("ETag", photoETag(ph.Data))
+	if existed {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Location", fmt.Sprintf("/person/%v/photo", id))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// DeletePhoto removes the photo of the person with the ID in the URL.
+func (a *App) DeletePhoto(w http.ResponseWriter, req *http.Request) {
+	log.Printf("Got DELETE photo %v", mux.Vars(req)["id"])
+	id, ok := personID(w, req)
+	if !ok {
+		return
+	}
+	// The photos of people in the trash are kept until they are purged.
+	if _, err := a.Store.Get(id); err != nil {
+		writeStoreError(w, req, err)
+		return
+	}
+	prev, err := a.Photos.Photo(id)
+	if err == nil {
+		err = a.Photos.DeletePhoto(id)
+	}
+	if err != nil {
+		writePhotoStoreError(w, req, err)
+		return
+	}
+	a.auditPhoto(req, id, photoETag(prev.Data), "")
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,138 @@
+package app
+
+// Profiles.go contains the CSV layouts used by other contact applications, selected with the profile query parameter.
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// csvProfile is a named CSV layout.
+type csvProfile struct {
+	// Columns are written on export, in order, and recognised in the header on import.
+	Columns []csvColumn
+	// Dialect is the default dialect for the profile, the dialect query parameters override it.
+	Dialect csvDialect
+	// Custom adds a column for each custom field after Columns.
+	Custom bool
+}
+
+// columns returns the profile's columns, followed by those of the custom fields if it has them.
+func (p csvProfile) columns(fields []CustomField) []csvColumn {
+	if !p.Custom {
+		return p.Columns
+	}
+	return appendCustomColumns(p.Columns, fields)
+}
+
+// csvProfiles are the profiles accepted by the profile query parameter.
+// The empty name is the default, this service's own layout.
+var csvProfiles = map[string]csvProfile{
+	"":        {Columns: personColumns, Dialect: defaultCSVDialect, Custom: true},
+	"google":  {Columns: googleColumns, Dialect: defaultCSVDialect},
+	"outlook": {Columns: outlookColumns, Dialect: outlookDialect},
+}
+
+// googleColumns is the layout of a Google Contacts CSV export.
+// Older exports used "Given Name" and "Family Name", which are also recognised.
+var googleColumns = []csvColumn{
+	{
+		Header: "First Name",
+		Names:  []string{"firstname", "givenname"},
+		get:    func(p *Person) string { return p.FirstName },
+		set:    func(p *Person, v string) { p.FirstName = v },
+	},
+	{
+		Header: "Last Name",
+		Names:  []string{"lastname", "familyname"},
+		get:    func(p *Person) string { return p.LastName },
+		set:    func(p *Person, v string) { p.LastName = v },
+	},
+	{
+		Header: "E-mail 1 - Label",
+		get:    labelIfSet("* Other", func(p *Person) string { return p.Email }),
+	},
+	{
+		Header: "E-mail 1 - Value",
+		Names:  []string{"email1value", "email2value", "email3value"},
+		get:    func(p *Person) string { return p.Email },
+		set:    func(p *Person, v string) { p.Email = firstMultiValue(v) },
+	},
+	{
+		Header: "Phone 1 - Label",
+		get:    labelIfSet("Mobile", func(p *Person) string { return p.Phone }),
+	},
+	{
+		Header: "Phone 1 - Value",
+		Names:  []string{"phone1value", "phone2value", "phone3value"},
+		get:    func(p *Person) string { return p.Phone },
+		set:    func(p *Person, v string) { p.Phone = firstMultiValue(v) },
+	},
+}
+
+// outlookColumns is the layout of an Outlook contacts CSV export.
+// Outlook has a column for each kind of phone number, the first one set is imported.
+var outlookColumns = []csvColumn{
+	{
+		Header: "First Name",
+		Names:  []string{"firstname"},
+		get:    func(p *Person) string { return p.FirstName },
+		set:    func(p *Person, v string) { p.FirstName = v },
+	},
+	{
+		Header: "Last Name",
+		Names:  []string{"lastname"},
+		get:    func(p *Person) string { return p.LastName },
+		set:    func(p *Person, v string) { p.LastName = v },
+	},
+	{
+		Header: "E-mail Address",
+		Names:  []string{"emailaddress", "email2address", "email3address"},
+		get:    func(p *Person) string { return p.Email },
+		set:    func(p *Person, v string) { p.Email = v },
+	},
+	{
+		Header: "Mobile Phone",
+		Names:  []string{"primaryphone", "mobilephone", "businessphone", "homephone", "otherphone"},
+		get:    func(p *Person) string { return p.Phone },
+		set:    func(p *Person, v string) { p.Phone = v },
+	},
+}
+
+// outlookDialect writes a UTF-8 byte order mark, without which Outlook and Excel assume the
+// Windows code page and garble anything outside ASCII.
+var outlookDialect = csvDialect{Comma: ',', Quote: '"', BOM: true}
+
+// labelIfSet returns a column getter that writes label when field is not empty.
+func labelIfSet(label string, field func(p *Person) string) func(p *Person) string {
+	return func(p *Person) string {
+		if field(p) == "" {
+			return ""
+		}
+		return label
+	}
+}
+
+// firstMultiValue returns the first of the values Google Contacts joins with " ::: "
+// when a contact has several addresses with the same label.
+func firstMultiValue(v string) string {
+	return strings.TrimSpace(strings.Split(v, ":::")[0])
+}
+
+// parseCSVProfile reads the profile query parameter.
+func parseCSVProfile(v url.Values) (csvProfile, error) {
+	p, ok := csvProfiles[v.Get("profile")]
+	if !ok {
+		names := []string{}
+		for name := range csvProfiles {
+			if name != "" {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		return p, fmt.Errorf("profile must be one of %v", strings.Join(names, ", "))
+	}
+	return p, nil
+}
@@ -0,0 +1,255 @@
+package app
+
+// Query.go contains the pagination, sorting and filtering options for listing people.
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// maxQueryLimit is the largest page size a client may request.
+const maxQueryLimit = 1000
+
+// Values of PeopleQuery.Deleted. By default people in the trash are left out.
+const (
+	DeletedInclude = "include"
+	DeletedOnly    = "only"
+)
+
+// SortField is a field to order people by.
+type SortField struct {
+	Field string
+	Desc  bool
+}
+
+// PeopleQuery selects a page of people.
+// Empty filter fields match everything.
+type PeopleQuery struct {
+	// Offset is the number of matching people to skip.
+	Offset int
+	// Limit is the number of people to return. -1 returns all matching people.
+	Limit int
+	// AfterID only returns people with an ID greater than AfterID (keyset pagination).
+	AfterID int
+	// Sort orders the results. People are always ordered by ID last.
+	Sort []SortField
+	// keyset is set when the client is paging with after rather than offset.
+	keyset bool
+
+	FirstName   string
+	LastName    string
+	Email       string
+	Phone       string
+	EmailDomain string
+	// Custom maps custom field names to the value people must have, see PeopleQuery.checkCustom.
+	Custom map[string]string
+	// Group is the name of a group people must be in, ignoring case.
+	Group string
+	// Where, if set, must also be satisfied. It is not read from query parameters.
+	Where *Condition
+	// Deleted is DeletedInclude to also return people in the trash, or DeletedOnly to return only them.
+	Deleted string
+}
+
+// sortColumns maps the lower-cased sort field names to database columns.
+var sortColumns = map[string]string{
+	"id":        "id",
+	"firstname": "fname",
+	"lastname":  "lname",
+	"email":     "email",
+	"phone":     "phone",
+}
+
+// parsePeopleQuery reads a PeopleQuery from request query parameters:
+// limit, offset, after, sort (e.g. sort=lastName,-email),
+// firstName, lastName, email, phone, emailDomain, group, deleted and custom.<name> for each custom field.
+func parsePeopleQuery(v url.Values) (PeopleQuery, error) {
+	q := PeopleQuery{Limit: -1}
+	var err error
+	if s := v.Get("limit"); s != "" {
+		if q.Limit, err = strconv.Atoi(s); err != nil || q.Limit < 0 || q.Limit > maxQueryLimit {
+			return q, fmt.Errorf("limit must be between 0 and %v", maxQueryLimit)
+		}
+	}
+	if s := v.Get("offset"); s != "" {
+		if q.Offset, err = strconv.Atoi(s); err != nil || q.Offset < 0 {
+			return q, fmt.Errorf("offset must be a non-negative integer")
+		}
+	}
+	if s := v.Get("after"); s != "" {
+		if q.AfterID, err = strconv.Atoi(s); err != nil || q.AfterID < 0 {
+			return q, fmt.Errorf("after must be a non-negative integer")
+		}
+		q.keyset = true
+	}
+	if s := v.Get("sort"); s != "" {
+		for _, f := range strings.Split(s, ",") {
+			sf := SortField{Field: f}
+			if strings.HasPrefix(f, "-") {
+				sf = SortField{Field: f[1:], Desc: true}
+			}
+			if _, ok := sortColumns[strings.ToLower(sf.Field)]; !ok {
+				return q, fmt.Errorf("cannot sort by %q", sf.Field)
+			}
+			sf.Field = strings.ToLower(sf.Field)
+			q.Sort = append(q.Sort, sf)
+		}
+	}
+	if q.keyset && (q.Offset > 0 || len(q.Sort) > 0) {
+		return q, fmt.Errorf("after cannot be combined with offset or sort")
+	}
+	q.FirstName = v.Get("firstName")
+	q.LastName = v.Get("lastName")
+	q.Email = v.Get("email")
+	q.Phone = v.Get("phone")
+	q.EmailDomain = strings.TrimPrefix(v.Get("emailDomain"), "@")
+	q.Group = v.Get("group")
+	switch q.Deleted = v.Get("deleted"); q.Deleted {
+	case "", "exclude":
+		q.Deleted = ""
+	case DeletedInclude, DeletedOnly:
+	default:
+		return q, fmt.Errorf("deleted must be exclude, %v or %v", DeletedInclude, DeletedOnly)
+	}
+	for key := range v {
+		if !strings.HasPrefix(key, "custom.") {
+			continue
+		}
+		if q.Custom == nil {
+			q.Custom = map[string]string{}
+		}
+		q.Custom[strings.TrimPrefix(key, "custom.")] = v.Get(key)
+	}
+	return q, nil
+}
+
+// customNames returns the names of the custom fields the query filters on, in order.
+func (q *PeopleQuery) customNames() []string {
+	names := []string{}
+	for name := range q.Custom {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// matches reports whether p passes the query's filters, ignoring paging.
+func (q *PeopleQuery) matches(p *Person) bool {
+	if (p.DeletedAt != nil && q.Deleted == "") || (p.DeletedAt == nil && q.Deleted == DeletedOnly) {
+		return false
+	}
+	if q.FirstName != "" && p.FirstName != q.FirstName {
+		return false
+	}
+	if q.LastName != "" && p.LastName != q.LastName {
+		return false
+	}
+	if q.Email != "" && !anyValue(p, "email", func(v string) bool { return v == q.Email }) {
+		return false
+	}
+	if q.Phone != "" && !anyValue(p, "phone", func(v string) bool { return v == q.Phone }) {
+		return false
+	}
+	if q.EmailDomain != "" && !anyValue(p, "email", func(v string) bool {
+		return strings.HasSuffix(strings.ToLower(v), "@"+strings.ToLower(q.EmailDomain))
+	}) {
+		return false
+	}
+	if q.Group != "" && !p.inGroup(q.Group) {
+		return false
+	}
+	for name, v := range q.Custom {
+		if p.Custom[name] != v {
+			return false
+		}
+	}
+	if q.Where != nil && !q.Where.matches(p) {
+		return false
+	}
+	return true
+}
+
+// anyValue reports whether match accepts any of the values of p's condition field, such as any of their emails.
+func anyValue(p *Person, field string, match func(v string) bool) bool {
+	for _, v := range (&Condition{Field: field}).values(p) {
+		if match(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// less reports whether a sorts before b under the query's sort order.
+func (q *PeopleQuery) less(a, b *Person) bool {
+	for _, sf := range q.Sort {
+		x, y := a.sortValue(sf.Field), b.sortValue(sf.Field)
+		if x == y {
+			continue
+		}
+		if sf.Desc {
+			return x > y
+		}
+		return x < y
+	}
+	return a.ID < b.ID
+}
+
+// sortValue returns the value of a sortable field, with IDs zero padded so they compare as strings.
+func (p *Person) sortValue(field string) string {
+	switch field {
+	case "firstname":
+		return p.FirstName
+	case "lastname":
+		return p.LastName
+	case "email":
+		return p.Email
+	case "phone":
+		return p.Phone
+	}
+	return fmt.Sprintf("%020d", p.ID)
+}
+
+// pageLinks builds an RFC 8288 Link header value for the page of people returned for q.
+// Clients paging with after get a keyset next link, everyone else gets offset links.
+func pageLinks(u *url.URL, q PeopleQuery, people []Person, total int) string {
+	if q.Limit < 0 {
+		return ""
+	}
+	link := func(rel string, set map[string]string) string {
+		v := u.Query()
+		v.Del("after")
+		v.Del("offset")
+		for key, val := range set {
+			v.Set(key, val)
+		}
+		l := *u
+		l.RawQuery = v.Encode()
+		return fmt.Sprintf("<%v>; rel=\"%v\"", l.RequestURI(), rel)
+	}
+	if q.keyset {
+		links := []string{link("first", map[string]string{"after": "0"})}
+		if len(people) == q.Limit && len(people) > 0 {
+			links = append(links, link("next", map[string]string{"after": strconv.Itoa(people[len(people)-1].ID)}))
+		}
+		return strings.Join(links, ", ")
+	}
+	links := []string{link("first", nil)}
+	if q.Offset > 0 {
+		prev := q.Offset - q.Limit
+		if prev < 0 {
+			prev = 0
+		}
+		links = append(links, link("prev", map[string]string{"offset": strconv.Itoa(prev)}))
+	}
+	if q.Limit > 0 && q.Offset+q.Limit < total {
+		links = append(links, link("next", map[string]string{"offset": strconv.Itoa(q.Offset + q.Limit)}))
+	}
+	if q.Limit > 0 && total > 0 {
+		last := (total - 1) / q.Limit * q.Limit
+		links = append(links, link("last", map[string]string{"offset": strconv.Itoa(last)}))
+	}
+	return strings.Join(links, ", ")
+}
@@ -0,0 +1,248 @@
+package app
+
+// Relationships.go contains the typed links between people, such as who manages whom,
+// how they are stored, and the /person/{id}/relationships endpoints.
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+// Relationship types. A relationship of type RelManager says the related person is the person's manager.
+const (
+	RelManager   = "manager"
+	RelReport    = "report"
+	RelAssistant = "assistant"
+	RelExecutive = "executive"
+	RelSpouse    = "spouse"
+	RelColleague = "colleague"
+	RelCustom    = "custom"
+)
+
+// relationshipInverses maps each relationship type to the type of the same relationship seen from the
+// related person: if Bob is Ann's manager, Ann is Bob's report.
+var relationshipInverses = map[string]string{
+	RelManager:   RelReport,
+	RelReport:    RelManager,
+	RelAssistant: RelExecutive,
+	RelExecutive: RelAssistant,
+	RelSpouse:    RelSpouse,
+	RelColleague: RelColleague,
+	RelCustom:    RelCustom,
+}
+
+// relationshipTypes are the relationship types in the order they are listed in errors.
+var relationshipTypes = []string{RelManager, RelReport, RelAssistant, RelExecutive, RelSpouse, RelColleague, RelCustom}
+
+// maxRelationshipLabel is the most characters the label of a custom relationship may have.
+const maxRelationshipLabel = 100
+
+// Relationship says that the person with RelatedID is the Type of the person with PersonID,
+// e.g. their manager. Custom relationships are described by Label.
+// A bidirectional relationship is stored from both sides, see inverse.
+type Relationship struct {
+	ID            int    `json:"ID"`
+	PersonID      int    `json:"PersonID"`
+	RelatedID     int    `json:"RelatedID"`
+	Type          string `json:"Type"`
+	Label         string `json:"Label,omitempty"`
+	Bidirectional bool   `json:"Bidirectional"`
+}
+
+// inverse returns the relationship seen from the related person, without an ID.
+func (r *Relationship) inverse() Relationship {
+	return Relationship{
+		PersonID:      r.RelatedID,
+		RelatedID:     r.PersonID,
+		Type:          relationshipInverses[r.Type],
+		Label:         r.Label,
+		Bidirectional: r.Bidirectional,
+	}
+}
+
+// same reports whether r and o link the same people in the same way, ignoring their IDs.
+func (r *Relationship) same(o *Relationship) bool {
+	return r.PersonID == o.PersonID && r.RelatedID == o.RelatedID && r.Type == o.Type && r.Label == o.Label
+}
+
+// validate checks a relationship's fields, returning a FieldError for each invalid field.
+// Whether the related person exists is checked by the store.
+func (r *Relationship) validate() []FieldError {
+	errs := []FieldError{}
+	if _, ok := relationshipInverses[r.Type]; !ok {
+		errs = append(errs, FieldError{Field: "Type", Reason: "must be one of " + strings.Join(relationshipTypes, ", ")})
+	}
+	switch {
+	case r.Type == RelCustom && r.Label == "":
+		errs = append(errs, FieldError{Field: "Label", Reason: "is required for custom relationships"})
+	case r.Type != RelCustom && r.Label != "":
+		errs = append(errs, FieldError{Field: "Label", Reason: "is only allowed for custom relationships"})
+	case utf8.RuneCountInString(r.Label) > maxRelationshipLabel:
+		errs = append(errs, FieldError{Field: "Label", Reason: fmt.Sprintf("must be at most %v characters", maxRelationshipLabel)})
+	}
+	if r.RelatedID == r.PersonID {
+		errs = append(errs, FieldError{Field: "RelatedID", Reason: "must not be the person themselves"})
+	}
+	return errs
+}
+
+// dbCreateRelationship inserts r with the next free ID inside tx, and sets r.ID.
+func (r *Relationship) dbCreateRelationship(db *database, tx *sql.Tx) error {
+	if db.lockIDs != "" {
+		if _, err := tx.Exec(db.lockIDs); err != nil {
+			return fmt.Errorf("could not lock IDs: %v", err.Error())
+		}
+	}
+	err := tx.QueryRow(db.rebind(sqlCreateRelationship),
+		r.PersonID, r.RelatedID, r.Type, r.Label, r.Bidirectional).Scan(&r.ID)
+	if isUniqueViolation(err) {
+		return ErrExists
+	}
+	return err
+}
+
+// dbReadRelationships returns the relationships selected by query, in ID order.
+func dbReadRelationships(db queryer, query string, args ...interface{}) ([]Relationship, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error getting relationships: %v", err.Error())
+	}
+	defer rows.Close()
+	rels := []Relationship{}
+	for rows.Next() {
+		r := Relationship{}
+		if err := rows.Scan(&r.ID, &r.PersonID, &r.RelatedID, &r.Type, &r.Label, &r.Bidirectional); err != nil {
+			return nil, fmt.Errorf("error getting row: %v", err.Error())
+		}
+		rels = append(rels, r)
+	}
+	return rels, rows.Err()
+}
+
+// queryer is implemented by both *sql.DB and *sql.Tx.
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// writeRelationshipStoreError writes the problem matching an error returned by the PersonStore's
+// relationship methods.
+func writeRelationshipStoreError(w http.ResponseWriter, req *http.Request, err error) {
+	switch err {
+	case ErrNotFound:
+		writeProblem(w, req, http.StatusNotFound, CodeRelationshipNotFound, "Relationship not found.")
+	case ErrExists:
+		writeProblem(w, req, http.StatusConflict, CodeRelationshipExists, "The people already have this relationship.")
+	default:
+		writeInternalError(w, req, "Could not access the relationships.", err)
+	}
+}
+
+// ReadRelationships lists the relationships of the person with the ID in the URL, in ID order.
+// The type query parameter selects relationships of one type.
+func (a *App) ReadRelationships(w http.ResponseWriter, req *http.Request) {
+	id, ok := personID(w, req)
+	if !ok {
+		return
+	}
+	typ := req.URL.Query().Get("type")
+	if _, ok := relationshipInverses[typ]; typ != "" && !ok {
+		writeProblem(w, req, http.StatusBadRequest, CodeInvalidQuery, "type must be one of "+strings.Join(relationshipTypes, ", "))
+		return
+	}
+	if _, err := a.Store.Get(id); err != nil {
+		writeStoreError(w, req, err)
+		return
+	}
+	rels, err := a.Store.Relationships(id)
+	if err != nil {
+		writeRelationshipStoreError(w, req, err)
+		return
+	}
+	if typ != "" {
+		matching := []Relationship{}
+		for _, r := range rels {
+			if r.Type == typ {
+				matching = append(matching, r)
+			}
+		}
+		rels = matching
+	}
+	writeJSON(w, req, http.StatusOK, rels)
+}
+
+// CreateRelationship relates the person with the ID in the URL to another person,
+// and returns the relationship with a Location header pointing at it.
+func (a *App) CreateRelationship(w http.ResponseWriter, req *http.Request) {
+	log.Printf("Got POST relationship for %v", mux.Vars(req)["id"])
+	id, ok := personID(w, req)
+	if !ok {
+		return
+	}
+	buf := new(bytes.Buffer)
+	buf.ReadFrom(req.Body)
+	r := Relationship{}
+	if err := json.Unmarshal(buf.Bytes(), &r); err != nil {
+		log.Printf("error unmarshalling data: %v", err.Error())
+		writeProblem(w, req, http.StatusBadRequest, CodeInvalidJSON, "Invalid input data: "+err.Error())
+		return
+	}
+	r.ID, r.PersonID = 0, id
+	r.Label = strings.TrimSpace(r.Label)
+	if _, err := a.Store.Get(id); err != nil {
+		writeStoreError(w, req, err)
+		return
+	}
+	errs := r.validate()
+	if len(errs) == 0 {
+		if _, err := a.Store.Get(r.RelatedID); err == ErrNotFound {
+			errs = append(errs, FieldError{Field: "RelatedID", Reason: "no such person"})
+		} else if err != nil {
+			writeStoreError(w, req, err)
+			return
+		}
+	}
+	if len(errs) > 0 {
+		writeProblemBody(w, req, Problem{
+			Status: http.StatusUnprocessableEntity,
+			Code:   CodeValidationFailed,
+			Detail: "The relationship is invalid.",
+			Errors: errs,
+		})
+		return
+	}
+	if err := a.Store.CreateRelationship(&r); err != nil {
+		writeRelationshipStoreError(w, req, err)
+		return
+	}
+	w.Header().Set("Location", fmt.Sprintf("/person/%v/relationships/%v", id, r.ID))
+	writeJSON(w, req, http.StatusCreated, r)
+}
+
+// DeleteRelationship removes a relationship of the person with the ID in the URL,
+// along with its inverse if it is bidirectional.
+func (a *App) DeleteRelationship(w http.ResponseWriter, req *http.Request) {
+	log.Printf("Got DELETE relationship %v of %v", mux.Vars(req)["rel"], mux.Vars(req)["id"])
+	id, ok := personID(w, req)
+	if !ok {
+		return
+	}
+	relID, err := strconv.Atoi(mux.Vars(req)["rel"])
+	if err != nil {
+		writeProblem(w, req, http.StatusBadRequest, CodeInvalidID, "Invalid ID.")
+		return
+	}
+	if err := a.Store.DeleteRelationship(id, relID); err != nil {
+		writeRelationshipStoreError(w, req, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
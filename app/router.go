@@ -3,47 +3,143 @@ package app
 // Router.go contains combines the router and the database model to form the application.
 
 import (
-	"database/sql"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/unixblackhole/didactic-tribble/app/ldap"
 )
 
-// App contains an instanced router and assoicated backend database
+// App contains an instanced router and assoicated backend store
 type App struct {
-	Router   *mux.Router
-	Database *sql.DB
+	Router *mux.Router
+	Store  PersonStore
+	// SkipMigrations disables applying pending schema migrations in Initialize.
+	SkipMigrations bool
+	// LDAPAddr, if set, is the address Run also serves a read-only LDAP directory of the people on.
+	LDAPAddr string
+	// LDAPBaseDN is the DN people are listed under in the directory, defaultBaseDN if empty.
+	LDAPBaseDN string
+	// LDAPBindDN and LDAPPassword, if set, must be bound with before searching the directory.
+	LDAPBindDN   string
+	LDAPPassword string
+	// AdminToken, if set, must be sent as a bearer token to change the custom fields.
+	AdminToken string
+	// Photos is where people's photos are kept. If nil, InitializeWithStore uses the PersonStore.
+	Photos PhotoStore
+	// Audit is where changes to people are recorded. If nil, InitializeWithStore uses the PersonStore.
+	Audit AuditLog
+	// Cards is where the names CardDAV clients give cards are kept. If nil, InitializeWithStore uses the PersonStore,
+	// and if it is not a CardNameStore, cards can only be created with a person's ID as their name.
+	Cards CardNameStore
+	// TrustedProxies are the addresses of proxies trusted to name the user a request is made by
+	// in its X-Actor header, for the audit log. See ParseTrustedProxies.
+	TrustedProxies []*net.IPNet
+	// TrashRetention, if positive, is how long deleted people stay in the trash before Run purges them.
+	TrashRetention time.Duration
 }
 
-// Initialize creates our database instances
-func (a *App) Initialize(dbname string) (err error) {
-	a.Router = mux.NewRouter()
-	a.Database, err = connectDatabase(dbname)
+// Initialize creates our database instances.
+// dsn is either a postgres:// URL or the path to a SQLite database.
+func (a *App) Initialize(dsn string) (err error) {
+	s, err := OpenStore(dsn, !a.SkipMigrations)
 	if err != nil {
 		return fmt.Errorf("could not initialize: %v", err.Error())
 	}
+	a.InitializeWithStore(s)
 	return nil
 }
 
-// Run starts an http listener on a specified address
+// InitializeWithStore sets up the app using an existing PersonStore
+func (a *App) InitializeWithStore(s PersonStore) {
+	a.Router = mux.NewRouter()
+	a.Store = s
+	if ps, ok := s.(PhotoStore); ok && a.Photos == nil {
+		a.Photos = ps
+	}
+	if al, ok := s.(AuditLog); ok && a.Audit == nil {
+		a.Audit = al
+	}
+	if cs, ok := s.(CardNameStore); ok && a.Cards == nil {
+		a.Cards = cs
+	}
+}
+
+// Run starts an http listener on a specified address, and the LDAP listener if LDAPAddr is set.
+// If TrashRetention is set, people who have been in the trash for longer are purged in the background.
 func (a *App) Run(addr string) (err error) {
 	a.addHandles()
+	if a.TrashRetention > 0 {
+		go a.purgeTrash()
+	}
+	if a.LDAPAddr != "" {
+		l, err := net.Listen("tcp", a.LDAPAddr)
+		if err != nil {
+			return fmt.Errorf("could not listen for LDAP: %v", err.Error())
+		}
+		defer l.Close()
+		log.Printf("Serving LDAP on %v", a.LDAPAddr)
+		go (&ldap.Server{Handler: a.directory()}).Serve(l)
+	}
 	log.Printf("Listening on %v", addr)
 	return http.ListenAndServe(addr, a.Router)
 }
 
 // addHanles assings handler functions to the various methods and endpoints.
 func (a *App) addHandles() {
+	a.Router.Use(withRequestID)
+	a.Router.NotFoundHandler = withRequestID(http.HandlerFunc(notFound))
+	a.Router.MethodNotAllowedHandler = withRequestID(http.HandlerFunc(methodNotAllowed))
 	a.Router.HandleFunc("/people", a.ReadPeople).Methods("GET")
+	a.Router.HandleFunc("/people/search", a.SearchPeople).Methods("GET")
 	a.Router.HandleFunc("/person", a.CreatePerson).Methods("POST")
 	a.Router.HandleFunc("/person/{id:[0-9]+}", a.CreatePerson).Methods("POST")
 	a.Router.HandleFunc("/person/{id:[0-9]+}", a.ReadPerson).Methods("GET")
+	a.Router.HandleFunc("/person/{id:[0-9]+}.vcf", a.ReadPersonVCard).Methods("GET")
 	a.Router.HandleFunc("/person/{id:[0-9]+}", a.UpdatePerson).Methods("PUT")
 	a.Router.HandleFunc("/person/{id:[0-9]+}", a.UpdatePatchPerson).Methods("PATCH")
 	a.Router.HandleFunc("/person/{id:[0-9]+}", a.DeletePerson).Methods("DELETE")
+	a.Router.HandleFunc("/person/{id:[0-9]+}/restore", a.RestorePerson).Methods("POST")
+	a.Router.HandleFunc("/person/{id:[0-9]+}/history", a.ReadHistory).Methods("GET")
+	a.Router.HandleFunc("/person/{id:[0-9]+}/history/{entry:[0-9]+}/revert", a.RevertPerson).Methods("POST")
+	a.Router.HandleFunc("/audit", a.ReadAudit).Methods("GET")
+	a.Router.HandleFunc("/trash", a.ReadTrash).Methods("GET")
+	a.Router.HandleFunc("/trash", a.EmptyTrash).Methods("DELETE")
+	a.Router.HandleFunc("/trash/{id:[0-9]+}", a.PurgePerson).Methods("DELETE")
+	a.Router.HandleFunc("/person/{id:[0-9]+}/photo", a.ReadPhoto).Methods("GET", "HEAD")
+	a.Router.HandleFunc("/person/{id:[0-9]+}/photo", a.UpdatePhoto).Methods("PUT")
+	a.Router.HandleFunc("/person/{id:[0-9]+}/photo", a.DeletePhoto).Methods("DELETE")
+	a.Router.HandleFunc("/person/{id:[0-9]+}/relationships", a.ReadRelationships).Methods("GET")
+	a.Router.HandleFunc("/person/{id:[0-9]+}/relationships", a.CreateRelationship).Methods("POST")
+	a.Router.HandleFunc("/person/{id:[0-9]+}/relationships/{rel:[0-9]+}", a.DeleteRelationship).Methods("DELETE")
 	a.Router.HandleFunc("/import", a.ImportCSV).Methods("POST")
 	a.Router.HandleFunc("/export", a.ExportCSV).Methods("GET")
+	a.Router.HandleFunc("/fields", a.ReadFields).Methods("GET")
+	a.Router.HandleFunc("/fields", a.CreateField).Methods("POST")
+	a.Router.HandleFunc("/fields/{name}", a.ReadField).Methods("GET")
+	a.Router.HandleFunc("/fields/{name}", a.UpdateField).Methods("PUT")
+	a.Router.HandleFunc("/fields/{name}", a.DeleteField).Methods("DELETE")
+	a.Router.HandleFunc("/groups", a.ReadGroups).Methods("GET")
+	a.Router.HandleFunc("/groups", a.CreateGroup).Methods("POST")
+	a.Router.HandleFunc("/groups/{id:[0-9]+}", a.ReadGroup).Methods("GET")
+	a.Router.HandleFunc("/groups/{id:[0-9]+}", a.UpdateGroup).Methods("PUT")
+	a.Router.HandleFunc("/groups/{id:[0-9]+}", a.DeleteGroup).Methods("DELETE")
+	a.Router.HandleFunc("/groups/{id:[0-9]+}/people", a.ReadGroupPeople).Methods("GET")
+	a.Router.HandleFunc("/groups/{id:[0-9]+}/people/{person:[0-9]+}", a.AddGroupMember).Methods("PUT")
+	a.Router.HandleFunc("/groups/{id:[0-9]+}/people/{person:[0-9]+}", a.RemoveGroupMember).Methods("DELETE")
+	a.Router.HandleFunc("/.well-known/carddav", a.CardDAVWellKnown)
+	a.Router.HandleFunc(cardDAVHome, a.CardDAVOptions).Methods("OPTIONS")
+	a.Router.HandleFunc(cardDAVHome, a.CardDAVPropfind).Methods("PROPFIND")
+	a.Router.HandleFunc(cardDAVBook, a.CardDAVOptions).Methods("OPTIONS")
+	a.Router.HandleFunc(cardDAVBook, a.CardDAVPropfind).Methods("PROPFIND")
+	a.Router.HandleFunc(cardDAVBook, a.CardDAVReport).Methods("REPORT")
+	a.Router.HandleFunc(cardDAVBook+"{name}.vcf", a.CardDAVOptions).Methods("OPTIONS")
+	a.Router.HandleFunc(cardDAVBook+"{name}.vcf", a.CardDAVPropfind).Methods("PROPFIND")
+	a.Router.HandleFunc(cardDAVBook+"{name}.vcf", a.CardDAVGet).Methods("GET", "HEAD")
+	a.Router.HandleFunc(cardDAVBook+"{name}.vcf", a.CardDAVPut).Methods("PUT")
+	a.Router.HandleFunc(cardDAVBook+"{name}.vcf", a.CardDAVDelete).Methods("DELETE")
 
 }
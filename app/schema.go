@@ -0,0 +1,142 @@
+package app
+
+// Schema.go contains the numbered schema migrations for each database dialect.
+// New migrations must be appended with the next version number; never edit one that has shipped.
+
+import (
+	"github.com/unixblackhole/didactic-tribble/app/migrations"
+)
+
+// sqliteMigrations are the schema migrations for SQLite databases.
+// Version 2 is the FTS5 index, which is only applied when built with -tags sqlite_fts5.
+// Version 8 differs between the dialects in the column type of binary data.
+var sqliteMigrations = append(append([]migrations.Migration{
+	{
+		Version: 1,
+		Name:    "create people table",
+		Up:      sqlTableCreate,
+		Down:    sqlTableDrop,
+	},
+}, sqliteSearchMigrations...), detailsMigration, profileMigration, customFieldsMigration, groupsMigration, relationshipsMigration,
+	sqlitePhotosMigration, trashMigration, auditMigration, cardNamesMigration,
+	personIDsMigration, cardUIDsMigration)
+
+// postgresMigrations are the schema migrations for PostgreSQL databases.
+var postgresMigrations = []migrations.Migration{
+	{
+		Version: 1,
+		Name:    "create people table",
+		Up:      sqlTableCreate,
+		Down:    sqlTableDrop,
+	},
+	detailsMigration,
+	profileMigration,
+	customFieldsMigration,
+	groupsMigration,
+	relationshipsMigration,
+	pgPhotosMigration,
+	trashMigration,
+	auditMigration,
+	cardNamesMigration,
+	personIDsMigration,
+	cardUIDsMigration,
+}
+
+// detailsMigration creates the tables of people's emails, phones and addresses,
+// copying in each person's existing email and phone, for both dialects.
+var detailsMigration = migrations.Migration{
+	Version: 3,
+	Name:    "create person emails, phones and addresses",
+	Up:      sqlDetailsCreate,
+	Down:    sqlDetailsDrop,
+}
+
+// profileMigration adds the organization, title, department, nickname, birthday, website
+// and notes columns to the people table, for both dialects.
+var profileMigration = migrations.Migration{
+	Version: 4,
+	Name:    "add person organization and profile columns",
+	Up:      sqlProfileCreate,
+	Down:    sqlProfileDrop,
+}
+
+// customFieldsMigration creates the tables of custom field definitions and people's values for them,
+// for both dialects.
+var customFieldsMigration = migrations.Migration{
+	Version: 5,
+	Name:    "create custom fields",
+	Up:      sqlCustomFieldsCreate,
+	Down:    sqlCustomFieldsDrop,
+}
+
+// groupsMigration creates the tables of groups and the people in them, for both dialects.
+var groupsMigration = migrations.Migration{
+	Version: 6,
+	Name:    "create groups",
+	Up:      sqlGroupsCreate,
+	Down:    sqlGroupsDrop,
+}
+
+// relationshipsMigration creates the table of relationships between people, for both dialects.
+var relationshipsMigration = migrations.Migration{
+	Version: 7,
+	Name:    "create relationships",
+	Up:      sqlRelationshipsCreate,
+	Down:    sqlRelationshipsDrop,
+}
+
+// sqlitePhotosMigration creates the table of people's photos for SQLite.
+var sqlitePhotosMigration = migrations.Migration{
+	Version: 8,
+	Name:    "create person photos",
+	Up:      sqlPhotosCreate,
+	Down:    sqlPhotosDrop,
+}
+
+// pgPhotosMigration creates the table of people's photos for PostgreSQL.
+var pgPhotosMigration = migrations.Migration{
+	Version: 8,
+	Name:    "create person photos",
+	Up:      pgPhotosCreate,
+	Down:    sqlPhotosDrop,
+}
+
+// trashMigration adds the deleted_at column that marks people in the trash, for both dialects.
+var trashMigration = migrations.Migration{
+	Version: 9,
+	Name:    "add person deleted_at",
+	Up:      sqlTrashCreate,
+	Down:    sqlTrashDrop,
+}
+
+// auditMigration creates the audit log of changes to people, for both dialects.
+var auditMigration = migrations.Migration{
+	Version: 10,
+	Name:    "create audit log",
+	Up:      sqlAuditCreate,
+	Down:    sqlAuditDrop,
+}
+
+// cardNamesMigration creates the table of the names CardDAV clients gave cards, for both dialects.
+var cardNamesMigration = migrations.Migration{
+	Version: 11,
+	Name:    "create card names",
+	Up:      sqlCardNamesCreate,
+	Down:    sqlCardNamesDrop,
+}
+
+// personIDsMigration creates the record of the highest person ID ever used, for both dialects.
+var personIDsMigration = migrations.Migration{
+	Version: 12,
+	Name:    "create person ID high-water mark",
+	Up:      sqlPersonIDsCreate,
+	Down:    sqlPersonIDsDrop,
+}
+
+// cardUIDsMigration creates the table of the UIDs CardDAV clients gave cards, for both dialects.
+var cardUIDsMigration = migrations.Migration{
+	Version: 13,
+	Name:    "create card UIDs",
+	Up:      sqlCardUIDsCreate,
+	Down:    sqlCardUIDsDrop,
+}
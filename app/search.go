@@ -0,0 +1,204 @@
+package app
+
+// Search.go contains the full-text search over people shared by all stores.
+
+import (
+	"fmt"
+	"html"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// defaultSearchLimit is the number of results returned when no limit is given.
+const defaultSearchLimit = 20
+
+// SearchResult is a person matching a search, with the matching fields highlighted.
+type SearchResult struct {
+	Person
+	// Score ranks the result, higher scores are better matches.
+	Score float64 `json:"Score"`
+	// Highlights contains the HTML escaped value of each matching field,
+	// with the matching words wrapped in <mark></mark>.
+	Highlights map[string]string `json:"Highlights"`
+}
+
+// searchColumns are the fields searched, those of the people table and its full-text index.
+var searchColumns = personColumns[:4]
+
+// searchTerms splits a search query into lower-cased words.
+func searchTerms(q string) []string {
+	return strings.FieldsFunc(strings.ToLower(q), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// ftsQuery converts search terms into an FTS5 query matching every term as a prefix.
+func ftsQuery(terms []string) string {
+	q := make([]string, len(terms))
+	for i, t := range terms {
+		q[i] = `"` + strings.Replace(t, `"`, `""`, -1) + `"*`
+	}
+	return strings.Join(q, " ")
+}
+
+// searchPerson matches every term as a word prefix against the person's fields.
+// ok is false if any term does not match.
+// Exact word matches score higher than prefix matches.
+func searchPerson(p Person, terms []string) (r SearchResult, ok bool) {
+	fields := make([]string, len(searchColumns))
+	values := make([]string, len(searchColumns))
+	for i, c := range searchColumns {
+		fields[i], values[i] = c.Header, c.get(&p)
+	}
+	marked := make([][]bool, len(values))
+	for i := range values {
+		marked[i] = make([]bool, len(values[i]))
+	}
+	for _, term := range terms {
+		best := 0.0
+		for i, v := range values {
+			lower := strings.ToLower(v)
+			for _, w := range wordSpans(lower) {
+				word := lower[w[0]:w[1]]
+				if !strings.HasPrefix(word, term) {
+					continue
+				}
+				score := 1.0
+				if word == term {
+					score = 2.0
+				}
+				if score > best {
+					best = score
+				}
+				for j := w[0]; j < w[0]+len(term) && j < len(marked[i]); j++ {
+					marked[i][j] = true
+				}
+			}
+		}
+		if best == 0 {
+			return r, false
+		}
+		r.Score += best
+	}
+	r.Person = p
+	r.Highlights = map[string]string{}
+	for i, v := range values {
+		if h, found := highlight(v, marked[i]); found {
+			r.Highlights[fields[i]] = h
+		}
+	}
+	return r, true
+}
+
+// wordSpans returns the byte offsets of each word in s.
+func wordSpans(s string) [][2]int {
+	spans := [][2]int{}
+	start := -1
+	for i, r := range s {
+		word := unicode.IsLetter(r) || unicode.IsNumber(r)
+		if word && start < 0 {
+			start = i
+		} else if !word && start >= 0 {
+			spans = append(spans, [2]int{start, i})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		spans = append(spans, [2]int{start, len(s)})
+	}
+	return spans
+}
+
+// highlight HTML escapes s and wraps each run of marked bytes in <mark></mark>.
+func highlight(s string, marked []bool) (string, bool) {
+	var b strings.Builder
+	found := false
+	for i := 0; i < len(s); {
+		j := i
+		for j < len(s) && marked[j] == marked[i] {
+			j++
+		}
+		if marked[i] {
+			found = true
+			fmt.Fprintf(&b, "<mark>%v</mark>", html.EscapeString(s[i:j]))
+		} else {
+			b.WriteString(html.EscapeString(s[i:j]))
+		}
+		i = j
+	}
+	return b.String(), found
+}
+
+// rankResults orders results by score, then by ID, and trims them to limit.
+func rankResults(results []SearchResult, limit int) []SearchResult {
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].ID < results[j].ID
+	})
+	if limit >= 0 && limit < len(results) {
+		results = results[:limit]
+	}
+	return results
+}
+
+// dbSearchPeople searches people in the database.
+// If the database has a full-text index it is used to find and rank matches,
+// otherwise candidates are found with LIKE and ranked by searchPerson.
+func dbSearchPeople(db *database, terms []string, limit int) ([]SearchResult, error) {
+	if db.fullText {
+		return dbSearchPeopleFTS(db, terms, limit)
+	}
+	where, args := []string{}, []interface{}{}
+	for _, t := range terms {
+		cols := []string{}
+		for _, col := range []string{"fname", "lname", "email", "phone"} {
+			args = append(args, "%"+escapeLike(t)+"%")
+			cols = append(cols, fmt.Sprintf(`LOWER(%v) LIKE %v ESCAPE '\'`, col, db.bind(len(args))))
+		}
+		where = append(where, "("+strings.Join(cols, " OR ")+")")
+	}
+	where = append(where, "deleted_at IS NULL")
+	rows, err := db.Query(sqlQueryPeople+" WHERE "+strings.Join(where, " AND "), args...)
+	if err != nil {
+		return nil, fmt.Errorf("error searching people: %v", err.Error())
+	}
+	defer rows.Close()
+	results := []SearchResult{}
+	for rows.Next() {
+		p := Person{}
+		if err := rows.Scan(p.dbFields()...); err != nil {
+			return nil, fmt.Errorf("error getting row: %v", err.Error())
+		}
+		if r, ok := searchPerson(p, terms); ok {
+			results = append(results, r)
+		}
+	}
+	return rankResults(results, limit), rows.Err()
+}
+
+// dbSearchPeopleFTS searches people using the people_fts full-text index, ranked by bm25.
+func dbSearchPeopleFTS(db *database, terms []string, limit int) ([]SearchResult, error) {
+	rows, err := db.Query(sqlSearchPeopleFTS, ftsQuery(terms), limit)
+	if err != nil {
+		return nil, fmt.Errorf("error searching people: %v", err.Error())
+	}
+	defer rows.Close()
+	results := []SearchResult{}
+	for rows.Next() {
+		p := Person{}
+		rank := 0.0
+		if err := rows.Scan(append(p.dbFields(), &rank)...); err != nil {
+			return nil, fmt.Errorf("error getting row: %v", err.Error())
+		}
+		r, ok := searchPerson(p, terms)
+		if !ok {
+			r = SearchResult{Person: p, Highlights: map[string]string{}}
+		}
+		r.Score = -rank
+		results = append(results, r)
+	}
+	return results, rows.Err()
+}
@@ -0,0 +1,25 @@
+//go:build sqlite_fts5
+
+package app
+
+// Search_fts5.go enables the SQLite FTS5 full-text index. Build with -tags sqlite_fts5 to use it.
+
+import (
+	"github.com/unixblackhole/didactic-tribble/app/migrations"
+)
+
+// sqliteFullText is set when the SQLite driver is built with FTS5 support.
+const sqliteFullText = true
+
+// sqliteSearchMigrations create the people_fts index and the triggers that keep it in sync.
+var sqliteSearchMigrations = []migrations.Migration{
+	{
+		Version: 2,
+		Name:    "create people_fts full-text index",
+		Up:      sqlFTSCreate,
+		Down:    sqlFTSDrop,
+	},
+}
+
+// checkFullText is nil, as this build can maintain the people_fts index.
+var checkFullText func(db *database) error
@@ -0,0 +1,31 @@
+//go:build !sqlite_fts5
+
+package app
+
+// Search_nofts5.go is used when the SQLite driver is built without FTS5,
+// in which case searches fall back to scanning with LIKE.
+
+import (
+	"fmt"
+
+	"github.com/unixblackhole/didactic-tribble/app/migrations"
+)
+
+// sqliteFullText is set when the SQLite driver is built with FTS5 support.
+const sqliteFullText = false
+
+// sqliteSearchMigrations is empty as there is no full-text index to create.
+var sqliteSearchMigrations []migrations.Migration
+
+// checkFullText returns an error if the database has the people_fts index created by a build with FTS5,
+// as its triggers would make every write to people fail with "no such module: fts5".
+func checkFullText(db *database) error {
+	n := 0
+	if err := db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE name = 'people_fts'`).Scan(&n); err != nil {
+		return fmt.Errorf("could not check for a full-text index: %v", err.Error())
+	}
+	if n > 0 {
+		return fmt.Errorf("the database has an FTS5 full-text index, so it must be opened by a build with -tags sqlite_fts5")
+	}
+	return nil
+}
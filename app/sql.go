@@ -3,9 +3,109 @@ package app
 //SQL.go Contains the SQL queries used in the app
 
 import (
-	_ "github.com/mattn/go-sqlite3" // SQLITE3 driver for database/sql
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"           // PostgreSQL driver for database/sql
+	"github.com/mattn/go-sqlite3" // SQLITE3 driver for database/sql
+	"github.com/unixblackhole/didactic-tribble/app/migrations"
 )
 
+// dialect contains the driver name and the SQL queries for a specific database.
+type dialect struct {
+	driver       string
+	migrations   []migrations.Migration
+	numbered     bool
+	noLimit      string
+	fullText     bool
+	tableClear   string
+	readPeople   string
+	createNew    string
+	lockIDs      string
+	dsnOptions   string
+	createPerson string
+	readPerson   string
+	updatePerson string
+	deletePerson string
+	// check, if set, returns an error if this build cannot safely use the database.
+	check func(db *database) error
+}
+
+// sqliteDialect contains the queries used for SQLite databases.
+var sqliteDialect = dialect{
+	driver:       "sqlite3",
+	migrations:   sqliteMigrations,
+	noLimit:      "-1",
+	fullText:     sqliteFullText,
+	check:        checkFullText,
+	tableClear:   sqlTableClear,
+	readPeople:   sqlReadPeople,
+	createNew:    sqlCreateNewPerson,
+	dsnOptions:   sqliteDSNOptions,
+	createPerson: sqlCreatePerson,
+	readPerson:   sqlReadPerson,
+	updatePerson: sqlUpdatePerson,
+	deletePerson: sqlDeletePerson,
+}
+
+// postgresDialect contains the queries used for PostgreSQL databases.
+var postgresDialect = dialect{
+	driver:       "postgres",
+	migrations:   postgresMigrations,
+	numbered:     true,
+	noLimit:      "ALL",
+	tableClear:   sqlTableClear,
+	readPeople:   pgReadPeople,
+	createNew:    pgCreateNewPerson,
+	lockIDs:      pgLockIDs,
+	createPerson: pgCreatePerson,
+	readPerson:   pgReadPerson,
+	updatePerson: pgUpdatePerson,
+	deletePerson: pgDeletePerson,
+}
+
+// bind returns the placeholder for the nth (1 based) query argument.
+func (d *dialect) bind(n int) string {
+	if d.numbered {
+		return fmt.Sprintf("$%d", n)
+	}
+	return "?"
+}
+
+// rebind replaces the ? placeholders of a query written for SQLite with the dialect's placeholders.
+// Statements shared by both dialects are written for SQLite and converted with rebind before use.
+func (d *dialect) rebind(query string) string {
+	if !d.numbered {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString(d.bind(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// isUniqueViolation reports whether err is a primary key or unique constraint failure.
+func isUniqueViolation(err error) bool {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey ||
+			sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Code == "23505"
+	}
+	return false
+}
+
 const sqlTableCreate = `
 CREATE TABLE IF NOT EXISTS people
 (
@@ -17,36 +117,663 @@ phone TEXT NOT NULL,
 CONSTRAINT products_pkey PRIMARY KEY (id)
 )`
 
+const sqlTableDrop = `
+DROP TABLE people
+`
+
 const sqlTableClear = `
-DELETE FROM people
+DELETE FROM people;
+DELETE FROM custom_fields;
+DELETE FROM contact_groups;
+DELETE FROM audit_log;
+UPDATE person_ids SET last_id = 0;
 `
 
 const sqlReadPeople = `
-SELECT id, fname, lname, email, phone 
+SELECT id, fname, lname, email, phone,
+organization, title, department, nickname, birthday, website, notes, deleted_at
 FROM people 
+WHERE deleted_at IS NULL
+ORDER BY id
 LIMIT ? 
 OFFSET ?
 `
 
-const sqlGetNextID = `
-SELECT IFNULL(MAX(id),0)+1 FROM people
+// sqliteDSNOptions makes concurrent writers wait for the database lock instead of failing,
+// and makes transactions take the write lock up front so they cannot deadlock upgrading it.
+// The write-ahead log lets writers commit while a long running read, such as an export, is open.
+// Foreign keys are enforced so deleting a person deletes their emails, phones and addresses.
+const sqliteDSNOptions = "_busy_timeout=5000&_txlock=immediate&_journal_mode=WAL&_foreign_keys=1"
+
+// sqlCreateNewPerson allocates the ID after the highest ever used and inserts the person in a single statement,
+// which SQLite runs while holding the write lock.
+const sqlCreateNewPerson = `
+INSERT INTO people (id, fname, lname, email, phone,
+organization, title, department, nickname, birthday, website, notes)
+SELECT last_id+1, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ? FROM person_ids
+RETURNING id
 `
 
 const sqlCreatePerson = `
-INSERT INTO people (id, fname, lname, email, phone) 
-VALUES (?, ?, ?, ?, ?)
+INSERT INTO people (id, fname, lname, email, phone,
+organization, title, department, nickname, birthday, website, notes)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 `
 
 const sqlReadPerson = `
-SELECT id, fname, lname, email, phone FROM people WHERE id = ?
+SELECT id, fname, lname, email, phone,
+organization, title, department, nickname, birthday, website, notes, deleted_at
+FROM people WHERE id = ? AND deleted_at IS NULL
 `
 
 const sqlUpdatePerson = `
 UPDATE people 
-SET fname = ?, lname = ?, email = ?, phone = ?  
-WHERE id = ?
+SET fname = ?, lname = ?, email = ?, phone = ?,
+organization = ?, title = ?, department = ?, nickname = ?, birthday = ?, website = ?, notes = ?
+WHERE id = ? AND deleted_at IS NULL
 `
 
 const sqlDeletePerson = `
-DELETE from people WHERE id = ?
+UPDATE people SET deleted_at = ? WHERE id = ? AND deleted_at IS NULL
+`
+
+// PostgreSQL uses numbered placeholders, and a NULL limit instead of -1 to return all rows.
+
+const pgReadPeople = `
+SELECT id, fname, lname, email, phone,
+organization, title, department, nickname, birthday, website, notes, deleted_at
+FROM people
+WHERE deleted_at IS NULL
+ORDER BY id
+LIMIT NULLIF($1, -1)
+OFFSET $2
+`
+
+// pgLockIDs serializes ID allocation between transactions until the transaction ends.
+const pgLockIDs = `
+SELECT pg_advisory_xact_lock(7242)
+`
+
+const pgCreateNewPerson = `
+INSERT INTO people (id, fname, lname, email, phone,
+organization, title, department, nickname, birthday, website, notes)
+SELECT last_id+1, $1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11 FROM person_ids
+RETURNING id
+`
+
+const pgCreatePerson = `
+INSERT INTO people (id, fname, lname, email, phone,
+organization, title, department, nickname, birthday, website, notes)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+`
+
+const pgReadPerson = `
+SELECT id, fname, lname, email, phone,
+organization, title, department, nickname, birthday, website, notes, deleted_at
+FROM people WHERE id = $1 AND deleted_at IS NULL
+`
+
+const pgUpdatePerson = `
+UPDATE people
+SET fname = $1, lname = $2, email = $3, phone = $4,
+organization = $5, title = $6, department = $7, nickname = $8, birthday = $9, website = $10, notes = $11
+WHERE id = $12 AND deleted_at IS NULL
+`
+
+const pgDeletePerson = `
+UPDATE people SET deleted_at = $1 WHERE id = $2 AND deleted_at IS NULL
+`
+
+// The people query is built by dbQueryPeople from these fragments.
+
+const sqlQueryPeople = `
+SELECT id, fname, lname, email, phone,
+organization, title, department, nickname, birthday, website, notes, deleted_at
+FROM people`
+
+// sqlWalkPeople reads the next batch of people after an ID, in ID order, for both dialects.
+const sqlWalkPeople = sqlQueryPeople + `
+WHERE id > ? AND deleted_at IS NULL
+ORDER BY id
+LIMIT ?`
+
+const sqlCountPeople = `
+SELECT COUNT(*) FROM people`
+
+// people_fts is an external content FTS5 index over people, kept in sync by triggers.
+
+const sqlFTSCreate = `
+CREATE VIRTUAL TABLE people_fts USING fts5(
+fname, lname, email, phone,
+content='people', content_rowid='id'
+);
+CREATE TRIGGER people_fts_insert AFTER INSERT ON people BEGIN
+INSERT INTO people_fts (rowid, fname, lname, email, phone)
+VALUES (new.id, new.fname, new.lname, new.email, new.phone);
+END;
+CREATE TRIGGER people_fts_delete AFTER DELETE ON people BEGIN
+INSERT INTO people_fts (people_fts, rowid, fname, lname, email, phone)
+VALUES ('delete', old.id, old.fname, old.lname, old.email, old.phone);
+END;
+CREATE TRIGGER people_fts_update AFTER UPDATE ON people BEGIN
+INSERT INTO people_fts (people_fts, rowid, fname, lname, email, phone)
+VALUES ('delete', old.id, old.fname, old.lname, old.email, old.phone);
+INSERT INTO people_fts (rowid, fname, lname, email, phone)
+VALUES (new.id, new.fname, new.lname, new.email, new.phone);
+END;
+INSERT INTO people_fts (people_fts) VALUES ('rebuild');
+`
+
+const sqlFTSDrop = `
+DROP TRIGGER IF EXISTS people_fts_insert;
+DROP TRIGGER IF EXISTS people_fts_delete;
+DROP TRIGGER IF EXISTS people_fts_update;
+DROP TABLE IF EXISTS people_fts;
+`
+
+const sqlSearchPeopleFTS = `
+SELECT p.id, p.fname, p.lname, p.email, p.phone,
+p.organization, p.title, p.department, p.nickname, p.birthday, p.website, p.notes, p.deleted_at, bm25(people_fts)
+FROM people_fts
+JOIN people p ON p.id = people_fts.rowid
+WHERE people_fts MATCH ? AND p.deleted_at IS NULL
+ORDER BY bm25(people_fts), p.id
+LIMIT ?
+`
+
+// Each person's emails, phones and addresses are kept in order in a table of their own.
+
+const sqlDetailsCreate = `
+CREATE TABLE person_emails
+(
+person_id INTEGER NOT NULL REFERENCES people (id) ON DELETE CASCADE,
+seq INTEGER NOT NULL,
+type TEXT NOT NULL,
+value TEXT NOT NULL,
+PRIMARY KEY (person_id, seq)
+);
+CREATE TABLE person_phones
+(
+person_id INTEGER NOT NULL REFERENCES people (id) ON DELETE CASCADE,
+seq INTEGER NOT NULL,
+type TEXT NOT NULL,
+value TEXT NOT NULL,
+PRIMARY KEY (person_id, seq)
+);
+CREATE TABLE person_addresses
+(
+person_id INTEGER NOT NULL REFERENCES people (id) ON DELETE CASCADE,
+seq INTEGER NOT NULL,
+type TEXT NOT NULL,
+street TEXT NOT NULL,
+city TEXT NOT NULL,
+region TEXT NOT NULL,
+postcode TEXT NOT NULL,
+country TEXT NOT NULL,
+PRIMARY KEY (person_id, seq)
+);
+INSERT INTO person_emails (person_id, seq, type, value)
+SELECT id, 0, '', email FROM people WHERE email <> '';
+INSERT INTO person_phones (person_id, seq, type, value)
+SELECT id, 0, '', phone FROM people WHERE phone <> '';
+`
+
+const sqlDetailsDrop = `
+DROP TABLE person_addresses;
+DROP TABLE person_phones;
+DROP TABLE person_emails;
+`
+
+const sqlCreateEmail = `
+INSERT INTO person_emails (person_id, seq, type, value) VALUES (?, ?, ?, ?)
+`
+
+const sqlCreatePhone = `
+INSERT INTO person_phones (person_id, seq, type, value) VALUES (?, ?, ?, ?)
+`
+
+const sqlCreateAddress = `
+INSERT INTO person_addresses (person_id, seq, type, street, city, region, postcode, country)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+`
+
+const sqlDeleteEmails = `
+DELETE FROM person_emails WHERE person_id = ?
+`
+
+const sqlDeletePhones = `
+DELETE FROM person_phones WHERE person_id = ?
+`
+
+const sqlDeleteAddresses = `
+DELETE FROM person_addresses WHERE person_id = ?
+`
+
+// The read statements select the records of a list of people, filled in with fmt.Sprintf.
+
+const sqlReadEmails = `
+SELECT person_id, type, value FROM person_emails
+WHERE person_id IN (%v)
+ORDER BY person_id, seq
+`
+
+const sqlReadPhones = `
+SELECT person_id, type, value FROM person_phones
+WHERE person_id IN (%v)
+ORDER BY person_id, seq
+`
+
+const sqlReadAddresses = `
+SELECT person_id, type, street, city, region, postcode, country FROM person_addresses
+WHERE person_id IN (%v)
+ORDER BY person_id, seq
+`
+
+// The organization, job and personal details of people are columns of the people table.
+
+const sqlProfileCreate = `
+ALTER TABLE people ADD COLUMN organization TEXT NOT NULL DEFAULT '';
+ALTER TABLE people ADD COLUMN title TEXT NOT NULL DEFAULT '';
+ALTER TABLE people ADD COLUMN department TEXT NOT NULL DEFAULT '';
+ALTER TABLE people ADD COLUMN nickname TEXT NOT NULL DEFAULT '';
+ALTER TABLE people ADD COLUMN birthday TEXT NOT NULL DEFAULT '';
+ALTER TABLE people ADD COLUMN website TEXT NOT NULL DEFAULT '';
+ALTER TABLE people ADD COLUMN notes TEXT NOT NULL DEFAULT '';
+`
+
+const sqlProfileDrop = `
+ALTER TABLE people DROP COLUMN notes;
+ALTER TABLE people DROP COLUMN website;
+ALTER TABLE people DROP COLUMN birthday;
+ALTER TABLE people DROP COLUMN nickname;
+ALTER TABLE people DROP COLUMN department;
+ALTER TABLE people DROP COLUMN title;
+ALTER TABLE people DROP COLUMN organization;
+`
+
+// Custom field definitions, and each person's values for them.
+
+const sqlCustomFieldsCreate = `
+CREATE TABLE custom_fields
+(
+name TEXT PRIMARY KEY,
+type TEXT NOT NULL,
+required BOOLEAN NOT NULL,
+options TEXT NOT NULL,
+pattern TEXT NOT NULL,
+max_length INTEGER NOT NULL,
+minimum TEXT NOT NULL,
+maximum TEXT NOT NULL
+);
+CREATE TABLE person_custom
+(
+person_id INTEGER NOT NULL REFERENCES people (id) ON DELETE CASCADE,
+field TEXT NOT NULL REFERENCES custom_fields (name) ON DELETE CASCADE,
+value TEXT NOT NULL,
+PRIMARY KEY (person_id, field)
+);
+CREATE INDEX person_custom_field ON person_custom (field, value);
+`
+
+const sqlCustomFieldsDrop = `
+DROP TABLE person_custom;
+DROP TABLE custom_fields;
+`
+
+const sqlReadCustomFields = `
+SELECT name, type, required, options, pattern, max_length, minimum, maximum
+FROM custom_fields
+ORDER BY name
+`
+
+const sqlCreateCustomField = `
+INSERT INTO custom_fields (name, type, required, options, pattern, max_length, minimum, maximum)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+`
+
+const sqlUpdateCustomField = `
+UPDATE custom_fields
+SET type = ?, required = ?, options = ?, pattern = ?, max_length = ?, minimum = ?, maximum = ?
+WHERE name = ?
+`
+
+const sqlDeleteCustomField = `
+DELETE FROM custom_fields WHERE name = ?
+`
+
+const sqlCreateCustom = `
+INSERT INTO person_custom (person_id, field, value) VALUES (?, ?, ?)
+`
+
+const sqlDeleteCustom = `
+DELETE FROM person_custom WHERE person_id = ?
+`
+
+const sqlReadCustom = `
+SELECT person_id, field, value FROM person_custom
+WHERE person_id IN (%v)
+ORDER BY person_id, field
+`
+
+// sqlDetailFilter is filled in with the table of people's emails or phones, and a condition on its rows, by detailFilter.
+const sqlDetailFilter = `EXISTS (SELECT 1 FROM %v d WHERE d.person_id = people.id AND %v)`
+
+// sqlCustomFilter is filled in with the placeholders of a field name and value by customFilter.
+const sqlCustomFilter = `EXISTS (SELECT 1 FROM person_custom c WHERE c.person_id = people.id AND c.field = %v AND c.value = %v)`
+
+// Groups, and the people in them. Group names are unique ignoring case, and group IDs are allocated
+// like people's.
+
+const sqlGroupsCreate = `
+CREATE TABLE contact_groups
+(
+id INTEGER NOT NULL PRIMARY KEY,
+name TEXT NOT NULL,
+description TEXT NOT NULL
+);
+CREATE UNIQUE INDEX contact_groups_name ON contact_groups (LOWER(name));
+CREATE TABLE person_groups
+(
+person_id INTEGER NOT NULL REFERENCES people (id) ON DELETE CASCADE,
+group_id INTEGER NOT NULL REFERENCES contact_groups (id) ON DELETE CASCADE,
+PRIMARY KEY (person_id, group_id)
+);
+CREATE INDEX person_groups_group ON person_groups (group_id);
+`
+
+const sqlGroupsDrop = `
+DROP TABLE person_groups;
+DROP TABLE contact_groups;
+`
+
+// People in the trash are not counted as members of their groups.
+
+const sqlReadGroups = `
+SELECT g.id, g.name, g.description, COUNT(pg.person_id)
+FROM contact_groups g LEFT JOIN person_groups pg
+ON pg.group_id = g.id AND pg.person_id IN (SELECT id FROM people WHERE deleted_at IS NULL)
+GROUP BY g.id, g.name, g.description
+ORDER BY g.name, g.id
+`
+
+const sqlReadGroup = `
+SELECT g.id, g.name, g.description, COUNT(pg.person_id)
+FROM contact_groups g LEFT JOIN person_groups pg
+ON pg.group_id = g.id AND pg.person_id IN (SELECT id FROM people WHERE deleted_at IS NULL)
+WHERE g.id = ?
+GROUP BY g.id, g.name, g.description
+`
+
+const sqlFindGroup = `
+SELECT id, name FROM contact_groups WHERE LOWER(name) = LOWER(?)
+`
+
+const sqlCreateGroup = `
+INSERT INTO contact_groups (id, name, description)
+SELECT COALESCE(MAX(id),0)+1, ?, ? FROM contact_groups
+RETURNING id
+`
+
+const sqlUpdateGroup = `
+UPDATE contact_groups SET name = ?, description = ? WHERE id = ?
+`
+
+const sqlDeleteGroup = `
+DELETE FROM contact_groups WHERE id = ?
+`
+
+const sqlCreateMembership = `
+INSERT INTO person_groups (person_id, group_id) VALUES (?, ?)
+`
+
+const sqlDeleteMemberships = `
+DELETE FROM person_groups WHERE person_id = ?
+`
+
+const sqlReadMemberships = `
+SELECT pg.person_id, g.name FROM person_groups pg
+JOIN contact_groups g ON g.id = pg.group_id
+WHERE pg.person_id IN (%v)
+ORDER BY pg.person_id, g.name
+`
+
+// sqlGroupFilter is filled in with the placeholder of a group name by groupFilter.
+const sqlGroupFilter = `EXISTS (SELECT 1 FROM person_groups pg JOIN contact_groups g ON g.id = pg.group_id WHERE pg.person_id = people.id AND LOWER(g.name) = LOWER(%v))`
+
+// Relationships between people, one row for each side of a bidirectional relationship.
+// Relationships to people in the trash are hidden, and purging either person deletes the relationship.
+
+const sqlRelationshipsCreate = `
+CREATE TABLE relationships
+(
+id INTEGER NOT NULL PRIMARY KEY,
+person_id INTEGER NOT NULL REFERENCES people (id) ON DELETE CASCADE,
+related_id INTEGER NOT NULL REFERENCES people (id) ON DELETE CASCADE,
+type TEXT NOT NULL,
+label TEXT NOT NULL,
+bidirectional BOOLEAN NOT NULL
+);
+CREATE UNIQUE INDEX relationships_link ON relationships (person_id, related_id, type, label);
+CREATE INDEX relationships_related ON relationships (related_id);
+`
+
+const sqlRelationshipsDrop = `
+DROP TABLE relationships;
+`
+
+const sqlCountRelated = `
+SELECT COUNT(*) FROM people WHERE id IN (?, ?) AND deleted_at IS NULL
+`
+
+const sqlReadRelationships = `
+SELECT id, person_id, related_id, type, label, bidirectional FROM relationships
+WHERE person_id = ? AND related_id IN (SELECT id FROM people WHERE deleted_at IS NULL)
+ORDER BY id
+`
+
+const sqlReadRelationship = `
+SELECT id, person_id, related_id, type, label, bidirectional FROM relationships
+WHERE id = ? AND person_id = ?
+`
+
+const sqlCreateRelationship = `
+INSERT INTO relationships (id, person_id, related_id, type, label, bidirectional)
+SELECT COALESCE(MAX(id),0)+1, ?, ?, ?, ?, ? FROM relationships
+RETURNING id
+`
+
+const sqlDeleteRelationship = `
+DELETE FROM relationships WHERE id = ?
+`
+
+const sqlDeleteRelationshipLink = `
+DELETE FROM relationships WHERE person_id = ? AND related_id = ? AND type = ? AND label = ?
+`
+
+// People's photos, when they are kept in the database. Purging a person deletes their photo.
+// SQLite stores the images as BLOBs and PostgreSQL as BYTEA.
+
+const sqlPhotosCreate = `
+CREATE TABLE person_photos
+(
+person_id INTEGER NOT NULL PRIMARY KEY REFERENCES people (id) ON DELETE CASCADE,
+content_type TEXT NOT NULL,
+data BLOB NOT NULL,
+thumbnail BLOB NOT NULL
+)`
+
+const pgPhotosCreate = `
+CREATE TABLE person_photos
+(
+person_id INTEGER NOT NULL PRIMARY KEY REFERENCES people (id) ON DELETE CASCADE,
+content_type TEXT NOT NULL,
+data BYTEA NOT NULL,
+thumbnail BYTEA NOT NULL
+)`
+
+const sqlPhotosDrop = `
+DROP TABLE person_photos
+`
+
+const sqlReadPhoto = `
+SELECT content_type, data, thumbnail FROM person_photos WHERE person_id = ?
+`
+
+const sqlPutPhoto = `
+INSERT INTO person_photos (person_id, content_type, data, thumbnail) VALUES (?, ?, ?, ?)
+ON CONFLICT (person_id) DO UPDATE
+SET content_type = excluded.content_type, data = excluded.data, thumbnail = excluded.thumbnail
+`
+
+const sqlDeletePhoto = `
+DELETE FROM person_photos WHERE person_id = ?
+`
+
+// The trash holds deleted people, marked with the time they were deleted, until they are restored
+// or purged.
+
+const sqlTrashCreate = `
+ALTER TABLE people ADD COLUMN deleted_at TIMESTAMP;
+CREATE INDEX people_deleted_at ON people (deleted_at);
+`
+
+const sqlTrashDrop = `
+DROP INDEX people_deleted_at;
+ALTER TABLE people DROP COLUMN deleted_at;
+`
+
+const sqlRestorePerson = `
+UPDATE people SET deleted_at = NULL WHERE id = ? AND deleted_at IS NOT NULL
+`
+
+const sqlPurgePerson = `
+DELETE FROM people WHERE id = ? AND deleted_at IS NOT NULL
+`
+
+const sqlPurgeDeleted = `
+DELETE FROM people WHERE deleted_at < ?
+RETURNING id
+`
+
+// The audit log of changes to people. Entries are kept after the people they describe are purged,
+// so person_id is not a foreign key. The changes and the person before and after each change are
+// stored as JSON, or '' if there is no such person.
+
+const sqlAuditCreate = `
+CREATE TABLE audit_log
+(
+id INTEGER NOT NULL PRIMARY KEY,
+person_id INTEGER NOT NULL,
+action TEXT NOT NULL,
+actor TEXT NOT NULL,
+logged_at TIMESTAMP NOT NULL,
+request_id TEXT NOT NULL,
+changes TEXT NOT NULL,
+before_person TEXT NOT NULL,
+after_person TEXT NOT NULL
+);
+CREATE INDEX audit_log_person ON audit_log (person_id);
+CREATE INDEX audit_log_logged_at ON audit_log (logged_at);
+`
+
+const sqlAuditDrop = `
+DROP TABLE audit_log;
+`
+
+const sqlCreateAuditEntry = `
+INSERT INTO audit_log (id, person_id, action, actor, logged_at, request_id, changes, before_person, after_person)
+SELECT COALESCE(MAX(id),0)+1, ?, ?, ?, ?, ?, ?, ?, ? FROM audit_log
+RETURNING id
+`
+
+// The audit log query is built by SQLStore.Audit from these fragments.
+
+const sqlReadAuditEntries = `
+SELECT id, person_id, action, actor, logged_at, request_id, changes, before_person, after_person
+FROM audit_log`
+
+const sqlCountAuditEntries = `
+SELECT COUNT(*) FROM audit_log`
+
+// The names CardDAV clients gave the cards they created. Purging a person forgets the name of their card.
+
+const sqlCardNamesCreate = `
+CREATE TABLE card_names
+(
+name TEXT NOT NULL PRIMARY KEY,
+person_id INTEGER NOT NULL UNIQUE REFERENCES people (id) ON DELETE CASCADE
+)`
+
+const sqlCardNamesDrop = `
+DROP TABLE card_names
+`
+
+// The highest person ID ever used, so the IDs of purged people are never given out again. Their audit
+// log entries outlive them, and would otherwise become the history of the next person created.
+// The mark starts above the IDs of existing people and of people already purged from the audit log.
+
+const sqlPersonIDsCreate = `
+CREATE TABLE person_ids
+(
+last_id INTEGER NOT NULL
+);
+INSERT INTO person_ids (last_id)
+SELECT COALESCE(MAX(id),0) FROM
+(SELECT MAX(id) AS id FROM people UNION ALL SELECT MAX(person_id) FROM audit_log) ids
+`
+
+const sqlPersonIDsDrop = `
+DROP TABLE person_ids
+`
+
+const sqlReadLastID = `
+SELECT last_id FROM person_ids
+`
+
+const sqlUseID = `
+UPDATE person_ids SET last_id = ? WHERE last_id < ?
+`
+
+const sqlReadCardNames = `
+SELECT person_id, name FROM card_names
+`
+
+const sqlCardPerson = `
+SELECT person_id FROM card_names WHERE name = ?
+`
+
+const sqlNameCard = `
+INSERT INTO card_names (name, person_id) VALUES (?, ?)
+ON CONFLICT (name) DO UPDATE SET person_id = excluded.person_id
+`
+
+// The UIDs CardDAV clients gave cards, served back in them in place of the UID made from the person's ID.
+// Purging a person forgets the UID of their card.
+
+const sqlCardUIDsCreate = `
+CREATE TABLE card_uids
+(
+person_id INTEGER NOT NULL PRIMARY KEY REFERENCES people (id) ON DELETE CASCADE,
+uid TEXT NOT NULL UNIQUE
+)`
+
+const sqlCardUIDsDrop = `
+DROP TABLE card_uids
+`
+
+const sqlCardUID = `
+SELECT uid FROM card_uids WHERE person_id = ?
+`
+
+const sqlUIDPerson = `
+SELECT person_id FROM card_uids WHERE uid = ?
+`
+
+const sqlTakeCardUID = `
+DELETE FROM card_uids WHERE uid = ? AND person_id <> ?
+`
+
+const sqlSetCardUID = `
+INSERT INTO card_uids (person_id, uid) VALUES (?, ?)
+ON CONFLICT (person_id) DO UPDATE SET uid = excluded.uid
 `
@@ -0,0 +1,92 @@
+package app
+
+// Store.go contains the storage interface the App uses to persist people.
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrNotFound is returned by a PersonStore when the requested ID does not exist.
+var ErrNotFound = errors.New("ID not found")
+
+// ErrExists is returned by PersonStore.Create when the ID is already in use.
+var ErrExists = errors.New("ID already exists")
+
+// ErrNoPeople is returned by PersonStore.List when there are no people to return.
+var ErrNoPeople = errors.New("no people returned")
+
+// PersonStore is a storage backend for address book entries.
+// Deleted people are kept in a trash until they are restored or purged. Only Query, Restore and
+// the Purge methods see them; to the others they do not exist, although their IDs stay in use.
+type PersonStore interface {
+	// Create inserts a new person using the person's ID.
+	// If the ID is 0, the store atomically allocates the highest ID ever used + 1 and sets p.ID,
+	// so the ID of a purged person is never given to someone else.
+	// ErrExists is returned if the ID is already in use, or is no higher than the highest ID ever used.
+	Create(p *Person) error
+	// Get returns the person with the given ID, or ErrNotFound.
+	Get(id int) (Person, error)
+	// List returns count people starting at offset start.
+	// A count of -1 returns all people.
+	List(start, count int) ([]Person, error)
+	// Walk calls fn for every person in ID order, without loading them all into memory,
+	// and stops at the first error fn returns.
+	Walk(fn func(p *Person) error) error
+	// Query returns the page of people selected by q, along with the
+	// total number of people matching q's filters.
+	Query(q PeopleQuery) ([]Person, int, error)
+	// Search returns up to limit people matching every word in q as a prefix, best matches first.
+	Search(q string, limit int) ([]SearchResult, error)
+	// Update replaces the stored person with the same ID, or returns ErrNotFound.
+	Update(p *Person) error
+	// Delete moves the person with the given ID to the trash, or returns ErrNotFound.
+	// Their groups, relationships and photo are kept, but relationships to them are hidden.
+	Delete(id int) error
+	// Restore takes the person with the given ID out of the trash, or returns ErrNotFound.
+	Restore(id int) error
+	// Purge permanently removes the person with the given ID from the trash, along with their photo
+	// and every relationship to or from them, or returns ErrNotFound.
+	Purge(id int) error
+	// PurgeDeleted permanently removes everyone moved to the trash before the given time, like Purge,
+	// and returns their IDs.
+	PurgeDeleted(before time.Time) ([]int, error)
+	// Import creates each of the given people with newly allocated IDs, setting their IDs,
+	// and returns the number of people created.
+	// Concurrent imports and creates never allocate the same ID.
+	Import(people []Person) (int, error)
+
+	// Fields returns the custom field definitions in name order.
+	Fields() ([]CustomField, error)
+	// CreateField adds a custom field, or returns ErrExists if the name is in use.
+	CreateField(f *CustomField) error
+	// UpdateField replaces the custom field with the same name, or returns ErrNotFound.
+	// People's values are not checked against the new definition.
+	UpdateField(f *CustomField) error
+	// DeleteField removes a custom field and every person's value for it, or returns ErrNotFound.
+	DeleteField(name string) error
+
+	// Groups returns every group in name order.
+	Groups() ([]Group, error)
+	// GetGroup returns the group with the given ID, or ErrNotFound.
+	GetGroup(id int) (Group, error)
+	// CreateGroup adds a group with the highest used group ID + 1 and sets g.ID,
+	// or returns ErrExists if the name is in use, ignoring case.
+	CreateGroup(g *Group) error
+	// UpdateGroup renames the group with the same ID or changes its description.
+	// It returns ErrNotFound if there is no such group, or ErrExists if the new name is in use.
+	UpdateGroup(g *Group) error
+	// DeleteGroup removes a group and every membership of it, but not its members, or returns ErrNotFound.
+	DeleteGroup(id int) error
+
+	// Relationships returns the relationships of a person, in ID order.
+	Relationships(personID int) ([]Relationship, error)
+	// CreateRelationship adds r with the highest used relationship ID + 1 and sets r.ID.
+	// A bidirectional relationship's inverse is added too, with an ID of its own.
+	// It returns ErrNotFound if either person does not exist, or ErrExists if the relationship,
+	// or its inverse, already does.
+	CreateRelationship(r *Relationship) error
+	// DeleteRelationship removes a relationship of a person, and its inverse if it is bidirectional,
+	// or returns ErrNotFound.
+	DeleteRelationship(personID, id int) error
+}
@@ -0,0 +1,813 @@
+package app
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/unixblackhole/didactic-tribble/app/ldap"
+	"github.com/unixblackhole/didactic-tribble/app/migrations"
+)
+
+const TestStoreDBName = "TestStore.sqlitedb"
+
+// testStores returns each PersonStore implementation, empty, along with a cleanup function.
+func testStores(t *testing.T) (map[string]PersonStore, func()) {
+	s, err := NewSQLiteStore(TestStoreDBName)
+	if err != nil {
+		t.Fatalf("Error creating SQLite store: %v", err.Error())
+	}
+	clearTable(s.db)
+	stores := map[string]PersonStore{
+		"sqlite": s,
+		"memory": NewMemoryStore(),
+	}
+	var pg *SQLStore
+	if dsn := os.Getenv("TEST_POSTGRES_DSN"); dsn != "" {
+		pg, err = NewPostgresStore(dsn)
+		if err != nil {
+			t.Fatalf("Error creating PostgreSQL store: %v", err.Error())
+		}
+		clearTable(pg.db)
+		stores["postgres"] = pg
+	}
+	return stores, func() {
+		s.db.Close()
+		if pg != nil {
+			pg.db.Close()
+		}
+		os.Remove(TestStoreDBName)
+	}
+}
+
+func TestPersonStore(t *testing.T) {
+	stores, cleanup := testStores(t)
+	defer cleanup()
+	for name, s := range stores {
+		t.Run(name, func(t *testing.T) {
+			if _, err := s.List(0, -1); err != ErrNoPeople {
+				t.Errorf("List() on empty store error = %v, want %v", err, ErrNoPeople)
+			}
+			p := Person{FirstName: "Test", LastName: "Name", Email: "Test.Name@example.com", Phone: "123-456-7890"}
+			if err := s.Create(&p); err != nil || p.ID != 1 {
+				t.Errorf("Create() allocated ID %v, %v, want 1", p.ID, err)
+			}
+			if err := s.Create(&p); err != ErrExists {
+				t.Errorf("Create() with duplicate ID error = %v, want %v", err, ErrExists)
+			}
+			got, err := s.Get(1)
+			if err != nil || !reflect.DeepEqual(got, p) {
+				t.Errorf("Get() = %+v, %v, want %+v", got, err, p)
+			}
+			if _, err := s.Get(99); err != ErrNotFound {
+				t.Errorf("Get() missing ID error = %v, want %v", err, ErrNotFound)
+			}
+			p.Email = "Changed@example.com"
+			if err := s.Update(&p); err != nil {
+				t.Errorf("Update() error = %v", err)
+			}
+			if got, _ := s.Get(1); got.Email != p.Email {
+				t.Errorf("Update() did not persist, got %v", got.Email)
+			}
+			if err := s.Update(&Person{ID: 99}); err != ErrNotFound {
+				t.Errorf("Update() missing ID error = %v, want %v", err, ErrNotFound)
+			}
+			n, err := s.Import([]Person{{FirstName: "A"}, {FirstName: "B"}})
+			if err != nil || n != 2 {
+				t.Errorf("Import() = %v, %v, want 2", n, err)
+			}
+			people, err := s.List(1, 1)
+			if err != nil || len(people) != 1 || people[0].ID != 2 {
+				t.Errorf("List(1, 1) = %+v, %v, want ID 2", people, err)
+			}
+			ids := []int{}
+			err = s.Walk(func(p *Person) error {
+				ids = append(ids, p.ID)
+				return nil
+			})
+			if err != nil || !reflect.DeepEqual(ids, []int{1, 2, 3}) {
+				t.Errorf("Walk() = %v, %v, want IDs 1, 2, 3", ids, err)
+			}
+			stop := errors.New("stop")
+			if err := s.Walk(func(p *Person) error { return stop }); err != stop {
+				t.Errorf("Walk() error = %v, want %v", err, stop)
+			}
+			people, total, err := s.Query(PeopleQuery{Limit: 1, Sort: []SortField{{Field: "firstname", Desc: true}}})
+			if err != nil || total != 3 || len(people) != 1 || people[0].FirstName != "Test" {
+				t.Errorf("Query() sorted = %+v, %v, %v", people, total, err)
+			}
+			people, total, err = s.Query(PeopleQuery{Limit: -1, AfterID: 1, EmailDomain: "EXAMPLE.com"})
+			if err != nil || total != 1 || len(people) != 0 {
+				t.Errorf("Query() filtered = %+v, %v, %v", people, total, err)
+			}
+			people, total, err = s.Query(PeopleQuery{Limit: 5, Offset: 1, FirstName: "B"})
+			if err != nil || total != 1 || len(people) != 0 {
+				t.Errorf("Query() offset = %+v, %v, %v", people, total, err)
+			}
+			results, err := s.Search("chan exam", 10)
+			if err != nil || len(results) != 1 || results[0].ID != 1 {
+				t.Errorf("Search() = %+v, %v, want ID 1", results, err)
+			} else if h := results[0].Highlights["Email"]; h != "<mark>Chan</mark>ged@<mark>exam</mark>ple.com" {
+				t.Errorf("Search() highlight = %v", h)
+			}
+			if results, err := s.Search("nobody", 10); err != nil || len(results) != 0 {
+				t.Errorf("Search() with no matches = %+v, %v", results, err)
+			}
+			if err := s.Delete(1); err != nil {
+				t.Errorf("Delete() error = %v", err)
+			}
+			if people, _ := s.List(0, -1); len(people) != 2 {
+				t.Errorf("List() after Delete() = %v people, want 2", len(people))
+			}
+			if results, _ := s.Search("test", 10); len(results) != 0 {
+				t.Errorf("Search() after Delete() = %+v, want no results", results)
+			}
+		})
+	}
+}
+
+func TestPersonStore_Details(t *testing.T) {
+	stores, cleanup := testStores(t)
+	defer cleanup()
+	for name, s := range stores {
+		t.Run(name, func(t *testing.T) {
+			p := Person{
+				FirstName:    "Ann",
+				Email:        "ann@work.example.com",
+				Emails:       []Email{{Type: TypeHome, Value: "ann@example.com"}, {Type: TypeWork, Value: "ann@work.example.com"}},
+				Phones:       []Phone{{Type: TypeMobile, Value: "555-0100"}, {Type: TypeWork, Value: "555-0101"}},
+				Addresses:    []Address{{Type: TypeHome, Street: "1 Main St", City: "Springfield", Country: "USA"}},
+				Nickname:     "Annie",
+				Organization: "Acme",
+				Department:   "Sales",
+				Title:        "Manager",
+				Birthday:     "--04-12",
+				Website:      "https://example.com",
+				Notes:        "Prefers email.",
+			}
+			if err := s.Create(&p); err != nil {
+				t.Fatalf("Create() error = %v", err)
+			}
+			if p.Emails[0].Value != "ann@work.example.com" || p.Phone != "555-0100" {
+				t.Errorf("Create() did not make Email and Phone primary, got %+v", p)
+			}
+			p.Emails[1].Value = "changed@example.com"
+			if got, _ := s.Get(p.ID); got.Emails[1].Value != "ann@example.com" {
+				t.Errorf("Get() shares the caller's emails, got %+v", got.Emails)
+			}
+			p.Emails[1].Value = "ann@example.com"
+			s.Import([]Person{{FirstName: "Bob", Phone: "555-0200"}})
+			want := []Person{p, normalised(Person{ID: p.ID + 1, FirstName: "Bob", Phone: "555-0200"})[0]}
+			if got, err := s.Get(p.ID); err != nil || !reflect.DeepEqual(got, want[0]) {
+				t.Errorf("Get() = %+v, %v, want %+v", got, err, want[0])
+			}
+			if got, err := s.List(0, -1); err != nil || !reflect.DeepEqual(got, want) {
+				t.Errorf("List() = %+v, %v, want %+v", got, err, want)
+			}
+			if got, _, err := s.Query(PeopleQuery{Limit: -1}); err != nil || !reflect.DeepEqual(got, want) {
+				t.Errorf("Query() = %+v, %v, want %+v", got, err, want)
+			}
+			walked := []Person{}
+			s.Walk(func(p *Person) error {
+				walked = append(walked, *p)
+				return nil
+			})
+			if !reflect.DeepEqual(walked, want) {
+				t.Errorf("Walk() = %+v, want %+v", walked, want)
+			}
+			if results, err := s.Search("ann", 10); err != nil || len(results) != 1 || !reflect.DeepEqual(results[0].Person, want[0]) {
+				t.Errorf("Search() = %+v, %v, want %+v", results, err, want[0])
+			}
+			p.Email, p.Phone, p.Phones, p.Addresses = "", "", nil, nil
+			p.Emails = p.Emails[1:]
+			if err := s.Update(&p); err != nil {
+				t.Fatalf("Update() error = %v", err)
+			}
+			if got, _ := s.Get(p.ID); got.Email != "ann@example.com" || len(got.Emails) != 1 || got.Phones != nil || got.Addresses != nil {
+				t.Errorf("Update() did not replace details, got %+v", got)
+			}
+		})
+	}
+}
+
+func TestPersonStore_CustomFields(t *testing.T) {
+	stores, cleanup := testStores(t)
+	defer cleanup()
+	for name, s := range stores {
+		t.Run(name, func(t *testing.T) {
+			tier := CustomField{Name: "tier", Type: FieldEnum, Required: true, Options: []string{"gold", "silver"}}
+			badge := CustomField{Name: "badge", Type: FieldNumber, Min: "1"}
+			for _, f := range []*CustomField{&tier, &badge} {
+				if err := s.CreateField(f); err != nil {
+					t.Fatalf("CreateField() error = %v", err)
+				}
+			}
+			if err := s.CreateField(&badge); err != ErrExists {
+				t.Errorf("CreateField() of an existing field error = %v, want ErrExists", err)
+			}
+			if got, err := s.Fields(); err != nil || !reflect.DeepEqual(got, []CustomField{badge, tier}) {
+				t.Errorf("Fields() = %+v, %v, want %+v", got, err, []CustomField{badge, tier})
+			}
+			badge.Max = "99"
+			if err := s.UpdateField(&badge); err != nil {
+				t.Errorf("UpdateField() error = %v", err)
+			}
+			if err := s.UpdateField(&CustomField{Name: "shoe", Type: FieldNumber}); err != ErrNotFound {
+				t.Errorf("UpdateField() of a missing field error = %v, want ErrNotFound", err)
+			}
+
+			ann := Person{FirstName: "Ann", Custom: map[string]string{"tier": "gold", "badge": "42"}}
+			bob := Person{FirstName: "Bob", Custom: map[string]string{"tier": "silver"}}
+			s.Create(&ann)
+			s.Create(&bob)
+			ann.Custom["badge"] = "changed"
+			if got, _ := s.Get(ann.ID); got.Custom["badge"] != "42" {
+				t.Errorf("Get() shares the caller's custom values, got %+v", got.Custom)
+			}
+			ann.Custom["badge"] = "43"
+			if err := s.Update(&ann); err != nil {
+				t.Fatalf("Update() error = %v", err)
+			}
+			got, _, err := s.Query(PeopleQuery{Limit: -1, Custom: map[string]string{"tier": "gold"}})
+			if err != nil || len(got) != 1 || !reflect.DeepEqual(got[0], ann) {
+				t.Errorf("Query() by custom field = %+v, %v, want %+v", got, err, ann)
+			}
+			if err := s.DeleteField("badge"); err != nil {
+				t.Fatalf("DeleteField() error = %v", err)
+			}
+			if err := s.DeleteField("badge"); err != ErrNotFound {
+				t.Errorf("DeleteField() of a missing field error = %v, want ErrNotFound", err)
+			}
+			want := map[string]string{"tier": "gold"}
+			if got, _ := s.Get(ann.ID); !reflect.DeepEqual(got.Custom, want) {
+				t.Errorf("Get() after DeleteField() custom = %+v, want %+v", got.Custom, want)
+			}
+		})
+	}
+}
+
+func TestPersonStore_Groups(t *testing.T) {
+	stores, cleanup := testStores(t)
+	defer cleanup()
+	for name, s := range stores {
+		t.Run(name, func(t *testing.T) {
+			friends := Group{Name: "Friends", Description: "People I know"}
+			if err := s.CreateGroup(&friends); err != nil || friends.ID != 1 {
+				t.Fatalf("CreateGroup() = %v, ID %v, want ID 1", err, friends.ID)
+			}
+			if err := s.CreateGroup(&Group{Name: "FRIENDS"}); err != ErrExists {
+				t.Errorf("CreateGroup() of an existing name in another case error = %v, want ErrExists", err)
+			}
+
+			ann := Person{FirstName: "Ann", Groups: []string{" work", "friends", "Friends "}}
+			bob := Person{FirstName: "Bob", Groups: []string{"Work"}}
+			s.Create(&ann)
+			s.Create(&bob)
+			if want := []string{"Friends", "work"}; !reflect.DeepEqual(ann.Groups, want) {
+				t.Errorf("Create() groups = %q, want %q", ann.Groups, want)
+			}
+			if got, _ := s.Get(ann.ID); !reflect.DeepEqual(got, ann) {
+				t.Errorf("Get() = %+v, want %+v", got, ann)
+			}
+			want := []Group{{ID: 1, Name: "Friends", Description: "People I know", Members: 1}, {ID: 2, Name: "work", Members: 2}}
+			if got, err := s.Groups(); err != nil || !reflect.DeepEqual(got, want) {
+				t.Errorf("Groups() = %+v, %v, want %+v", got, err, want)
+			}
+
+			work := Group{ID: 2, Name: "Work", Description: "Colleagues"}
+			if err := s.UpdateGroup(&work); err != nil {
+				t.Fatalf("UpdateGroup() error = %v", err)
+			}
+			if err := s.UpdateGroup(&Group{ID: 2, Name: "friends"}); err != ErrExists {
+				t.Errorf("UpdateGroup() to an existing name error = %v, want ErrExists", err)
+			}
+			if err := s.UpdateGroup(&Group{ID: 9, Name: "Family"}); err != ErrNotFound {
+				t.Errorf("UpdateGroup() of a missing group error = %v, want ErrNotFound", err)
+			}
+			if got, _ := s.Get(bob.ID); !reflect.DeepEqual(got.Groups, []string{"Work"}) {
+				t.Errorf("Get() after UpdateGroup() groups = %q, want [Work]", got.Groups)
+			}
+			got, total, err := s.Query(PeopleQuery{Limit: -1, Group: "work"})
+			if err != nil || total != 2 || len(got) != 2 {
+				t.Errorf("Query() by group = %+v, %v, %v, want Ann and Bob", got, total, err)
+			}
+
+			if err := s.DeleteGroup(1); err != nil {
+				t.Fatalf("DeleteGroup() error = %v", err)
+			}
+			if err := s.DeleteGroup(1); err != ErrNotFound {
+				t.Errorf("DeleteGroup() of a missing group error = %v, want ErrNotFound", err)
+			}
+			if _, err := s.GetGroup(1); err != ErrNotFound {
+				t.Errorf("GetGroup() of a deleted group error = %v, want ErrNotFound", err)
+			}
+			if got, _ := s.Get(ann.ID); !reflect.DeepEqual(got.Groups, []string{"Work"}) {
+				t.Errorf("Get() after DeleteGroup() groups = %q, want [Work]", got.Groups)
+			}
+			if g, err := s.GetGroup(2); err != nil || g.Members != 2 {
+				t.Errorf("GetGroup() = %+v, %v, want 2 members", g, err)
+			}
+		})
+	}
+}
+
+func TestPersonStore_Relationships(t *testing.T) {
+	stores, cleanup := testStores(t)
+	defer cleanup()
+	for name, s := range stores {
+		t.Run(name, func(t *testing.T) {
+			ann, bob, cat := Person{FirstName: "Ann"}, Person{FirstName: "Bob"}, Person{FirstName: "Cat"}
+			for _, p := range []*Person{&ann, &bob, &cat} {
+				s.Create(p)
+			}
+			manager := Relationship{PersonID: ann.ID, RelatedID: bob.ID, Type: RelManager, Bidirectional: true}
+			if err := s.CreateRelationship(&manager); err != nil || manager.ID != 1 {
+				t.Fatalf("CreateRelationship() = %v, ID %v, want ID 1", err, manager.ID)
+			}
+			spouse := Relationship{PersonID: ann.ID, RelatedID: cat.ID, Type: RelSpouse}
+			if err := s.CreateRelationship(&spouse); err != nil || spouse.ID != 3 {
+				t.Fatalf("CreateRelationship() = %v, ID %v, want ID 3", err, spouse.ID)
+			}
+			if err := s.CreateRelationship(&Relationship{PersonID: bob.ID, RelatedID: ann.ID, Type: RelReport}); err != ErrExists {
+				t.Errorf("CreateRelationship() of an existing inverse error = %v, want ErrExists", err)
+			}
+			if err := s.CreateRelationship(&Relationship{PersonID: ann.ID, RelatedID: 99, Type: RelColleague}); err != ErrNotFound {
+				t.Errorf("CreateRelationship() with a missing person error = %v, want ErrNotFound", err)
+			}
+
+			if got, err := s.Relationships(ann.ID); err != nil || !reflect.DeepEqual(got, []Relationship{manager, spouse}) {
+				t.Errorf("Relationships() = %+v, %v, want %+v", got, err, []Relationship{manager, spouse})
+			}
+			want := []Relationship{{ID: 2, PersonID: bob.ID, RelatedID: ann.ID, Type: RelReport, Bidirectional: true}}
+			if got, err := s.Relationships(bob.ID); err != nil || !reflect.DeepEqual(got, want) {
+				t.Errorf("Relationships() of the inverse = %+v, %v, want %+v", got, err, want)
+			}
+
+			if err := s.DeleteRelationship(ann.ID, 2); err != ErrNotFound {
+				t.Errorf("DeleteRelationship() of another person's relationship error = %v, want ErrNotFound", err)
+			}
+			if err := s.DeleteRelationship(bob.ID, 2); err != nil {
+				t.Fatalf("DeleteRelationship() error = %v", err)
+			}
+			if got, _ := s.Relationships(ann.ID); !reflect.DeepEqual(got, []Relationship{spouse}) {
+				t.Errorf("Relationships() after deleting the inverse = %+v, want %+v", got, []Relationship{spouse})
+			}
+
+			if err := s.Delete(cat.ID); err != nil {
+				t.Fatalf("Delete() error = %v", err)
+			}
+			if got, _ := s.Relationships(ann.ID); len(got) != 0 {
+				t.Errorf("Relationships() after deleting the related person = %+v, want none", got)
+			}
+		})
+	}
+}
+
+func TestPhotoStores(t *testing.T) {
+	stores, cleanup := testStores(t)
+	defer cleanup()
+	dir, err := NewDirPhotoStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewDirPhotoStore() error = %v", err)
+	}
+	photoStores := map[string]PhotoStore{"dir": dir}
+	for name, s := range stores {
+		photoStores[name] = s.(PhotoStore)
+		ann := Person{ID: 1, FirstName: "Ann"}
+		s.Create(&ann)
+	}
+	for name, s := range photoStores {
+		t.Run(name, func(t *testing.T) {
+			if _, err := s.Photo(1); err != ErrNotFound {
+				t.Errorf("Photo() before PutPhoto() error = %v, want ErrNotFound", err)
+			}
+			ph := Photo{PersonID: 1, ContentType: PhotoPNG, Data: []byte("\x89PNG\r\n\x1a\nphoto"), Thumbnail: []byte("thumb")}
+			if err := s.PutPhoto(&ph); err != nil {
+				t.Fatalf("PutPhoto() error = %v", err)
+			}
+			ph.Data = []byte("\xff\xd8\xffjpeg")
+			ph.ContentType = PhotoJPEG
+			if err := s.PutPhoto(&ph); err != nil {
+				t.Fatalf("PutPhoto() replacing the photo error = %v", err)
+			}
+			if got, err := s.Photo(1); err != nil || !reflect.DeepEqual(got, ph) {
+				t.Errorf("Photo() = %+v, %v, want %+v", got, err, ph)
+			}
+			if err := s.DeletePhoto(1); err != nil {
+				t.Fatalf("DeletePhoto() error = %v", err)
+			}
+			if err := s.DeletePhoto(1); err != ErrNotFound {
+				t.Errorf("DeletePhoto() of a missing photo error = %v, want ErrNotFound", err)
+			}
+			if ps, ok := stores[name]; ok {
+				s.PutPhoto(&ph)
+				ps.Delete(1)
+				ps.Purge(1)
+				if _, err := s.Photo(1); err != ErrNotFound {
+					t.Errorf("Photo() after purging the person error = %v, want ErrNotFound", err)
+				}
+			}
+		})
+	}
+}
+
+func TestCardNameStores(t *testing.T) {
+	stores, cleanup := testStores(t)
+	defer cleanup()
+	for name, s := range stores {
+		t.Run(name, func(t *testing.T) {
+			cs, ok := s.(CardNameStore)
+			if !ok {
+				t.Fatalf("%v does not implement CardNameStore", name)
+			}
+			ann, bob := Person{FirstName: "Ann"}, Person{FirstName: "Bob"}
+			s.Create(&ann)
+			s.Create(&bob)
+			if _, err := cs.CardPerson("ABC-123"); err != ErrNotFound {
+				t.Errorf("CardPerson() of an unknown name error = %v, want ErrNotFound", err)
+			}
+			if err := cs.NameCard(ann.ID, "ABC-123"); err != nil {
+				t.Fatalf("NameCard() error = %v", err)
+			}
+			if id, err := cs.CardPerson("ABC-123"); err != nil || id != ann.ID {
+				t.Errorf("CardPerson() = %v, %v, want %v", id, err, ann.ID)
+			}
+			if err := cs.NameCard(bob.ID, "ABC-123"); err != nil {
+				t.Fatalf("NameCard() of a name in use error = %v", err)
+			}
+			if names, err := cs.CardNames(); err != nil || !reflect.DeepEqual(names, map[int]string{bob.ID: "ABC-123"}) {
+				t.Errorf("CardNames() = %v, %v, want the name moved to Bob", names, err)
+			}
+			if uid, err := cs.CardUID(ann.ID); err != nil || uid != "" {
+				t.Errorf("CardUID() of a card without a UID = %q, %v, want none", uid, err)
+			}
+			if _, err := cs.UIDPerson("urn:uuid:1"); err != ErrNotFound {
+				t.Errorf("UIDPerson() of an unknown UID error = %v, want ErrNotFound", err)
+			}
+			cs.SetCardUID(ann.ID, "urn:uuid:1")
+			if err := cs.SetCardUID(ann.ID, "urn:uuid:2"); err != nil {
+				t.Fatalf("SetCardUID() error = %v", err)
+			}
+			if err := cs.SetCardUID(bob.ID, "urn:uuid:2"); err != nil {
+				t.Fatalf("SetCardUID() of a UID in use error = %v", err)
+			}
+			if uid, _ := cs.CardUID(ann.ID); uid != "" {
+				t.Errorf("CardUID() = %q, want the UID moved to Bob", uid)
+			}
+			if id, err := cs.UIDPerson("urn:uuid:2"); err != nil || id != bob.ID {
+				t.Errorf("UIDPerson() = %v, %v, want %v", id, err, bob.ID)
+			}
+			s.Delete(bob.ID)
+			s.Purge(bob.ID)
+			if _, err := cs.CardPerson("ABC-123"); err != ErrNotFound {
+				t.Errorf("CardPerson() of a purged person's card error = %v, want ErrNotFound", err)
+			}
+			if _, err := cs.UIDPerson("urn:uuid:2"); err != ErrNotFound {
+				t.Errorf("UIDPerson() of a purged person's card error = %v, want ErrNotFound", err)
+			}
+		})
+	}
+}
+
+func TestPersonStore_Trash(t *testing.T) {
+	stores, cleanup := testStores(t)
+	defer cleanup()
+	for name, s := range stores {
+		t.Run(name, func(t *testing.T) {
+			ann := Person{FirstName: "Ann", Email: "ann@example.com", Groups: []string{"Friends"}}
+			bob := Person{FirstName: "Bob"}
+			s.Create(&ann)
+			s.Create(&bob)
+			s.CreateRelationship(&Relationship{PersonID: ann.ID, RelatedID: bob.ID, Type: RelManager, Bidirectional: true})
+
+			if err := s.Delete(ann.ID); err != nil {
+				t.Fatalf("Delete() error = %v", err)
+			}
+			if err := s.Delete(ann.ID); err != ErrNotFound {
+				t.Errorf("Delete() of a person in the trash error = %v, want ErrNotFound", err)
+			}
+			if err := s.Delete(99); err != ErrNotFound {
+				t.Errorf("Delete() of a missing person error = %v, want ErrNotFound", err)
+			}
+			if _, err := s.Get(ann.ID); err != ErrNotFound {
+				t.Errorf("Get() of a person in the trash error = %v, want ErrNotFound", err)
+			}
+			if err := s.Update(&ann); err != ErrNotFound {
+				t.Errorf("Update() of a person in the trash error = %v, want ErrNotFound", err)
+			}
+			if err := s.Create(&Person{ID: ann.ID, FirstName: "Other"}); err != ErrExists {
+				t.Errorf("Create() with the ID of a person in the trash error = %v, want ErrExists", err)
+			}
+			if people, total, err := s.Query(PeopleQuery{Limit: -1}); err != nil || total != 1 || people[0].ID != bob.ID {
+				t.Errorf("Query() = %+v, %v, %v, want only Bob", people, total, err)
+			}
+			if _, total, _ := s.Query(PeopleQuery{Limit: -1, Deleted: DeletedInclude}); total != 2 {
+				t.Errorf("Query() including the trash total = %v, want 2", total)
+			}
+			people, total, err := s.Query(PeopleQuery{Limit: -1, Deleted: DeletedOnly})
+			if err != nil || total != 1 {
+				t.Fatalf("Query() of the trash = %+v, %v, %v, want Ann", people, total, err)
+			}
+			if got := people[0]; got.ID != ann.ID || got.DeletedAt == nil || time.Since(*got.DeletedAt) > time.Minute ||
+				got.Email != "ann@example.com" || !reflect.DeepEqual(got.Groups, []string{"Friends"}) {
+				t.Errorf("Query() of the trash = %+v, want Ann with her details and a DeletedAt", got)
+			}
+			if results, _ := s.Search("ann", 10); len(results) != 0 {
+				t.Errorf("Search() = %+v, want no one in the trash", results)
+			}
+			if rels, _ := s.Relationships(bob.ID); len(rels) != 0 {
+				t.Errorf("Relationships() = %+v, want relationships to the trash hidden", rels)
+			}
+			if g, _ := s.GetGroup(1); g.Members != 0 {
+				t.Errorf("GetGroup() = %+v, want people in the trash left out", g)
+			}
+
+			if err := s.Restore(ann.ID); err != nil {
+				t.Fatalf("Restore() error = %v", err)
+			}
+			if err := s.Restore(ann.ID); err != ErrNotFound {
+				t.Errorf("Restore() of a person not in the trash error = %v, want ErrNotFound", err)
+			}
+			if got, err := s.Get(ann.ID); err != nil || got.DeletedAt != nil || !reflect.DeepEqual(got.Groups, []string{"Friends"}) {
+				t.Errorf("Get() after Restore() = %+v, %v", got, err)
+			}
+			if rels, _ := s.Relationships(bob.ID); len(rels) != 1 {
+				t.Errorf("Relationships() after Restore() = %+v, want the relationship back", rels)
+			}
+
+			if err := s.Purge(bob.ID); err != ErrNotFound {
+				t.Errorf("Purge() of a person not in the trash error = %v, want ErrNotFound", err)
+			}
+			s.Delete(ann.ID)
+			if ids, err := s.PurgeDeleted(time.Now().Add(-time.Hour)); err != nil || len(ids) != 0 {
+				t.Errorf("PurgeDeleted() an hour ago = %v, %v, want none", ids, err)
+			}
+			if ids, err := s.PurgeDeleted(time.Now().Add(time.Minute)); err != nil || !reflect.DeepEqual(ids, []int{ann.ID}) {
+				t.Errorf("PurgeDeleted() = %v, %v, want [%v]", ids, err, ann.ID)
+			}
+			if err := s.Restore(ann.ID); err != ErrNotFound {
+				t.Errorf("Restore() of a purged person error = %v, want ErrNotFound", err)
+			}
+			if _, total, _ := s.Query(PeopleQuery{Limit: -1, Deleted: DeletedInclude}); total != 1 {
+				t.Errorf("Query() including the trash after PurgeDeleted() total = %v, want 1", total)
+			}
+			s.Delete(bob.ID)
+			if err := s.Purge(bob.ID); err != nil {
+				t.Errorf("Purge() error = %v", err)
+			}
+			if _, total, _ := s.Query(PeopleQuery{Limit: -1, Deleted: DeletedOnly}); total != 0 {
+				t.Errorf("Query() of the trash after Purge() total = %v, want 0", total)
+			}
+			cat := Person{FirstName: "Cat"}
+			if err := s.Create(&cat); err != nil || cat.ID <= bob.ID {
+				t.Errorf("Create() after Purge() allocated ID %v, %v, want above %v", cat.ID, err, bob.ID)
+			}
+			if err := s.Create(&Person{ID: bob.ID, FirstName: "Bob"}); err != ErrExists {
+				t.Errorf("Create() with a purged person's ID error = %v, want %v", err, ErrExists)
+			}
+		})
+	}
+}
+
+func TestAuditLogs(t *testing.T) {
+	stores, cleanup := testStores(t)
+	defer cleanup()
+	for name, s := range stores {
+		t.Run(name, func(t *testing.T) {
+			al, ok := s.(AuditLog)
+			if !ok {
+				t.Fatalf("%v does not implement AuditLog", name)
+			}
+			ann := Person{ID: 1, FirstName: "Ann", Email: "ann@example.com"}
+			ann2 := ann
+			ann2.Email = "ann@example.org"
+			now := time.Now().UTC().Truncate(time.Second)
+			entries := []AuditEntry{
+				{PersonID: 1, Action: AuditCreate, Actor: "alice", Time: now.Add(-time.Hour), After: &ann},
+				{PersonID: 1, Action: AuditUpdate, Actor: "bob", Time: now, RequestID: "req-1",
+					Changes: diffPeople(&ann, &ann2), Before: &ann, After: &ann2},
+				{PersonID: 2, Action: AuditDelete, Actor: "alice", Time: now},
+			}
+			if err := al.Record(entries); err != nil {
+				t.Fatalf("Record() error = %v", err)
+			}
+			if entries[0].ID != 1 || entries[2].ID != 3 {
+				t.Errorf("Record() IDs = %v, %v, want 1, 3", entries[0].ID, entries[2].ID)
+			}
+
+			got, total, err := al.Audit(AuditQuery{Limit: -1})
+			if err != nil || total != 3 || len(got) != 3 || got[0].ID != 3 {
+				t.Fatalf("Audit() = %+v, %v, %v, want all three newest first", got, total, err)
+			}
+			for _, tt := range []struct {
+				q    AuditQuery
+				want []int
+			}{
+				{AuditQuery{PersonID: 1, Limit: -1}, []int{2, 1}},
+				{AuditQuery{Actor: "alice", Limit: -1}, []int{3, 1}},
+				{AuditQuery{Action: AuditUpdate, Limit: -1}, []int{2}},
+				{AuditQuery{RequestID: "req-1", Limit: -1}, []int{2}},
+				{AuditQuery{Since: now, Limit: -1}, []int{3, 2}},
+				{AuditQuery{Until: now, Limit: -1}, []int{1}},
+				{AuditQuery{Limit: 1, Offset: 1}, []int{2}},
+				{AuditQuery{AfterID: 1, Limit: -1}, []int{3, 2}},
+				{AuditQuery{PersonID: 1, Offset: 5, Limit: -1}, []int{}},
+			} {
+				got, _, err := al.Audit(tt.q)
+				ids := []int{}
+				for _, e := range got {
+					ids = append(ids, e.ID)
+				}
+				if err != nil || !reflect.DeepEqual(ids, tt.want) {
+					t.Errorf("Audit(%+v) = %v, %v, want %v", tt.q, ids, err, tt.want)
+				}
+			}
+
+			e, err := al.GetAuditEntry(2)
+			if err != nil {
+				t.Fatalf("GetAuditEntry() error = %v", err)
+			}
+			if !e.Time.Equal(now) || e.Actor != "bob" || e.Before == nil || e.After == nil || e.After.Email != "ann@example.org" ||
+				!reflect.DeepEqual(e.Changes, entries[1].Changes) {
+				t.Errorf("GetAuditEntry() = %+v, want %+v", e, entries[1])
+			}
+			if e, _ := al.GetAuditEntry(3); e.Before != nil || e.After != nil {
+				t.Errorf("GetAuditEntry() of a deletion without snapshots = %+v", e)
+			}
+			if _, err := al.GetAuditEntry(99); err != ErrNotFound {
+				t.Errorf("GetAuditEntry() of a missing entry error = %v, want ErrNotFound", err)
+			}
+		})
+	}
+}
+
+func TestDetailsMigration(t *testing.T) {
+	defer os.Remove(TestStoreDBName)
+	db, err := connectDatabase(sqliteDialect, TestStoreDBName, false)
+	if err != nil {
+		t.Fatalf("Error opening database: %v", err)
+	}
+	m, err := migrations.New(db.DB, db.migrations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.To(1); err != nil {
+		t.Fatalf("To(1) error = %v", err)
+	}
+	insert := "INSERT INTO people(id, fname, lname, email, phone) VALUES(?, ?, ?, ?, ?)"
+	db.Exec(insert, 1, "Ann", "Smith", "ann@example.com", "555-0100")
+	db.Exec(insert, 2, "Bob", "Jones", "", "")
+	if err := m.Up(); err != nil {
+		t.Fatalf("Up() error = %v", err)
+	}
+	s := &SQLStore{db: db}
+	defer s.Close()
+	want := []Person{
+		{ID: 1, FirstName: "Ann", LastName: "Smith", Email: "ann@example.com", Phone: "555-0100",
+			Emails: []Email{{Value: "ann@example.com"}}, Phones: []Phone{{Value: "555-0100"}}},
+		{ID: 2, FirstName: "Bob", LastName: "Jones"},
+	}
+	if got, err := s.List(0, -1); err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("List() after migrating = %+v, %v, want %+v", got, err, want)
+	}
+	if err := s.Delete(1); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if err := s.Purge(1); err != nil {
+		t.Fatalf("Purge() error = %v", err)
+	}
+	count := 0
+	db.QueryRow("SELECT COUNT(*) FROM person_emails").Scan(&count)
+	if count != 0 {
+		t.Errorf("Purge() left %v emails behind", count)
+	}
+}
+
+func TestFullTextCheck(t *testing.T) {
+	if sqliteFullText {
+		t.Skip("built with FTS5, which can open any database")
+	}
+	defer os.Remove(TestStoreDBName)
+	s, err := NewSQLiteStore(TestStoreDBName)
+	if err != nil {
+		t.Fatalf("Error creating SQLite store: %v", err)
+	}
+	// A stand in for the FTS5 table, which this build cannot create.
+	s.db.Exec("CREATE TABLE people_fts (rowid INTEGER)")
+	s.Close()
+	if _, err := NewSQLiteStore(TestStoreDBName); err == nil || !strings.Contains(err.Error(), "sqlite_fts5") {
+		t.Errorf("NewSQLiteStore() of a database with a full-text index error = %v, want one naming sqlite_fts5", err)
+	}
+	if _, err := OpenStore(TestStoreDBName, false); err == nil {
+		t.Errorf("OpenStore() of a database with a full-text index succeeded, want an error")
+	}
+}
+
+func TestLDAPDirectory(t *testing.T) {
+	stores, cleanup := testStores(t)
+	defer cleanup()
+	for name, s := range stores {
+		t.Run(name, func(t *testing.T) {
+			for _, p := range []Person{
+				{FirstName: "Jane", LastName: "Smith", Email: "jane@example.com", Phone: "555-0100"},
+				{FirstName: "John", LastName: "Smithers", Email: "john@example.org"},
+				{FirstName: "Ann", LastName: "Jones", Email: "ann@EXAMPLE.com"},
+				{FirstName: "Bob", LastName: "Brown_",
+					Emails: []Email{{Value: "bob@example.net"}, {Type: TypeWork, Value: "robert@work.example.net"}},
+					Phones: []Phone{{Type: TypeWork, Value: "555-0200"}, {Type: TypeMobile, Value: "555-0300"}, {Type: TypeHome, Value: "555-0400"}}},
+			} {
+				if err := s.Create(&p); err != nil {
+					t.Fatal(err)
+				}
+			}
+			d := &ldapDirectory{store: s, baseDN: "ou=people,dc=example,dc=com"}
+			search := func(base string, scope int, filter string, sizeLimit int) ([]string, int) {
+				f, err := ldap.ParseFilter(filter)
+				if err != nil {
+					t.Fatal(err)
+				}
+				dns := []string{}
+				res := d.Search("", &ldap.SearchRequest{BaseDN: base, Scope: scope, Filter: f, SizeLimit: sizeLimit}, func(e *ldap.Entry) error {
+					dns = append(dns, e.DN)
+					return nil
+				})
+				return dns, res.Code
+			}
+			base := "OU=People, dc=example,dc=com"
+			tests := []struct {
+				name      string
+				base      string
+				scope     int
+				filter    string
+				sizeLimit int
+				want      []string
+				code      int
+			}{
+				{"or", base, ldap.ScopeWholeSubtree, "(|(sn=smi*)(mail=*@example.com))", 0, []string{"uid=1", "uid=2", "uid=3"}, ldap.Success},
+				{"and", base, ldap.ScopeSingleLevel, "(&(objectClass=inetOrgPerson)(sn=smith))", 0, []string{"uid=1"}, ldap.Success},
+				{"not", base, ldap.ScopeSingleLevel, "(!(mail=*example.com))", 0, []string{"uid=2", "uid=4"}, ldap.Success},
+				{"any", base, ldap.ScopeSingleLevel, "(cn=j*n*smith*)", 0, []string{"uid=1", "uid=2"}, ldap.Success},
+				{"like metacharacter", base, ldap.ScopeSingleLevel, "(sn=*_)", 0, []string{"uid=4"}, ldap.Success},
+				{"present", base, ldap.ScopeSingleLevel, "(telephoneNumber=*)", 0, []string{"uid=1", "uid=4"}, ldap.Success},
+				{"secondary mail", base, ldap.ScopeSingleLevel, "(mail=Robert@work.example.net)", 0, []string{"uid=4"}, ldap.Success},
+				{"mobile", base, ldap.ScopeSingleLevel, "(mobile=555-0300)", 0, []string{"uid=4"}, ldap.Success},
+				{"homePhone", base, ldap.ScopeSingleLevel, "(homePhone=555-04*)", 0, []string{"uid=4"}, ldap.Success},
+				{"mobile is not telephoneNumber", base, ldap.ScopeSingleLevel, "(telephoneNumber=555-0300)", 0, []string{}, ldap.Success},
+				{"primary is telephoneNumber", base, ldap.ScopeSingleLevel, "(|(mobile=555-0200)(facsimileTelephoneNumber=*))", 0, []string{}, ldap.Success},
+				{"uid range", base, ldap.ScopeSingleLevel, "(&(uid>=2)(uid<=3))", 0, []string{"uid=2", "uid=3"}, ldap.Success},
+				{"unknown attribute", base, ldap.ScopeSingleLevel, "(title=*)", 0, []string{}, ldap.Success},
+				{"subtree includes base", base, ldap.ScopeWholeSubtree, "(objectClass=*)", 2, []string{"ou=people,dc=example,dc=com", "uid=1"}, ldap.SizeLimitExceeded},
+				{"base entry", base, ldap.ScopeBaseObject, "(objectClass=organizationalUnit)", 0, []string{"ou=people,dc=example,dc=com"}, ldap.Success},
+				{"person", "uid=3," + base, ldap.ScopeBaseObject, "(objectClass=*)", 0, []string{"uid=3"}, ldap.Success},
+				{"person filtered out", "uid=3," + base, ldap.ScopeBaseObject, "(sn=smith)", 0, []string{}, ldap.Success},
+				{"missing person", "uid=9," + base, ldap.ScopeBaseObject, "(objectClass=*)", 0, []string{}, ldap.NoSuchObject},
+				{"outside base", "dc=example,dc=org", ldap.ScopeWholeSubtree, "(objectClass=*)", 0, []string{}, ldap.NoSuchObject},
+				{"root DSE", "", ldap.ScopeBaseObject, "(objectClass=*)", 0, []string{""}, ldap.Success},
+			}
+			for _, tt := range tests {
+				dns, code := search(tt.base, tt.scope, tt.filter, tt.sizeLimit)
+				for i := range tt.want {
+					if strings.HasPrefix(tt.want[i], "uid=") {
+						tt.want[i] += ",ou=people,dc=example,dc=com"
+					}
+				}
+				if code != tt.code || !reflect.DeepEqual(dns, tt.want) {
+					t.Errorf("%v: Search() = %v, %v, want %v, %v", tt.name, dns, code, tt.want, tt.code)
+				}
+			}
+			for _, q := range []PeopleQuery{{Email: "robert@work.example.net"}, {Phone: "555-0400"}, {EmailDomain: "WORK.example.net"}} {
+				q.Limit = -1
+				if people, _, err := s.Query(q); err != nil || len(people) != 1 || people[0].FirstName != "Bob" {
+					t.Errorf("Query(%+v) = %+v, %v, want Bob by a secondary email or phone", q, people, err)
+				}
+			}
+		})
+	}
+}
+
+func TestLDAPDirectory_Bind(t *testing.T) {
+	d := &ldapDirectory{store: NewMemoryStore(), baseDN: defaultBaseDN, bindDN: "cn=reader,dc=example,dc=com", password: "secret"}
+	tests := []struct {
+		name, dn, password string
+		code               int
+	}{
+		{"anonymous", "", "", ldap.Success},
+		{"bind DN", "CN=reader, dc=example,dc=com", "secret", ldap.Success},
+		{"wrong password", "cn=reader,dc=example,dc=com", "guess", ldap.InvalidCredentials},
+		{"unauthenticated", "cn=reader,dc=example,dc=com", "", ldap.UnwillingToPerform},
+		{"other DN", "cn=admin,dc=example,dc=com", "secret", ldap.InvalidCredentials},
+	}
+	for _, tt := range tests {
+		if res := d.Bind(tt.dn, tt.password); res.Code != tt.code {
+			t.Errorf("%v: Bind() = %v, want %v", tt.name, res.Code, tt.code)
+		}
+	}
+	f, _ := ldap.ParseFilter("(objectClass=*)")
+	res := d.Search("", &ldap.SearchRequest{BaseDN: defaultBaseDN, Scope: ldap.ScopeWholeSubtree, Filter: f}, func(*ldap.Entry) error { return nil })
+	if res.Code != ldap.InsufficientAccessRights {
+		t.Errorf("anonymous Search() = %v, want %v", res.Code, ldap.InsufficientAccessRights)
+	}
+}
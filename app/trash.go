@@ -0,0 +1,113 @@
+package app
+
+// Trash.go contains the trash deleted people are kept in until they are restored or purged,
+// its endpoints, and the job that purges people who have been in it too long.
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// trashPurgeInterval is how often Run purges people who have been in the trash for longer than TrashRetention.
+const trashPurgeInterval = time.Hour
+
+// writeTrashStoreError writes the problem matching an error returned by Restore or Purge.
+func writeTrashStoreError(w http.ResponseWriter, req *http.Request, err error) {
+	if err == ErrNotFound {
+		writeProblem(w, req, http.StatusNotFound, CodePersonNotFound, "Person not found in the trash.")
+		return
+	}
+	writeStoreError(w, req, err)
+}
+
+// ReadTrash lists the people in the trash. It accepts the same query parameters as /people.
+func (a *App) ReadTrash(w http.ResponseWriter, req *http.Request) {
+	q, ok := a.peopleQuery(w, req)
+	if !ok {
+		return
+	}
+	q.Deleted = DeletedOnly
+	a.writePeople(w, req, q)
+}
+
+// RestorePerson takes the person with the ID in the URL out of the trash, and returns them.
+func (a *App) RestorePerson(w http.ResponseWriter, req *http.Request) {
+	log.Printf("Got POST restore %v", mux.Vars(req)["id"])
+	id, ok := personID(w, req)
+	if !ok {
+		return
+	}
+	if err := a.Store.Restore(id); err != nil {
+		writeTrashStoreError(w, req, err)
+		return
+	}
+	p, err := a.Store.Get(id)
+	if err != nil {
+		writeStoreError(w, req, err)
+		return
+	}
+	a.audit(req, AuditRestore, id, nil, &p)
+	writePerson(w, req, http.StatusOK, &p)
+}
+
+// PurgePerson permanently deletes the person in the trash with the ID in the URL,
+// along with their photo and every relationship to or from them.
+func (a *App) PurgePerson(w http.ResponseWriter, req *http.Request) {
+	log.Printf("Got DELETE trash %v", mux.Vars(req)["id"])
+	id, ok := personID(w, req)
+	if !ok {
+		return
+	}
+	if err := a.Store.Purge(id); err != nil {
+		writeTrashStoreError(w, req, err)
+		return
+	}
+	a.purgedPhoto(id)
+	a.audit(req, AuditPurge, id, nil, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// EmptyTrash permanently deletes everyone in the trash.
+func (a *App) EmptyTrash(w http.ResponseWriter, req *http.Request) {
+	log.Printf("Got DELETE trash")
+	if err := a.purgeDeleted(req, time.Now()); err != nil {
+		writeInternalError(w, req, "Could not empty the trash.", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// purgeDeleted permanently deletes everyone moved to the trash before the given time, and their photos,
+// recording it as done by req, or by the service itself if req is nil.
+func (a *App) purgeDeleted(req *http.Request, before time.Time) error {
+	ids, err := a.Store.PurgeDeleted(before)
+	if err != nil {
+		return err
+	}
+	entries := make([]AuditEntry, len(ids))
+	for i, id := range ids {
+		a.purgedPhoto(id)
+		entries[i] = a.newAuditEntry(req, AuditPurge, id, nil, nil)
+	}
+	a.record(entries...)
+	if len(ids) > 0 {
+		log.Printf("Purged %v people from the trash", len(ids))
+	}
+	return nil
+}
+
+// purgeTrash purges people who have been in the trash for longer than TrashRetention
+// every trashPurgeInterval, starting straight away. It never returns.
+func (a *App) purgeTrash() {
+	ticker := time.NewTicker(trashPurgeInterval)
+	defer ticker.Stop()
+	for {
+		if err := a.purgeDeleted(nil, time.Now().Add(-a.TrashRetention)); err != nil {
+			log.Printf("error purging the trash: %v", err.Error())
+		}
+		<-ticker.C
+	}
+}
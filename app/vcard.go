@@ -0,0 +1,627 @@
+package app
+
+// Vcard.go contains the reading and writing of people as vCards (RFC 6350 and RFC 2426).
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime/quotedprintable"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// vCard versions that can be written. Version 2.1 files can also be read.
+const (
+	VCardVersion3 = "3.0"
+	VCardVersion4 = "4.0"
+)
+
+// vcardMaxLine is the length in octets at which vCard lines are folded.
+const vcardMaxLine = 75
+
+// vcardNoPref is the preference of a property without a PREF parameter, lower than any PREF value.
+const vcardNoPref = 101
+
+// vcardProperty is a single unfolded content line of a vCard.
+type vcardProperty struct {
+	// Line is the line number the property starts on.
+	Line int
+	// Name is the upper-cased property name, without any group.
+	Name string
+	// Params maps upper-cased parameter names to their values.
+	// Version 2.1 parameters without a name, such as HOME, are stored as TYPE values.
+	Params map[string][]string
+	// Value is the value with any quoted-printable encoding removed, but still escaped.
+	Value string
+}
+
+// hasType reports whether the property has the given TYPE parameter value.
+func (p vcardProperty) hasType(t string) bool {
+	for _, v := range p.Params["TYPE"] {
+		if strings.EqualFold(v, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// pref returns the property's preference, 1 being the most preferred.
+// Version 3.0 marks preferred properties with TYPE=pref.
+func (p vcardProperty) pref() int {
+	if v := p.Params["PREF"]; len(v) > 0 {
+		if n, err := strconv.Atoi(v[0]); err == nil && n >= 1 && n <= 100 {
+			return n
+		}
+	}
+	if p.hasType("pref") {
+		return 1
+	}
+	return vcardNoPref
+}
+
+// parseVCardVersion reads the version query parameter, defaulting to 4.0.
+func parseVCardVersion(v url.Values) (string, error) {
+	switch version := v.Get("version"); version {
+	case "", VCardVersion4:
+		return VCardVersion4, nil
+	case VCardVersion3:
+		return VCardVersion3, nil
+	}
+	return "", fmt.Errorf("version must be %v or %v", VCardVersion3, VCardVersion4)
+}
+
+// vcardLines splits text into unfolded content lines, keeping the line number each starts on.
+// Continuation lines start with a space or tab. Version 2.1 quoted-printable values
+// are also continued by a soft line break, a line ending in "=".
+func vcardLines(text string) (lines []string, numbers []int) {
+	quoted := false
+	for i, l := range strings.Split(text, "\n") {
+		l = strings.TrimSuffix(l, "\r")
+		n := len(lines) - 1
+		switch {
+		case n >= 0 && l != "" && (l[0] == ' ' || l[0] == '\t'):
+			lines[n] += l[1:]
+		case n >= 0 && quoted && strings.HasSuffix(lines[n], "="):
+			lines[n] = strings.TrimSuffix(lines[n], "=") + l
+		default:
+			if strings.TrimSpace(l) == "" {
+				quoted = false
+				continue
+			}
+			lines = append(lines, l)
+			numbers = append(numbers, i+1)
+			colon := strings.IndexByte(l, ':')
+			quoted = colon >= 0 && strings.Contains(strings.ToUpper(l[:colon]), "QUOTED-PRINTABLE")
+		}
+	}
+	return lines, numbers
+}
+
+// parseVCardProperty parses an unfolded content line: [group.]name *(;param):value.
+func parseVCardProperty(line string, number int) (vcardProperty, error) {
+	p := vcardProperty{Line: number, Params: map[string][]string{}}
+	colon, quoted := -1, false
+	for i := 0; i < len(line) && colon < 0; i++ {
+		switch line[i] {
+		case '"':
+			quoted = !quoted
+		case ':':
+			if !quoted {
+				colon = i
+			}
+		}
+	}
+	if colon < 0 {
+		return p, fmt.Errorf("line %v: expected a property, got %q", number, line)
+	}
+	params := splitQuoted(line[:colon], ';')
+	p.Name = strings.ToUpper(params[0])
+	if dot := strings.LastIndexByte(p.Name, '.'); dot >= 0 {
+		p.Name = p.Name[dot+1:]
+	}
+	if p.Name == "" {
+		return p, fmt.Errorf("line %v: missing property name", number)
+	}
+	for _, param := range params[1:] {
+		name, value := "TYPE", param
+		if eq := strings.IndexByte(param, '='); eq >= 0 {
+			name, value = strings.ToUpper(param[:eq]), param[eq+1:]
+		}
+		for _, v := range splitQuoted(value, ',') {
+			p.Params[name] = append(p.Params[name], strings.Trim(v, `"`))
+		}
+	}
+	p.Value = line[colon+1:]
+	for _, enc := range p.Params["ENCODING"] {
+		if strings.EqualFold(enc, "QUOTED-PRINTABLE") {
+			if b, err := io.ReadAll(quotedprintable.NewReader(strings.NewReader(p.Value))); err == nil {
+				p.Value = string(b)
+			}
+		}
+	}
+	if cs := p.Params["CHARSET"]; len(cs) > 0 {
+		if enc, ok := encodingNames[strings.ToLower(cs[0])]; ok && enc != EncodingUTF8 {
+			if s, err := decodeText([]byte(p.Value), enc); err == nil {
+				p.Value = s
+			}
+		}
+	}
+	return p, nil
+}
+
+// splitQuoted splits s on sep, except where sep is inside double quotes.
+func splitQuoted(s string, sep byte) []string {
+	parts := []string{}
+	quoted, start := false, 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			quoted = !quoted
+		case sep:
+			if !quoted {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// splitValue splits an escaped vCard value on sep, except where sep is escaped with a backslash.
+// The parts are still escaped.
+func splitValue(v string, sep byte) []string {
+	parts := []string{}
+	start := 0
+	for i := 0; i < len(v); i++ {
+		switch v[i] {
+		case '\\':
+			i++
+		case sep:
+			parts = append(parts, v[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, v[start:])
+}
+
+// unescapeVCard removes the backslash escaping from a vCard text value.
+func unescapeVCard(v string) string {
+	var b strings.Builder
+	for i := 0; i < len(v); i++ {
+		if v[i] != '\\' || i == len(v)-1 {
+			b.WriteByte(v[i])
+			continue
+		}
+		i++
+		switch v[i] {
+		case 'n', 'N':
+			b.WriteByte('\n')
+		default:
+			b.WriteByte(v[i])
+		}
+	}
+	return b.String()
+}
+
+// escapeVCard escapes a vCard text value.
+func escapeVCard(v string) string {
+	return strings.NewReplacer(`\`, `\\`, "\r\n", `\n`, "\n", `\n`, ",", `\,`, ";", `\;`).Replace(v)
+}
+
+// vcardPhoneTypes are the phone types read from TEL properties, in order of precedence.
+var vcardPhoneTypes = []string{TypeMobile, TypeFax, TypeHome, TypeWork}
+
+// vcardPerson maps the properties of a vCard to a person.
+// The name is taken from N, or from FN if N is missing or empty.
+// EMAIL, TEL and ADR properties are ordered by preference, so the most preferred are the primary ones.
+// Only the first NICKNAME is kept, and ORG gives the organization and department.
+// A BDAY that is not a date, with or without the year, is dropped.
+// CATEGORIES are the names of the person's groups.
+func vcardPerson(props []vcardProperty) (Person, error) {
+	p := Person{}
+	fn := ""
+	emailPrefs, telPrefs, adrPrefs := []int{}, []int{}, []int{}
+	for _, prop := range props {
+		switch prop.Name {
+		case "VERSION":
+			if v := prop.Value; v != "2.1" && v != VCardVersion3 && v != VCardVersion4 {
+				return p, fmt.Errorf("unsupported vCard version %q", v)
+			}
+		case "FN":
+			fn = strings.TrimSpace(unescapeVCard(prop.Value))
+		case "N":
+			n := splitValue(prop.Value, ';')
+			p.LastName = vcardComponent(n[0])
+			if len(n) > 1 {
+				p.FirstName = vcardComponent(n[1])
+			}
+		case "EMAIL":
+			if v := strings.TrimSpace(unescapeVCard(prop.Value)); v != "" {
+				p.Emails = append(p.Emails, Email{Type: vcardType(prop, emailTypes), Value: v})
+				emailPrefs = append(emailPrefs, prop.pref())
+			}
+		case "TEL":
+			if v := vcardTel(prop.Value); v != "" {
+				p.Phones = append(p.Phones, Phone{Type: vcardType(prop, vcardPhoneTypes), Value: v})
+				telPrefs = append(telPrefs, prop.pref())
+			}
+		case "ADR":
+			if a := vcardAddress(prop); !a.empty() {
+				p.Addresses = append(p.Addresses, a)
+				adrPrefs = append(adrPrefs, prop.pref())
+			}
+		case "NICKNAME":
+			p.Nickname = strings.TrimSpace(unescapeVCard(splitValue(prop.Value, ',')[0]))
+		case "ORG":
+			n := splitValue(prop.Value, ';')
+			p.Organization = vcardComponent(n[0])
+			if len(n) > 1 {
+				p.Department = vcardComponent(n[1])
+			}
+		case "TITLE":
+			p.Title = strings.TrimSpace(unescapeVCard(prop.Value))
+		case "BDAY":
+			p.Birthday = vcardBirthday(prop.Value)
+		case "URL":
+			p.Website = strings.TrimSpace(unescapeVCard(prop.Value))
+		case "NOTE":
+			p.Notes = unescapeVCard(prop.Value)
+		case "CATEGORIES":
+			for _, c := range splitValue(prop.Value, ',') {
+				p.Groups = append(p.Groups, unescapeVCard(c))
+			}
+			p.Groups = uniqueGroups(p.Groups)
+		}
+	}
+	sort.Stable(byPref{emailPrefs, func(i, j int) { p.Emails[i], p.Emails[j] = p.Emails[j], p.Emails[i] }})
+	sort.Stable(byPref{telPrefs, func(i, j int) { p.Phones[i], p.Phones[j] = p.Phones[j], p.Phones[i] }})
+	sort.Stable(byPref{adrPrefs, func(i, j int) { p.Addresses[i], p.Addresses[j] = p.Addresses[j], p.Addresses[i] }})
+	if len(p.Emails) > 0 {
+		p.Email = p.Emails[0].Value
+	}
+	if len(p.Phones) > 0 {
+		p.Phone = p.Phones[0].Value
+	}
+	if p.FirstName == "" && p.LastName == "" && fn != "" {
+		if i := strings.LastIndexByte(fn, ' '); i >= 0 {
+			p.FirstName, p.LastName = strings.TrimSpace(fn[:i]), fn[i+1:]
+		} else {
+			p.FirstName = fn
+		}
+	}
+	return p, nil
+}
+
+// byPref sorts properties by their preferences, swapping them with swap.
+type byPref struct {
+	prefs []int
+	swap  func(i, j int)
+}
+
+func (b byPref) Len() int           { return len(b.prefs) }
+func (b byPref) Less(i, j int) bool { return b.prefs[i] < b.prefs[j] }
+func (b byPref) Swap(i, j int) {
+	b.prefs[i], b.prefs[j] = b.prefs[j], b.prefs[i]
+	b.swap(i, j)
+}
+
+// vcardType returns the first of types the property has as a TYPE, CELL counting as mobile, or "".
+func vcardType(prop vcardProperty, types []string) string {
+	for _, t := range types {
+		if prop.hasType(t) || t == TypeMobile && prop.hasType("cell") {
+			return t
+		}
+	}
+	return ""
+}
+
+// vcardAddress maps an ADR property to an address.
+// The post office box is dropped, and the extended address becomes the first line of the street.
+func vcardAddress(prop vcardProperty) Address {
+	n := splitValue(prop.Value, ';')
+	for len(n) < 7 {
+		n = append(n, "")
+	}
+	street := []string{}
+	for _, c := range n[1:3] {
+		if c = vcardComponent(c); c != "" {
+			street = append(street, c)
+		}
+	}
+	return Address{
+		Type:     vcardType(prop, addressTypes),
+		Street:   strings.Join(street, "\n"),
+		City:     vcardComponent(n[3]),
+		Region:   vcardComponent(n[4]),
+		Postcode: vcardComponent(n[5]),
+		Country:  vcardComponent(n[6]),
+	}
+}
+
+// vcardBirthday returns a BDAY value as a birthday, YYYY-MM-DD or --MM-DD.
+// The basic format of version 4.0, YYYYMMDD or --MMDD, is also read, and any time is dropped.
+// Anything else, such as a text value or a date without the day, gives "".
+func vcardBirthday(v string) string {
+	v = strings.TrimSpace(v)
+	if i := strings.IndexByte(v, 'T'); i >= 0 {
+		v = v[:i]
+	}
+	switch {
+	case len(v) == 8 && !strings.HasPrefix(v, "-"):
+		v = v[:4] + "-" + v[4:6] + "-" + v[6:]
+	case len(v) == 6 && strings.HasPrefix(v, "--"):
+		v = v[:4] + "-" + v[4:]
+	}
+	if _, _, err := parseBirthday(v); err != nil {
+		return ""
+	}
+	return v
+}
+
+// vcardComponent returns a component of a structured value, joining any list of values with spaces.
+func vcardComponent(c string) string {
+	values := []string{}
+	for _, v := range splitValue(c, ',') {
+		if v = strings.TrimSpace(unescapeVCard(v)); v != "" {
+			values = append(values, v)
+		}
+	}
+	return strings.Join(values, " ")
+}
+
+// vcardTel returns the phone number of a TEL value, which in version 4.0 may be a tel: URI.
+func vcardTel(v string) string {
+	if strings.HasPrefix(strings.ToLower(v), "tel:") {
+		v = v[len("tel:"):]
+		if i := strings.IndexByte(v, ';'); i >= 0 {
+			v = v[:i]
+		}
+		return v
+	}
+	return strings.TrimSpace(unescapeVCard(v))
+}
+
+// vcardRows decodes the vCards in a file, one importRow per card.
+// The Line of each row is the line of its BEGIN:VCARD.
+func vcardRows(r io.Reader) ([]importRow, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	text, err := decodeText(data, "")
+	if err != nil {
+		return nil, err
+	}
+	lines, numbers := vcardLines(text)
+	rows := []importRow{}
+	var card []vcardProperty
+	var cardErr error
+	begin := 0
+	for i, line := range lines {
+		prop, err := parseVCardProperty(line, numbers[i])
+		switch {
+		case err == nil && prop.Name == "BEGIN" && strings.EqualFold(prop.Value, "VCARD"):
+			if card != nil {
+				rows = append(rows, importRow{Line: begin, Err: fmt.Errorf("missing END:VCARD")})
+			}
+			card, cardErr, begin = []vcardProperty{}, nil, numbers[i]
+		case card == nil:
+			rows = append(rows, importRow{Line: numbers[i], Err: fmt.Errorf("expected BEGIN:VCARD, got %q", line)})
+		case err == nil && prop.Name == "END" && strings.EqualFold(prop.Value, "VCARD"):
+			row := importRow{Line: begin, Err: cardErr}
+			if cardErr == nil {
+				row.Person, row.Err = vcardPerson(card)
+			}
+			rows = append(rows, row)
+			card = nil
+		case err != nil:
+			if cardErr == nil {
+				cardErr = err
+			}
+		default:
+			card = append(card, prop)
+		}
+	}
+	if card != nil {
+		rows = append(rows, importRow{Line: begin, Err: fmt.Errorf("missing END:VCARD")})
+	}
+	return rows, nil
+}
+
+// writeVCard writes a person as a vCard of the given version.
+func writeVCard(w io.Writer, p *Person, version string) error {
+	buf := new(bytes.Buffer)
+	line := func(s string) {
+		buf.WriteString(foldVCardLine(s))
+	}
+	line("BEGIN:VCARD")
+	line("VERSION:" + version)
+	line("FN:" + escapeVCard(strings.TrimSpace(p.FirstName+" "+p.LastName)))
+	line("N:" + escapeVCard(p.LastName) + ";" + escapeVCard(p.FirstName) + ";;;")
+	for i, e := range p.Emails {
+		types := []string{}
+		if version == VCardVersion3 {
+			types = append(types, "INTERNET")
+		}
+		if e.Type == TypeHome || e.Type == TypeWork {
+			types = append(types, strings.ToUpper(e.Type))
+		}
+		line("EMAIL" + vcardParams(types, i == 0 && len(p.Emails) > 1, version) + ":" + escapeVCard(e.Value))
+	}
+	for i, ph := range p.Phones {
+		line("TEL" + vcardParams(vcardTelTypes[ph.Type], i == 0 && len(p.Phones) > 1, version) + ":" + escapeVCard(ph.Value))
+	}
+	for i, a := range p.Addresses {
+		types := []string{}
+		if a.Type == TypeHome || a.Type == TypeWork {
+			types = append(types, strings.ToUpper(a.Type))
+		}
+		line("ADR" + vcardParams(types, i == 0 && len(p.Addresses) > 1, version) + ":;;" + escapeVCard(a.Street) + ";" +
+			escapeVCard(a.City) + ";" + escapeVCard(a.Region) + ";" + escapeVCard(a.Postcode) + ";" + escapeVCard(a.Country))
+	}
+	if p.Nickname != "" {
+		line("NICKNAME:" + escapeVCard(p.Nickname))
+	}
+	if p.Organization != "" || p.Department != "" {
+		org := escapeVCard(p.Organization)
+		if p.Department != "" {
+			org += ";" + escapeVCard(p.Department)
+		}
+		line("ORG:" + org)
+	}
+	if p.Title != "" {
+		line("TITLE:" + escapeVCard(p.Title))
+	}
+	if p.Birthday != "" {
+		bday := p.Birthday
+		if version == VCardVersion4 {
+			// Version 4.0 uses the basic format, YYYYMMDD or --MMDD.
+			bday = strings.Replace(bday, "-", "", -1)
+			if strings.HasPrefix(p.Birthday, "--") {
+				bday = "--" + bday
+			}
+		}
+		line("BDAY:" + bday)
+	}
+	if p.Website != "" {
+		line("URL:" + p.Website)
+	}
+	if p.Notes != "" {
+		line("NOTE:" + escapeVCard(p.Notes))
+	}
+	if p.photo != nil {
+		line(vcardPhoto(p.photo, version))
+	}
+	if len(p.Groups) > 0 {
+		categories := make([]string, len(p.Groups))
+		for i, g := range p.Groups {
+			categories[i] = escapeVCard(g)
+		}
+		line("CATEGORIES:" + strings.Join(categories, ","))
+	}
+	line("END:VCARD")
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// vcardTelTypes are the TYPE values written for each phone type.
+var vcardTelTypes = map[string][]string{
+	"":         {"VOICE"},
+	TypeHome:   {"VOICE", "HOME"},
+	TypeWork:   {"VOICE", "WORK"},
+	TypeMobile: {"CELL"},
+	TypeFax:    {"FAX"},
+	TypeOther:  {"VOICE"},
+}
+
+// vcardParams returns the TYPE parameter of a property, and marks it preferred if pref is set:
+// version 3.0 with TYPE=PREF and version 4.0 with PREF=1.
+func vcardParams(types []string, pref bool, version string) string {
+	if pref && version == VCardVersion3 {
+		types = append(types[:len(types):len(types)], "PREF")
+	}
+	params := ""
+	if len(types) > 0 {
+		params = ";TYPE=" + strings.Join(types, ",")
+	}
+	if pref && version != VCardVersion3 {
+		params += ";PREF=1"
+	}
+	return params
+}
+
+// jcardPerson returns a person as an RFC 7095 jCard, the JSON form of a version 4.0 vCard.
+func jcardPerson(p *Person) []interface{} {
+	none := map[string]interface{}{}
+	props := []interface{}{
+		[]interface{}{"version", none, "text", VCardVersion4},
+		[]interface{}{"fn", none, "text", strings.TrimSpace(p.FirstName + " " + p.LastName)},
+		[]interface{}{"n", none, "text", []string{p.LastName, p.FirstName, "", "", ""}},
+	}
+	for i, e := range p.Emails {
+		props = append(props, []interface{}{"email", jcardParams(e.Type, emailTypes, i == 0 && len(p.Emails) > 1), "text", e.Value})
+	}
+	for i, ph := range p.Phones {
+		params := jcardParams(ph.Type, nil, i == 0 && len(p.Phones) > 1)
+		types := vcardTelTypes[ph.Type]
+		if len(types) == 1 {
+			params["type"] = strings.ToLower(types[0])
+		} else {
+			params["type"] = []string{strings.ToLower(types[0]), strings.ToLower(types[1])}
+		}
+		props = append(props, []interface{}{"tel", params, "text", ph.Value})
+	}
+	for i, a := range p.Addresses {
+		props = append(props, []interface{}{"adr", jcardParams(a.Type, addressTypes, i == 0 && len(p.Addresses) > 1), "text",
+			[]string{"", "", a.Street, a.City, a.Region, a.Postcode, a.Country}})
+	}
+	if p.Nickname != "" {
+		props = append(props, []interface{}{"nickname", none, "text", p.Nickname})
+	}
+	if p.Department != "" {
+		props = append(props, []interface{}{"org", none, "text", []string{p.Organization, p.Department}})
+	} else if p.Organization != "" {
+		props = append(props, []interface{}{"org", none, "text", p.Organization})
+	}
+	if p.Title != "" {
+		props = append(props, []interface{}{"title", none, "text", p.Title})
+	}
+	if p.Birthday != "" {
+		props = append(props, []interface{}{"bday", none, "date-and-or-time", p.Birthday})
+	}
+	if p.Website != "" {
+		props = append(props, []interface{}{"url", none, "uri", p.Website})
+	}
+	if p.Notes != "" {
+		props = append(props, []interface{}{"note", none, "text", p.Notes})
+	}
+	if p.photo != nil {
+		props = append(props, []interface{}{"photo", none, "uri", photoDataURI(p.photo)})
+	}
+	if len(p.Groups) > 0 {
+		categories := []interface{}{"categories", none, "text"}
+		for _, g := range p.Groups {
+			categories = append(categories, g)
+		}
+		props = append(props, categories)
+	}
+	return []interface{}{"vcard", props}
+}
+
+// jcardParams returns the parameters of a jCard property: its type if it is home or work
+// and one of types, and a pref of 1 if pref is set.
+func jcardParams(typ string, types []string, pref bool) map[string]interface{} {
+	params := map[string]interface{}{}
+	if (typ == TypeHome || typ == TypeWork) && validType(typ, types) {
+		params["type"] = typ
+	}
+	if pref {
+		params["pref"] = "1"
+	}
+	return params
+}
+
+// foldVCardLine folds a content line into lines of at most vcardMaxLine octets,
+// without splitting UTF-8 sequences, and terminates each with CRLF.
+func foldVCardLine(s string) string {
+	var b strings.Builder
+	limit := vcardMaxLine
+	for len(s) > limit {
+		i := limit
+		for i > 0 && !utf8.RuneStart(s[i]) {
+			i--
+		}
+		b.WriteString(s[:i])
+		b.WriteString("\r\n ")
+		s = s[i:]
+		// Continuation lines start with a space, which counts towards the limit.
+		limit = vcardMaxLine - 1
+	}
+	b.WriteString(s)
+	b.WriteString("\r\n")
+	return b.String()
+}
@@ -1,16 +1,123 @@
 package main
 
 import (
+	"flag"
+	"fmt"
 	"log"
+	"os"
+	"strconv"
+	"time"
 
 	"github.com/unixblackhole/didactic-tribble/app"
 )
 
 func main() {
-	a := app.App{}
-	err := a.Initialize("AddressBook.sqlitedb")
+	dbname := flag.String("db", "AddressBook.sqlitedb", "SQLite database file or postgres:// DSN")
+	memory := flag.Bool("memory", false, "Use an ephemeral in-memory store instead of a database")
+	noMigrate := flag.Bool("no-migrate", false, "Do not apply pending schema migrations on startup")
+	ldapAddr := flag.String("ldap", "", "Also serve a read-only LDAP directory of the people on this address, e.g. :3389")
+	ldapBase := flag.String("ldap-base", "", "Base DN of the LDAP directory (default ou=people,dc=example,dc=com)")
+	ldapBindDN := flag.String("ldap-bind-dn", "", "DN LDAP clients must bind as before searching")
+	ldapPassword := flag.String("ldap-password", "", "Password of -ldap-bind-dn")
+	adminToken := flag.String("admin-token", "", "Bearer token required to define custom fields")
+	photoDir := flag.String("photo-dir", "", "Keep people's photos in this directory instead of the database")
+	trustedProxies := flag.String("trusted-proxies", "", "Comma separated addresses or CIDR ranges of proxies trusted to set the X-Actor header recorded in the audit log")
+	trashRetention := flag.Duration("trash-retention", 30*24*time.Hour, "How long deleted people stay in the trash before they are purged, 0 to keep them")
+	flag.Parse()
+
+	if flag.Arg(0) == "migrate" {
+		if err := migrate(*dbname, flag.Args()[1:]); err != nil {
+			log.Fatalf("Error migrating: %v", err.Error())
+		}
+		return
+	}
+
+	a := app.App{
+		SkipMigrations: *noMigrate,
+		LDAPAddr:       *ldapAddr,
+		LDAPBaseDN:     *ldapBase,
+		LDAPBindDN:     *ldapBindDN,
+		LDAPPassword:   *ldapPassword,
+		AdminToken:     *adminToken,
+		TrashRetention: *trashRetention,
+	}
+	proxies, err := app.ParseTrustedProxies(*trustedProxies)
 	if err != nil {
 		log.Fatalf("Error Initializing: %v", err.Error())
 	}
-	a.Run(":3001")
+	a.TrustedProxies = proxies
+	if *photoDir != "" {
+		photos, err := app.NewDirPhotoStore(*photoDir)
+		if err != nil {
+			log.Fatalf("Error Initializing: %v", err.Error())
+		}
+		a.Photos = photos
+	}
+	if *memory {
+		a.InitializeWithStore(app.NewMemoryStore())
+	} else if err := a.Initialize(*dbname); err != nil {
+		log.Fatalf("Error Initializing: %v", err.Error())
+	}
+	log.Fatal(a.Run(":3001"))
+}
+
+// migrate handles the migrate subcommand:
+//
+//	migrate status        lists every migration and whether it is applied
+//	migrate up            applies all pending migrations
+//	migrate down [n]      rolls back the last n migrations (default 1)
+//	migrate to <version>  migrates up or down to a specific version
+func migrate(dsn string, args []string) error {
+	s, err := app.OpenStore(dsn, false)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	m, err := s.Migrator()
+	if err != nil {
+		return err
+	}
+	cmd := "status"
+	if len(args) > 0 {
+		cmd = args[0]
+	}
+	switch cmd {
+	case "status":
+	case "up":
+		err = m.Up()
+	case "down":
+		n := 1
+		if len(args) > 1 {
+			if n, err = strconv.Atoi(args[1]); err != nil {
+				return fmt.Errorf("invalid step count %q", args[1])
+			}
+		}
+		err = m.Down(n)
+	case "to":
+		if len(args) < 2 {
+			return fmt.Errorf("migrate to requires a version")
+		}
+		v, convErr := strconv.Atoi(args[1])
+		if convErr != nil {
+			return fmt.Errorf("invalid version %q", args[1])
+		}
+		err = m.To(v)
+	default:
+		return fmt.Errorf("unknown migrate command %q", cmd)
+	}
+	if err != nil {
+		return err
+	}
+	status, err := m.Status()
+	if err != nil {
+		return err
+	}
+	for _, st := range status {
+		state := "pending"
+		if st.Applied {
+			state = "applied"
+		}
+		fmt.Fprintf(os.Stdout, "%4d  %-8s %v\n", st.Version, state, st.Name)
+	}
+	return nil
 }